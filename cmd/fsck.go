@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/asdine/storm"
+	"github.com/spf13/cobra"
+
+	"github.com/kochman/hotshots/config"
+	"github.com/kochman/hotshots/server"
+)
+
+var fsckRepair bool
+
+func init() {
+	fsckCmd.Flags().BoolVar(&fsckRepair, "repair", false, "repair the problems that are found")
+
+	serverCmd.AddCommand(fsckCmd)
+}
+
+var fsckCmd = &cobra.Command{
+	Use:   "fsck [--repair]",
+	Short: "Check stored photos for missing and corrupt files",
+	Long: `Check the server's photos against their files, hashing originals again to
+find corruption, and find files that don't belong to any photo.
+
+With --repair, thumbnails are made again, display images of RAW photos are queued
+to be made again when the server next starts, photos whose original is lost are
+marked as failed so that the pusher sends them again, and stray files are removed.
+This command uses the server's database directly, so the server must not be
+running while it is used.
+
+Exits with status 1 if problems were found and not repaired.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		unrepaired := 0
+		withServerDB("photo", func(db *storm.DB) error {
+			cfg, err := config.New()
+			if err != nil {
+				return err
+			}
+			problems, err := server.Fsck(cfg, db, fsckRepair)
+			for _, problem := range problems {
+				fmt.Println(problem)
+				if problem.Repair == "" {
+					unrepaired++
+				}
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d problems found, %d repaired\n", len(problems), len(problems)-unrepaired)
+			return nil
+		})
+		if unrepaired > 0 {
+			os.Exit(1)
+		}
+	},
+}
@@ -9,7 +9,11 @@ import (
 	"github.com/kochman/hotshots/pusher"
 )
 
+var pusherRetryFailed bool
+
 func init() {
+	pusherCmd.Flags().BoolVar(&pusherRetryFailed, "retry-failed", false, "upload photos that were given up on again")
+
 	rootCmd.AddCommand(pusherCmd)
 }
 
@@ -31,6 +35,9 @@ var pusherCmd = &cobra.Command{
 			log.WithError(err).Error("Unable to create pusher")
 			return
 		}
+		if pusherRetryFailed {
+			log.Infof("retrying %d photos that failed to upload", pusher.RetryFailed())
+		}
 
 		runner := runner.New()
 		runner.Add(pusher)
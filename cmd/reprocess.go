@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/asdine/storm"
+	"github.com/spf13/cobra"
+
+	"github.com/kochman/hotshots/config"
+	"github.com/kochman/hotshots/log"
+	"github.com/kochman/hotshots/server"
+)
+
+var (
+	reprocessFailed bool
+	reprocessAll    bool
+)
+
+func init() {
+	reprocessCmd.Flags().BoolVar(&reprocessFailed, "failed", false, "reprocess photos that failed (the default)")
+	reprocessCmd.Flags().BoolVar(&reprocessAll, "all", false, "reprocess every photo")
+
+	serverCmd.AddCommand(reprocessCmd)
+}
+
+var reprocessCmd = &cobra.Command{
+	Use:   "reprocess [--failed|--all]",
+	Short: "Process photos again from their originals",
+	Long: `Process photos again from their originals, to bring back photos that failed
+or to update thumbnails and metadata of processed ones. With --failed, which is
+the default, only photos that failed are reprocessed, along with processed
+photos that failed to be reprocessed before. With --all, every photo is.
+
+Photos are queued for the server to process when it next starts. This command
+changes the server's database directly, so the server must not be running while
+it is used.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if reprocessFailed && reprocessAll {
+			log.Error("only one of --failed and --all may be given")
+			os.Exit(1)
+		}
+
+		withServerDB("photo", func(db *storm.DB) error {
+			cfg, err := config.New()
+			if err != nil {
+				return err
+			}
+			queued, err := server.Reprocess(cfg, db, reprocessAll)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("queued %d photos\n", queued)
+			return nil
+		})
+	},
+}
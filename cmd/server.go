@@ -1,7 +1,11 @@
 package cmd
 
 import (
-	"github.com/kochman/runner"
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/spf13/cobra"
 
 	"github.com/kochman/hotshots/config"
@@ -25,15 +29,35 @@ var serverCmd = &cobra.Command{
 			log.WithError(err).Error("unable to create config")
 			return
 		}
-		runner := runner.New()
 
 		server, err := server.New(config)
 		if err != nil {
 			log.WithError(err).Error("unable to create server")
 			return
 		}
-		runner.Add(server)
 
-		runner.Run()
+		// finish what's in progress before exiting on SIGINT or SIGTERM
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		stopped := make(chan struct{})
+		go func() {
+			server.Run()
+			close(stopped)
+		}()
+
+		select {
+		case sig := <-signals:
+			log.Infof("received %s, shutting down", sig)
+		case <-stopped:
+		}
+		signal.Stop(signals)
+
+		ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.WithError(err).Error("unable to shut down cleanly")
+			return
+		}
+		log.Info("Hotshots server stopped")
 	},
 }
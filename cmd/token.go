@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/spf13/cobra"
+
+	"github.com/kochman/hotshots/server"
+)
+
+var tokenRole string
+
+func init() {
+	tokenAddCmd.Flags().StringVar(&tokenRole, "role", server.RolePhotographer, "role of the token: admin, editor, photographer or viewer")
+
+	tokenCmd.AddCommand(tokenAddCmd, tokenListCmd, tokenRevokeCmd)
+	rootCmd.AddCommand(tokenCmd)
+}
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manage API tokens for devices like pushers",
+	Long: `Manage API tokens for devices like pushers.
+
+These commands change the server's database directly, so the server must not be
+running while they are used. Tokens can also be managed through /tokens.`,
+}
+
+var tokenAddCmd = &cobra.Command{
+	Use:   "add <name>",
+	Short: "Create a token and print it",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		withServerDB("token", func(db *storm.DB) error {
+			_, secret, err := server.AddToken(db, args[0], tokenRole, "")
+			if err != nil {
+				return err
+			}
+			fmt.Println(secret)
+			return nil
+		})
+	},
+}
+
+var tokenListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List tokens and when they were last used",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		withServerDB("token", func(db *storm.DB) error {
+			tokens, err := server.ListTokens(db)
+			if err != nil {
+				return err
+			}
+			for _, token := range tokens {
+				lastUsed := "never"
+				if token.LastUsedAt != nil {
+					lastUsed = token.LastUsedAt.Format(time.RFC3339) + " from " + token.LastUsedIP
+				}
+				fmt.Printf("%s\t%s\t%s\t%s\n", token.ID, token.Name, token.Role, lastUsed)
+			}
+			return nil
+		})
+	},
+}
+
+var tokenRevokeCmd = &cobra.Command{
+	Use:   "revoke <name or id>",
+	Short: "Revoke a token",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		withServerDB("token", func(db *storm.DB) error {
+			return server.RevokeToken(db, args[0])
+		})
+	},
+}
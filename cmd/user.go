@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/asdine/storm"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/kochman/hotshots/config"
+	"github.com/kochman/hotshots/log"
+	"github.com/kochman/hotshots/server"
+)
+
+var userRole string
+
+func init() {
+	userAddCmd.Flags().StringVar(&userRole, "role", server.RoleViewer, "role of the user: admin, editor, photographer or viewer")
+
+	userCmd.AddCommand(userAddCmd, userListCmd, userRemoveCmd, userPasswdCmd)
+	rootCmd.AddCommand(userCmd)
+}
+
+var userCmd = &cobra.Command{
+	Use:   "user",
+	Short: "Manage users of the Hotshots server",
+	Long: `Manage users of the Hotshots server.
+
+These commands change the server's database directly, so the server must not be
+running while they are used.`,
+}
+
+var userAddCmd = &cobra.Command{
+	Use:   "add <username>",
+	Short: "Add a user",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		withServerDB("user", func(db *storm.DB) error {
+			password, err := readPassword()
+			if err != nil {
+				return err
+			}
+			return server.AddUser(db, args[0], password, userRole)
+		})
+	},
+}
+
+var userListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List users",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		withServerDB("user", func(db *storm.DB) error {
+			users, err := server.ListUsers(db)
+			if err != nil {
+				return err
+			}
+			for _, user := range users {
+				fmt.Printf("%s\t%s\n", user.Username, user.Role)
+			}
+			return nil
+		})
+	},
+}
+
+var userRemoveCmd = &cobra.Command{
+	Use:   "remove <username>",
+	Short: "Remove a user",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		withServerDB("user", func(db *storm.DB) error {
+			return server.RemoveUser(db, args[0])
+		})
+	},
+}
+
+var userPasswdCmd = &cobra.Command{
+	Use:   "passwd <username>",
+	Short: "Change a user's password",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		withServerDB("user", func(db *storm.DB) error {
+			password, err := readPassword()
+			if err != nil {
+				return err
+			}
+			return server.SetUserPassword(db, args[0], password)
+		})
+	},
+}
+
+// withServerDB opens the server's database for f, logging any error. Errors from
+// looking up something that doesn't exist are reported as "no such <what>".
+func withServerDB(what string, f func(db *storm.DB) error) {
+	config, err := config.New()
+	if err != nil {
+		log.WithError(err).Error("unable to create config")
+		os.Exit(1)
+	}
+
+	db, err := storm.Open(config.StormFile())
+	if err != nil {
+		log.WithError(err).Error("unable to open database")
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	if err := f(db); err != nil {
+		if err == storm.ErrNotFound {
+			err = errors.New("no such " + what)
+		}
+		log.WithError(err).Error("unable to update database")
+		db.Close()
+		os.Exit(1)
+	}
+}
+
+// readPassword prompts for a new password, or reads one line from stdin if it
+// isn't a terminal.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Confirm password: ")
+	confirm, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(password) != string(confirm) {
+		return "", errors.New("passwords do not match")
+	}
+	return string(password), nil
+}
@@ -1,21 +1,85 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Storage backends for photos.
+const (
+	StorageLocal = "local"
+	StorageS3    = "s3"
+)
+
+// DefaultRenditions are the sizes photos can be requested in unless configured otherwise.
+const DefaultRenditions = "small=480x480,medium=1080x1080,large=2048x2048,social-square=1080x1080:crop"
+
+// Rendition is a named size that photos are resized to on request.
+type Rendition struct {
+	Name   string
+	Width  uint
+	Height uint
+
+	// Whether the photo is cropped to fill the size exactly, rather than fit within it
+	Crop bool
+}
+
+var renditionPattern = regexp.MustCompile(`^([a-z0-9-]+)=([0-9]+)x([0-9]+)(:crop)?$`)
+
+// ParseRenditions reads renditions written like "small=480x480,social-square=1080x1080:crop".
+func ParseRenditions(s string) ([]Rendition, error) {
+	renditions := []Rendition{}
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		m := renditionPattern.FindStringSubmatch(spec)
+		if m == nil {
+			return nil, fmt.Errorf("invalid rendition %q", spec)
+		}
+		width, _ := strconv.ParseUint(m[2], 10, 32)
+		height, _ := strconv.ParseUint(m[3], 10, 32)
+		if width == 0 || height == 0 {
+			return nil, fmt.Errorf("invalid rendition %q", spec)
+		}
+		renditions = append(renditions, Rendition{
+			Name:   m[1],
+			Width:  uint(width),
+			Height: uint(height),
+			Crop:   m[4] != "",
+		})
+	}
+	return renditions, nil
+}
+
 // Config contains Hotshots configuration.
 type Config struct {
 	// Where the server listens
 	ListenURL string
 
-	// Where the server stores data
+	// Where the server stores data and the pusher keeps its journal
 	PhotosDirectory string
 	WebDirectory    string
 
+	// Where the server keeps photos: StorageLocal for PhotosDirectory or StorageS3
+	// for a bucket of an S3-compatible service
+	Storage     string
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+
+	// Sizes the server resizes photos to on request
+	Renditions []Rendition
+
 	// Where the pusher should expect to find the server
 	ServerURL string
 
@@ -25,19 +89,76 @@ type Config struct {
 	// How long the Pusher can take to transfer a photo
 	UploadTimeout time.Duration
 
-	// Server/Pusher authentication
+	// How long the Pusher waits before retrying a failed upload, doubled on each failure
+	RetryBackoff time.Duration
+
+	// How many times the Pusher tries to upload a photo before giving up on it until
+	// it's started with --retry-failed
+	MaxUploadAttempts int
+
+	// Whether the Pusher transfers RAW and HEIF files as well as JPEGs
+	TransferRaw bool
+
+	// Server/Pusher authentication. The server also accepts the users in its
+	// database, and treats these credentials as an admin.
 	AuthUsername string
 	AuthPassword string
+
+	// API token the Pusher sends instead of the username and password
+	AuthToken string
+
+	// How long a login to the dashboard lasts
+	SessionLifetime time.Duration
+
+	// Server TLS. The certificate is either read from files or, given domains,
+	// obtained automatically from Let's Encrypt. Clients may be asked for a
+	// certificate signed by TLSClientCAFile, which is required if TLSRequireClientCert.
+	// Plain HTTP requests to TLSRedirectURL are redirected to HTTPS.
+	TLSCertFile          string
+	TLSKeyFile           string
+	TLSAutocertDomains   []string
+	TLSClientCAFile      string
+	TLSRequireClientCert bool
+	TLSRedirectURL       string
+
+	// Pusher TLS. The server's certificate is checked against TLSServerCAFile rather
+	// than the system's CAs, or trusted only if its SHA-256 fingerprint matches
+	// TLSServerFingerprint; only one of the two may be set. The client certificate is
+	// sent to servers that ask for one.
+	TLSServerCAFile      string
+	TLSServerFingerprint string
+	TLSClientCertFile    string
+	TLSClientKeyFile     string
+
+	// How many photos the server processes at once. Photos beyond these wait in a
+	// queue on disk.
+	ProcessingWorkers int
+
+	// How long the server waits for requests and photo processing to finish when
+	// shutting down
+	ShutdownTimeout time.Duration
+
+	// How long deleted photos stay in the trash before the server purges them, or
+	// forever if 0
+	TrashRetention time.Duration
 }
 
 // New reads from the environment to determine the configuration.
 func New() (*Config, error) {
 	c := &Config{
-		ListenURL:       "127.0.0.1:8000",
-		PhotosDirectory: "/var/hotshots",
-		ServerURL:       "http://127.0.0.1:8000",
-		RefreshInterval: 5 * time.Second,
-		UploadTimeout:   15 * time.Second,
+		ListenURL:         "127.0.0.1:8000",
+		PhotosDirectory:   "/var/hotshots",
+		Storage:           StorageLocal,
+		S3Region:          "us-east-1",
+		ServerURL:         "http://127.0.0.1:8000",
+		RefreshInterval:   5 * time.Second,
+		UploadTimeout:     15 * time.Second,
+		RetryBackoff:      5 * time.Second,
+		MaxUploadAttempts: 10,
+		SessionLifetime:   7 * 24 * time.Hour,
+		ProcessingWorkers: 2,
+		ShutdownTimeout:   30 * time.Second,
+		TrashRetention:    30 * 24 * time.Hour,
 	}
 
 	hotshotsDir, ok := os.LookupEnv("HOTSHOTS_DIR")
@@ -45,6 +166,46 @@ func New() (*Config, error) {
 		c.PhotosDirectory = hotshotsDir
 	}
 
+	renditions := DefaultRenditions
+	if r, ok := os.LookupEnv("HOTSHOTS_RENDITIONS"); ok {
+		renditions = r
+	}
+	parsed, err := ParseRenditions(renditions)
+	if err != nil {
+		return nil, err
+	}
+	c.Renditions = parsed
+
+	storage, ok := os.LookupEnv("HOTSHOTS_STORAGE")
+	if ok {
+		c.Storage = storage
+	}
+
+	s3Endpoint, ok := os.LookupEnv("HOTSHOTS_S3_ENDPOINT")
+	if ok {
+		c.S3Endpoint = s3Endpoint
+	}
+
+	s3Region, ok := os.LookupEnv("HOTSHOTS_S3_REGION")
+	if ok {
+		c.S3Region = s3Region
+	}
+
+	s3Bucket, ok := os.LookupEnv("HOTSHOTS_S3_BUCKET")
+	if ok {
+		c.S3Bucket = s3Bucket
+	}
+
+	s3AccessKey, ok := os.LookupEnv("HOTSHOTS_S3_ACCESS_KEY")
+	if ok {
+		c.S3AccessKey = s3AccessKey
+	}
+
+	s3SecretKey, ok := os.LookupEnv("HOTSHOTS_S3_SECRET_KEY")
+	if ok {
+		c.S3SecretKey = s3SecretKey
+	}
+
 	listenURL, ok := os.LookupEnv("HOTSHOTS_LISTEN_URL")
 	if ok {
 		c.ListenURL = listenURL
@@ -81,6 +242,33 @@ func New() (*Config, error) {
 		c.UploadTimeout = duration
 	}
 
+	retryBackoff, ok := os.LookupEnv("HOTSHOTS_RETRY_BACKOFF")
+	if ok {
+		duration, err := time.ParseDuration(retryBackoff)
+		if err != nil {
+			return nil, err
+		}
+		c.RetryBackoff = duration
+	}
+
+	maxAttempts, ok := os.LookupEnv("HOTSHOTS_MAX_UPLOAD_ATTEMPTS")
+	if ok {
+		attempts, err := strconv.Atoi(maxAttempts)
+		if err != nil {
+			return nil, err
+		}
+		c.MaxUploadAttempts = attempts
+	}
+
+	transferRaw, ok := os.LookupEnv("HOTSHOTS_TRANSFER_RAW")
+	if ok {
+		raw, err := strconv.ParseBool(transferRaw)
+		if err != nil {
+			return nil, err
+		}
+		c.TransferRaw = raw
+	}
+
 	username, ok := os.LookupEnv("HOTSHOTS_USERNAME")
 	if ok {
 		c.AuthUsername = username
@@ -91,12 +279,123 @@ func New() (*Config, error) {
 		c.AuthPassword = password
 	}
 
+	token, ok := os.LookupEnv("HOTSHOTS_TOKEN")
+	if ok {
+		c.AuthToken = token
+	}
+
+	sessionLifetime, ok := os.LookupEnv("HOTSHOTS_SESSION_LIFETIME")
+	if ok {
+		duration, err := time.ParseDuration(sessionLifetime)
+		if err != nil {
+			return nil, err
+		}
+		c.SessionLifetime = duration
+	}
+
+	tlsCert, ok := os.LookupEnv("HOTSHOTS_TLS_CERT")
+	if ok {
+		c.TLSCertFile = tlsCert
+	}
+
+	tlsKey, ok := os.LookupEnv("HOTSHOTS_TLS_KEY")
+	if ok {
+		c.TLSKeyFile = tlsKey
+	}
+
+	autocertDomains, ok := os.LookupEnv("HOTSHOTS_TLS_AUTOCERT_DOMAINS")
+	if ok {
+		for _, domain := range strings.Split(autocertDomains, ",") {
+			if domain = strings.TrimSpace(domain); domain != "" {
+				c.TLSAutocertDomains = append(c.TLSAutocertDomains, domain)
+			}
+		}
+	}
+
+	clientCA, ok := os.LookupEnv("HOTSHOTS_TLS_CLIENT_CA")
+	if ok {
+		c.TLSClientCAFile = clientCA
+	}
+
+	requireClientCert, ok := os.LookupEnv("HOTSHOTS_TLS_REQUIRE_CLIENT_CERT")
+	if ok {
+		require, err := strconv.ParseBool(requireClientCert)
+		if err != nil {
+			return nil, err
+		}
+		c.TLSRequireClientCert = require
+	}
+
+	redirectURL, ok := os.LookupEnv("HOTSHOTS_TLS_REDIRECT_URL")
+	if ok {
+		c.TLSRedirectURL = redirectURL
+	}
+
+	serverCA, ok := os.LookupEnv("HOTSHOTS_TLS_SERVER_CA")
+	if ok {
+		c.TLSServerCAFile = serverCA
+	}
+
+	fingerprint, ok := os.LookupEnv("HOTSHOTS_TLS_SERVER_FINGERPRINT")
+	if ok {
+		c.TLSServerFingerprint = fingerprint
+	}
+
+	clientCert, ok := os.LookupEnv("HOTSHOTS_TLS_CLIENT_CERT")
+	if ok {
+		c.TLSClientCertFile = clientCert
+	}
+
+	clientKey, ok := os.LookupEnv("HOTSHOTS_TLS_CLIENT_KEY")
+	if ok {
+		c.TLSClientKeyFile = clientKey
+	}
+
+	processingWorkers, ok := os.LookupEnv("HOTSHOTS_PROCESSING_WORKERS")
+	if ok {
+		workers, err := strconv.Atoi(processingWorkers)
+		if err != nil {
+			return nil, err
+		}
+		if workers < 1 {
+			return nil, fmt.Errorf("invalid number of processing workers %d", workers)
+		}
+		c.ProcessingWorkers = workers
+	}
+
+	shutdownTimeout, ok := os.LookupEnv("HOTSHOTS_SHUTDOWN_TIMEOUT")
+	if ok {
+		duration, err := time.ParseDuration(shutdownTimeout)
+		if err != nil {
+			return nil, err
+		}
+		c.ShutdownTimeout = duration
+	}
+
+	trashRetention, ok := os.LookupEnv("HOTSHOTS_TRASH_RETENTION")
+	if ok {
+		duration, err := time.ParseDuration(trashRetention)
+		if err != nil {
+			return nil, err
+		}
+		if duration < 0 {
+			return nil, fmt.Errorf("invalid trash retention %s", duration)
+		}
+		c.TrashRetention = duration
+	}
+
 	return c, nil
 }
 
 func (c *Config) ImgFolder() string {
 	return path.Join(c.PhotosDirectory, "/img")
 }
+func (c *Config) UploadFolder() string {
+	return path.Join(c.PhotosDirectory, "/uploads")
+}
+func (c *Config) QueueFolder() string {
+	return path.Join(c.PhotosDirectory, "/queue")
+}
 func (c *Config) ConfFolder() string {
 	return path.Join(c.PhotosDirectory, "/conf.d")
 }
@@ -104,3 +403,24 @@ func (c *Config) ConfFolder() string {
 func (c *Config) StormFile() string {
 	return path.Join(c.ConfFolder(), "/hotshot.db")
 }
+
+func (c *Config) SessionKeyFile() string {
+	return path.Join(c.ConfFolder(), "/session.key")
+}
+
+func (c *Config) AutocertFolder() string {
+	return path.Join(c.ConfFolder(), "/autocert")
+}
+
+// TLS returns whether the server serves HTTPS.
+func (c *Config) TLS() bool {
+	return (c.TLSCertFile != "" && c.TLSKeyFile != "") || len(c.TLSAutocertDomains) > 0
+}
+
+func (c *Config) PusherFolder() string {
+	return path.Join(c.PhotosDirectory, "/pusher")
+}
+
+func (c *Config) JournalFile() string {
+	return path.Join(c.PusherFolder(), "/journal.db")
+}
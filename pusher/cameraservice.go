@@ -6,6 +6,7 @@ import (
 	"io"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/micahwedemeyer/gphoto2go"
 
@@ -33,9 +34,24 @@ const (
 	unknownModel = "Unknown model"
 )
 
+// Extensions of the files transferred from a camera.
+var (
+	jpegExtensions = []string{".jpg"}
+	rawExtensions  = []string{".cr2", ".cr3", ".nef", ".arw", ".dng", ".heic", ".heif"}
+)
+
+// cameraFile is a file on the camera. Files can be told apart from earlier ones
+// with the same name by their size and modification time, which are zero if the
+// camera doesn't report them.
+type cameraFile struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
 // cameraService provides methods for transferring data from a camera
 type cameraService interface {
-	listFilenames() ([]string, error)
+	listFilenames() ([]cameraFile, error)
 	getFile(filename string) ([]byte, error)
 }
 
@@ -48,15 +64,36 @@ type gphoto2Camera interface {
 	FileReader(folder, name string) io.ReadCloser
 }
 
+// gphoto2FileInfo looks up the sizes and modification times of files on the camera,
+// which gphoto2go doesn't expose.
+type gphoto2FileInfo interface {
+	FileInfo(filenames []string) ([]cameraFile, int)
+}
+
 // localCamera communicates with a local camera through libgphoto2.
 type localCamera struct {
-	gphoto2 gphoto2Camera
+	gphoto2    gphoto2Camera
+	info       gphoto2FileInfo
+	extensions map[string]bool
 }
 
-// newLocalCamera creates a new localCamera with internal mutex.
-func newLocalCamera() *localCamera {
+// newLocalCamera creates a new localCamera that transfers JPEGs, and RAW and HEIF
+// files as well if raw is set.
+func newLocalCamera(raw bool) *localCamera {
+	extensions := map[string]bool{}
+	for _, ext := range jpegExtensions {
+		extensions[ext] = true
+	}
+	if raw {
+		for _, ext := range rawExtensions {
+			extensions[ext] = true
+		}
+	}
+
 	return &localCamera{
-		gphoto2: &gphoto2go.Camera{},
+		gphoto2:    &gphoto2go.Camera{},
+		info:       libgphoto2FileInfo{},
+		extensions: extensions,
 	}
 }
 
@@ -81,7 +118,25 @@ func (c *localCamera) exitCamera() error {
 	return nil
 }
 
-func (c *localCamera) listFilenames() ([]string, error) {
+func (c *localCamera) listFilenames() ([]cameraFile, error) {
+	filenames, err := c.listNames()
+	if err != nil {
+		return []cameraFile{}, err
+	}
+	if len(filenames) == 0 {
+		return []cameraFile{}, nil
+	}
+
+	// gphoto2go has let go of the camera by now, so it can be opened again
+	files, gphotoErr := c.info.FileInfo(filenames)
+	if gphotoErr < 0 {
+		return []cameraFile{}, &UnhandledError{msg: gphoto2go.CameraResultToString(gphotoErr)}
+	}
+	return files, nil
+}
+
+// listNames returns the names of the files on the camera that should be transferred.
+func (c *localCamera) listNames() ([]string, error) {
 	filenames := []string{}
 
 	err := c.initCamera()
@@ -103,8 +158,8 @@ func (c *localCamera) listFilenames() ([]string, error) {
 			return filenames, &UnhandledError{msg: gphotoErr}
 		}
 		for _, file := range files {
-			// only transfer JPEGs
-			if strings.ToLower(path.Ext(file)) != ".jpg" {
+			// only transfer photos we can process
+			if !c.extensions[strings.ToLower(path.Ext(file))] {
 				continue
 			}
 
@@ -5,6 +5,7 @@ import (
 	"io"
 	"io/ioutil"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/mock"
 )
@@ -38,8 +39,22 @@ func (m *mockGphoto2Camera) FileReader(folder, name string) io.ReadCloser {
 	return args.Get(0).(io.ReadCloser)
 }
 
+// fakeFileInfo reports every file as the same size, modified at the same time.
+type fakeFileInfo struct {
+	size    int64
+	modTime time.Time
+}
+
+func (f fakeFileInfo) FileInfo(filenames []string) ([]cameraFile, int) {
+	files := []cameraFile{}
+	for _, filename := range filenames {
+		files = append(files, cameraFile{Name: filename, Size: f.size, ModTime: f.modTime})
+	}
+	return files, 0
+}
+
 func TestListFilenames(t *testing.T) {
-	c := newLocalCamera()
+	c := newLocalCamera(false)
 
 	gphoto2Camera := &mockGphoto2Camera{}
 	gphoto2Camera.On("Init").Return(0)
@@ -48,6 +63,8 @@ func TestListFilenames(t *testing.T) {
 	gphoto2Camera.On("ListFiles", "testdir2").Return([]string{"haha.JPG"}, 0)
 	gphoto2Camera.On("Exit").Return(0)
 	c.gphoto2 = gphoto2Camera
+	modTime := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	c.info = fakeFileInfo{size: 5, modTime: modTime}
 
 	filenames, err := c.listFilenames()
 	if err != nil {
@@ -57,14 +74,17 @@ func TestListFilenames(t *testing.T) {
 		t.Errorf("got %d filenames, expected 3", len(filenames))
 		return
 	}
-	if filenames[0] != "testdir/hello.JPG" {
-		t.Errorf("got unexpected filename: %s", filenames[0])
+	if filenames[0].Name != "testdir/hello.JPG" {
+		t.Errorf("got unexpected filename: %s", filenames[0].Name)
+	}
+	if filenames[1].Name != "testdir/there.JPG" {
+		t.Errorf("got unexpected filename: %s", filenames[1].Name)
 	}
-	if filenames[1] != "testdir/there.JPG" {
-		t.Errorf("got unexpected filename: %s", filenames[2])
+	if filenames[2].Name != "testdir2/haha.JPG" {
+		t.Errorf("got unexpected filename: %s", filenames[2].Name)
 	}
-	if filenames[2] != "testdir2/haha.JPG" {
-		t.Errorf("got unexpected filename: %s", filenames[3])
+	if filenames[0].Size != 5 || !filenames[0].ModTime.Equal(modTime) {
+		t.Errorf("got unexpected file info: %+v", filenames[0])
 	}
 
 	gphoto2Camera.AssertExpectations(t)
@@ -74,8 +94,45 @@ func TestListFilenames(t *testing.T) {
 	gphoto2Camera.AssertNumberOfCalls(t, "ListFiles", 2)
 }
 
+func TestListFilenamesRaw(t *testing.T) {
+	files := []string{"hello.JPG", "hello.CR2", "there.NEF", "phone.HEIC", "clip.MOV", "photo.DNG"}
+
+	c := newLocalCamera(false)
+	gphoto2Camera := &mockGphoto2Camera{}
+	gphoto2Camera.On("Init").Return(0)
+	gphoto2Camera.On("RListFolders", "/").Return([]string{"testdir"})
+	gphoto2Camera.On("ListFiles", "testdir").Return(files, 0)
+	gphoto2Camera.On("Exit").Return(0)
+	c.gphoto2 = gphoto2Camera
+	c.info = fakeFileInfo{}
+
+	filenames, err := c.listFilenames()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if len(filenames) != 1 || filenames[0].Name != "testdir/hello.JPG" {
+		t.Errorf("got unexpected filenames without raw: %v", filenames)
+	}
+
+	c = newLocalCamera(true)
+	c.gphoto2 = gphoto2Camera
+	c.info = fakeFileInfo{}
+
+	filenames, err = c.listFilenames()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if len(filenames) != 5 {
+		t.Errorf("got %d filenames, expected 5", len(filenames))
+		return
+	}
+	if filenames[3].Name != "testdir/phone.HEIC" || filenames[4].Name != "testdir/photo.DNG" {
+		t.Errorf("got unexpected filenames: %s, %s", filenames[3].Name, filenames[4].Name)
+	}
+}
+
 func TestGetFile(t *testing.T) {
-	c := newLocalCamera()
+	c := newLocalCamera(false)
 
 	gphoto2Camera := &mockGphoto2Camera{}
 	gphoto2Camera.On("Init").Return(0)
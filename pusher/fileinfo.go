@@ -0,0 +1,56 @@
+package pusher
+
+// #cgo pkg-config: libgphoto2
+// #include <stdlib.h>
+// #include <gphoto2/gphoto2.h>
+import "C"
+
+import (
+	"path"
+	"time"
+	"unsafe"
+)
+
+// libgphoto2FileInfo asks libgphoto2 directly for file information. It opens its own
+// connection to the camera, so gphoto2go must not have the camera open at the same time.
+type libgphoto2FileInfo struct{}
+
+func (libgphoto2FileInfo) FileInfo(filenames []string) ([]cameraFile, int) {
+	ctx := C.gp_context_new()
+	defer C.gp_context_unref(ctx)
+
+	var camera *C.Camera
+	if err := C.gp_camera_new(&camera); err < 0 {
+		return nil, int(err)
+	}
+	defer C.gp_camera_unref(camera)
+
+	if err := C.gp_camera_init(camera, ctx); err < 0 {
+		return nil, int(err)
+	}
+	defer C.gp_camera_exit(camera, ctx)
+
+	files := []cameraFile{}
+	for _, filename := range filenames {
+		folder := C.CString(path.Dir(filename))
+		name := C.CString(path.Base(filename))
+		var info C.CameraFileInfo
+		err := C.gp_camera_file_get_info(camera, folder, name, &info, ctx)
+		C.free(unsafe.Pointer(folder))
+		C.free(unsafe.Pointer(name))
+		if err < 0 {
+			return nil, int(err)
+		}
+
+		file := cameraFile{Name: filename}
+		if info.file.fields&C.GP_FILE_INFO_SIZE != 0 {
+			file.Size = int64(info.file.size)
+		}
+		if info.file.fields&C.GP_FILE_INFO_MTIME != 0 {
+			file.ModTime = time.Unix(int64(info.file.mtime), 0)
+		}
+		files = append(files, file)
+	}
+
+	return files, 0
+}
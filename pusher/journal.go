@@ -0,0 +1,89 @@
+package pusher
+
+import (
+	"time"
+
+	"github.com/asdine/storm"
+)
+
+// uploadState is how far along a camera file is in being uploaded.
+type uploadState uint8
+
+const (
+	statePending uploadState = iota
+	stateUploaded
+	stateFailed // gave up after too many attempts
+)
+
+// journalEntry records what the pusher knows about a single file on the camera,
+// so that it doesn't have to transfer and hash the file again after a restart.
+// Cameras reuse filenames once a card is formatted or their numbering wraps, so
+// the size and modification time tell whether the file is still the same one.
+type journalEntry struct {
+	Filename     string `storm:"id"`
+	Size         int64  `storm:"index"`
+	ModTime      time.Time
+	PhotoID      string      `storm:"index"`
+	State        uploadState `storm:"index"`
+	DiscoveredAt time.Time   `storm:"index"`
+	UpdatedAt    time.Time
+
+	// Retry bookkeeping for uploads that have failed
+	Attempts    int
+	LastError   string
+	NextAttempt time.Time
+}
+
+// sameFile returns whether the entry is about file, rather than an earlier file
+// with the same name. Entries recorded before modification times were kept only
+// have their size compared.
+func (e *journalEntry) sameFile(file cameraFile) bool {
+	if e.Size != file.Size {
+		return false
+	}
+	return e.ModTime.IsZero() || e.ModTime.Equal(file.ModTime)
+}
+
+// journal persists journal entries between runs of the pusher.
+type journal interface {
+	entries() ([]journalEntry, error)
+	record(entry journalEntry) error
+	close() error
+}
+
+// stormJournal is a journal stored on disk in a storm database.
+type stormJournal struct {
+	db *storm.DB
+}
+
+// openJournal opens the journal at path, creating it if it doesn't exist.
+func openJournal(path string) (*stormJournal, error) {
+	db, err := storm.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Init(&journalEntry{}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &stormJournal{db: db}, nil
+}
+
+func (j *stormJournal) entries() ([]journalEntry, error) {
+	entries := []journalEntry{}
+	if err := j.db.All(&entries); err != nil {
+		return []journalEntry{}, err
+	}
+	return entries, nil
+}
+
+func (j *stormJournal) record(entry journalEntry) error {
+	entry.UpdatedAt = time.Now()
+	return j.db.Save(&entry)
+}
+
+func (j *stormJournal) close() error {
+	return j.db.Close()
+}
@@ -0,0 +1,59 @@
+package pusher
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := openJournal(path.Join(dir, "journal.db"))
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+		return
+	}
+	defer j.close()
+
+	entries, err := j.entries()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("got %d entries, expected 0", len(entries))
+	}
+
+	err = j.record(journalEntry{Filename: "hi.JPG", Size: 5, PhotoID: "abc"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err = j.record(journalEntry{Filename: "hi.JPG", Size: 5, PhotoID: "abc", State: stateUploaded})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	entries, err = j.entries()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d entries, expected 1", len(entries))
+		return
+	}
+	if entries[0].Filename != "hi.JPG" || entries[0].Size != 5 || entries[0].PhotoID != "abc" {
+		t.Errorf("got unexpected entry: %+v", entries[0])
+	}
+	if entries[0].State != stateUploaded {
+		t.Errorf("got state %d, expected %d", entries[0].State, stateUploaded)
+	}
+	if entries[0].UpdatedAt.IsZero() {
+		t.Errorf("expected entry to have an updated time")
+	}
+}
@@ -2,11 +2,13 @@ package pusher
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"mime/multipart"
 	"net/http"
+	"path"
 	"strconv"
 	"time"
 
@@ -14,8 +16,9 @@ import (
 )
 
 type photoService interface {
-	existingPhotos() ([]string, error)
-	uploadPhoto([]byte) error
+	unknownPhotos(ids []string) ([]string, error)
+	failedPhotos(ids []string) ([]string, error)
+	uploadPhoto(filename string, photo []byte) error
 }
 
 type remoteAPI struct {
@@ -23,18 +26,154 @@ type remoteAPI struct {
 	uploadTimeout time.Duration
 	username      string
 	password      string
+	token         string
+	// Used for all requests, or http.DefaultTransport if nil
+	transport http.RoundTripper
+
+	// Send photos in chunks that can be resumed, rather than in a single request
+	resumable bool
 }
 
 const photosEndpoint = "/photos"
 const photoIDEndpoint = photosEndpoint + "/ids"
+const photoExistsEndpoint = photosEndpoint + "/exists"
+const uploadsEndpoint = "/uploads"
+
+// existsBatchSize is how many photo IDs are checked in each request.
+const existsBatchSize = 500
+
+// uploadChunkSize is how much of a photo is sent in each resumable upload request.
+const uploadChunkSize = 1 << 20 // 1M
+
+var (
+	errPhotoExists          = errors.New("photo already exists")
+	errResumableUnsupported = errors.New("server does not support resumable uploads")
+	errExistsUnsupported    = errors.New("server does not support checking photo IDs")
+)
+
+// client returns an HTTP client for requests to the server.
+func (r *remoteAPI) client(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: r.transport,
+		Timeout:   timeout,
+	}
+}
+
+// setAuth adds credentials to a request if any are configured, preferring an API token.
+func (r *remoteAPI) setAuth(req *http.Request) {
+	if len(r.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	} else if len(r.username) > 0 || len(r.password) > 0 {
+		// HTTP basic auth
+		req.SetBasicAuth(r.username, r.password)
+	}
+}
+
+// unknownPhotos returns the photo IDs in ids that the remote server doesn't have.
+func (r *remoteAPI) unknownPhotos(ids []string) ([]string, error) {
+	checked, err := r.checkPhotos(ids)
+	if err == errExistsUnsupported {
+		return r.unknownPhotosFromExisting(ids)
+	} else if err != nil {
+		return []string{}, err
+	}
+	return checked.Unknown, nil
+}
+
+// failedPhotos returns the photo IDs in ids that the remote server failed to process,
+// and wants to be sent again. Servers that can't check photo IDs never report any.
+func (r *remoteAPI) failedPhotos(ids []string) ([]string, error) {
+	checked, err := r.checkPhotos(ids)
+	if err == errExistsUnsupported {
+		return []string{}, nil
+	} else if err != nil {
+		return []string{}, err
+	}
+	return checked.Failed, nil
+}
+
+// checkPhotos asks the remote server about photo IDs, in batches.
+func (r *remoteAPI) checkPhotos(ids []string) (server.PhotosExistsResponse, error) {
+	checked := server.PhotosExistsResponse{Unknown: []string{}, Failed: []string{}}
+	for start := 0; start < len(ids); start += existsBatchSize {
+		end := start + existsBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		batch, err := r.checkPhotosBatch(ids[start:end])
+		if err != nil {
+			return checked, err
+		}
+		checked.Unknown = append(checked.Unknown, batch.Unknown...)
+		checked.Failed = append(checked.Failed, batch.Failed...)
+	}
+
+	checked.Success = true
+	return checked, nil
+}
 
-var errPhotoExists = errors.New("photo already exists")
+func (r *remoteAPI) checkPhotosBatch(ids []string) (server.PhotosExistsResponse, error) {
+	var existsResp server.PhotosExistsResponse
+	c := r.client(5 * time.Second)
+
+	body, err := json.Marshal(server.PhotosExistsRequest{IDs: ids})
+	if err != nil {
+		return existsResp, err
+	}
+
+	req, err := http.NewRequest("POST", r.url+photoExistsEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return existsResp, err
+	}
+	r.setAuth(req)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return existsResp, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return existsResp, errors.New("invalid authentication credentials")
+	} else if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		return existsResp, errExistsUnsupported
+	} else if resp.StatusCode != 200 {
+		return existsResp, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&existsResp); err != nil {
+		return existsResp, err
+	}
+	return existsResp, nil
+}
+
+// unknownPhotosFromExisting finds unknown photos on servers that can only list every ID.
+func (r *remoteAPI) unknownPhotosFromExisting(ids []string) ([]string, error) {
+	existing, err := r.existingPhotos()
+	if err != nil {
+		return []string{}, err
+	}
+
+	known := map[string]bool{}
+	for _, id := range existing {
+		known[id] = true
+	}
+
+	unknown := []string{}
+	for _, id := range ids {
+		if !known[id] {
+			unknown = append(unknown, id)
+		}
+	}
+	return unknown, nil
+}
 
 // existingPhotos returns all photo IDs that the remote server currently knows about.
 func (r *remoteAPI) existingPhotos() ([]string, error) {
-	c := &http.Client{
-		Timeout: 5 * time.Second,
-	}
+	c := r.client(5 * time.Second)
 
 	ids := []string{}
 	start := 0
@@ -46,10 +185,7 @@ func (r *remoteAPI) existingPhotos() ([]string, error) {
 			return []string{}, err
 		}
 
-		if len(r.username) > 0 || len(r.password) > 0 {
-			// HTTP basic auth
-			req.SetBasicAuth(r.username, r.password)
-		}
+		r.setAuth(req)
 
 		query := req.URL.Query()
 		query.Set("start", strconv.Itoa(start))
@@ -84,15 +220,25 @@ func (r *remoteAPI) existingPhotos() ([]string, error) {
 	return ids, nil
 }
 
-// uploadPhoto uploads a photo to the remote server.
-func (r *remoteAPI) uploadPhoto(photo []byte) error {
-	c := &http.Client{
-		Timeout: r.uploadTimeout,
+// uploadPhoto uploads a photo to the remote server. The server uses the photo's
+// filename on the camera to tell RAW formats apart and to pair RAW and JPEG files.
+func (r *remoteAPI) uploadPhoto(filename string, photo []byte) error {
+	if r.resumable {
+		err := r.uploadPhotoResumable(filename, photo)
+		if err != errResumableUnsupported {
+			return err
+		}
 	}
+	return r.uploadPhotoMultipart(filename, photo)
+}
+
+// uploadPhotoMultipart uploads a photo in a single multipart form request.
+func (r *remoteAPI) uploadPhotoMultipart(filename string, photo []byte) error {
+	c := r.client(r.uploadTimeout)
 
 	buf := bytes.Buffer{}
 	writer := multipart.NewWriter(&buf)
-	w, err := writer.CreateFormFile("photo", "photo")
+	w, err := writer.CreateFormFile("photo", path.Base(filename))
 	if err != nil {
 		return err
 	}
@@ -112,10 +258,7 @@ func (r *remoteAPI) uploadPhoto(photo []byte) error {
 		return err
 	}
 
-	if len(r.username) > 0 || len(r.password) > 0 {
-		// HTTP basic auth
-		req.SetBasicAuth(r.username, r.password)
-	}
+	r.setAuth(req)
 
 	req.Header.Set("Content-Type", writer.FormDataContentType())
 
@@ -123,16 +266,30 @@ func (r *remoteAPI) uploadPhoto(photo []byte) error {
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
+	return checkPhotoResponse(resp)
+}
+
+// checkPhotoResponse interprets the server's response to a new photo.
+func checkPhotoResponse(resp *http.Response) error {
 	if resp.StatusCode == 400 {
-		return errPhotoExists
+		var errResp server.ErrorResponse
+		dec := json.NewDecoder(resp.Body)
+		if err := dec.Decode(&errResp); err != nil {
+			return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		}
+		if errResp.Error == server.PhotoExistsError {
+			return errPhotoExists
+		}
+		return fmt.Errorf("server rejected photo: %s", errResp.Error)
 	} else if resp.StatusCode != 200 {
 		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
 
 	var photoResp server.PostPhotoResponse
 	dec := json.NewDecoder(resp.Body)
-	err = dec.Decode(&photoResp)
+	err := dec.Decode(&photoResp)
 	if err != nil {
 		return err
 	}
@@ -143,3 +300,98 @@ func (r *remoteAPI) uploadPhoto(photo []byte) error {
 
 	return nil
 }
+
+// uploadPhotoResumable uploads a photo in chunks, picking up from wherever an
+// earlier attempt for the same photo left off. The server finds the earlier upload
+// from the photo's ID, so this works across restarts of the pusher too.
+func (r *remoteAPI) uploadPhotoResumable(filename string, photo []byte) error {
+	id := fmt.Sprintf("%x", sha1.Sum(photo))
+	length := int64(len(photo))
+
+	upload, err := r.uploadRequest("POST", "", nil, map[string]string{
+		"Upload-Length":   strconv.FormatInt(length, 10),
+		"Upload-Filename": path.Base(filename),
+		"Upload-Photo-ID": id,
+	})
+	if err != nil {
+		return err
+	}
+	uploadID := upload.ID
+	offset := upload.Offset
+
+	for offset < length {
+		end := offset + uploadChunkSize
+		if end > length {
+			end = length
+		}
+		upload, err := r.uploadRequest("PATCH", uploadID, photo[offset:end], map[string]string{
+			"Upload-Offset": strconv.FormatInt(offset, 10),
+			"Content-Type":  "application/offset+octet-stream",
+		})
+		if err != nil {
+			return err
+		}
+		offset = upload.Offset
+	}
+
+	return r.completeUpload(uploadID)
+}
+
+// uploadRequest makes a request about a resumable upload and returns its state.
+// An empty uploadID creates a new upload.
+func (r *remoteAPI) uploadRequest(method, uploadID string, body []byte, headers map[string]string) (server.UploadResponse, error) {
+	c := r.client(r.uploadTimeout)
+
+	url := r.url + uploadsEndpoint
+	if uploadID != "" {
+		url += "/" + uploadID
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return server.UploadResponse{}, err
+	}
+	r.setAuth(req)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return server.UploadResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	if uploadID == "" && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed) {
+		return server.UploadResponse{}, errResumableUnsupported
+	} else if resp.StatusCode != 200 && resp.StatusCode != 201 {
+		return server.UploadResponse{}, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var uploadResp server.UploadResponse
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&uploadResp); err != nil {
+		return server.UploadResponse{}, err
+	}
+
+	return uploadResp, nil
+}
+
+// completeUpload asks the server to process a fully uploaded photo.
+func (r *remoteAPI) completeUpload(uploadID string) error {
+	c := r.client(r.uploadTimeout)
+
+	req, err := http.NewRequest("POST", r.url+uploadsEndpoint+"/"+uploadID+"/complete", nil)
+	if err != nil {
+		return err
+	}
+	r.setAuth(req)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkPhotoResponse(resp)
+}
@@ -1,6 +1,7 @@
 package pusher
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -195,6 +196,10 @@ func TestUploadPhoto(t *testing.T) {
 			return
 		}
 
+		if field[0].Filename != "hello.JPG" {
+			t.Errorf("got unexpected filename: %s", field[0].Filename)
+		}
+
 		file, err := field[0].Open()
 		if err != nil {
 			t.Errorf("unexpected error: %s", err)
@@ -220,7 +225,7 @@ func TestUploadPhoto(t *testing.T) {
 		url: server.URL,
 	}
 
-	err := ps.uploadPhoto([]byte("hello"))
+	err := ps.uploadPhoto("DCIM/hello.JPG", []byte("hello"))
 	if err != nil {
 		t.Errorf("unexpected error: %s", err)
 		return
@@ -239,7 +244,7 @@ func TestUploadPhotoExists(t *testing.T) {
 		url: server.URL,
 	}
 
-	err := ps.uploadPhoto([]byte("hello"))
+	err := ps.uploadPhoto("DCIM/hello.JPG", []byte("hello"))
 	if err != errPhotoExists {
 		t.Errorf("unexpected error: %s", err)
 	}
@@ -255,7 +260,7 @@ func TestUploadPhotoUnexpectedStatus(t *testing.T) {
 		url: server.URL,
 	}
 
-	err := ps.uploadPhoto([]byte("hello"))
+	err := ps.uploadPhoto("DCIM/hello.JPG", []byte("hello"))
 	if err.Error() != "unexpected status code: 500" {
 		t.Errorf("unexpected error: %s", err)
 	}
@@ -273,8 +278,254 @@ func TestUploadPhotoUnsuccessfulResponse(t *testing.T) {
 		url: server.URL,
 	}
 
-	err := ps.uploadPhoto([]byte("hello"))
+	err := ps.uploadPhoto("DCIM/hello.JPG", []byte("hello"))
 	if err.Error() != "unsuccessful response" {
 		t.Errorf("unexpected error: %s", err)
 	}
 }
+
+// resumableServer is a minimal stand-in for the server's resumable upload endpoints.
+type resumableServer struct {
+	t         *testing.T
+	data      []byte
+	length    int64
+	patches   int
+	failPatch int // fail the nth PATCH request
+	posts     int
+	completed bool
+}
+
+func (rs *resumableServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/uploads":
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil {
+			rs.t.Errorf("unexpected error: %s", err)
+		}
+		rs.length = length
+		if r.Header.Get("Upload-Filename") != "hello.CR2" {
+			rs.t.Errorf("got unexpected filename: %s", r.Header.Get("Upload-Filename"))
+		}
+		if r.Header.Get("Upload-Photo-ID") == "" {
+			rs.t.Errorf("expected a photo ID")
+		}
+		rs.posts++
+		// the upload created by the first request is returned after that
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(rs.data)))
+		if rs.posts == 1 {
+			w.WriteHeader(201)
+		}
+		fmt.Fprintf(w, `{"success": true, "id": "abc", "offset": %d}`, len(rs.data))
+	case r.Method == "PATCH" && r.URL.Path == "/uploads/abc":
+		rs.patches++
+		if rs.patches == rs.failPatch {
+			w.WriteHeader(500)
+			return
+		}
+		if r.Header.Get("Upload-Offset") != strconv.Itoa(len(rs.data)) {
+			rs.t.Errorf("got unexpected offset %s", r.Header.Get("Upload-Offset"))
+		}
+		chunk, _ := ioutil.ReadAll(r.Body)
+		rs.data = append(rs.data, chunk...)
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(rs.data)))
+		fmt.Fprintf(w, `{"success": true, "id": "abc", "offset": %d}`, len(rs.data))
+	case r.Method == "POST" && r.URL.Path == "/uploads/abc/complete":
+		rs.completed = true
+		fmt.Fprint(w, `{"success": true}`)
+	default:
+		rs.t.Errorf("got unexpected request %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(404)
+	}
+}
+
+func TestUploadPhotoResumable(t *testing.T) {
+	rs := &resumableServer{t: t, failPatch: 2}
+	server := httptest.NewServer(rs)
+	defer server.Close()
+
+	ps := &remoteAPI{
+		url:       server.URL,
+		resumable: true,
+	}
+
+	photo := bytes.Repeat([]byte("hello"), uploadChunkSize)
+
+	// the second chunk fails, so the first attempt gives up partway through
+	err := ps.uploadPhoto("DCIM/hello.CR2", photo)
+	if err == nil {
+		t.Errorf("expected error")
+	}
+	if len(rs.data) != uploadChunkSize {
+		t.Errorf("got %d bytes, expected %d", len(rs.data), uploadChunkSize)
+	}
+
+	// the next attempt picks up after the first chunk, even from a restarted pusher
+	ps = &remoteAPI{
+		url:       server.URL,
+		resumable: true,
+	}
+	err = ps.uploadPhoto("DCIM/hello.CR2", photo)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if rs.posts != 2 {
+		t.Errorf("got %d POST requests, expected 2", rs.posts)
+	}
+	if rs.patches != 1+len(photo)/uploadChunkSize {
+		t.Errorf("got %d PATCH requests, expected the first chunk not to be sent again", rs.patches)
+	}
+	if !bytes.Equal(rs.data, photo) {
+		t.Errorf("server got unexpected photo")
+	}
+	if !rs.completed {
+		t.Errorf("expected upload to be completed")
+	}
+}
+
+func TestUploadPhotoIncomplete(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		fmt.Fprint(w, `{"success": false, "error": "upload is incomplete"}`)
+	}))
+	defer server.Close()
+
+	ps := &remoteAPI{
+		url: server.URL,
+	}
+
+	// only the server saying it has the photo means it has been uploaded
+	err := ps.uploadPhoto("DCIM/hello.JPG", []byte("hello"))
+	if err == nil || err == errPhotoExists {
+		t.Errorf("got unexpected error: %v", err)
+	}
+}
+
+func TestUploadPhotoResumableUnsupported(t *testing.T) {
+	multipartUploads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != photosEndpoint {
+			w.WriteHeader(404)
+			return
+		}
+		multipartUploads++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"success": true}`)
+	}))
+	defer server.Close()
+
+	ps := &remoteAPI{
+		url:       server.URL,
+		resumable: true,
+	}
+
+	err := ps.uploadPhoto("DCIM/hello.JPG", []byte("hello"))
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if multipartUploads != 1 {
+		t.Errorf("got %d multipart uploads, expected 1", multipartUploads)
+	}
+}
+
+func TestUnknownPhotos(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != photoExistsEndpoint {
+			t.Errorf("got unexpected request %s %s", r.Method, r.URL.Path)
+			return
+		}
+		requests++
+
+		var req server.PhotosExistsRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+			return
+		}
+		if len(req.IDs) > existsBatchSize {
+			t.Errorf("got %d IDs, expected at most %d", len(req.IDs), existsBatchSize)
+		}
+
+		// pretend the server only has the first photo
+		resp := server.PhotosExistsResponse{
+			Success: true,
+			Unknown: []string{},
+		}
+		for _, id := range req.IDs {
+			if id != "0" {
+				resp.Unknown = append(resp.Unknown, id)
+			}
+		}
+		body, _ := json.Marshal(resp)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	ps := &remoteAPI{
+		url: server.URL,
+	}
+
+	ids := []string{}
+	for i := 0; i < existsBatchSize+1; i++ {
+		ids = append(ids, strconv.Itoa(i))
+	}
+
+	unknown, err := ps.unknownPhotos(ids)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+		return
+	}
+	if len(unknown) != existsBatchSize {
+		t.Errorf("got %d unknown photos, expected %d", len(unknown), existsBatchSize)
+	}
+	if requests != 2 {
+		t.Errorf("got %d requests, expected 2", requests)
+	}
+}
+
+func TestUnknownPhotosUnsupported(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != photoIDEndpoint {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"success": true, "ids": ["aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"]}`)
+	}))
+	defer server.Close()
+
+	ps := &remoteAPI{
+		url: server.URL,
+	}
+
+	unknown, err := ps.unknownPhotos([]string{
+		"aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+		"490528f36debf7c15cea5e9a9d1ea024cf6b2921",
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+		return
+	}
+	if len(unknown) != 1 || unknown[0] != "490528f36debf7c15cea5e9a9d1ea024cf6b2921" {
+		t.Errorf("got unexpected unknown photos: %v", unknown)
+	}
+}
+
+func TestSetAuth(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	ps := &remoteAPI{username: "user", password: "pass"}
+	ps.setAuth(req)
+	if username, password, ok := req.BasicAuth(); !ok || username != "user" || password != "pass" {
+		t.Errorf("expected basic auth, got %s", req.Header.Get("Authorization"))
+	}
+
+	// tokens are preferred
+	req = httptest.NewRequest("GET", "/", nil)
+	ps.token = "1234.5678"
+	ps.setAuth(req)
+	if auth := req.Header.Get("Authorization"); auth != "Bearer 1234.5678" {
+		t.Errorf("expected bearer token, got %s", auth)
+	}
+}
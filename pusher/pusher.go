@@ -4,38 +4,107 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/kochman/hotshots/config"
 	"github.com/kochman/hotshots/log"
 )
 
+// uploadRecheckInterval is how often photos that were uploaded are checked again, in
+// case the server has failed them since, such as when their files were found damaged.
+const uploadRecheckInterval = time.Hour
+
 // Pusher is responsible for uploading photos from a camera to a remote location.
 // It only uploads photos that don't exist remotely, in an effort to reduce bandwidth usage.
 type Pusher struct {
-	cfg               config.Config
-	cameraService     cameraService
-	filenameToPhotoID map[string]string
-	photoService      photoService
+	cfg           config.Config
+	cameraService cameraService
+	entries       map[string]*journalEntry
+	journal       journal
+	photoService  photoService
+	lastRecheck   time.Time
 }
 
-// New creates a new Pusher.
+// New creates a new Pusher, picking up where the last one left off if a journal exists.
 func New(cfg *config.Config) (*Pusher, error) {
+	if err := os.MkdirAll(cfg.PusherFolder(), 0775); err != nil {
+		return nil, err
+	}
+
+	transport, err := newTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	j, err := openJournal(cfg.JournalFile())
+	if err != nil {
+		return nil, err
+	}
+
 	p := &Pusher{
-		cfg:               *cfg,
-		cameraService:     newLocalCamera(),
-		filenameToPhotoID: map[string]string{},
+		cfg:           *cfg,
+		cameraService: newLocalCamera(cfg.TransferRaw),
+		entries:       map[string]*journalEntry{},
+		journal:       j,
 		photoService: &remoteAPI{
 			url:           cfg.ServerURL,
 			uploadTimeout: cfg.UploadTimeout,
 			username:      cfg.AuthUsername,
 			password:      cfg.AuthPassword,
+			token:         cfg.AuthToken,
+			transport:     transport,
+			resumable:     true,
 		},
+		lastRecheck: time.Now(),
+	}
+
+	if err := p.loadJournal(); err != nil {
+		j.close()
+		return nil, err
 	}
 
 	return p, nil
 }
 
+// loadJournal fills in photo IDs and upload states recorded by previous runs.
+func (p *Pusher) loadJournal() error {
+	entries, err := p.journal.entries()
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for i := range entries {
+		entry := entries[i]
+		p.entries[entry.Filename] = &entry
+		if entry.State == stateFailed {
+			failed++
+		}
+	}
+
+	if len(entries) > 0 {
+		log.Infof("loaded %d photos from journal", len(entries))
+	}
+	if failed > 0 {
+		log.Warnf("%d photos in the journal have failed to upload too many times and will not be retried without --retry-failed", failed)
+	}
+	return nil
+}
+
+// RetryFailed queues the photos that were given up on to be uploaded again, and
+// returns how many there were.
+func (p *Pusher) RetryFailed() int {
+	retried := 0
+	for _, entry := range p.entries {
+		if entry.State == stateFailed {
+			p.retry(entry)
+			retried++
+		}
+	}
+	return retried
+}
+
 // Run runs the Pusher's upload functionality in a loop forever.
 func (p *Pusher) Run() {
 	ticker := time.NewTicker(p.cfg.RefreshInterval)
@@ -47,46 +116,120 @@ func (p *Pusher) Run() {
 func (p *Pusher) uploadNewPhotos() {
 	p.generatePhotoIDs()
 
-	photos, err := p.photoService.existingPhotos()
+	p.recheckUploads(time.Now())
+	p.confirmUploads()
+
+	toUpload := p.dueUploads(time.Now())
+	if len(toUpload) > 0 {
+		log.Infof("%d photos to upload", len(toUpload))
+	}
+
+	for _, entry := range toUpload {
+		b, err := p.cameraService.getFile(entry.Filename)
+		if err != nil {
+			log.WithError(err).Error("unable to get file")
+			continue
+		}
+
+		log.Infof("uploading photo %s", entry.Filename)
+		err = p.photoService.uploadPhoto(entry.Filename, b)
+		if err == errPhotoExists {
+			log.Infof("photo %s already exists on server", entry.Filename)
+			p.markUploaded(entry)
+			continue
+		} else if err != nil {
+			log.WithError(err).Errorf("unable to upload %s", entry.Filename)
+			p.markFailed(entry, err)
+			continue
+		}
+		log.Infof("uploaded photo %s", entry.Filename)
+		p.markUploaded(entry)
+	}
+
+}
+
+// confirmUploads asks the server about photos that haven't been confirmed as
+// uploaded yet, and marks any it already has.
+func (p *Pusher) confirmUploads() {
+	// the same photo can be on the camera under more than one filename
+	pending := map[string][]*journalEntry{}
+	ids := []string{}
+	for _, entry := range p.entries {
+		if entry.State != statePending {
+			continue
+		}
+		if _, ok := pending[entry.PhotoID]; !ok {
+			ids = append(ids, entry.PhotoID)
+		}
+		pending[entry.PhotoID] = append(pending[entry.PhotoID], entry)
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	unknown, err := p.photoService.unknownPhotos(ids)
 	if err != nil {
-		log.WithError(err).Error("unable to get existing photos")
+		// Keep working through the queue anyway, since the server refuses duplicates.
+		log.WithError(err).Error("unable to check for existing photos")
 		return
 	}
 
-	toUpload := []string{}
-	for filename, id := range p.filenameToPhotoID {
-		found := false
-		for _, existing := range photos {
-			if id == existing {
-				found = true
-				break
-			}
-		}
-		if !found {
-			toUpload = append(toUpload, filename)
+	for _, id := range unknown {
+		delete(pending, id)
+	}
+	for _, entries := range pending {
+		for _, entry := range entries {
+			p.markUploaded(entry)
 		}
 	}
+}
 
-	if len(toUpload) > 0 {
-		log.Infof("%d existing photos on server, %d to upload", len(photos), len(toUpload))
+// recheckUploads asks the server about photos that were uploaded, once every
+// uploadRecheckInterval, and queues the ones it has failed to be uploaded again.
+func (p *Pusher) recheckUploads(now time.Time) {
+	if now.Sub(p.lastRecheck) < uploadRecheckInterval {
+		return
 	}
 
-	for _, filename := range toUpload {
-		b, err := p.cameraService.getFile(filename)
-		if err != nil {
-			log.WithError(err).Error("unable to get file")
+	uploaded := map[string][]*journalEntry{}
+	ids := []string{}
+	for _, entry := range p.entries {
+		if entry.State != stateUploaded {
 			continue
 		}
-
-		log.Infof("uploading photo %s", filename)
-		err = p.photoService.uploadPhoto(b)
+		if _, ok := uploaded[entry.PhotoID]; !ok {
+			ids = append(ids, entry.PhotoID)
+		}
+		uploaded[entry.PhotoID] = append(uploaded[entry.PhotoID], entry)
+	}
+	if len(ids) > 0 {
+		failed, err := p.photoService.failedPhotos(ids)
 		if err != nil {
-			log.WithError(err).Errorf("unable to upload %s", filename)
-			continue
+			// tried again on the next run
+			log.WithError(err).Error("unable to check uploaded photos")
+			return
+		}
+		for _, id := range failed {
+			for _, entry := range uploaded[id] {
+				log.Infof("server failed %s, uploading it again", entry.Filename)
+				p.retry(entry)
+			}
 		}
-		log.Infof("uploaded photo %s", filename)
 	}
+	p.lastRecheck = now
+}
+
+// markUploaded notes in the journal that the server has a photo.
+func (p *Pusher) markUploaded(entry *journalEntry) {
+	entry.State = stateUploaded
+	entry.LastError = ""
+	p.saveEntry(entry)
+}
 
+func (p *Pusher) saveEntry(entry *journalEntry) {
+	if err := p.journal.record(*entry); err != nil {
+		log.WithError(err).Errorf("unable to update journal for %s", entry.Filename)
+	}
 }
 
 func (p *Pusher) generatePhotoID(photo []byte) (string, error) {
@@ -99,7 +242,7 @@ func (p *Pusher) generatePhotoID(photo []byte) (string, error) {
 }
 
 func (p *Pusher) generatePhotoIDs() {
-	filenames, err := p.cameraService.listFilenames()
+	files, err := p.cameraService.listFilenames()
 	if err == errCameraNotConnected {
 		return
 	} else if err != nil {
@@ -107,22 +250,38 @@ func (p *Pusher) generatePhotoIDs() {
 		return
 	}
 
-	for _, filename := range filenames {
+	for _, file := range files {
 		// generate an ID for this photo if not exists
-		if _, ok := p.filenameToPhotoID[filename]; ok {
-			continue
+		if entry, ok := p.entries[file.Name]; ok {
+			if entry.sameFile(file) {
+				if entry.ModTime.IsZero() && !file.ModTime.IsZero() {
+					entry.ModTime = file.ModTime
+					p.saveEntry(entry)
+				}
+				continue
+			}
+			log.Infof("%s is a different file than before, treating it as a new photo", file.Name)
 		}
-		b, err := p.cameraService.getFile(filename)
+		b, err := p.cameraService.getFile(file.Name)
 		if err != nil {
 			log.WithError(err).Error("unable to get file")
 			continue
 		}
 		id, err := p.generatePhotoID(b)
 		if err != nil {
-			log.WithError(err).Errorf("unable to generate photo ID %s", filename)
+			log.WithError(err).Errorf("unable to generate photo ID %s", file.Name)
 			continue
 		}
 
-		p.filenameToPhotoID[filename] = id
+		entry := &journalEntry{
+			Filename:     file.Name,
+			Size:         file.Size,
+			ModTime:      file.ModTime,
+			PhotoID:      id,
+			State:        statePending,
+			DiscoveredAt: time.Now(),
+		}
+		p.entries[file.Name] = entry
+		p.saveEntry(entry)
 	}
 }
@@ -1,13 +1,23 @@
 package pusher
 
 import (
+	"crypto/sha1"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/mock"
 
 	"github.com/kochman/hotshots/config"
 	"github.com/kochman/hotshots/log"
+	"github.com/kochman/hotshots/server"
 )
 
 func init() {
@@ -22,32 +32,65 @@ type mockPhotoService struct {
 	mock.Mock
 }
 
+// testConfig returns a config that keeps pusher state in a temporary directory,
+// along with a function that removes it.
+func testConfig() (*config.Config, func(), error) {
+	cfg, err := config.New()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "hotshots")
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.PhotosDirectory = dir
+
+	return cfg, func() { os.RemoveAll(dir) }, nil
+}
+
 func (mc *mockCameraService) getFile(file string) ([]byte, error) {
 	args := mc.Called(file)
 	return args.Get(0).([]byte), args.Error(1)
 }
 
-func (mc *mockCameraService) listFilenames() ([]string, error) {
+func (mc *mockCameraService) listFilenames() ([]cameraFile, error) {
 	args := mc.Called()
+	return args.Get(0).([]cameraFile), args.Error(1)
+}
+
+// cameraFiles returns files with the given names, as listed by a camera that doesn't
+// report sizes or modification times.
+func cameraFiles(names ...string) []cameraFile {
+	files := []cameraFile{}
+	for _, name := range names {
+		files = append(files, cameraFile{Name: name})
+	}
+	return files
+}
+
+func (mps *mockPhotoService) unknownPhotos(ids []string) ([]string, error) {
+	args := mps.Called(ids)
 	return args.Get(0).([]string), args.Error(1)
 }
 
-func (mps *mockPhotoService) existingPhotos() ([]string, error) {
-	args := mps.Called()
+func (mps *mockPhotoService) failedPhotos(ids []string) ([]string, error) {
+	args := mps.Called(ids)
 	return args.Get(0).([]string), args.Error(1)
 }
 
-func (mps *mockPhotoService) uploadPhoto(photo []byte) error {
-	args := mps.Called(photo)
+func (mps *mockPhotoService) uploadPhoto(filename string, photo []byte) error {
+	args := mps.Called(filename, photo)
 	return args.Error(0)
 }
 
 func TestGeneratePhotoID(t *testing.T) {
-	cfg, err := config.New()
+	cfg, cleanup, err := testConfig()
 	if err != nil {
 		t.Errorf("unexpected error: %s", err)
 		return
 	}
+	defer cleanup()
 
 	p, err := New(cfg)
 	if err != nil {
@@ -66,11 +109,12 @@ func TestGeneratePhotoID(t *testing.T) {
 }
 
 func TestGeneratePhotoIDs(t *testing.T) {
-	cfg, err := config.New()
+	cfg, cleanup, err := testConfig()
 	if err != nil {
 		t.Errorf("unexpected error: %s", err)
 		return
 	}
+	defer cleanup()
 
 	p, err := New(cfg)
 	if err != nil {
@@ -79,25 +123,23 @@ func TestGeneratePhotoIDs(t *testing.T) {
 	}
 
 	cameraService := &mockCameraService{}
-	cameraService.On("listFilenames").Return([]string{"hi.JPG", "there.JPG"}, nil)
+	cameraService.On("listFilenames").Return(cameraFiles("hi.JPG", "there.JPG"), nil)
 	cameraService.On("getFile", "hi.JPG").Return([]byte("hello"), nil)
 	cameraService.On("getFile", "there.JPG").Return([]byte("there"), nil)
 	p.cameraService = cameraService
 
 	p.generatePhotoIDs()
 
-	val, ok := p.filenameToPhotoID["hi.JPG"]
-	if ok {
-		if val != "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d" {
+	if entry, ok := p.entries["hi.JPG"]; ok {
+		if entry.PhotoID != "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d" {
 			t.Errorf("\"hi.JPG\" has unexpected photo ID")
 		}
 	} else {
 		t.Errorf("expected \"hi.JPG\" to have a photo ID")
 	}
 
-	val, ok = p.filenameToPhotoID["there.JPG"]
-	if ok {
-		if val != "490528f36debf7c15cea5e9a9d1ea024cf6b2921" {
+	if entry, ok := p.entries["there.JPG"]; ok {
+		if entry.PhotoID != "490528f36debf7c15cea5e9a9d1ea024cf6b2921" {
 			t.Errorf("\"there.JPG\" has unexpected photo ID")
 		}
 	} else {
@@ -110,11 +152,12 @@ func TestGeneratePhotoIDs(t *testing.T) {
 }
 
 func TestUploadNewPhotos(t *testing.T) {
-	cfg, err := config.New()
+	cfg, cleanup, err := testConfig()
 	if err != nil {
 		t.Errorf("unexpected error: %s", err)
 		return
 	}
+	defer cleanup()
 
 	p, err := New(cfg)
 	if err != nil {
@@ -123,14 +166,17 @@ func TestUploadNewPhotos(t *testing.T) {
 	}
 
 	cameraService := &mockCameraService{}
-	cameraService.On("listFilenames").Return([]string{"hi.JPG", "there.JPG"}, nil)
+	cameraService.On("listFilenames").Return(cameraFiles("hi.JPG", "there.JPG"), nil)
 	cameraService.On("getFile", "hi.JPG").Return([]byte("hello"), nil)
 	cameraService.On("getFile", "there.JPG").Return([]byte("there"), nil)
 	p.cameraService = cameraService
 
 	photoService := &mockPhotoService{}
-	photoService.On("existingPhotos").Return([]string{}, nil)
-	photoService.On("uploadPhoto", mock.Anything).Return(nil)
+	photoService.On("unknownPhotos", mock.Anything).Return([]string{
+		"aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+		"490528f36debf7c15cea5e9a9d1ea024cf6b2921",
+	}, nil)
+	photoService.On("uploadPhoto", mock.Anything, mock.Anything).Return(nil)
 	p.photoService = photoService
 
 	p.uploadNewPhotos()
@@ -138,16 +184,17 @@ func TestUploadNewPhotos(t *testing.T) {
 	cameraService.AssertExpectations(t)
 
 	photoService.AssertExpectations(t)
-	photoService.AssertNumberOfCalls(t, "existingPhotos", 1)
+	photoService.AssertNumberOfCalls(t, "unknownPhotos", 1)
 	photoService.AssertNumberOfCalls(t, "uploadPhoto", 2)
 }
 
-func TestUploadNewPhotosExistingPhotosErr(t *testing.T) {
-	cfg, err := config.New()
+func TestUploadNewPhotosUnknownPhotosErr(t *testing.T) {
+	cfg, cleanup, err := testConfig()
 	if err != nil {
 		t.Errorf("unexpected error: %s", err)
 		return
 	}
+	defer cleanup()
 
 	p, err := New(cfg)
 	if err != nil {
@@ -156,11 +203,14 @@ func TestUploadNewPhotosExistingPhotosErr(t *testing.T) {
 	}
 
 	cameraService := &mockCameraService{}
-	cameraService.On("listFilenames").Return([]string{}, nil)
+	cameraService.On("listFilenames").Return(cameraFiles("hi.JPG"), nil)
+	cameraService.On("getFile", "hi.JPG").Return([]byte("hello"), nil)
 	p.cameraService = cameraService
 
+	// the upload is still attempted when the server can't be asked about photos
 	photoService := &mockPhotoService{}
-	photoService.On("existingPhotos").Return([]string{}, errors.New("some error"))
+	photoService.On("unknownPhotos", mock.Anything).Return([]string{}, errors.New("some error"))
+	photoService.On("uploadPhoto", "hi.JPG", []byte("hello")).Return(nil)
 	p.photoService = photoService
 
 	p.uploadNewPhotos()
@@ -168,15 +218,17 @@ func TestUploadNewPhotosExistingPhotosErr(t *testing.T) {
 	cameraService.AssertExpectations(t)
 
 	photoService.AssertExpectations(t)
-	photoService.AssertNumberOfCalls(t, "existingPhotos", 1)
+	photoService.AssertNumberOfCalls(t, "unknownPhotos", 1)
+	photoService.AssertNumberOfCalls(t, "uploadPhoto", 1)
 }
 
 func TestUploadNewPhotosNotExisting(t *testing.T) {
-	cfg, err := config.New()
+	cfg, cleanup, err := testConfig()
 	if err != nil {
 		t.Errorf("unexpected error: %s", err)
 		return
 	}
+	defer cleanup()
 
 	p, err := New(cfg)
 	if err != nil {
@@ -185,22 +237,330 @@ func TestUploadNewPhotosNotExisting(t *testing.T) {
 	}
 
 	cameraService := &mockCameraService{}
-	cameraService.On("listFilenames").Return([]string{"hi.JPG", "there.JPG"}, nil)
+	cameraService.On("listFilenames").Return(cameraFiles("hi.JPG", "there.JPG"), nil)
 	cameraService.On("getFile", "hi.JPG").Return([]byte("hello"), nil)
 	cameraService.On("getFile", "there.JPG").Return([]byte("there"), nil)
 	p.cameraService = cameraService
 
 	photoService := &mockPhotoService{}
-	// this is the sha1 hash of "hello", so it shouldn't get uploaded again
-	photoService.On("existingPhotos").Return([]string{"aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"}, nil)
-	photoService.On("uploadPhoto", []byte("there")).Return(nil)
+	// only the sha1 hash of "there" is unknown, so "hello" shouldn't get uploaded again
+	photoService.On("unknownPhotos", mock.Anything).Return([]string{"490528f36debf7c15cea5e9a9d1ea024cf6b2921"}, nil)
+	photoService.On("uploadPhoto", "there.JPG", []byte("there")).Return(nil)
 	p.photoService = photoService
 
 	p.uploadNewPhotos()
 
+	// once everything is confirmed, the server isn't asked again
+	p.uploadNewPhotos()
+
 	cameraService.AssertExpectations(t)
 
 	photoService.AssertExpectations(t)
-	photoService.AssertNumberOfCalls(t, "existingPhotos", 1)
+	photoService.AssertNumberOfCalls(t, "unknownPhotos", 1)
 	photoService.AssertNumberOfCalls(t, "uploadPhoto", 1)
 }
+
+func TestGeneratePhotoIDsFromJournal(t *testing.T) {
+	cfg, cleanup, err := testConfig()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+		return
+	}
+	defer cleanup()
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+		return
+	}
+
+	cameraService := &mockCameraService{}
+	cameraService.On("listFilenames").Return(cameraFiles("hi.JPG", "there.JPG"), nil)
+	cameraService.On("getFile", "hi.JPG").Return([]byte("hello"), nil)
+	cameraService.On("getFile", "there.JPG").Return([]byte("there"), nil)
+	p.cameraService = cameraService
+
+	photoService := &mockPhotoService{}
+	photoService.On("unknownPhotos", mock.Anything).Return([]string{"490528f36debf7c15cea5e9a9d1ea024cf6b2921"}, nil)
+	photoService.On("uploadPhoto", "there.JPG", []byte("there")).Return(nil)
+	p.photoService = photoService
+
+	p.uploadNewPhotos()
+	p.journal.close()
+
+	// a restarted pusher shouldn't need to read either file from the camera again
+	p, err = New(cfg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+		return
+	}
+	defer p.journal.close()
+
+	cameraService = &mockCameraService{}
+	cameraService.On("listFilenames").Return(cameraFiles("hi.JPG", "there.JPG"), nil)
+	p.cameraService = cameraService
+
+	p.generatePhotoIDs()
+
+	if p.entries["hi.JPG"] == nil || p.entries["hi.JPG"].PhotoID != "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d" {
+		t.Errorf("\"hi.JPG\" has unexpected photo ID")
+	}
+	if p.entries["there.JPG"] == nil || p.entries["there.JPG"].PhotoID != "490528f36debf7c15cea5e9a9d1ea024cf6b2921" {
+		t.Errorf("\"there.JPG\" has unexpected photo ID")
+	}
+	if p.entries["hi.JPG"].State != stateUploaded || p.entries["there.JPG"].State != stateUploaded {
+		t.Errorf("expected both photos to be marked as uploaded")
+	}
+
+	cameraService.AssertExpectations(t)
+	cameraService.AssertNumberOfCalls(t, "getFile", 0)
+}
+
+func TestGeneratePhotoIDsReusedFilename(t *testing.T) {
+	cfg, cleanup, err := testConfig()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+		return
+	}
+	defer cleanup()
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+		return
+	}
+	defer p.journal.close()
+
+	taken := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	cameraService := &mockCameraService{}
+	cameraService.On("listFilenames").Return([]cameraFile{{Name: "IMG_0001.JPG", Size: 5, ModTime: taken}}, nil).Once()
+	cameraService.On("getFile", "IMG_0001.JPG").Return([]byte("hello"), nil).Once()
+	p.cameraService = cameraService
+
+	photoService := &mockPhotoService{}
+	photoService.On("unknownPhotos", []string{"aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"}).Return([]string{}, nil)
+	p.photoService = photoService
+
+	p.uploadNewPhotos()
+	if p.entries["IMG_0001.JPG"].State != stateUploaded {
+		t.Errorf("expected the first photo to be marked as uploaded")
+	}
+
+	// the card is formatted and the camera starts numbering from the beginning again
+	cameraService.On("listFilenames").Return([]cameraFile{{Name: "IMG_0001.JPG", Size: 6, ModTime: taken.Add(24 * time.Hour)}}, nil)
+	cameraService.On("getFile", "IMG_0001.JPG").Return([]byte("there!"), nil)
+	photoService.On("unknownPhotos", []string{"691443077293d53a57e9fc21f4a0a37a71fb5aab"}).Return([]string{"691443077293d53a57e9fc21f4a0a37a71fb5aab"}, nil)
+	photoService.On("uploadPhoto", "IMG_0001.JPG", []byte("there!")).Return(nil)
+
+	p.uploadNewPhotos()
+
+	entry := p.entries["IMG_0001.JPG"]
+	if entry.PhotoID != "691443077293d53a57e9fc21f4a0a37a71fb5aab" {
+		t.Errorf("expected the new photo to get its own ID, got %s", entry.PhotoID)
+	}
+	if entry.State != stateUploaded {
+		t.Errorf("expected the new photo to be uploaded")
+	}
+
+	photoService.AssertNumberOfCalls(t, "uploadPhoto", 1)
+}
+
+func TestUploadNewPhotosRetry(t *testing.T) {
+	cfg, cleanup, err := testConfig()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+		return
+	}
+	defer cleanup()
+	cfg.MaxUploadAttempts = 2
+	cfg.RetryBackoff = 0
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+		return
+	}
+	defer p.journal.close()
+
+	cameraService := &mockCameraService{}
+	cameraService.On("listFilenames").Return(cameraFiles("hi.JPG"), nil)
+	cameraService.On("getFile", "hi.JPG").Return([]byte("hello"), nil)
+	p.cameraService = cameraService
+
+	// uploads are still attempted when the server can't be asked about photos
+	photoService := &mockPhotoService{}
+	photoService.On("unknownPhotos", mock.Anything).Return([]string{}, errors.New("some error"))
+	photoService.On("uploadPhoto", "hi.JPG", []byte("hello")).Return(errors.New("network down"))
+	p.photoService = photoService
+
+	p.uploadNewPhotos()
+
+	entry := p.entries["hi.JPG"]
+	if entry.State != statePending {
+		t.Errorf("expected photo to still be pending after one failure")
+	}
+	if entry.Attempts != 1 || entry.LastError != "network down" {
+		t.Errorf("got unexpected retry state: %+v", entry)
+	}
+
+	p.uploadNewPhotos()
+	if entry.State != stateFailed {
+		t.Errorf("expected photo to be given up on after two failures")
+	}
+
+	// failed photos aren't tried again
+	p.uploadNewPhotos()
+
+	photoService.AssertNumberOfCalls(t, "unknownPhotos", 2)
+	photoService.AssertNumberOfCalls(t, "uploadPhoto", 2)
+
+	// not even after a restart
+	p.journal.close()
+	p, err = New(cfg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+		return
+	}
+	defer p.journal.close()
+
+	entry = p.entries["hi.JPG"]
+	if entry.State != stateFailed {
+		t.Errorf("expected photo to stay given up on after a restart: %+v", entry)
+	}
+
+	// until they're retried by hand
+	if retried := p.RetryFailed(); retried != 1 {
+		t.Errorf("got %d photos retried, expected 1", retried)
+	}
+	if entry.State != statePending || entry.Attempts != 0 {
+		t.Errorf("expected photo to be queued again: %+v", entry)
+	}
+
+	p.cameraService = cameraService
+	photoService = &mockPhotoService{}
+	photoService.On("unknownPhotos", mock.Anything).Return([]string{"aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"}, nil)
+	photoService.On("uploadPhoto", "hi.JPG", []byte("hello")).Return(nil)
+	p.photoService = photoService
+
+	p.uploadNewPhotos()
+	if entry.State != stateUploaded {
+		t.Errorf("expected photo to be uploaded once it was retried")
+	}
+}
+
+// photoServer stands in for the server, keeping the status of each photo it's sent.
+type photoServer struct {
+	t       *testing.T
+	mu      sync.Mutex
+	failed  map[string]bool
+	uploads int
+}
+
+// fail marks a photo as failed, as fsck does when it finds a photo's files damaged.
+func (s *photoServer) fail(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed[id] = true
+}
+
+func (s *photoServer) status(id string) (uploads int, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uploads, s.failed[id]
+}
+
+func (s *photoServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.URL.Path {
+	case photoExistsEndpoint:
+		var req server.PhotosExistsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.t.Errorf("unexpected error: %s", err)
+			return
+		}
+		resp := server.PhotosExistsResponse{Success: true, Unknown: []string{}, Failed: []string{}}
+		for _, id := range req.IDs {
+			if failed, ok := s.failed[id]; !ok || failed {
+				resp.Unknown = append(resp.Unknown, id)
+			}
+			if s.failed[id] {
+				resp.Failed = append(resp.Failed, id)
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+
+	case photosEndpoint:
+		file, _, err := r.FormFile("photo")
+		if err != nil {
+			s.t.Errorf("unexpected error: %s", err)
+			return
+		}
+		photo, _ := ioutil.ReadAll(file)
+		s.failed[fmt.Sprintf("%x", sha1.Sum(photo))] = false
+		s.uploads++
+		fmt.Fprint(w, `{"success": true}`)
+
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func TestRecheckUploads(t *testing.T) {
+	cfg, cleanup, err := testConfig()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+		return
+	}
+	defer cleanup()
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+		return
+	}
+	defer p.journal.close()
+
+	cameraService := &mockCameraService{}
+	cameraService.On("listFilenames").Return(cameraFiles("hi.JPG"), nil)
+	cameraService.On("getFile", "hi.JPG").Return([]byte("hello"), nil)
+	p.cameraService = cameraService
+
+	photos := &photoServer{t: t, failed: map[string]bool{}}
+	ts := httptest.NewServer(photos)
+	defer ts.Close()
+	p.photoService = &remoteAPI{url: ts.URL}
+
+	id := "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"
+	p.uploadNewPhotos()
+	entry := p.entries["hi.JPG"]
+	if uploads, _ := photos.status(id); entry.State != stateUploaded || uploads != 1 {
+		t.Errorf("expected photo to be uploaded: %+v", entry)
+	}
+
+	photos.fail(id)
+
+	// which goes unnoticed until it's time to check uploaded photos again
+	p.uploadNewPhotos()
+	if uploads, _ := photos.status(id); uploads != 1 {
+		t.Errorf("expected uploaded photos to only be checked again after a while")
+	}
+
+	p.lastRecheck = time.Now().Add(-uploadRecheckInterval)
+	p.uploadNewPhotos()
+	uploads, failed := photos.status(id)
+	if entry.State != stateUploaded || uploads != 2 {
+		t.Errorf("expected failed photo to be uploaded again: %+v, %d uploads", entry, uploads)
+	}
+	if failed {
+		t.Errorf("expected server to have the photo again")
+	}
+
+	// and it isn't sent again once the server has it
+	p.lastRecheck = time.Now().Add(-uploadRecheckInterval)
+	p.uploadNewPhotos()
+	if uploads, _ := photos.status(id); uploads != 2 {
+		t.Errorf("got %d uploads, expected 2", uploads)
+	}
+}
@@ -0,0 +1,68 @@
+package pusher
+
+import (
+	"sort"
+	"time"
+
+	"github.com/kochman/hotshots/log"
+)
+
+// maxBackoff caps how long a failed upload waits before it's retried.
+const maxBackoff = 10 * time.Minute
+
+// dueUploads returns the photos that still need to be uploaded and aren't
+// waiting out a backoff, newest first.
+func (p *Pusher) dueUploads(now time.Time) []*journalEntry {
+	due := []*journalEntry{}
+	for _, entry := range p.entries {
+		if entry.State != statePending || entry.NextAttempt.After(now) {
+			continue
+		}
+		due = append(due, entry)
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].DiscoveredAt.Equal(due[j].DiscoveredAt) {
+			return due[i].DiscoveredAt.After(due[j].DiscoveredAt)
+		}
+		// cameras number files sequentially, so later names are newer
+		return due[i].Filename > due[j].Filename
+	})
+	return due
+}
+
+// markFailed records a failed upload attempt and schedules the next one.
+// After MaxUploadAttempts the photo is given up on until it's retried by hand.
+func (p *Pusher) markFailed(entry *journalEntry, err error) {
+	entry.Attempts++
+	entry.LastError = err.Error()
+	entry.NextAttempt = time.Now().Add(backoff(p.cfg.RetryBackoff, entry.Attempts))
+
+	if p.cfg.MaxUploadAttempts > 0 && entry.Attempts >= p.cfg.MaxUploadAttempts {
+		entry.State = stateFailed
+		log.WithField("error", entry.LastError).Errorf("giving up on %s after %d attempts", entry.Filename, entry.Attempts)
+	}
+
+	p.saveEntry(entry)
+}
+
+// retry queues a photo that was given up on to be uploaded again as if it were new.
+func (p *Pusher) retry(entry *journalEntry) {
+	entry.State = statePending
+	entry.Attempts = 0
+	entry.NextAttempt = time.Time{}
+	p.saveEntry(entry)
+}
+
+// backoff returns how long to wait after the given number of failed attempts,
+// doubling each time.
+func backoff(base time.Duration, attempts int) time.Duration {
+	d := base
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
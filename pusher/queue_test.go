@@ -0,0 +1,54 @@
+package pusher
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	type testCase struct {
+		attempts int
+		expected time.Duration
+	}
+	cases := []testCase{
+		{attempts: 1, expected: 5 * time.Second},
+		{attempts: 2, expected: 10 * time.Second},
+		{attempts: 3, expected: 20 * time.Second},
+		{attempts: 7, expected: 320 * time.Second},
+		{attempts: 8, expected: maxBackoff},
+		{attempts: 100, expected: maxBackoff},
+	}
+
+	for _, c := range cases {
+		d := backoff(5*time.Second, c.attempts)
+		if d != c.expected {
+			t.Errorf("got backoff %s after %d attempts, expected %s", d, c.attempts, c.expected)
+		}
+	}
+}
+
+func TestDueUploads(t *testing.T) {
+	now := time.Now()
+	p := &Pusher{
+		entries: map[string]*journalEntry{
+			"100/IMG_0001.JPG": {Filename: "100/IMG_0001.JPG", DiscoveredAt: now.Add(-time.Minute)},
+			"100/IMG_0002.JPG": {Filename: "100/IMG_0002.JPG", DiscoveredAt: now},
+			"100/IMG_0003.JPG": {Filename: "100/IMG_0003.JPG", DiscoveredAt: now},
+			"100/IMG_0004.JPG": {Filename: "100/IMG_0004.JPG", DiscoveredAt: now, NextAttempt: now.Add(time.Minute)},
+			"100/IMG_0005.JPG": {Filename: "100/IMG_0005.JPG", DiscoveredAt: now, State: stateUploaded},
+			"100/IMG_0006.JPG": {Filename: "100/IMG_0006.JPG", DiscoveredAt: now, State: stateFailed},
+		},
+	}
+
+	due := p.dueUploads(now)
+	expected := []string{"100/IMG_0003.JPG", "100/IMG_0002.JPG", "100/IMG_0001.JPG"}
+	if len(due) != len(expected) {
+		t.Errorf("got %d due uploads, expected %d", len(due), len(expected))
+		return
+	}
+	for i, filename := range expected {
+		if due[i].Filename != filename {
+			t.Errorf("got %s at position %d, expected %s", due[i].Filename, i, filename)
+		}
+	}
+}
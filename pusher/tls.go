@@ -0,0 +1,99 @@
+package pusher
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kochman/hotshots/config"
+)
+
+var errFingerprintMismatch = errors.New("server certificate does not match the pinned fingerprint")
+
+// newTransport returns the transport for requests to the server, which trusts the
+// configured CA or pinned certificate and presents a client certificate if there is one.
+// It returns nil if the defaults will do.
+func newTransport(cfg *config.Config) (http.RoundTripper, error) {
+	if cfg.TLSServerCAFile == "" && cfg.TLSServerFingerprint == "" && cfg.TLSClientCertFile == "" {
+		return nil, nil
+	}
+	// a pinned certificate skips checking the chain, so a CA given with it would be ignored
+	if cfg.TLSServerCAFile != "" && cfg.TLSServerFingerprint != "" {
+		return nil, errors.New("only one of a server CA and a server fingerprint may be given")
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if cfg.TLSServerCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.TLSServerCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + cfg.TLSServerCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.TLSServerFingerprint != "" {
+		fingerprint, err := parseFingerprint(cfg.TLSServerFingerprint)
+		if err != nil {
+			return nil, err
+		}
+		// the pinned certificate is trusted instead of a chain, which is typical of
+		// self-signed certificates on a local network
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errFingerprintMismatch
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if string(sum[:]) != string(fingerprint) {
+				return errFingerprintMismatch
+			}
+			return nil
+		}
+	}
+
+	if cfg.TLSClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSClientCertFile, cfg.TLSClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// the same settings as http.DefaultTransport, which can't be copied before Go 1.13
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}, nil
+}
+
+// parseFingerprint decodes a SHA-256 fingerprint written in hex, with or without colons.
+func parseFingerprint(s string) ([]byte, error) {
+	fingerprint, err := hex.DecodeString(strings.Replace(s, ":", "", -1))
+	if err != nil || len(fingerprint) != sha256.Size {
+		return nil, errors.New("invalid SHA-256 fingerprint: " + s)
+	}
+	return fingerprint, nil
+}
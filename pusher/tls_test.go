@@ -0,0 +1,108 @@
+package pusher
+
+import (
+	"crypto/sha256"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/kochman/hotshots/config"
+)
+
+func newTLSServer() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"success": true, "ids": []}`)
+	}))
+}
+
+func TestTransportDefault(t *testing.T) {
+	transport, err := newTransport(&config.Config{})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if transport != nil {
+		t.Errorf("expected the default transport")
+	}
+
+	server := newTLSServer()
+	defer server.Close()
+
+	// the test server's certificate isn't trusted by the system
+	ps := &remoteAPI{url: server.URL}
+	if _, err := ps.existingPhotos(); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestTransportServerCA(t *testing.T) {
+	server := newTLSServer()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "hotshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := path.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	transport, err := newTransport(&config.Config{TLSServerCAFile: caFile})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ps := &remoteAPI{url: server.URL, transport: transport}
+	if _, err := ps.existingPhotos(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestTransportFingerprint(t *testing.T) {
+	server := newTLSServer()
+	defer server.Close()
+
+	sum := sha256.Sum256(server.Certificate().Raw)
+	var parts []string
+	for _, b := range sum {
+		parts = append(parts, fmt.Sprintf("%02X", b))
+	}
+
+	// both plain hex and the colon separated form openssl prints are accepted
+	for _, fingerprint := range []string{fmt.Sprintf("%x", sum), strings.Join(parts, ":")} {
+		transport, err := newTransport(&config.Config{TLSServerFingerprint: fingerprint})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ps := &remoteAPI{url: server.URL, transport: transport}
+		if _, err := ps.existingPhotos(); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+
+	transport, err := newTransport(&config.Config{TLSServerFingerprint: strings.Repeat("00", sha256.Size)})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ps := &remoteAPI{url: server.URL, transport: transport}
+	if _, err := ps.existingPhotos(); err == nil || !strings.Contains(err.Error(), errFingerprintMismatch.Error()) {
+		t.Errorf("expected a fingerprint mismatch, got %v", err)
+	}
+
+	if _, err := newTransport(&config.Config{TLSServerFingerprint: "abcd"}); err == nil {
+		t.Errorf("expected an error for an invalid fingerprint")
+	}
+
+	// the CA would go unchecked next to a pinned certificate
+	cfg := &config.Config{TLSServerFingerprint: fmt.Sprintf("%x", sum), TLSServerCAFile: "ca.pem"}
+	if _, err := newTransport(cfg); err == nil {
+		t.Errorf("expected an error for both a CA and a fingerprint")
+	}
+}
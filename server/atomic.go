@@ -0,0 +1,98 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+/*
+ * Atomic writes
+ *
+ * Files are written to a temporary file next to where they belong, synced to disk and
+ * only then renamed into place. A crash or a failed write leaves the file that was
+ * there before, or none, rather than a partly written one.
+ */
+
+// tempPrefix starts the names of files that are still being written.
+const tempPrefix = ".tmp-"
+
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, tempPrefix)
+}
+
+// atomicFile is written in place of the file at path, which it replaces when it's
+// committed.
+type atomicFile struct {
+	*os.File
+	path string
+	done bool
+}
+
+func createAtomic(filename string) (*atomicFile, error) {
+	f, err := ioutil.TempFile(path.Dir(filename), tempPrefix+path.Base(filename)+"-")
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{File: f, path: filename}, nil
+}
+
+// Commit syncs the file and moves it to its path.
+func (f *atomicFile) Commit() error {
+	if f.done {
+		return os.ErrClosed
+	}
+	f.done = true
+
+	err := f.Sync()
+	if closeErr := f.File.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// temporary files are only readable by their owner
+		err = os.Chmod(f.Name(), 0660)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return syncDir(path.Dir(f.path))
+}
+
+// Close discards the file if it wasn't committed, so that it can be deferred.
+func (f *atomicFile) Close() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+	f.File.Close()
+	return os.Remove(f.Name())
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// writeFileAtomic replaces the file at filename with what's read from data.
+func writeFileAtomic(filename string, data io.Reader) error {
+	f, err := createAtomic(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, data); err != nil {
+		return err
+	}
+	return f.Commit()
+}
@@ -1,28 +1,175 @@
 package server
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/subtle"
 	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kochman/hotshots/log"
 )
 
+// loginCacheTTL is how long a checked password is remembered, since bcrypt is too slow
+// to run for every thumbnail the dashboard loads.
+const loginCacheTTL = 5 * time.Minute
+
+// loginCache remembers recent successful logins. Entries are keyed on the stored
+// password hash, so they stop matching as soon as a password is changed.
+type loginCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]time.Time
+}
+
+func newLoginCache() *loginCache {
+	return &loginCache{entries: map[[sha256.Size]byte]time.Time{}}
+}
+
+func loginKey(user User, password string) [sha256.Size]byte {
+	var key [sha256.Size]byte
+	h := sha256.New()
+	h.Write(user.PasswordHash)
+	h.Write([]byte{0})
+	h.Write([]byte(password))
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+func (c *loginCache) check(user User, password string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires, ok := c.entries[loginKey(user, password)]
+	return ok && time.Now().Before(expires)
+}
+
+func (c *loginCache) add(user User, password string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) > 1000 {
+		c.entries = map[[sha256.Size]byte]time.Time{}
+	}
+	c.entries[loginKey(user, password)] = time.Now().Add(loginCacheTTL)
+}
+
+// dummyHash is checked against when a user doesn't exist, so that a missing user
+// takes as long to reject as a wrong password.
+var dummyHash = []byte("$2a$10$2LSDcsXL9Ow3q4tDhT9JhuZP8D34RzZev8jjxdT.lIFZRGNKbvBVq")
+
+// authenticate returns the user with the given credentials. The username and password
+// from the config are an admin that always exists.
+func (s *Server) authenticate(username string, password string) (User, bool) {
+	if len(s.cfg.AuthUsername) != 0 || len(s.cfg.AuthPassword) != 0 {
+		okUsername := subtle.ConstantTimeCompare([]byte(s.cfg.AuthUsername), []byte(username)) == 1
+		okPassword := subtle.ConstantTimeCompare([]byte(s.cfg.AuthPassword), []byte(password)) == 1
+		if okUsername && okPassword {
+			return User{Username: username, Role: RoleAdmin}, true
+		}
+	}
+
+	var user User
+	if err := s.db.One("Username", username, &user); err != nil {
+		(&User{PasswordHash: dummyHash}).CheckPassword(password)
+		return User{}, false
+	}
+	if s.logins.check(user, password) {
+		return user, true
+	}
+	if !user.CheckPassword(password) {
+		return User{}, false
+	}
+	s.logins.add(user, password)
+	return user, true
+}
+
+// authRequired returns whether there is anyone or anything to authenticate as.
+// Without any credentials configured, everyone may do everything.
+func (s *Server) authRequired() bool {
+	if len(s.cfg.AuthUsername) != 0 || len(s.cfg.AuthPassword) != 0 {
+		return true
+	}
+	users, err := s.db.Count(&User{})
+	if err != nil {
+		log.Error(err)
+		return true
+	}
+	tokens, err := s.db.Count(&Token{})
+	if err != nil {
+		log.Error(err)
+		return true
+	}
+	return users+tokens > 0
+}
+
 func (s *Server) auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if len(s.cfg.AuthUsername) == 0 && len(s.cfg.AuthPassword) == 0 {
-			// Authentication is not configured
-			next.ServeHTTP(w, r)
+		if bearer, ok := bearerToken(r); ok {
+			if token, ok := s.authenticateToken(bearer, r); ok {
+				ctx := context.WithValue(r.Context(), "user", User{Username: token.CreatedBy, Role: token.Role})
+				ctx = context.WithValue(ctx, "token", token)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="Hotshots", error="invalid_token"`)
+			http.Error(w, "Unauthorized.", http.StatusUnauthorized)
 			return
 		}
 
-		username, password, _ := r.BasicAuth()
+		username, password, ok := r.BasicAuth()
+		if ok {
+			if user, ok := s.authenticate(username, password); ok {
+				ctx := context.WithValue(r.Context(), "user", user)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+		} else {
+			cookie, err := r.Cookie(sessionCookie)
+			hadSession := err == nil
+			if hadSession {
+				if session, user, ok := s.authenticateSession(cookie.Value); ok {
+					if !safeMethod(r.Method) && !validCSRF(session, r) {
+						WriteError("missing or invalid CSRF token", 403, w)
+						return
+					}
+					next.ServeHTTP(w, withSession(r, session, user))
+					return
+				}
+				clearSessionCookies(w)
+			}
 
-		okUsername := subtle.ConstantTimeCompare([]byte(s.cfg.AuthUsername), []byte(username)) == 1
-		okPassword := subtle.ConstantTimeCompare([]byte(s.cfg.AuthPassword), []byte(password)) == 1
+			if !s.authRequired() {
+				// Authentication is not configured
+				next.ServeHTTP(w, r)
+				return
+			}
 
-		if okUsername && okPassword {
-			next.ServeHTTP(w, r)
-		} else {
-			w.Header().Set("WWW-Authenticate", `Basic realm="Hotshots"`)
-			http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+			// browsers are sent to the login page rather than prompted for basic auth
+			if wantsHTML(r) {
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+				return
+			}
+			if hadSession {
+				http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+				return
+			}
 		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="Hotshots"`)
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
 	})
 }
+
+// allow only lets users with one of the given roles through. Everyone is let through
+// when authentication is not configured.
+func (s *Server) allow(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := r.Context().Value("user").(User)
+			if ok && !user.HasRole(roles...) {
+				WriteError("forbidden for role "+user.Role, 403, w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -1,22 +1,35 @@
 package server
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/asdine/storm"
 	"github.com/go-chi/chi"
-	"github.com/kochman/hotshots/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestAuth(t *testing.T) {
-	s := &Server{
-		cfg: config.Config{
-			AuthUsername: "testuname",
-			AuthPassword: "testpass",
-		},
-	}
+	s, db, _ := prepareMockServer(t)
+	s.cfg.AuthUsername = "testuname"
+	s.cfg.AuthPassword = "testpass"
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("editorpass"), bcrypt.MinCost)
+	require.Nil(t, err)
+	db.On("One", "Username", "editor", mock.Anything).Run(func(args mock.Arguments) {
+		user := args.Get(2).(*User)
+		user.Username = "editor"
+		user.PasswordHash = hash
+		user.Role = RoleEditor
+	}).Return(nil)
+	db.On("One", "Username", mock.Anything, mock.Anything).Return(storm.ErrNotFound)
+
 	r := chi.NewRouter()
 	r.Use(s.auth)
 
@@ -54,6 +67,25 @@ func TestAuth(t *testing.T) {
 			statusCode: 401,
 			body:       "Unauthorized.\n",
 		},
+		{
+			username:   "editor",
+			password:   "editorpass",
+			statusCode: 200,
+			body:       "hello there",
+		},
+		{
+			// remembered from the last request
+			username:   "editor",
+			password:   "editorpass",
+			statusCode: 200,
+			body:       "hello there",
+		},
+		{
+			username:   "editor",
+			password:   "testpass",
+			statusCode: 401,
+			body:       "Unauthorized.\n",
+		},
 	}
 
 	for _, c := range cases {
@@ -94,12 +126,9 @@ func TestAuth(t *testing.T) {
 }
 
 func TestNoAuth(t *testing.T) {
-	s := &Server{
-		cfg: config.Config{
-			AuthUsername: "",
-			AuthPassword: "",
-		},
-	}
+	s, db, _ := prepareMockServer(t)
+	db.On("Count", mock.Anything).Return(0, nil)
+
 	r := chi.NewRouter()
 	r.Use(s.auth)
 
@@ -137,3 +166,63 @@ func TestNoAuth(t *testing.T) {
 		t.Errorf("expected status code 200, got %d", res.StatusCode)
 	}
 }
+
+func TestAuthUsersOnly(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+	db.On("Count", mock.Anything).Return(1, nil)
+
+	r := chi.NewRouter()
+	r.Use(s.auth)
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello there"))
+	})
+
+	// once there are users, requests without credentials are turned away
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.EqualValues(t, 401, w.Code)
+	assert.EqualValues(t, `Basic realm="Hotshots"`, w.Header().Get("WWW-Authenticate"))
+}
+
+func TestAllow(t *testing.T) {
+	s, _, _ := prepareMockServer(t)
+
+	r := chi.NewRouter()
+	r.With(s.allow(readers...)).Get("/", func(w http.ResponseWriter, r *http.Request) {})
+	r.With(s.allow(uploaders...)).Post("/", func(w http.ResponseWriter, r *http.Request) {})
+	r.With(s.allow(editors...)).Delete("/", func(w http.ResponseWriter, r *http.Request) {})
+	r.With(s.allow(everyone...)).Put("/", func(w http.ResponseWriter, r *http.Request) {})
+
+	type testCase struct {
+		role       string
+		method     string
+		statusCode int
+	}
+	cases := []testCase{
+		{RoleViewer, "GET", 200},
+		{RoleViewer, "POST", 403},
+		{RoleViewer, "DELETE", 403},
+		{RoleViewer, "PUT", 200},
+		{RolePhotographer, "GET", 403},
+		{RolePhotographer, "PUT", 200},
+		{RolePhotographer, "POST", 200},
+		{RolePhotographer, "DELETE", 403},
+		{RoleEditor, "GET", 200},
+		{RoleEditor, "POST", 200},
+		{RoleEditor, "DELETE", 200},
+		{RoleAdmin, "DELETE", 200},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), "user", User{Username: "someone", Role: c.role}))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.EqualValues(t, c.statusCode, w.Code, "%s %s", c.role, c.method)
+	}
+
+	// without authentication everything is allowed
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("DELETE", "/", nil))
+	assert.EqualValues(t, 200, w.Code)
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/asdine/storm"
+	"github.com/kochman/hotshots/log"
+)
+
+/*
+ * Batches
+ *
+ * POST /photos/batch applies a list of operations to many photos in one transaction,
+ * so either every photo is changed or none are. Operations that leave a photo as it
+ * was, like adding a tag it has, succeed. When an operation can't be applied to a
+ * photo, the batch is rolled back and the results say which photos it failed for.
+ * Deleted photos are moved to the trash, and can be restored until they're purged.
+ */
+
+// MaxBatchSize is the most photos a batch can change.
+const MaxBatchSize = 1000
+
+const (
+	BatchAddTags    = "add_tags"
+	BatchRemoveTags = "remove_tags"
+	BatchDelete     = "delete"
+	BatchRestore    = "restore"
+	BatchSetRating  = "set_rating"
+	BatchAddToAlbum = "add_to_album"
+)
+
+const MaxRating = 5
+
+type BatchOperation struct {
+	Op string `json:"op"`
+	// For add_tags and remove_tags
+	Tags []string `json:"tags,omitempty"`
+	// For set_rating, 0 to clear it
+	Rating int `json:"rating,omitempty"`
+	// For add_to_album
+	Album string `json:"album,omitempty"`
+}
+
+type BatchRequest struct {
+	IDs        []string         `json:"ids"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchResult is what became of a photo in a batch.
+type BatchResult struct {
+	ID    string `json:"id"`
+	Error string `json:"error,omitempty"`
+	// The photo after the batch, if it was committed
+	Photo *Photo `json:"photo,omitempty"`
+}
+
+type BatchResponse struct {
+	Success bool          `json:"success"`
+	Results []BatchResult `json:"results"`
+}
+
+// batchEvent is an event to publish once a batch is committed.
+type batchEvent struct {
+	event string
+	photo Photo
+	tag   string
+}
+
+// validate checks an operation before any photo is changed.
+func (op *BatchOperation) validate() error {
+	switch op.Op {
+	case BatchAddTags, BatchRemoveTags:
+		if len(op.Tags) == 0 {
+			return fmt.Errorf("%s needs tags", op.Op)
+		}
+		for _, tag := range op.Tags {
+			if TagSlug(tag) == "" {
+				return InvalidTag
+			}
+		}
+	case BatchDelete, BatchRestore:
+	case BatchSetRating:
+		if op.Rating < 0 || op.Rating > MaxRating {
+			return fmt.Errorf("rating must be from 0 to %d", MaxRating)
+		}
+	case BatchAddToAlbum:
+		if TagSlug(op.Album) == "" {
+			return errors.New("album must have letters or numbers")
+		}
+	default:
+		return fmt.Errorf("unknown operation: %s", op.Op)
+	}
+	return nil
+}
+
+// applyBatch applies the operations of a batch to a photo, and returns the events to
+// publish if the batch is committed. tags are the tags to add from the catalog, and
+// stored is whether the photo's files are stored, for restoring it.
+func applyBatch(photo *Photo, ops []BatchOperation, tags map[string]Tag, stored bool) ([]batchEvent, error) {
+	events := []batchEvent{}
+	for _, op := range ops {
+		switch op.Op {
+		case BatchAddTags:
+			for _, name := range op.Tags {
+				tag := tags[TagSlug(name)]
+				if photo.AddTag(tag.Name) == nil {
+					events = append(events, batchEvent{EventTagAdded, *photo, tag.Name})
+				}
+			}
+		case BatchRemoveTags:
+			for _, tag := range op.Tags {
+				if photo.DeleteTag(tag) == nil {
+					events = append(events, batchEvent{EventTagRemoved, *photo, tag})
+				}
+			}
+		case BatchDelete:
+			trashed, err := trashPhoto(photo)
+			if err != nil {
+				return nil, err
+			}
+			if trashed {
+				events = append(events, batchEvent{EventPhotoDeleted, *photo, ""})
+			}
+		case BatchRestore:
+			restored, err := restorePhoto(photo, stored)
+			if err != nil {
+				return nil, err
+			}
+			if restored {
+				events = append(events, batchEvent{EventPhotoRestored, *photo, ""})
+			}
+		case BatchSetRating:
+			photo.Rating = op.Rating
+		case BatchAddToAlbum:
+			tag, _ := newTag(op.Album)
+			photo.AddToAlbum(tag.Name)
+		}
+	}
+	return events, nil
+}
+
+/*
+ * Handlers
+ */
+
+func (s *Server) PostBatch(w http.ResponseWriter, r *http.Request) {
+	var v BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		WriteError("unable to parse batch", 400, w)
+		return
+	}
+	if len(v.IDs) == 0 || len(v.Operations) == 0 {
+		WriteError("batch needs ids and operations", 400, w)
+		return
+	}
+	if len(v.IDs) > MaxBatchSize {
+		WriteError(fmt.Sprintf("batch can change at most %d photos", MaxBatchSize), 400, w)
+		return
+	}
+	for i := range v.Operations {
+		if err := v.Operations[i].validate(); err != nil {
+			WriteError(err.Error(), 400, w)
+			return
+		}
+	}
+
+	// the store is read before the transaction starts, so the database isn't locked
+	// while it is
+	stored := map[string]bool{}
+	for _, op := range v.Operations {
+		if op.Op != BatchRestore {
+			continue
+		}
+		for _, id := range v.IDs {
+			if _, ok := stored[id]; ok {
+				continue
+			}
+			exists, err := s.photoFilesExist(Photo{ID: id})
+			if err != nil {
+				log.Error(err)
+				WriteError("unable to access internal storage of photos", 500, w)
+				return
+			}
+			stored[id] = exists
+		}
+		break
+	}
+
+	tx, err := s.db.Begin(true)
+	if err != nil {
+		log.Error(err)
+		WriteError("unable to update image database", 500, w)
+		return
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			if err := tx.Rollback(); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+
+	// tags are added with their names in the catalog
+	tags := map[string]Tag{}
+	for _, op := range v.Operations {
+		if op.Op != BatchAddTags {
+			continue
+		}
+		for _, name := range op.Tags {
+			tag, err := catalogTag(tx, name)
+			if err != nil {
+				log.Error(err)
+				WriteError("unable to update tag catalog", 500, w)
+				return
+			}
+			tags[tag.Slug] = tag
+		}
+	}
+
+	results := []BatchResult{}
+	seen := map[string]bool{}
+	events := []batchEvent{}
+	failed := false
+	for _, id := range v.IDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		result := BatchResult{ID: id}
+
+		var photo Photo
+		err := tx.One("ID", id, &photo)
+		if err == storm.ErrNotFound {
+			result.Error = "photo not found"
+		} else if err != nil {
+			log.Error(err)
+			WriteError("unable to query photos", 500, w)
+			return
+		}
+		if result.Error == "" {
+			applied, err := applyBatch(&photo, v.Operations, tags, stored[id])
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				// Save writes every field, where Update leaves out zero values
+				if err := tx.Save(&photo); err != nil {
+					log.Error(err)
+					WriteError("unable to update image database", 500, w)
+					return
+				}
+				events = append(events, applied...)
+				result.Photo = &photo
+			}
+		}
+		if result.Error != "" {
+			failed = true
+		}
+		results = append(results, result)
+	}
+
+	if failed {
+		for i := range results {
+			results[i].Photo = nil
+		}
+		WriteJsonResponse(&BatchResponse{
+			Success: false,
+			Results: results,
+		}, 400, w)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Error(err)
+		WriteError("unable to update image database", 500, w)
+		return
+	}
+	committed = true
+
+	for _, e := range events {
+		s.publish(e.event, e.photo, e.tag)
+	}
+
+	WriteJsonResponse(&BatchResponse{
+		Success: true,
+		Results: results,
+	}, 200, w)
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/asdine/storm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// readCountingStore is a BlobStore that counts the blobs read from it.
+type readCountingStore struct {
+	BlobStore
+	reads int
+}
+
+func (s *readCountingStore) Get(key string) (Blob, error) {
+	s.reads++
+	return s.BlobStore.Get(key)
+}
+
+func TestPostBatch(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+
+	photos := map[string]Photo{
+		"a": {ID: "a", Status: ProcessingSucceeded, Tags: []string{"goal"}},
+		"b": {ID: "b", Status: ProcessingSucceeded, Deleted: true, Rating: 3},
+		"c": {ID: "c", Status: Processing},
+	}
+	store := &readCountingStore{BlobStore: s.store}
+	s.store = store
+	readsAtBegin := 0
+	db.On("Begin", true).Run(func(mock.Arguments) {
+		readsAtBegin = store.reads
+	}).Return(nil)
+	db.On("Commit").Return(nil)
+	db.On("Rollback").Return(nil)
+	for id := range photos {
+		id := id
+		db.On("One", "ID", id, mock.Anything).Run(func(args mock.Arguments) {
+			*args.Get(2).(*Photo) = photos[id]
+		}).Return(nil)
+	}
+	db.On("One", "ID", mock.Anything, mock.Anything).Return(storm.ErrNotFound)
+	db.On("One", "Slug", "red-sox", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*Tag) = Tag{Slug: "red-sox", Name: "Red Sox"}
+	}).Return(nil)
+	db.On("One", "Slug", mock.Anything, mock.Anything).Return(storm.ErrNotFound)
+	saved := map[string]Photo{}
+	db.On("Save", mock.Anything).Run(func(args mock.Arguments) {
+		if photo, ok := args.Get(0).(*Photo); ok {
+			saved[photo.ID] = *photo
+		}
+	}).Return(nil)
+	db.On("All", mock.Anything, mock.Anything).Return(nil)
+
+	// b's files are still stored, so it can be restored
+	for _, key := range []string{PhotoKey("b"), ThumbKey("b")} {
+		err := s.store.Put(key, bytes.NewReader([]byte("jpeg")))
+		require.Nil(t, err)
+	}
+
+	post := func(body string) (int, BatchResponse) {
+		r := httptest.NewRequest("POST", "/photos/batch", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		s.PostBatch(w, r)
+		var v BatchResponse
+		json.Unmarshal(w.Body.Bytes(), &v)
+		return w.Code, v
+	}
+
+	code, v := post(`{"ids": ["a", "b", "a"], "operations": [
+		{"op": "add_tags", "tags": ["red sox", "Goal"]},
+		{"op": "remove_tags", "tags": ["yankees"]},
+		{"op": "restore"},
+		{"op": "set_rating", "rating": 0},
+		{"op": "add_to_album", "album": " Home  Games"}
+	]}`)
+	require.EqualValues(t, 200, code)
+	assert.True(t, v.Success)
+	require.Len(t, v.Results, 2)
+	assert.EqualValues(t, "a", v.Results[0].ID)
+	assert.EqualValues(t, []string{"goal", "Red Sox"}, saved["a"].Tags)
+	assert.EqualValues(t, []string{"Home Games"}, saved["a"].Albums)
+	assert.False(t, saved["b"].Deleted)
+	assert.EqualValues(t, 0, saved["b"].Rating)
+	assert.EqualValues(t, []string{"Red Sox", "Goal"}, v.Results[1].Photo.Tags)
+	db.AssertNumberOfCalls(t, "Commit", 1)
+	// the files are checked before the transaction
+	assert.True(t, store.reads > 0)
+	assert.EqualValues(t, store.reads, readsAtBegin)
+
+	// nothing is committed when a photo can't be changed
+	saved = map[string]Photo{}
+	code, v = post(`{"ids": ["a", "c", "x"], "operations": [{"op": "delete"}]}`)
+	require.EqualValues(t, 400, code)
+	assert.False(t, v.Success)
+	assert.EqualValues(t, []BatchResult{
+		{ID: "a"},
+		{ID: "c", Error: "photo not processed"},
+		{ID: "x", Error: "photo not found"},
+	}, v.Results)
+	db.AssertNumberOfCalls(t, "Commit", 1)
+	db.AssertNumberOfCalls(t, "Rollback", 1)
+
+	// deleted photos go to the trash, and can't be restored once they're purged
+	code, v = post(`{"ids": ["a"], "operations": [{"op": "delete"}]}`)
+	require.EqualValues(t, 200, code)
+	assert.True(t, saved["a"].Deleted)
+	assert.NotNil(t, saved["a"].DeletedAt)
+	for _, key := range []string{PhotoKey("b"), ThumbKey("b")} {
+		require.Nil(t, s.store.Delete(key))
+	}
+	code, v = post(`{"ids": ["b"], "operations": [{"op": "restore"}]}`)
+	require.EqualValues(t, 400, code)
+	assert.EqualValues(t, PhotoPurged.Error(), v.Results[0].Error)
+
+	for _, body := range []string{
+		`{"ids": [], "operations": [{"op": "delete"}]}`,
+		`{"ids": ["a"], "operations": []}`,
+		`{"ids": ["a"], "operations": [{"op": "star"}]}`,
+		`{"ids": ["a"], "operations": [{"op": "set_rating", "rating": 6}]}`,
+		`{"ids": ["a"], "operations": [{"op": "add_tags", "tags": ["!"]}]}`,
+		`{"ids": ["a"], "operations": [{"op": "add_to_album"}]}`,
+	} {
+		code, _ := post(body)
+		assert.EqualValues(t, 400, code, body)
+	}
+	db.AssertNumberOfCalls(t, "Begin", 4)
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/kochman/hotshots/config"
+	"github.com/kochman/hotshots/log"
+)
+
+/*
+ * Photo storage
+ *
+ * Originals, display images and thumbnails are kept in a BlobStore under keys named
+ * like the files always have been: {id}.jpg, {id}-thumb.jpg and {id}.{format}.
+ */
+
+var BlobNotFound = errors.New("blob not found")
+
+type BlobStore interface {
+	Put(key string, data io.ReadSeeker) error
+	Get(key string) (Blob, error)
+	Delete(key string) error
+}
+
+// BlobLister is implemented by stores that can list their keys, so that files no
+// photo refers to can be found.
+type BlobLister interface {
+	Keys() ([]string, error)
+}
+
+// Blob is a stored file, which can be read from anywhere so that ranges can be served.
+type Blob interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+func PhotoKey(id string) string {
+	return fmt.Sprintf("%s.jpg", id)
+}
+
+func ThumbKey(id string) string {
+	return fmt.Sprintf("%s-thumb.jpg", id)
+}
+
+func OriginalKey(id string, format string) string {
+	return fmt.Sprintf("%s.%s", id, format)
+}
+
+// NewBlobStore creates the store selected by cfg.Storage.
+func NewBlobStore(cfg *config.Config) (BlobStore, error) {
+	switch cfg.Storage {
+	case config.StorageLocal, "":
+		return NewLocalStore(cfg.ImgFolder()), nil
+	case config.StorageS3:
+		if cfg.S3Endpoint == "" || cfg.S3Bucket == "" {
+			return nil, errors.New("S3 storage needs an endpoint and a bucket")
+		}
+		return NewS3Store(cfg.S3Endpoint, cfg.S3Region, cfg.S3Bucket, cfg.S3AccessKey, cfg.S3SecretKey), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Storage)
+	}
+}
+
+// LocalStore keeps blobs as files in a directory.
+type LocalStore struct {
+	dir string
+}
+
+func NewLocalStore(dir string) *LocalStore {
+	return &LocalStore{dir: dir}
+}
+
+func (l *LocalStore) path(key string) string {
+	return path.Join(l.dir, path.Base(key))
+}
+
+func (l *LocalStore) Put(key string, data io.ReadSeeker) error {
+	return writeFileAtomic(l.path(key), data)
+}
+
+func (l *LocalStore) Get(key string) (Blob, error) {
+	f, err := os.Open(l.path(key))
+	if os.IsNotExist(err) {
+		return nil, BlobNotFound
+	}
+	return f, err
+}
+
+func (l *LocalStore) Delete(key string) error {
+	if err := os.Remove(l.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (l *LocalStore) Keys() ([]string, error) {
+	files, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, file := range files {
+		if file.Mode().IsRegular() && !isTempFile(file.Name()) {
+			keys = append(keys, file.Name())
+		}
+	}
+	return keys, nil
+}
+
+// storeFiles moves the files named by keys from dir into the store. Files already
+// stored are removed again if one of them fails.
+func (s *Server) storeFiles(dir string, keys ...string) error {
+	for i, key := range keys {
+		if err := s.storeFile(dir, key); err != nil {
+			s.deleteFiles(keys[:i]...)
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceFiles moves the files named by keys from dir into the store over the blobs
+// they replace. Files already stored are kept if one of them fails, since the blobs
+// they replaced are gone.
+func (s *Server) replaceFiles(dir string, keys ...string) error {
+	for _, key := range keys {
+		if err := s.storeFile(dir, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) storeFile(dir string, key string) error {
+	f, err := os.Open(path.Join(dir, key))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.store.Put(key, f)
+}
+
+// deleteFiles removes blobs from the store, logging any that couldn't be removed.
+func (s *Server) deleteFiles(keys ...string) {
+	for _, key := range keys {
+		if err := s.store.Delete(key); err != nil {
+			log.Error(err)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kochman/hotshots/log"
+)
+
+/*
+ * Event stream
+ *
+ * Changes to photos are published to clients of GET /events as Server-Sent Events.
+ * Recent events are kept in memory so that a client that reconnects with a
+ * Last-Event-ID header gets the ones it missed. Event IDs are based on the time
+ * they were published, so they keep increasing across restarts of the server.
+ */
+
+const (
+	EventPhotoCreated   = "photo.created"
+	EventPhotoProcessed = "photo.processed"
+	EventPhotoFailed    = "photo.failed"
+	EventPhotoDeleted   = "photo.deleted"
+	EventPhotoRotated   = "photo.rotated"
+	EventPhotoRestored  = "photo.restored"
+	EventPhotoPurged    = "photo.purged"
+	EventTagAdded       = "tag.added"
+	EventTagRemoved     = "tag.removed"
+	EventTagRenamed     = "tag.renamed"
+)
+
+// EventHistory is how many events are kept for clients that reconnect.
+const EventHistory = 1000
+
+// eventHeartbeat is how often idle streams get a comment, so that proxies keep them open.
+const eventHeartbeat = 15 * time.Second
+
+type Event struct {
+	ID    uint64    `json:"id"`
+	Type  string    `json:"type"`
+	Time  time.Time `json:"time"`
+	Photo Photo     `json:"photo"`
+	Tag   string    `json:"tag,omitempty"`
+}
+
+// eventBroker hands published events to every subscribed stream.
+type eventBroker struct {
+	mu          sync.Mutex
+	lastID      uint64
+	history     []Event
+	subscribers map[chan Event]bool
+	closed      bool
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subscribers: map[chan Event]bool{}}
+}
+
+func (b *eventBroker) publish(eventType string, photo Photo, tag string) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	id := uint64(now.UnixNano())
+	if id <= b.lastID {
+		id = b.lastID + 1
+	}
+	b.lastID = id
+
+	event := Event{
+		ID:    id,
+		Type:  eventType,
+		Time:  now,
+		Photo: photo,
+		Tag:   tag,
+	}
+
+	b.history = append(b.history, event)
+	if len(b.history) > EventHistory {
+		b.history = b.history[len(b.history)-EventHistory:]
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// too far behind, so let it reconnect and catch up from the history
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return event
+}
+
+// subscribe returns a channel of new events, along with the kept events after lastID
+// if the subscriber is resuming.
+func (b *eventBroker) subscribe(resume bool, lastID uint64) (chan Event, []Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan Event, 64)
+	if b.closed {
+		close(ch)
+		return ch, []Event{}
+	}
+	b.subscribers[ch] = true
+
+	missed := []Event{}
+	for _, event := range b.history {
+		if resume && event.ID > lastID {
+			missed = append(missed, event)
+		}
+	}
+	return ch, missed
+}
+
+func (b *eventBroker) unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subscribers[ch] {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// close ends every subscription, so that streams finish when the server shuts down.
+func (b *eventBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+func writeEvent(event Event, w http.ResponseWriter) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+func (s *Server) GetEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		WriteError("streaming not supported", 500, w)
+		return
+	}
+
+	var lastID uint64
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	if lastEventID != "" {
+		id, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			WriteError("invalid Last-Event-ID", 400, w)
+			return
+		}
+		lastID = id
+	}
+
+	events, missed := s.events.subscribe(lastEventID != "", lastID)
+	defer s.events.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+
+	for _, event := range missed {
+		if err := writeEvent(event, w); err != nil {
+			return
+		}
+		lastID = event.ID
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ":\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			// may already have been sent from the history
+			if event.ID <= lastID {
+				continue
+			}
+			if err := writeEvent(event, w); err != nil {
+				log.Info(err)
+				return
+			}
+			lastID = event.ID
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventBroker(t *testing.T) {
+	b := newEventBroker()
+
+	first := b.publish(EventPhotoCreated, Photo{ID: "1234"}, "")
+	second := b.publish(EventTagAdded, Photo{ID: "1234"}, "goal")
+	assert.True(t, second.ID > first.ID)
+
+	// New subscribers only get new events
+	ch, missed := b.subscribe(false, 0)
+	assert.Len(t, missed, 0)
+
+	third := b.publish(EventPhotoProcessed, Photo{ID: "1234"}, "")
+	assert.EqualValues(t, third, <-ch)
+	b.unsubscribe(ch)
+
+	// Resuming subscribers get what they missed
+	ch, missed = b.subscribe(true, first.ID)
+	assert.EqualValues(t, []Event{second, third}, missed)
+	b.unsubscribe(ch)
+
+	// Subscribers that fall behind are dropped
+	ch, _ = b.subscribe(false, 0)
+	for i := 0; i < cap(ch)+1; i++ {
+		b.publish(EventPhotoCreated, Photo{ID: strconv.Itoa(i)}, "")
+	}
+	for range ch {
+	}
+	b.unsubscribe(ch)
+
+	// Only so many events are kept
+	for i := 0; i < EventHistory; i++ {
+		b.publish(EventPhotoCreated, Photo{ID: strconv.Itoa(i)}, "")
+	}
+	ch, missed = b.subscribe(true, 0)
+	assert.Len(t, missed, EventHistory)
+	b.unsubscribe(ch)
+
+	// Closing ends subscriptions, including later ones
+	ch, _ = b.subscribe(false, 0)
+	b.close()
+	_, ok := <-ch
+	assert.False(t, ok)
+	ch, _ = b.subscribe(false, 0)
+	_, ok = <-ch
+	assert.False(t, ok)
+	b.unsubscribe(ch)
+}
+
+// readEvent reads the next event from a stream, skipping heartbeats.
+func readEvent(t *testing.T, r *bufio.Reader) Event {
+	var event Event
+	for {
+		line, err := r.ReadString('\n')
+		require.Nil(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		if strings.HasPrefix(line, "data: ") {
+			err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event)
+			require.Nil(t, err)
+		}
+		if line == "" && event.ID != 0 {
+			return event
+		}
+	}
+}
+
+func TestGetEvents(t *testing.T) {
+	s, _, _ := prepareMockServer(t)
+
+	server := httptest.NewServer(http.HandlerFunc(s.GetEvents))
+	defer server.Close()
+
+	missed := s.events.publish(EventPhotoCreated, Photo{ID: "1234"}, "")
+
+	res, err := http.Get(server.URL)
+	require.Nil(t, err)
+	defer res.Body.Close()
+	require.EqualValues(t, 200, res.StatusCode)
+	assert.EqualValues(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	// give the stream a moment to subscribe
+	time.Sleep(50 * time.Millisecond)
+
+	processed := s.events.publish(EventPhotoProcessed, Photo{ID: "1234", Status: ProcessingSucceeded}, "")
+	tagged := s.events.publish(EventTagAdded, Photo{ID: "1234", Tags: []string{"goal"}}, "goal")
+
+	r := bufio.NewReader(res.Body)
+	event := readEvent(t, r)
+	assert.EqualValues(t, processed.ID, event.ID)
+	assert.EqualValues(t, EventPhotoProcessed, event.Type)
+	assert.EqualValues(t, ProcessingSucceeded, event.Photo.Status)
+
+	event = readEvent(t, r)
+	assert.EqualValues(t, EventTagAdded, event.Type)
+	assert.EqualValues(t, "goal", event.Tag)
+
+	// Resume after the first event
+	req, err := http.NewRequest("GET", server.URL, nil)
+	require.Nil(t, err)
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(missed.ID, 10))
+	res, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	defer res.Body.Close()
+
+	r = bufio.NewReader(res.Body)
+	assert.EqualValues(t, processed.ID, readEvent(t, r).ID)
+	assert.EqualValues(t, tagged.ID, readEvent(t, r).ID)
+
+	// Invalid ID
+	req, err = http.NewRequest("GET", server.URL, nil)
+	require.Nil(t, err)
+	req.Header.Set("Last-Event-ID", "nope")
+	res, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	res.Body.Close()
+	assert.EqualValues(t, 400, res.StatusCode)
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"fmt"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/asdine/storm"
+	"github.com/kochman/hotshots/config"
+	"github.com/kochman/hotshots/log"
+)
+
+/*
+ * Consistency checks
+ *
+ * The files in the BlobStore are checked against the photos in the database. Originals
+ * are hashed again and compared with their photo's ID, which is the SHA-1 of the file
+ * that was uploaded, and display images and thumbnails are decoded. When asked to,
+ * problems are repaired:
+ *
+ *  - thumbnails are made again from the display image
+ *  - display images of RAW photos are made again by reprocessing the original
+ *  - photos whose original is lost are failed, so that the pusher sends them again,
+ *    and keep their files until it does
+ *  - RAW files paired with a photo are unpaired if lost
+ *  - files that don't belong to any photo are removed, and so are files left partly
+ *    written
+ */
+
+const (
+	ProblemMissing   = "missing"
+	ProblemCorrupt   = "corrupt"
+	ProblemOrphaned  = "orphaned"
+	ProblemTemporary = "partly written"
+)
+
+// FsckProblem is something wrong with a file in the BlobStore.
+type FsckProblem struct {
+	Key     string
+	PhotoID string
+	Problem string
+	// What was done about it, if it was repaired
+	Repair string
+}
+
+func (p FsckProblem) String() string {
+	s := fmt.Sprintf("%s: %s", p.Key, p.Problem)
+	if p.PhotoID != "" {
+		s += fmt.Sprintf(" (photo %s)", p.PhotoID)
+	}
+	if p.Repair != "" {
+		s += ", " + p.Repair
+	}
+	return s
+}
+
+// Fsck checks the photos in the server's database against their files, and repairs
+// the problems it finds if repair is set. Display images that need to be made again
+// are queued, and made once the server starts.
+func Fsck(cfg *config.Config, db PhotoDB, repair bool) ([]FsckProblem, error) {
+	s, err := newOfflineServer(cfg, db)
+	if err != nil {
+		return nil, err
+	}
+	return s.fsck(repair)
+}
+
+func (s *Server) fsck(repair bool) ([]FsckProblem, error) {
+	var photos []Photo
+	if err := s.db.All(&photos); err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	problems, err := s.findOrphans(photos, repair)
+	if err != nil {
+		return problems, err
+	}
+	for _, photo := range photos {
+		if photo.Status != ProcessingSucceeded {
+			continue
+		}
+		found, err := s.checkPhoto(photo, repair)
+		problems = append(problems, found...)
+		if err != nil {
+			return problems, err
+		}
+	}
+	return problems, nil
+}
+
+// findOrphans finds files that don't belong to any photo, and files that were never
+// finished, which are only found in a LocalStore. A photo that failed may still have
+// its RAW original, or the files it had before it failed.
+func (s *Server) findOrphans(photos []Photo, repair bool) ([]FsckProblem, error) {
+	problems := []FsckProblem{}
+
+	if local, ok := s.store.(*LocalStore); ok {
+		files, err := ioutil.ReadDir(local.dir)
+		if err != nil {
+			return problems, err
+		}
+		for _, file := range files {
+			if !isTempFile(file.Name()) {
+				continue
+			}
+			problem := FsckProblem{Key: file.Name(), Problem: ProblemTemporary}
+			if repair {
+				if err := os.Remove(path.Join(local.dir, file.Name())); err != nil {
+					log.Error(err)
+				} else {
+					problem.Repair = "removed"
+				}
+			}
+			problems = append(problems, problem)
+		}
+	}
+
+	lister, ok := s.store.(BlobLister)
+	if !ok {
+		return problems, nil
+	}
+	keys, err := lister.Keys()
+	if err != nil {
+		return problems, err
+	}
+
+	known := map[string]bool{}
+	raws := map[string]bool{}
+	for _, photo := range photos {
+		known[photo.ID] = true
+		if photo.RawID != "" {
+			raws[OriginalKey(photo.RawID, photo.RawFormat)] = true
+		}
+	}
+	for _, key := range keys {
+		match := blobPhotoID.FindStringSubmatch(key)
+		if match == nil || known[match[1]] || raws[key] {
+			continue
+		}
+		problem := FsckProblem{Key: key, Problem: ProblemOrphaned}
+		if repair {
+			if err := s.store.Delete(key); err != nil {
+				log.Error(err)
+			} else {
+				problem.Repair = "removed"
+			}
+		}
+		problems = append(problems, problem)
+	}
+	return problems, nil
+}
+
+// checkPhoto checks the original, display image and thumbnail of a processed photo,
+// and the RAW file paired with it.
+func (s *Server) checkPhoto(photo Photo, repair bool) ([]FsckProblem, error) {
+	problems := []FsckProblem{}
+	report := func(key string, problem string, repair string) {
+		problems = append(problems, FsckProblem{
+			Key:     key,
+			PhotoID: photo.ID,
+			Problem: problem,
+			Repair:  repair,
+		})
+	}
+
+	// the display image of a JPEG is its original
+	original := PhotoKey(photo.ID)
+	if IsRaw(photo.Format) {
+		original = OriginalKey(photo.ID, photo.Format)
+	}
+	problem, err := s.checkOriginal(original, photo.ID)
+	if err != nil {
+		return problems, err
+	}
+	if problem != "" {
+		fix := ""
+		if repair {
+			// the files are left for the pusher to replace, since the display image
+			// of a JPEG is its original and may be all that's left of it
+			photo.UpdateStatus(ProcessingFailed)
+			if err := s.db.Update(&photo); err != nil {
+				return problems, err
+			}
+			fix = "photo failed for the pusher to send again"
+		}
+		report(original, problem, fix)
+		return problems, nil
+	}
+
+	if photo.RawID != "" {
+		key := OriginalKey(photo.RawID, photo.RawFormat)
+		problem, err := s.checkOriginal(key, photo.RawID)
+		if err != nil {
+			return problems, err
+		}
+		if problem != "" {
+			fix := ""
+			if repair {
+				s.deleteFiles(key)
+				photo.RawID = ""
+				photo.RawFormat = ""
+				if err := s.db.Update(&photo); err != nil {
+					return problems, err
+				}
+				fix = "RAW unpaired for the pusher to send again"
+			}
+			report(key, problem, fix)
+		}
+	}
+
+	display := ""
+	if IsRaw(photo.Format) {
+		display, err = s.checkImage(PhotoKey(photo.ID))
+		if err != nil {
+			return problems, err
+		}
+	}
+	if display != "" {
+		fix := ""
+		if repair {
+			if err := s.reprocess(photo); err == nil {
+				fix = "queued for reprocessing"
+			} else if err != PhotoProcessing && err != OriginalNotFound {
+				return problems, err
+			}
+		}
+		report(PhotoKey(photo.ID), display, fix)
+	}
+
+	problem, err = s.checkImage(ThumbKey(photo.ID))
+	if err != nil {
+		return problems, err
+	}
+	if problem == "" {
+		return problems, nil
+	}
+	fix := ""
+	if repair && display != "" {
+		// the thumbnail is made again with the display image
+		fix = "queued for reprocessing"
+	} else if repair {
+		if err := s.makeThumb(photo); err != nil {
+			return problems, err
+		}
+		fix = "made again"
+	}
+	report(ThumbKey(photo.ID), problem, fix)
+	return problems, nil
+}
+
+// checkOriginal hashes a stored original to check it against the ID it was given.
+func (s *Server) checkOriginal(key string, id string) (string, error) {
+	blob, err := s.store.Get(key)
+	if err == BlobNotFound {
+		return ProblemMissing, nil
+	} else if err != nil {
+		return "", err
+	}
+	defer blob.Close()
+
+	hash, err := GenPhotoID(blob)
+	if err != nil {
+		return "", err
+	}
+	if hash != id {
+		return ProblemCorrupt, nil
+	}
+	return "", nil
+}
+
+// checkImage decodes a stored JPEG.
+func (s *Server) checkImage(key string) (string, error) {
+	blob, err := s.store.Get(key)
+	if err == BlobNotFound {
+		return ProblemMissing, nil
+	} else if err != nil {
+		return "", err
+	}
+	defer blob.Close()
+
+	if _, err := jpeg.Decode(blob); err != nil {
+		return ProblemCorrupt, nil
+	}
+	return "", nil
+}
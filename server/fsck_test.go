@@ -0,0 +1,144 @@
+package server
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/asdine/storm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFsck(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+	defer os.RemoveAll(s.cfg.PhotosDirectory)
+	err := os.Mkdir(s.cfg.UploadFolder(), 0775)
+	require.Nil(t, err)
+
+	sum := func(data []byte) string {
+		return fmt.Sprintf("%x", sha1.Sum(data))
+	}
+	thumb := encodeJPEG(t, 16, 12)
+	good := encodeJPEG(t, 64, 48)
+	unthumbed := encodeJPEG(t, 64, 49)
+	corrupt := encodeJPEG(t, 64, 50)
+	raw := []byte("raw")
+	paired := []byte("paired raw")
+	orphan := "3333333333333333333333333333333333333333"
+	failed := "4444444444444444444444444444444444444444"
+
+	files := map[string][]byte{
+		PhotoKey(sum(good)):                             good,
+		ThumbKey(sum(good)):                             thumb,
+		RenditionKey(sum(good), "small", renditionJPEG): thumb,
+		OriginalKey(sum(paired), FormatCR2):             []byte("paired"),
+		PhotoKey(sum(paired)):                           thumb,
+		PhotoKey(sum(unthumbed)):                        unthumbed,
+		PhotoKey(sum(corrupt)):                          corrupt[:100],
+		ThumbKey(sum(corrupt)):                          thumb,
+		OriginalKey(sum(raw), FormatCR2):                raw,
+		PhotoKey(sum(raw)):                              []byte("garbage"),
+		ThumbKey(sum(raw)):                              thumb,
+		PhotoKey(orphan):                                thumb,
+		OriginalKey(failed, FormatCR2):                  raw,
+		tempPrefix + PhotoKey(sum(good)) + "-123":       good[:10],
+		"README": []byte("hello"),
+	}
+	for key, data := range files {
+		err = ioutil.WriteFile(path.Join(s.cfg.ImgFolder(), key), data, 0660)
+		require.Nil(t, err)
+	}
+
+	db.On("All", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(0).(*[]Photo) = []Photo{
+			{ID: sum(good), Format: FormatJPEG, Status: ProcessingSucceeded, RawID: sum(paired), RawFormat: FormatCR2},
+			{ID: sum(unthumbed), Status: ProcessingSucceeded},
+			{ID: sum(corrupt), Format: FormatJPEG, Status: ProcessingSucceeded},
+			{ID: sum(raw), Format: FormatCR2, Status: ProcessingSucceeded},
+			{ID: failed, Format: FormatCR2, Status: ProcessingFailed},
+		}
+	}).Return(nil)
+	db.On("One", mock.Anything, mock.Anything, mock.Anything).Return(storm.ErrNotFound)
+	updated := []Photo{}
+	db.On("Update", mock.Anything).Run(func(args mock.Arguments) {
+		updated = append(updated, *args.Get(0).(*Photo))
+	}).Return(nil)
+	saved := []Job{}
+	db.On("Save", mock.Anything).Run(func(args mock.Arguments) {
+		saved = append(saved, *args.Get(0).(*Job))
+	}).Return(nil)
+
+	expected := []string{
+		tempPrefix + PhotoKey(sum(good)) + "-123: partly written",
+		PhotoKey(orphan) + ": orphaned",
+		PhotoKey(sum(paired)) + ": orphaned",
+		OriginalKey(sum(paired), FormatCR2) + ": corrupt (photo " + sum(good) + ")",
+		ThumbKey(sum(unthumbed)) + ": missing (photo " + sum(unthumbed) + ")",
+		PhotoKey(sum(corrupt)) + ": corrupt (photo " + sum(corrupt) + ")",
+		PhotoKey(sum(raw)) + ": corrupt (photo " + sum(raw) + ")",
+	}
+	described := func(problems []FsckProblem) []string {
+		descriptions := []string{}
+		for _, problem := range problems {
+			descriptions = append(descriptions, problem.String())
+		}
+		return descriptions
+	}
+
+	// problems are only reported
+	problems, err := s.fsck(false)
+	require.Nil(t, err)
+	assert.ElementsMatch(t, expected, described(problems))
+	keys, err := s.store.(BlobLister).Keys()
+	require.Nil(t, err)
+	assert.Len(t, keys, len(files)-1)
+	db.AssertNotCalled(t, "Update", mock.Anything)
+	db.AssertNotCalled(t, "Save", mock.Anything)
+
+	// until they're repaired
+	problems, err = s.fsck(true)
+	require.Nil(t, err)
+	for _, problem := range problems {
+		assert.NotEmpty(t, problem.Repair, problem.String())
+	}
+	assert.Len(t, problems, len(expected))
+
+	keys, err = s.store.(BlobLister).Keys()
+	require.Nil(t, err)
+	sort.Strings(keys)
+	expectedKeys := []string{
+		PhotoKey(sum(good)), ThumbKey(sum(good)), RenditionKey(sum(good), "small", renditionJPEG),
+		PhotoKey(sum(unthumbed)), ThumbKey(sum(unthumbed)),
+		PhotoKey(sum(corrupt)), ThumbKey(sum(corrupt)),
+		OriginalKey(sum(raw), FormatCR2), PhotoKey(sum(raw)), ThumbKey(sum(raw)),
+		OriginalKey(failed, FormatCR2), "README",
+	}
+	sort.Strings(expectedKeys)
+	assert.EqualValues(t, expectedKeys, keys)
+
+	// the thumbnail was made again
+	problem, err := s.checkImage(ThumbKey(sum(unthumbed)))
+	require.Nil(t, err)
+	assert.Empty(t, problem)
+
+	// the corrupt RAW was unpaired, and the corrupt JPEG failed but kept its files
+	require.Len(t, updated, 2)
+	assert.EqualValues(t, sum(good), updated[0].ID)
+	assert.Empty(t, updated[0].RawID)
+	assert.EqualValues(t, sum(corrupt), updated[1].ID)
+	assert.EqualValues(t, ProcessingFailed, updated[1].Status)
+
+	// and the RAW photo is queued to get its display image back
+	require.Len(t, saved, 1)
+	assert.EqualValues(t, sum(raw), saved[0].PhotoID)
+	assert.True(t, saved[0].Reprocess)
+	data, err := ioutil.ReadFile(s.queuePath(sum(raw)))
+	require.Nil(t, err)
+	assert.EqualValues(t, raw, data)
+}
@@ -0,0 +1,75 @@
+package server
+
+// #cgo pkg-config: libheif
+// #include <stdlib.h>
+// #include <libheif/heif.h>
+import "C"
+
+import (
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+	"unsafe"
+)
+
+// heifError returns the error libheif reported, or nil if it succeeded.
+func heifError(err C.struct_heif_error) error {
+	if err.code == C.heif_error_Ok {
+		return nil
+	}
+	return errors.New("heif: " + C.GoString(err.message))
+}
+
+// DecodeHEIF decodes the primary image of a HEIF file of the given size, turned the
+// way the file says to show it. It uses the system's libheif, the same way WebP
+// renditions use the system's libwebp. HEIF photos are small next to RAW files, so
+// the whole file is read into memory for libheif.
+func DecodeHEIF(input io.ReaderAt, size int64) (image.Image, error) {
+	data, err := ioutil.ReadAll(io.NewSectionReader(input, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("heif: empty file")
+	}
+
+	ctx := C.heif_context_alloc()
+	if ctx == nil {
+		return nil, errors.New("heif: unable to allocate a context")
+	}
+	defer C.heif_context_free(ctx)
+	// libheif keeps a copy of the data, so it can be passed from Go
+	if err := heifError(C.heif_context_read_from_memory(ctx, unsafe.Pointer(&data[0]), C.size_t(len(data)), nil)); err != nil {
+		return nil, err
+	}
+
+	var handle *C.struct_heif_image_handle
+	if err := heifError(C.heif_context_get_primary_image_handle(ctx, &handle)); err != nil {
+		return nil, err
+	}
+	defer C.heif_image_handle_release(handle)
+
+	// libheif applies the rotation and mirroring the file is shown with
+	var decoded *C.struct_heif_image
+	if err := heifError(C.heif_decode_image(handle, &decoded, C.heif_colorspace_RGB, C.heif_chroma_interleaved_RGBA, nil)); err != nil {
+		return nil, err
+	}
+	defer C.heif_image_release(decoded)
+
+	width := int(C.heif_image_get_width(decoded, C.heif_channel_interleaved))
+	height := int(C.heif_image_get_height(decoded, C.heif_channel_interleaved))
+	var stride C.int
+	plane := C.heif_image_get_plane_readonly(decoded, C.heif_channel_interleaved, &stride)
+	if plane == nil || width <= 0 || height <= 0 {
+		return nil, errors.New("heif: no image was decoded")
+	}
+
+	// libheif gives RGBA that isn't premultiplied, which is what NRGBA holds
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	pix := C.GoBytes(unsafe.Pointer(plane), stride*C.int(height))
+	for y := 0; y < height; y++ {
+		copy(img.Pix[y*img.Stride:y*img.Stride+width*4], pix[y*int(stride):])
+	}
+	return img, nil
+}
@@ -2,36 +2,19 @@ package server
 
 import (
 	"encoding/json"
-	"errors"
+	"fmt"
 	"math"
 	"net/http"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
 const (
-	PageSize = 20
+	PageSize     = 20
+	MaxExistsIDs = 1000
 )
 
-type TagMatcher struct {
-	tag string
-}
-
-func (m *TagMatcher) MatchField(v interface{}) (bool, error) {
-	tags, ok := v.([]string)
-	if !ok {
-		return false, errors.New("failed to convert field")
-	}
-	for _, t := range tags {
-		if strings.Contains(t, m.tag) {
-			return true, nil
-		}
-	}
-	return false, nil
-}
-
 func round(num float64) int {
 	return int(num + math.Copysign(0.5, num))
 }
@@ -92,10 +75,6 @@ func GetDeleted(r *http.Request) (bool, error) {
 	return deleted, nil
 }
 
-func GetTag(r *http.Request) string {
-	return r.URL.Query().Get("tag")
-}
-
 func WriteError(s string, status int, w http.ResponseWriter) {
 	v := ErrorResponse{
 		Success: false,
@@ -116,16 +95,50 @@ func WriteJsonResponse(v interface{}, status int, w http.ResponseWriter) {
 	w.Write(js)
 }
 
-func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
-	c := make(chan struct{})
-	go func() {
-		wg.Wait()
-		close(c)
-	}()
-	select {
-	case <-c:
-		return false // compl eted normally
-	case <-time.After(timeout):
-		return true // timed out
+// immutableCacheControl lets clients keep originals and display images for good,
+// since photo IDs are hashes of their contents.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// rotatableCacheControl lets clients keep thumbnails and renditions, which are made
+// again at the same URLs when a photo is rotated, as long as they check the ETag
+// before using them.
+const rotatableCacheControl = "public, no-cache"
+
+// imageETag tells apart the images made from a photo before and after it's rotated.
+func imageETag(tag string, photo Photo) string {
+	if photo.Rotation == 0 {
+		return tag
+	}
+	return fmt.Sprintf("%s-r%d", tag, photo.Rotation)
+}
+
+// setImageCacheHeaders marks a response as an image that's cached as cacheControl
+// says, with a strong ETag, and answers with 304 Not Modified if the client already
+// has it.
+func setImageCacheHeaders(etag string, modtime *time.Time, cacheControl string, w http.ResponseWriter, r *http.Request) bool {
+	etag = `"` + etag + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+	if modtime != nil {
+		w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		match = strings.TrimPrefix(strings.TrimSpace(match), "W/")
+		if match == etag || match == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// ServeBlob writes a stored image, handling conditional and range requests.
+func ServeBlob(blob Blob, contentType string, modtime *time.Time, w http.ResponseWriter, r *http.Request) {
+	var t time.Time
+	if modtime != nil {
+		t = *modtime
 	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", t, blob)
 }
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+/*
+ * IPTC
+ *
+ * Photo desks caption and keyword photos with IPTC-IIM metadata, which editing
+ * software saves among the Photoshop resources of a JPEG's APP13 segment. Only the
+ * datasets hotshots uses are read.
+ */
+
+const (
+	iptcCaption  = 120
+	iptcByline   = 80
+	iptcKeywords = 25
+	// Photoshop resource holding IPTC-IIM
+	irbIPTC = 0x0404
+)
+
+var photoshopHeader = []byte("Photoshop 3.0\x00")
+
+// IPTC is the IPTC metadata of a photo.
+type IPTC struct {
+	Caption  string
+	Byline   string
+	Keywords []string
+}
+
+// ReadIPTC reads the IPTC metadata from the start of a JPEG. JPEGs without any have
+// empty metadata.
+func ReadIPTC(input io.Reader) (*IPTC, error) {
+	r := bufio.NewReader(input)
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil {
+		return nil, err
+	}
+	if soi != [2]byte{0xFF, 0xD8} {
+		return nil, errors.New("file signature is incorrect")
+	}
+
+	iptc := &IPTC{}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != 0xFF {
+			return nil, errors.New("invalid JPEG marker")
+		}
+		marker, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case marker == 0xFF:
+			// padding before a marker
+			r.UnreadByte()
+			continue
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			continue
+		case marker == 0xDA || marker == 0xD9:
+			// the image data starts, and metadata comes before it
+			return iptc, nil
+		}
+
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		if length < 2 {
+			return nil, errors.New("invalid JPEG segment")
+		}
+		if marker != 0xED {
+			if _, err := io.CopyN(ioutil.Discard, r, int64(length-2)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(segment, photoshopHeader) {
+			iptc.readResources(segment[len(photoshopHeader):])
+		}
+	}
+}
+
+// readResources reads the IPTC resource from Photoshop image resource blocks.
+func (iptc *IPTC) readResources(b []byte) {
+	for len(b) >= 12 && bytes.Equal(b[:4], []byte("8BIM")) {
+		id := binary.BigEndian.Uint16(b[4:6])
+		// the name is a Pascal string padded to an even length
+		nameLength := 1 + int(b[6])
+		nameLength += nameLength % 2
+		if len(b) < 6+nameLength+4 {
+			return
+		}
+		b = b[6+nameLength:]
+		size := int(binary.BigEndian.Uint32(b[:4]))
+		b = b[4:]
+		if size > len(b) {
+			return
+		}
+		if id == irbIPTC {
+			iptc.readDatasets(b[:size])
+		}
+		size += size % 2
+		if size > len(b) {
+			return
+		}
+		b = b[size:]
+	}
+}
+
+// readDatasets reads the datasets of the application record.
+func (iptc *IPTC) readDatasets(b []byte) {
+	for len(b) >= 5 && b[0] == 0x1C {
+		record, dataset := b[1], b[2]
+		size := int(binary.BigEndian.Uint16(b[3:5]))
+		if size&0x8000 != 0 {
+			// extended datasets are too big for anything read here
+			return
+		}
+		b = b[5:]
+		if size > len(b) {
+			return
+		}
+		value := strings.TrimSpace(strings.TrimRight(string(b[:size]), "\x00"))
+		b = b[size:]
+		if record != 2 || value == "" {
+			continue
+		}
+		switch dataset {
+		case iptcCaption:
+			iptc.Caption = value
+		case iptcByline:
+			iptc.Byline = value
+		case iptcKeywords:
+			iptc.Keywords = append(iptc.Keywords, value)
+		}
+	}
+}
+
+// addIPTC adds the IPTC metadata of a JPEG to its photo.
+func addIPTC(photo *Photo, photoPath string) error {
+	f, err := os.Open(photoPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	iptc, err := ReadIPTC(f)
+	if err != nil {
+		return err
+	}
+	photo.AddIPTC(iptc)
+	return nil
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type iptcDataset struct {
+	record, dataset byte
+	value           string
+}
+
+// jpegWithIPTC adds an APP13 segment holding IPTC datasets to a JPEG, after another
+// Photoshop resource.
+func jpegWithIPTC(data []byte, datasets []iptcDataset) []byte {
+	iim := new(bytes.Buffer)
+	for _, d := range datasets {
+		iim.Write([]byte{0x1C, d.record, d.dataset})
+		binary.Write(iim, binary.BigEndian, uint16(len(d.value)))
+		iim.WriteString(d.value)
+	}
+
+	resources := new(bytes.Buffer)
+	resources.WriteString("Photoshop 3.0\x00")
+	// a resolution resource, with a name, which is skipped
+	resources.WriteString("8BIM")
+	binary.Write(resources, binary.BigEndian, uint16(0x03ED))
+	resources.Write([]byte{3, 'r', 'e', 's'})
+	binary.Write(resources, binary.BigEndian, uint32(3))
+	resources.Write([]byte{1, 2, 3, 0})
+	resources.WriteString("8BIM")
+	binary.Write(resources, binary.BigEndian, uint16(irbIPTC))
+	resources.Write([]byte{0, 0})
+	binary.Write(resources, binary.BigEndian, uint32(iim.Len()))
+	resources.Write(iim.Bytes())
+
+	buf := new(bytes.Buffer)
+	buf.Write(data[:2]) // SOI
+	buf.Write([]byte{0xFF, 0xED})
+	binary.Write(buf, binary.BigEndian, uint16(2+resources.Len()))
+	buf.Write(resources.Bytes())
+	buf.Write(data[2:])
+	return buf.Bytes()
+}
+
+func TestReadIPTC(t *testing.T) {
+	data := jpegWithIPTC(jpegWithExif(encodeJPEG(t, 16, 16), tiffWithMake("Canon")), []iptcDataset{
+		{1, 90, "\x1b%G"},
+		{2, iptcKeywords, "rugby"},
+		{2, iptcCaption, "A try in the first half"},
+		{2, iptcKeywords, "Varsity "},
+		{2, iptcByline, "Jo Smith"},
+		{3, iptcKeywords, "not a keyword"},
+	})
+	iptc, err := ReadIPTC(bytes.NewReader(data))
+	require.Nil(t, err)
+	assert.EqualValues(t, "A try in the first half", iptc.Caption)
+	assert.EqualValues(t, "Jo Smith", iptc.Byline)
+	assert.EqualValues(t, []string{"rugby", "Varsity"}, iptc.Keywords)
+
+	// photos without IPTC are fine
+	iptc, err = ReadIPTC(bytes.NewReader(encodeJPEG(t, 16, 16)))
+	require.Nil(t, err)
+	assert.EqualValues(t, &IPTC{}, iptc)
+
+	_, err = ReadIPTC(bytes.NewReader([]byte("not a jpeg")))
+	assert.NotNil(t, err)
+
+	// IPTC is preferred to EXIF
+	photo := Photo{Caption: "IMG_0001", Photographer: "Canon user"}
+	photo.AddIPTC(&IPTC{Byline: "Jo Smith", Keywords: []string{"rugby"}})
+	assert.EqualValues(t, "IMG_0001", photo.Caption)
+	assert.EqualValues(t, "Jo Smith", photo.Photographer)
+	assert.EqualValues(t, []string{"rugby"}, photo.Keywords)
+}
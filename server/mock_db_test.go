@@ -1 +1,47 @@
 package server
+
+import (
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+)
+
+// MockTx is a transaction on a MockDB. Its reads and writes are calls to the MockDB,
+// and so are Commit and Rollback.
+type MockTx struct {
+	storm.Node
+	db *MockDB
+}
+
+func (tx *MockTx) One(fieldName string, value interface{}, to interface{}) error {
+	return tx.db.One(fieldName, value, to)
+}
+
+func (tx *MockTx) Select(matchers ...q.Matcher) storm.Query {
+	return tx.db.Select(matchers...)
+}
+
+func (tx *MockTx) Save(data interface{}) error {
+	return tx.db.Save(data)
+}
+
+func (tx *MockTx) Update(data interface{}) error {
+	return tx.db.Update(data)
+}
+
+func (tx *MockTx) UpdateField(data interface{}, fieldName string, value interface{}) error {
+	return tx.db.UpdateField(data, fieldName, value)
+}
+
+func (tx *MockTx) DeleteStruct(data interface{}) error {
+	return tx.db.DeleteStruct(data)
+}
+
+func (tx *MockTx) Commit() error {
+	args := tx.db.Called()
+	return args.Error(0)
+}
+
+func (tx *MockTx) Rollback() error {
+	args := tx.db.Called()
+	return args.Error(0)
+}
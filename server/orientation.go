@@ -0,0 +1,247 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/kochman/hotshots/log"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+/*
+ * Orientation
+ *
+ * Cameras save photos the way the sensor was held, and record how to turn them
+ * upright in the EXIF Orientation tag. Browsers follow the tag when they show a JPEG,
+ * but images made from a photo don't carry it, so thumbnails, renditions and the
+ * display images of RAW photos are turned upright as they're made, and Width and
+ * Height are those of the upright photo. A photo can also be rotated by hand, which
+ * is applied on top of its orientation.
+ */
+
+var InvalidRotation = errors.New("rotation must be a multiple of 90 degrees")
+
+// orientations are the EXIF orientations, as a horizontal flip followed by a
+// clockwise rotation.
+var orientations = map[int]struct {
+	flip     bool
+	rotation int
+}{
+	1: {false, 0},
+	2: {true, 0},
+	3: {false, 180},
+	4: {true, 180},
+	5: {true, 270},
+	6: {false, 90},
+	7: {true, 90},
+	8: {false, 270},
+}
+
+// exifOrientation returns the orientation a photo was saved with, or 0 if it wasn't
+// recorded.
+func exifOrientation(x ExifData) int {
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 0
+	}
+	orientation, err := tag.Int(0)
+	if err != nil {
+		return 0
+	}
+	if _, ok := orientations[orientation]; !ok {
+		return 0
+	}
+	return orientation
+}
+
+// rotateOrientation returns the orientation that turns an image like orientation
+// does, then rotates it clockwise by degrees.
+func rotateOrientation(orientation int, degrees int) int {
+	o, ok := orientations[orientation]
+	if !ok {
+		o = orientations[1]
+	}
+	rotation := ((o.rotation+degrees)%360 + 360) % 360
+	for other, p := range orientations {
+		if p.flip == o.flip && p.rotation == rotation {
+			return other
+		}
+	}
+	return 1
+}
+
+// swapsAxes returns whether an orientation turns an image on its side.
+func swapsAxes(orientation int) bool {
+	return orientations[orientation].rotation%180 != 0
+}
+
+// normalizeRotation returns a rotation between 0 and 270 degrees.
+func normalizeRotation(degrees int) (int, error) {
+	if degrees%90 != 0 {
+		return 0, InvalidRotation
+	}
+	return (degrees%360 + 360) % 360, nil
+}
+
+// displayOrientation returns how the photo's display image is turned upright and
+// rotated the way it was by hand. RAW display images are made upright.
+func (p *Photo) displayOrientation() int {
+	orientation := p.Orientation
+	if IsRaw(p.Format) {
+		orientation = 1
+	}
+	return rotateOrientation(orientation, p.Rotation)
+}
+
+// Rotate sets the photo's rotation, which is clockwise in degrees, and swaps its
+// dimensions if it's turned on its side.
+func (p *Photo) Rotate(degrees int) error {
+	degrees, err := normalizeRotation(degrees)
+	if err != nil {
+		return err
+	}
+	if (degrees-p.Rotation)%180 != 0 {
+		p.Width, p.Height = p.Height, p.Width
+	}
+	p.Rotation = degrees
+	return nil
+}
+
+// Orient turns an image by an EXIF orientation.
+func Orient(img image.Image, orientation int) image.Image {
+	o, ok := orientations[orientation]
+	if !ok || orientation == 1 {
+		return img
+	}
+
+	b := img.Bounds()
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		src = image.NewRGBA(b)
+		draw.Draw(src, b, img, b.Min, draw.Src)
+	}
+	w, h := b.Dx(), b.Dy()
+
+	dw, dh := w, h
+	if o.rotation%180 != 0 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			fx := x
+			if o.flip {
+				fx = w - 1 - x
+			}
+			var dx, dy int
+			switch o.rotation {
+			case 0:
+				dx, dy = fx, y
+			case 90:
+				dx, dy = h-1-y, fx
+			case 180:
+				dx, dy = w-1-fx, h-1-y
+			case 270:
+				dx, dy = y, w-1-fx
+			}
+			si := src.PixOffset(b.Min.X+x, b.Min.Y+y)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// thumbFrom saves a thumbnail of the display image read from input.
+func thumbFrom(input io.Reader, orientation int, thumbPath string) error {
+	img, err := jpeg.Decode(input)
+	if err != nil {
+		return err
+	}
+	return writeThumb(img, orientation, thumbPath)
+}
+
+// makeThumb makes a photo's thumbnail again from its display image, for when it's
+// lost or the photo is rotated.
+func (s *Server) makeThumb(photo Photo) error {
+	input, err := s.store.Get(PhotoKey(photo.ID))
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	work, err := ioutil.TempDir(s.cfg.UploadFolder(), "processing-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(work)
+
+	if err := thumbFrom(input, photo.displayOrientation(), path.Join(work, ThumbKey(photo.ID))); err != nil {
+		return err
+	}
+	return s.storeFiles(work, ThumbKey(photo.ID))
+}
+
+/*
+ * Handlers
+ */
+
+type RotateRequest struct {
+	// Clockwise, in degrees, from the photo's orientation
+	Rotation int `json:"rotation"`
+}
+
+func (s *Server) PostRotate(w http.ResponseWriter, r *http.Request) {
+	photo := r.Context().Value("photo").(Photo)
+	if photo.Status != ProcessingSucceeded {
+		WriteError("photo not processed", 400, w)
+		return
+	}
+	if photo.Deleted {
+		WriteError("photo deleted", 400, w)
+		return
+	}
+
+	var v RotateRequest
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		WriteError("unable to parse rotation", 400, w)
+		return
+	}
+	if err := photo.Rotate(v.Rotation); err != nil {
+		WriteError(err.Error(), 400, w)
+		return
+	}
+
+	if err := s.makeThumb(photo); err != nil {
+		log.Error(err)
+		WriteError("unable to make thumbnail", 500, w)
+		return
+	}
+	// renditions are made again as they're requested
+	s.deleteFiles(s.renditionKeys(photo.ID)...)
+
+	err := s.db.Update(&photo)
+	if err == nil && photo.Rotation == 0 {
+		// Update leaves out fields with zero values
+		err = s.db.UpdateField(&Photo{ID: photo.ID}, "Rotation", 0)
+	}
+	if err != nil {
+		log.Error(err)
+		WriteError("unable to write to database", 500, w)
+		return
+	}
+	s.publish(EventPhotoRotated, photo, "")
+
+	WriteJsonResponse(&GetPhotoMetadataResponse{
+		Success: true,
+		Photo:   photo,
+	}, 200, w)
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kochman/hotshots/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// tiffWithOrientation builds a minimal little endian TIFF holding only an orientation.
+func tiffWithOrientation(orientation int) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("II*\x00")
+	binary.Write(buf, binary.LittleEndian, uint32(8)) // first IFD
+	binary.Write(buf, binary.LittleEndian, uint16(1)) // entries
+	binary.Write(buf, binary.LittleEndian, uint16(0x0112))
+	binary.Write(buf, binary.LittleEndian, uint16(3)) // SHORT
+	binary.Write(buf, binary.LittleEndian, uint32(1))
+	binary.Write(buf, binary.LittleEndian, uint16(orientation))
+	binary.Write(buf, binary.LittleEndian, uint16(0))
+	binary.Write(buf, binary.LittleEndian, uint32(0)) // no next IFD
+	return buf.Bytes()
+}
+
+func TestOrient(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	img.Set(0, 0, color.RGBA{255, 0, 0, 255})
+	img.Set(1, 0, color.RGBA{0, 255, 0, 255})
+
+	cases := []struct {
+		orientation   int
+		width, height int
+		// where the first two pixels of the top row end up
+		first, second image.Point
+	}{
+		{1, 3, 2, image.Pt(0, 0), image.Pt(1, 0)},
+		{2, 3, 2, image.Pt(2, 0), image.Pt(1, 0)},
+		{3, 3, 2, image.Pt(2, 1), image.Pt(1, 1)},
+		{4, 3, 2, image.Pt(0, 1), image.Pt(1, 1)},
+		{5, 2, 3, image.Pt(0, 0), image.Pt(0, 1)},
+		{6, 2, 3, image.Pt(1, 0), image.Pt(1, 1)},
+		{7, 2, 3, image.Pt(1, 2), image.Pt(1, 1)},
+		{8, 2, 3, image.Pt(0, 2), image.Pt(0, 1)},
+	}
+	for _, c := range cases {
+		oriented := Orient(img, c.orientation)
+		assert.EqualValues(t, image.Rect(0, 0, c.width, c.height), oriented.Bounds(), "orientation %d", c.orientation)
+		r, _, _, _ := oriented.At(c.first.X, c.first.Y).RGBA()
+		assert.EqualValues(t, 0xffff, r, "orientation %d", c.orientation)
+		_, g, _, _ := oriented.At(c.second.X, c.second.Y).RGBA()
+		assert.EqualValues(t, 0xffff, g, "orientation %d", c.orientation)
+	}
+
+	// images that aren't at the origin, like crops, are turned too
+	sub := img.SubImage(image.Rect(1, 0, 3, 2))
+	oriented := Orient(sub, 6)
+	assert.EqualValues(t, image.Rect(0, 0, 2, 2), oriented.Bounds())
+	_, g, _, _ := oriented.At(1, 0).RGBA()
+	assert.EqualValues(t, 0xffff, g)
+}
+
+func TestRotateOrientation(t *testing.T) {
+	assert.EqualValues(t, 6, rotateOrientation(1, 90))
+	assert.EqualValues(t, 3, rotateOrientation(6, 90))
+	assert.EqualValues(t, 1, rotateOrientation(6, 270))
+	assert.EqualValues(t, 7, rotateOrientation(2, 90))
+	assert.EqualValues(t, 5, rotateOrientation(7, 180))
+	assert.EqualValues(t, 8, rotateOrientation(1, -90))
+	// photos without an orientation are upright
+	assert.EqualValues(t, 3, rotateOrientation(0, 180))
+
+	// RAW display images are made upright when they're processed
+	photo := Photo{Format: FormatCR2, Orientation: 6, Rotation: 90}
+	assert.EqualValues(t, 6, photo.displayOrientation())
+	photo.Format = FormatJPEG
+	assert.EqualValues(t, 3, photo.displayOrientation())
+}
+
+func TestPhotoRotate(t *testing.T) {
+	photo := Photo{Width: 640, Height: 480}
+	err := photo.Rotate(-90)
+	require.Nil(t, err)
+	assert.EqualValues(t, 270, photo.Rotation)
+	assert.EqualValues(t, 480, photo.Width)
+	assert.EqualValues(t, 640, photo.Height)
+
+	err = photo.Rotate(90)
+	require.Nil(t, err)
+	assert.EqualValues(t, 90, photo.Rotation)
+	assert.EqualValues(t, 480, photo.Width)
+
+	err = photo.Rotate(45)
+	assert.EqualValues(t, InvalidRotation, err)
+	assert.EqualValues(t, 90, photo.Rotation)
+}
+
+func TestProcessPhotoOrientation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hotshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	photoPath := path.Join(dir, "photo.jpg")
+	thumbPath := path.Join(dir, "thumb.jpg")
+
+	// a portrait photo, saved on its side
+	data := jpegWithExif(encodeJPEG(t, 64, 48), tiffWithOrientation(6))
+	xif, rect, err := ProcessPhoto(bytes.NewReader(data), "1234", photoPath, thumbPath, time.Minute)
+	require.Nil(t, err)
+
+	var photo Photo
+	photo.AddMetadata(rect, xif)
+	assert.EqualValues(t, 6, photo.Orientation)
+	assert.EqualValues(t, 48, photo.Width)
+	assert.EqualValues(t, 64, photo.Height)
+
+	thumb, err := os.Open(thumbPath)
+	require.Nil(t, err)
+	defer thumb.Close()
+	cfg, err := jpeg.DecodeConfig(thumb)
+	require.Nil(t, err)
+	assert.EqualValues(t, 48, cfg.Width)
+	assert.EqualValues(t, 64, cfg.Height)
+}
+
+func TestPostRotate(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+	defer os.RemoveAll(s.cfg.PhotosDirectory)
+	err := os.Mkdir(s.cfg.UploadFolder(), 0775)
+	require.Nil(t, err)
+	s.cfg.Renditions = []config.Rendition{{Name: "small", Width: 40, Height: 40}}
+
+	id := "1234"
+	err = s.store.Put(PhotoKey(id), bytes.NewReader(encodeJPEG(t, 64, 48)))
+	require.Nil(t, err)
+	err = s.store.Put(RenditionKey(id, "small", renditionJPEG), bytes.NewReader([]byte("small")))
+	require.Nil(t, err)
+
+	db.On("Update", mock.Anything).Return(nil)
+	db.On("UpdateField", mock.Anything, "Rotation", 0).Return(nil)
+	db.On("All", mock.Anything, mock.Anything).Return(nil)
+
+	rotate := func(photo Photo, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), "photo", photo))
+		w := httptest.NewRecorder()
+		s.PostRotate(w, r)
+		return w
+	}
+
+	photo := Photo{ID: id, Format: FormatJPEG, Status: ProcessingSucceeded, Width: 64, Height: 48}
+	w := rotate(photo, `{"rotation": 90}`)
+	require.EqualValues(t, 200, w.Code)
+
+	var v GetPhotoMetadataResponse
+	err = json.Unmarshal(w.Body.Bytes(), &v)
+	require.Nil(t, err)
+	assert.EqualValues(t, 90, v.Photo.Rotation)
+	assert.EqualValues(t, 48, v.Photo.Width)
+	assert.EqualValues(t, 64, v.Photo.Height)
+	db.AssertNumberOfCalls(t, "Update", 1)
+
+	// the thumbnail is made again, and renditions will be
+	thumb, err := s.store.Get(ThumbKey(id))
+	require.Nil(t, err)
+	cfg, err := jpeg.DecodeConfig(thumb)
+	thumb.Close()
+	require.Nil(t, err)
+	assert.EqualValues(t, 48, cfg.Width)
+	assert.EqualValues(t, 64, cfg.Height)
+	_, err = s.store.Get(RenditionKey(id, "small", renditionJPEG))
+	assert.EqualValues(t, BlobNotFound, err)
+	small, err := s.generateRendition(v.Photo, s.cfg.Renditions[0], renditionJPEG)
+	require.Nil(t, err)
+	cfg, err = jpeg.DecodeConfig(small)
+	small.Close()
+	require.Nil(t, err)
+	assert.EqualValues(t, 30, cfg.Width)
+	assert.EqualValues(t, 40, cfg.Height)
+
+	// rotating back is stored too
+	w = rotate(v.Photo, `{"rotation": 0}`)
+	require.EqualValues(t, 200, w.Code)
+	db.AssertNumberOfCalls(t, "UpdateField", 1)
+
+	w = rotate(photo, `{"rotation": 45}`)
+	assert.EqualValues(t, 400, w.Code)
+	w = rotate(Photo{ID: id, Status: Processing}, `{"rotation": 90}`)
+	assert.EqualValues(t, 400, w.Code)
+}
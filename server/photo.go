@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/json"
 	"errors"
@@ -9,13 +10,12 @@ import (
 	"image"
 	"image/jpeg"
 	"io"
-	"os"
+	"io/ioutil"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/asdine/storm"
 	"github.com/kochman/hotshots/log"
-	"github.com/nfnt/resize"
 	"github.com/rwcarlsen/goexif/exif"
 	"github.com/rwcarlsen/goexif/mknote"
 	"github.com/rwcarlsen/goexif/tiff"
@@ -40,18 +40,13 @@ const (
 var (
 	TagExists   = errors.New("tag already exists")
 	TagNotExist = errors.New("tag does not exist")
+	InAlbum     = errors.New("photo already in album")
 )
 
 /*
  * Data structs
  */
 
-type ProcessorWaitGroup interface {
-	Add(delta int)
-	Done()
-	Wait()
-}
-
 type ExifData interface {
 	DateTime() (time.Time, error)
 	LatLong() (float64, float64, error)
@@ -61,6 +56,7 @@ type ExifData interface {
 type Photo struct {
 	ID              string     `storm:"id" json:"id"`
 	Deleted         bool       `storm:"index" json:"deleted"` // CANNOT BE OMITTED IN JSON BECAUSE STORM
+	DeletedAt       *time.Time `storm:"index" json:"deleted_at"`
 	UploadedAt      *time.Time `storm:"index" json:"uploaded_at"`
 	TakenAt         *time.Time `storm:"index" json:"taken_at"`
 	Width           int        `storm:"index" json:"width"`
@@ -74,12 +70,32 @@ type Photo struct {
 	Status          Status     `storm:"index" json:"status"`
 	StatusUpdatedAt *time.Time `storm:"index" json:"status_updated_at"`
 	Tags            []string   `storm:"index" json:"tags"` // not performant, but I don't care
+	Format          string     `json:"format"`
+	// From EXIF, or IPTC if the photo has it
+	Caption      string `json:"caption"`
+	Photographer string `json:"photographer"`
+	// IPTC keywords
+	Keywords []string `json:"keywords"`
+	// From 1 to 5 stars, 0 if it hasn't been rated
+	Rating int      `storm:"index" json:"rating"`
+	Albums []string `json:"albums"`
+	// EXIF orientation of the original, 0 if it has none
+	Orientation int `json:"orientation"`
+	// Clockwise rotation in degrees, set by hand
+	Rotation   int    `json:"rotation"`
+	Filename   string `json:"filename"`
+	RawID      string `storm:"index" json:"raw_id"`
+	RawFormat  string `json:"raw_format"`
+	UploadedBy string `storm:"index" json:"uploaded_by"`
+	Device     string `storm:"index" json:"device"`
 }
 
-func NewPhoto(id string) Photo {
+func NewPhoto(id string, format string, filename string) Photo {
 	now := time.Now()
 	return Photo{
 		ID:              id,
+		Format:          format,
+		Filename:        filename,
 		Deleted:         false,
 		UploadedAt:      &now,
 		Status:          Processing,
@@ -125,20 +141,51 @@ func (p *Photo) AddMetadata(r *image.Rectangle, x ExifData) {
 		p.CamModel = strings.TrimSuffix(string(cmodel.Val), "\u0000")
 	}
 
+	if description, err := x.Get(exif.ImageDescription); err == nil {
+		p.Caption = exifString(description)
+	}
+	if artist, err := x.Get(exif.Artist); err == nil {
+		p.Photographer = exifString(artist)
+	}
+
+	// dimensions are those of the photo shown upright
+	p.Orientation = exifOrientation(x)
 	p.Width = r.Dx()
 	p.Height = r.Dy()
+	if swapsAxes(p.displayOrientation()) {
+		p.Width, p.Height = p.Height, p.Width
+	}
 	p.Megapixels = toFixed(float64(r.Dx())*float64(r.Dy())/1000000.0, 2)
 }
 
+// AddIPTC adds a photo's IPTC metadata, whose caption and byline are preferred to
+// those in its EXIF.
+func (p *Photo) AddIPTC(iptc *IPTC) {
+	if iptc.Caption != "" {
+		p.Caption = iptc.Caption
+	}
+	if iptc.Byline != "" {
+		p.Photographer = iptc.Byline
+	}
+	p.Keywords = iptc.Keywords
+}
+
+// exifString returns the value of an ASCII tag.
+func exifString(tag *tiff.Tag) string {
+	return strings.TrimSpace(strings.TrimRight(string(tag.Val), "\u0000"))
+}
+
 func (p *Photo) UpdateStatus(status Status) {
 	p.Status = status
 	t := time.Now()
 	p.StatusUpdatedAt = &t
 }
 
+// AddTag adds a tag to the photo, unless it has a tag with the same slug.
 func (p *Photo) AddTag(tag string) error {
+	slug := TagSlug(tag)
 	for _, t := range p.Tags {
-		if strings.EqualFold(t, tag) {
+		if TagSlug(t) == slug {
 			return TagExists
 		}
 	}
@@ -147,9 +194,11 @@ func (p *Photo) AddTag(tag string) error {
 	return nil
 }
 
+// DeleteTag removes the tag with the same slug as tag.
 func (p *Photo) DeleteTag(tag string) error {
+	slug := TagSlug(tag)
 	for loc, t := range p.Tags {
-		if strings.EqualFold(t, tag) {
+		if TagSlug(t) == slug {
 			p.Tags = removeElement(p.Tags, loc)
 			return nil
 		}
@@ -158,125 +207,142 @@ func (p *Photo) DeleteTag(tag string) error {
 	return TagNotExist
 }
 
-func ProcessPhoto(input io.Reader, id string, photoPath string, thumbPath string, timeout time.Duration) (*exif.Exif, *image.Rectangle, error) {
-	rect := make(chan *image.Rectangle, 1)
-	xif := make(chan *exif.Exif, 1)
-	errs := make(chan error, 3)
-
-	photoBuff := new(bytes.Buffer)
-	thumbBuff := new(bytes.Buffer)
-	exifBuff := new(bytes.Buffer)
-
-	func() {
-		mw := io.MultiWriter(photoBuff, thumbBuff, exifBuff)
-
-		if _, err := io.Copy(mw, input); err != nil {
-			log.Error(err)
-			return
+// AddToAlbum adds the photo to an album, unless it's in an album with the same slug.
+func (p *Photo) AddToAlbum(album string) error {
+	slug := TagSlug(album)
+	for _, a := range p.Albums {
+		if TagSlug(a) == slug {
+			return InAlbum
 		}
-	}()
+	}
+	p.Albums = append(p.Albums, album)
+	return nil
+}
 
-	log.Info(fmt.Sprint("saving image ", id))
+// HasTag returns whether the photo has a tag with the same slug as tag.
+func (p *Photo) HasTag(tag string) bool {
+	slug := TagSlug(tag)
+	for _, t := range p.Tags {
+		if TagSlug(t) == slug {
+			return true
+		}
+	}
+	return false
+}
 
-	wg := new(sync.WaitGroup)
-	wg.Add(3)
+// exifHeaderSize is how much of the start of a JPEG is kept to read EXIF from, which
+// is stored in APP1 segments of up to 64K near the start of the file.
+const exifHeaderSize = 1 << 18 // 256K
 
-	go SaveImage(photoBuff, photoPath, wg, errs)
-	go SaveThumb(rect, thumbBuff, thumbPath, wg, errs)
-	go GetExif(xif, exifBuff, wg, errs)
+// prefixWriter keeps the first bytes written to it and discards the rest.
+type prefixWriter struct {
+	buf   []byte
+	limit int
+}
 
-	if waitTimeout(wg, timeout) {
-		log.Error("image processing timed out")
-		return nil, nil, errors.New("image processing timed out")
-	}
-	if len(errs) != 0 {
-		for err := range errs {
-			return nil, nil, err
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	if n := p.limit - len(p.buf); n > 0 {
+		if n > len(b) {
+			n = len(b)
 		}
+		p.buf = append(p.buf, b[:n]...)
 	}
-	x := <-xif
-	r := <-rect
-	return x, r, nil
+	return len(b), nil
 }
 
-func SaveImage(data io.Reader, path string, wg ProcessorWaitGroup, errs chan error) {
-	jpgSignature := []byte{0xFF, 0xD8, 0xFF}
-	sigCheck := make([]byte, 3)
-	if _, err := io.ReadFull(data, sigCheck); err != nil {
-		log.Error(err)
-		errs <- err
-		wg.Done()
-		return
-	}
+// contextReader fails reads once its context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
 
-	if !bytes.Equal(jpgSignature, sigCheck) {
-		err := errors.New("file signature is incorrect")
-		log.Error(err)
-		errs <- err
-		wg.Done()
-		return
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
 	}
+	return c.r.Read(p)
+}
 
-	data = io.MultiReader(bytes.NewReader(sigCheck), data)
+// ProcessPhoto streams a JPEG from input to photoPath, decoding it on the way for its
+// dimensions and thumbnail, and keeps just enough of the start to read its EXIF from.
+// input is only read once and the photo is decoded once.
+func ProcessPhoto(input io.Reader, id string, photoPath string, thumbPath string, timeout time.Duration) (*exif.Exif, *image.Rectangle, error) {
+	log.Info(fmt.Sprint("saving image ", id))
 
-	output, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0660)
-	if err != nil {
-		log.Error(err)
-		errs <- err
-		wg.Done()
-		return
-	}
-	defer output.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var x *exif.Exif
+	var rect *image.Rectangle
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		x, rect, err = processJPEG(ctx, input, photoPath, thumbPath)
+	}()
 
-	if _, err := io.Copy(output, data); err != nil {
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// the worker gives up at its next read, and is waited for so that it's done
+		// with photoPath and thumbPath before they're cleaned up
+		<-done
+		log.Error("image processing timed out")
+		return nil, nil, errors.New("image processing timed out")
+	}
+	if err != nil {
 		log.Error(err)
-		errs <- err
-		wg.Done()
-		return
+		return nil, nil, err
 	}
-
-	wg.Done()
+	return x, rect, nil
 }
 
-func SaveThumb(r chan *image.Rectangle, data io.Reader, path string, wg ProcessorWaitGroup, errs chan error) {
-	img, err := jpeg.Decode(data)
+func processJPEG(ctx context.Context, input io.Reader, photoPath string, thumbPath string) (*exif.Exif, *image.Rectangle, error) {
+	output, err := createAtomic(photoPath)
 	if err != nil {
-		log.Error(err)
-		errs <- err
-		wg.Done()
-		return
-	}
-	rect := img.Bounds()
-	r <- &rect
-	resizedImg := resize.Thumbnail(MaxWidth, MaxHeight, img, resize.Bicubic)
-	output, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0660)
-	if err != nil {
-		log.Error(err)
-		errs <- err
-		wg.Done()
-		return
+		return nil, nil, err
 	}
 	defer output.Close()
 
-	if err := jpeg.Encode(output, resizedImg, nil); err != nil {
-		log.Error(err)
-		errs <- err
+	header := &prefixWriter{limit: exifHeaderSize}
+	tee := io.TeeReader(&contextReader{ctx, input}, io.MultiWriter(output, header))
+
+	sigCheck := make([]byte, 3)
+	if _, err := io.ReadFull(tee, sigCheck); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal([]byte{0xFF, 0xD8, 0xFF}, sigCheck) {
+		return nil, nil, errors.New("file signature is incorrect")
 	}
 
-	wg.Done()
-}
+	img, err := jpeg.Decode(io.MultiReader(bytes.NewReader(sigCheck), tee))
+	if err != nil {
+		return nil, nil, err
+	}
+	// whatever follows the image data
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return nil, nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if err := output.Commit(); err != nil {
+		return nil, nil, err
+	}
 
-func GetExif(out chan *exif.Exif, data io.Reader, wg ProcessorWaitGroup, errs chan error) {
-	x, err := exif.Decode(data)
+	x, err := exif.Decode(bytes.NewReader(header.buf))
 	if err != nil {
-		log.Error(err)
-		errs <- err
-		wg.Done()
-		return
+		return nil, nil, err
 	}
-	out <- x
 
-	wg.Done()
+	r := img.Bounds()
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if err := writeThumb(img, exifOrientation(x), thumbPath); err != nil {
+		return nil, nil, err
+	}
+	return x, &r, nil
 }
 
 func (s *Server) GetPhotoFromDatabase(photoID string) (Photo, error) {
@@ -287,6 +353,18 @@ func (s *Server) GetPhotoFromDatabase(photoID string) (Photo, error) {
 	return photo, nil
 }
 
+// findPhoto looks up a photo by its ID or the ID of the RAW file paired with it.
+func (s *Server) findPhoto(id string) (Photo, error) {
+	photo, err := s.GetPhotoFromDatabase(id)
+	if err != storm.ErrNotFound {
+		return photo, err
+	}
+	if err := s.db.One("RawID", id, &photo); err != nil {
+		return Photo{}, err
+	}
+	return photo, nil
+}
+
 func GenPhotoID(f io.ReadSeeker) (string, error) {
 	if f == nil {
 		return "", errors.New("f is nil")
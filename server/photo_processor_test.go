@@ -1,17 +1,19 @@
 package server
 
 import (
+	"bytes"
+	"encoding/binary"
 	"image"
 	"image/jpeg"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"testing"
 	"time"
 
 	"github.com/rwcarlsen/goexif/exif"
 	"github.com/stretchr/testify/assert"
-	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
 
@@ -27,29 +29,6 @@ const exiflessID = "a78999ffcc074d8d05e1ff31707e5221373979e7"
 const validFilename = "_testdata/validFile.jpg"
 const validID = "064c350707017163f692032adb2db6cdddc6fab0"
 
-type ThumbParam struct {
-	largeWidth  int
-	largeHeight int
-	thumbWidth  int
-	thumbHeight int
-}
-
-type MockWaitGroup struct {
-	mock.Mock
-}
-
-func (wg *MockWaitGroup) Add(delta int) {
-	wg.Called(delta)
-}
-
-func (wg *MockWaitGroup) Done() {
-	wg.Called()
-}
-
-func (wg *MockWaitGroup) Wait() {
-	wg.Called()
-}
-
 func testGenPhotoIDHelper(t *testing.T, filename, expectedID string) {
 	f, err := os.Open(filename)
 	require.Nil(t, err)
@@ -73,142 +52,6 @@ func TestGenPhotoID(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
-func testGetExifHelper(t *testing.T, filename string, valid bool) {
-	imageFile, err := os.Open(filename)
-	require.Nil(t, err)
-	defer imageFile.Close()
-
-	xif := make(chan *exif.Exif, 1)
-	errs := make(chan error, 1)
-
-	wg := new(MockWaitGroup)
-	wg.On("Done").Return()
-
-	GetExif(xif, imageFile, wg, errs)
-
-	wg.AssertNumberOfCalls(t, "Done", 1)
-
-	if valid {
-		select {
-		case x := <-xif: // exif sent as expected
-			assert.NotNil(t, x)
-		default: // no exif sent
-			t.Error("exif not sent to go channel")
-		}
-	} else {
-		select {
-		case err := <-errs: // exif sent as expected
-			assert.NotNil(t, err)
-		default: // no exif sent
-			t.Error("err not sent to go channel")
-		}
-	}
-}
-
-func TestGetExif(t *testing.T) {
-	testGetExifHelper(t, emptyFilename, false)
-	testGetExifHelper(t, garbageFilename, false)
-	testGetExifHelper(t, exiflessFilename, false)
-	testGetExifHelper(t, validFilename, true)
-}
-
-func testSaveThumbHelper(t *testing.T, filename string, valid bool, param *ThumbParam) {
-	imageFile, err := os.Open(filename)
-	require.Nil(t, err)
-	defer imageFile.Close()
-
-	thumbFile, err := ioutil.TempFile("", "thumb")
-	require.Nil(t, err)
-	defer func() {
-		thumbFile.Close()
-		os.Remove(thumbFile.Name())
-	}()
-
-	rect := make(chan *image.Rectangle, 1)
-	errs := make(chan error, 1)
-
-	wg := new(MockWaitGroup)
-	wg.On("Done").Return()
-
-	SaveThumb(rect, imageFile, thumbFile.Name(), wg, errs)
-
-	wg.AssertNumberOfCalls(t, "Done", 1)
-
-	if valid {
-		select {
-		case r := <-rect: // exif sent as expected
-			require.NotNil(t, r)
-			assert.EqualValues(t, r.Dx(), param.largeWidth)
-			assert.EqualValues(t, r.Dy(), param.largeHeight)
-		default: // no exif sent
-			t.Error("exif not sent to go channel")
-		}
-		i, err := jpeg.Decode(thumbFile)
-		require.Nil(t, err)
-		assert.EqualValues(t, i.Bounds().Dx(), param.thumbWidth)
-		assert.EqualValues(t, i.Bounds().Dy(), param.thumbHeight)
-	} else {
-		select {
-		case err := <-errs: // exif sent as expected
-			assert.NotNil(t, err)
-		default: // no exif sent
-			t.Error("err not sent to go channel")
-		}
-	}
-}
-
-func TestSaveThumb(t *testing.T) {
-	testSaveThumbHelper(t, emptyFilename, false, nil)
-	testSaveThumbHelper(t, garbageFilename, false, nil)
-	testSaveThumbHelper(t, exiflessFilename, true, &ThumbParam{6000, 4000, 256, 170})
-	testSaveThumbHelper(t, validFilename, true, &ThumbParam{6000, 4000, 256, 170})
-}
-
-func testSaveImageHelper(t *testing.T, filename string, valid bool) {
-	inputFile, err := os.Open(filename)
-	require.Nil(t, err)
-	defer inputFile.Close()
-
-	outputFile, err := ioutil.TempFile("", "output")
-	require.Nil(t, err)
-	defer func() {
-		outputFile.Close()
-		os.Remove(outputFile.Name())
-	}()
-
-	errs := make(chan error, 1)
-
-	wg := new(MockWaitGroup)
-	wg.On("Done").Return()
-
-	SaveImage(inputFile, outputFile.Name(), wg, errs)
-
-	wg.AssertNumberOfCalls(t, "Done", 1)
-
-	if valid {
-		inputFile.Seek(0, io.SeekStart)
-		inputID, err := GenPhotoID(inputFile)
-		require.Nil(t, err)
-		outputID, err := GenPhotoID(outputFile)
-		require.Nil(t, err)
-		assert.EqualValues(t, inputID, outputID)
-	} else {
-		select {
-		case err := <-errs: // exif sent as expected
-			assert.NotNil(t, err)
-		default: // no exif sent
-			t.Error("err not sent to go channel")
-		}
-	}
-}
-
-func TestSaveImage(t *testing.T) {
-	testSaveImageHelper(t, emptyFilename, false)
-	testSaveImageHelper(t, garbageFilename, false)
-	testSaveImageHelper(t, exiflessFilename, true)
-	testSaveImageHelper(t, validFilename, true)
-}
-
 func testProcessPhotoHelper(t *testing.T, filename, expectedID string, valid bool) {
 	input, err := os.Open(filename)
 	require.Nil(t, err)
@@ -258,3 +101,102 @@ func TestProcessPhoto(t *testing.T) {
 	testProcessPhotoHelper(t, exiflessFilename, exiflessID, false)
 	testProcessPhotoHelper(t, validFilename, validID, true)
 }
+
+// jpegWithExif puts an APP1 segment holding tiff right after the start of a JPEG.
+func jpegWithExif(data []byte, tiff []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(data[:2]) // SOI
+	buf.Write([]byte{0xFF, 0xE1})
+	binary.Write(buf, binary.BigEndian, uint16(2+6+len(tiff)))
+	buf.WriteString("Exif\x00\x00")
+	buf.Write(tiff)
+	buf.Write(data[2:])
+	return buf.Bytes()
+}
+
+func TestProcessJPEG(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hotshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	photoPath := path.Join(dir, "photo.jpg")
+	thumbPath := path.Join(dir, "thumb.jpg")
+
+	data := jpegWithExif(encodeJPEG(t, 640, 480), tiffWithMake("Canon"))
+	xif, rect, err := ProcessPhoto(bytes.NewReader(data), "1234", photoPath, thumbPath, time.Minute)
+	require.Nil(t, err)
+	assert.EqualValues(t, image.Rect(0, 0, 640, 480), *rect)
+	make, err := xif.Get(exif.Make)
+	require.Nil(t, err)
+	value, err := make.StringVal()
+	require.Nil(t, err)
+	assert.EqualValues(t, "Canon", value)
+
+	// the photo is written as it was read
+	written, err := ioutil.ReadFile(photoPath)
+	require.Nil(t, err)
+	assert.EqualValues(t, data, written)
+	thumb, err := os.Open(thumbPath)
+	require.Nil(t, err)
+	defer thumb.Close()
+	config, err := jpeg.DecodeConfig(thumb)
+	require.Nil(t, err)
+	assert.True(t, config.Width <= 640)
+
+	// photos without EXIF fail, like before
+	_, _, err = ProcessPhoto(bytes.NewReader(encodeJPEG(t, 64, 48)), "1234", photoPath, thumbPath, time.Minute)
+	assert.NotNil(t, err)
+	_, _, err = ProcessPhoto(bytes.NewReader([]byte("not a photo")), "1234", photoPath, thumbPath, time.Minute)
+	assert.NotNil(t, err)
+}
+
+// slowReader reads a little at a time, pausing before each read.
+type slowReader struct {
+	r io.Reader
+}
+
+func (s slowReader) Read(p []byte) (int, error) {
+	time.Sleep(5 * time.Millisecond)
+	if len(p) > 64 {
+		p = p[:64]
+	}
+	return s.r.Read(p)
+}
+
+func TestProcessPhotoTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hotshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	photoPath := path.Join(dir, "photo.jpg")
+	thumbPath := path.Join(dir, "thumb.jpg")
+
+	data := jpegWithExif(encodeJPEG(t, 640, 480), tiffWithMake("Canon"))
+	_, _, err = ProcessPhoto(slowReader{bytes.NewReader(data)}, "1234", photoPath, thumbPath, 50*time.Millisecond)
+	assert.NotNil(t, err)
+
+	// nothing is written once it has given up
+	files, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	assert.Empty(t, files)
+	time.Sleep(100 * time.Millisecond)
+	files, err = ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	assert.Empty(t, files)
+}
+
+func BenchmarkProcessPhoto(b *testing.B) {
+	dir, err := ioutil.TempDir("", "hotshot")
+	require.Nil(b, err)
+	defer os.RemoveAll(dir)
+	photoPath := path.Join(dir, "photo.jpg")
+	thumbPath := path.Join(dir, "thumb.jpg")
+
+	data := jpegWithExif(encodeJPEG(b, 4000, 3000), tiffWithMake("Canon"))
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := ProcessPhoto(bytes.NewReader(data), "1234", photoPath, thumbPath, time.Minute); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"image"
 	"reflect"
 	"strings"
@@ -15,7 +16,7 @@ import (
 	"github.com/stretchr/testify/mock"
 )
 
-const emptyPhotoJSON = `{"id":"","deleted":false,"uploaded_at":null,"taken_at":null,"width":0,"height":0,"megapixels":0,"lat":0,"long":0,"cam_serial":"","cam_make":"","cam_model":"","status":"processing","status_updated_at":null,"tags":null}`
+const emptyPhotoJSON = `{"id":"","deleted":false,"deleted_at":null,"uploaded_at":null,"taken_at":null,"width":0,"height":0,"megapixels":0,"lat":0,"long":0,"cam_serial":"","cam_make":"","cam_model":"","status":"processing","status_updated_at":null,"tags":null,"format":"","caption":"","photographer":"","keywords":null,"rating":0,"albums":null,"orientation":0,"rotation":0,"filename":"","raw_id":"","raw_format":"","uploaded_by":"","device":""}`
 
 const emptyJSON = `{}`
 
@@ -165,6 +166,11 @@ func TestPhotoAddMetadata(t *testing.T) {
 	cmodel := new(tiff.Tag)
 	cmodel.Val = []byte("fuck\u0000")
 	xif.On("Get", Model).Return(cmodel, nil)
+	xif.On("Get", exif.Orientation).Return((*tiff.Tag)(nil), errors.New("not found"))
+	description := new(tiff.Tag)
+	description.Val = []byte("Kickoff \u0000")
+	xif.On("Get", exif.ImageDescription).Return(description, nil)
+	xif.On("Get", exif.Artist).Return((*tiff.Tag)(nil), errors.New("not found"))
 
 	rect := new(image.Rectangle)
 	rect.Min = image.Point{X: 0, Y: 0}
@@ -178,6 +184,8 @@ func TestPhotoAddMetadata(t *testing.T) {
 	assert.EqualValues(t, "shit", p.CamSerial)
 	assert.EqualValues(t, "piss", p.CamMake)
 	assert.EqualValues(t, "fuck", p.CamModel)
+	assert.EqualValues(t, "Kickoff", p.Caption)
+	assert.Empty(t, p.Photographer)
 	assert.EqualValues(t, rect.Max.X, p.Width)
 	assert.EqualValues(t, rect.Max.Y, p.Height)
 	assert.EqualValues(t, float64(1.92), p.Megapixels)
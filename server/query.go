@@ -0,0 +1,473 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+)
+
+/*
+ * Photo queries
+ *
+ * GET /photos and /photos/ids take filters as query parameters, and return the photos
+ * matching all of them:
+ *
+ *  make, model, serial               the camera, ignoring case
+ *  taken_after, taken_before         RFC 3339 times; after is inclusive, before isn't
+ *  uploaded_after, uploaded_before
+ *  min_megapixels, max_megapixels
+ *  min_rating
+ *  orientation                       landscape, portrait or square as the photo is
+ *                                    shown, or the EXIF orientation it was saved with
+ *  tag, tags, any_tags, not_tags     repeatable; photos with all, any or none of the
+ *                                    tags, compared by their slugs
+ *  tag_match                         exact, or prefix to match the tags starting with
+ *                                    those given
+ *  album                             repeatable; photos in all of the albums
+ *
+ * Photos are sorted by sort, which is any indexed field by its JSON name and taken_at
+ * if it isn't given, in the order given by order, asc or desc. Ties are broken by ID.
+ * A page that isn't the last has a next_cursor, which is passed back as cursor to get
+ * the photos after it. Unlike start, a cursor refers to the last photo on the page, so
+ * pages don't shift as photos are uploaded.
+ */
+
+var InvalidCursor = errors.New("invalid cursor")
+
+// sortFields are the fields photos can be sorted by, by their JSON names.
+var sortFields = photoSortFields()
+
+func photoSortFields() map[string]int {
+	fields := map[string]int{}
+	t := reflect.TypeOf(Photo{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("storm")
+		if (tag != "id" && tag != "index") || f.Type.Kind() == reflect.Slice {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		fields[name] = i
+	}
+	return fields
+}
+
+type photoQuery struct {
+	matchers []q.Matcher
+	sort     string
+	field    int
+	desc     bool
+	// where the page starts, either a number of photos or the photo before it
+	start  int
+	cursor *photoCursor
+	after  reflect.Value
+	limit  int
+}
+
+// photoCursor is the last photo on a page, and the order it was in.
+type photoCursor struct {
+	Sort  string          `json:"s"`
+	Desc  bool            `json:"d,omitempty"`
+	Value json.RawMessage `json:"v"`
+	ID    string          `json:"id"`
+}
+
+// parsePhotoQuery reads the filters, order and page of a photo query.
+func parsePhotoQuery(r *http.Request) (*photoQuery, error) {
+	values := r.URL.Query()
+
+	start, limit, err := GetPaginateValues(r)
+	if err != nil || start < 0 || limit < 1 {
+		return nil, errors.New("invalid start or limit")
+	}
+	pq := &photoQuery{start: start, limit: limit, sort: values.Get("sort")}
+
+	if pq.sort == "" {
+		pq.sort = "taken_at"
+	}
+	field, ok := sortFields[pq.sort]
+	if !ok {
+		return nil, fmt.Errorf("unable to sort by %s", pq.sort)
+	}
+	pq.field = field
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		pq.desc = true
+	default:
+		return nil, errors.New("order must be asc or desc")
+	}
+
+	for _, camera := range []struct{ param, field string }{
+		{"make", "CamMake"},
+		{"model", "CamModel"},
+		{"serial", "CamSerial"},
+	} {
+		if v := values.Get(camera.param); v != "" {
+			pq.matchers = append(pq.matchers, q.Re(camera.field, "(?i)^"+regexp.QuoteMeta(v)+"$"))
+		}
+	}
+
+	for _, times := range []struct{ field, after, before string }{
+		{"TakenAt", "taken_after", "taken_before"},
+		{"UploadedAt", "uploaded_after", "uploaded_before"},
+	} {
+		after, err := parseTimeParam(r, times.after)
+		if err != nil {
+			return nil, err
+		}
+		before, err := parseTimeParam(r, times.before)
+		if err != nil {
+			return nil, err
+		}
+		if after != nil || before != nil {
+			pq.matchers = append(pq.matchers, q.NewFieldMatcher(times.field, &timeRangeMatcher{after, before}))
+		}
+	}
+
+	if v := values.Get("min_megapixels"); v != "" {
+		min, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, errors.New("invalid min_megapixels")
+		}
+		pq.matchers = append(pq.matchers, q.Gte("Megapixels", min))
+	}
+	if v := values.Get("max_megapixels"); v != "" {
+		max, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, errors.New("invalid max_megapixels")
+		}
+		pq.matchers = append(pq.matchers, q.Lte("Megapixels", max))
+	}
+
+	if v := values.Get("min_rating"); v != "" {
+		min, err := strconv.Atoi(v)
+		if err != nil || min < 0 || min > MaxRating {
+			return nil, errors.New("invalid min_rating")
+		}
+		pq.matchers = append(pq.matchers, q.Gte("Rating", min))
+	}
+
+	switch v := values.Get("orientation"); v {
+	case "":
+	case "landscape", "portrait", "square":
+		pq.matchers = append(pq.matchers, shapeMatcher(v))
+	default:
+		orientation, err := strconv.Atoi(v)
+		if _, ok := orientations[orientation]; err != nil || !ok {
+			return nil, errors.New("orientation must be landscape, portrait, square or from 1 to 8")
+		}
+		if orientation == 1 {
+			// photos saved without an orientation are upright
+			pq.matchers = append(pq.matchers, q.In("Orientation", []int{0, 1}))
+		} else {
+			pq.matchers = append(pq.matchers, q.Eq("Orientation", orientation))
+		}
+	}
+
+	if err := pq.addTagMatchers(values); err != nil {
+		return nil, err
+	}
+
+	if v := values.Get("cursor"); v != "" {
+		if err := pq.setCursor(v); err != nil {
+			return nil, err
+		}
+	}
+	return pq, nil
+}
+
+// addTagMatchers adds the matchers for the tag parameters. tag is the same as tags,
+// and is kept for the clients that used it to find tags containing it.
+func (pq *photoQuery) addTagMatchers(values url.Values) error {
+	prefix := false
+	switch values.Get("tag_match") {
+	case "", "exact":
+	case "prefix":
+		prefix = true
+	default:
+		return errors.New("tag_match must be exact or prefix")
+	}
+	slugs := func(param string) ([]string, error) {
+		slugs := []string{}
+		for _, tag := range values[param] {
+			slug := TagSlug(tag)
+			if slug == "" {
+				return nil, fmt.Errorf("invalid %s", param)
+			}
+			slugs = append(slugs, slug)
+		}
+		return slugs, nil
+	}
+
+	albums, err := slugs("album")
+	if err != nil {
+		return err
+	}
+	for _, slug := range albums {
+		pq.matchers = append(pq.matchers, q.NewFieldMatcher("Albums", &TagMatcher{Slugs: []string{slug}}))
+	}
+
+	for _, param := range []string{"tag", "tags"} {
+		all, err := slugs(param)
+		if err != nil {
+			return err
+		}
+		for _, slug := range all {
+			pq.matchers = append(pq.matchers, q.NewFieldMatcher("Tags", &TagMatcher{Slugs: []string{slug}, Prefix: prefix}))
+		}
+	}
+	any, err := slugs("any_tags")
+	if err != nil {
+		return err
+	}
+	if len(any) > 0 {
+		pq.matchers = append(pq.matchers, q.NewFieldMatcher("Tags", &TagMatcher{Slugs: any, Prefix: prefix}))
+	}
+	none, err := slugs("not_tags")
+	if err != nil {
+		return err
+	}
+	if len(none) > 0 {
+		pq.matchers = append(pq.matchers, q.Not(q.NewFieldMatcher("Tags", &TagMatcher{Slugs: none, Prefix: prefix})))
+	}
+	return nil
+}
+
+func parseTimeParam(r *http.Request, param string) (*time.Time, error) {
+	v := r.URL.Query().Get(param)
+	if v == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s, must be an RFC 3339 time", param)
+	}
+	return &t, nil
+}
+
+// setCursor starts the query after the photo a cursor refers to. The cursor must come
+// from a query in the same order.
+func (pq *photoQuery) setCursor(encoded string) error {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return InvalidCursor
+	}
+	var cursor photoCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return InvalidCursor
+	}
+	if cursor.Sort != pq.sort || cursor.Desc != pq.desc || cursor.ID == "" {
+		return InvalidCursor
+	}
+	value := reflect.New(reflect.TypeOf(Photo{}).Field(pq.field).Type)
+	if err := json.Unmarshal(cursor.Value, value.Interface()); err != nil {
+		return InvalidCursor
+	}
+	pq.cursor = &cursor
+	pq.after = value.Elem()
+	return nil
+}
+
+// encodeCursor returns the cursor for the page after photo.
+func (pq *photoQuery) encodeCursor(photo Photo) string {
+	value, err := json.Marshal(reflect.ValueOf(photo).Field(pq.field).Interface())
+	if err != nil {
+		return ""
+	}
+	data, err := json.Marshal(photoCursor{
+		Sort:  pq.sort,
+		Desc:  pq.desc,
+		Value: value,
+		ID:    photo.ID,
+	})
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// compare orders a photo against a photo with the given sort value and ID.
+func (pq *photoQuery) compare(photo Photo, value reflect.Value, id string) int {
+	c := compareValues(reflect.ValueOf(photo).Field(pq.field), value)
+	if c == 0 {
+		c = strings.Compare(photo.ID, id)
+	}
+	if pq.desc {
+		return -c
+	}
+	return c
+}
+
+// find returns a page of the photos that match the query and the given matchers, and
+// the cursor for the next page if there is one. Photos after the cursor are found by
+// a matcher, and storm sorts them and keeps one more than the page, which tells
+// whether there's a page after it. Ties are broken by ID, which cursors rely on.
+func (pq *photoQuery) find(db PhotoDB, matchers ...q.Matcher) ([]Photo, string, error) {
+	all := make([]q.Matcher, 0, len(pq.matchers)+len(matchers)+1)
+	all = append(all, matchers...)
+	all = append(all, pq.matchers...)
+	if pq.cursor != nil {
+		all = append(all, cursorMatcher{pq})
+	}
+
+	query := db.Select(all...).OrderBy(reflect.TypeOf(Photo{}).Field(pq.field).Name, "ID")
+	if pq.desc {
+		query = query.Reverse()
+	}
+	if pq.cursor == nil && pq.start > 0 {
+		query = query.Skip(pq.start)
+	}
+	var photos []Photo
+	if err := query.Limit(pq.limit + 1).Find(&photos); err != nil && err != storm.ErrNotFound {
+		return nil, "", err
+	}
+	// the page is in storm's order, and is sorted again so photos without a time come
+	// first, the way the cursor matcher compares them
+	sort.Slice(photos, func(i, j int) bool {
+		other := photos[j]
+		return pq.compare(photos[i], reflect.ValueOf(other).Field(pq.field), other.ID) < 0
+	})
+
+	next := ""
+	if len(photos) > pq.limit {
+		photos = photos[:pq.limit]
+		next = pq.encodeCursor(photos[len(photos)-1])
+	}
+	if len(photos) == 0 {
+		photos = []Photo{}
+	}
+	return photos, next, nil
+}
+
+// compareValues orders two values of a sortable field. Photos without a time come
+// before those with one.
+func compareValues(a, b reflect.Value) int {
+	switch a.Kind() {
+	case reflect.Ptr:
+		switch {
+		case a.IsNil() && b.IsNil():
+			return 0
+		case a.IsNil():
+			return -1
+		case b.IsNil():
+			return 1
+		}
+		return compareValues(a.Elem(), b.Elem())
+	case reflect.Struct:
+		at, aok := a.Interface().(time.Time)
+		bt, bok := b.Interface().(time.Time)
+		if !aok || !bok {
+			return 0
+		}
+		switch {
+		case at.Before(bt):
+			return -1
+		case at.After(bt):
+			return 1
+		}
+	case reflect.String:
+		return strings.Compare(a.String(), b.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch {
+		case a.Int() < b.Int():
+			return -1
+		case a.Int() > b.Int():
+			return 1
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		switch {
+		case a.Uint() < b.Uint():
+			return -1
+		case a.Uint() > b.Uint():
+			return 1
+		}
+	case reflect.Float32, reflect.Float64:
+		switch {
+		case a.Float() < b.Float():
+			return -1
+		case a.Float() > b.Float():
+			return 1
+		}
+	case reflect.Bool:
+		if a.Bool() != b.Bool() {
+			if a.Bool() {
+				return 1
+			}
+			return -1
+		}
+	}
+	return 0
+}
+
+/*
+ * Matchers
+ */
+
+// timeRangeMatcher matches times from after, until before. Fields without a time
+// don't match.
+type timeRangeMatcher struct {
+	after  *time.Time
+	before *time.Time
+}
+
+func (m *timeRangeMatcher) MatchField(v interface{}) (bool, error) {
+	t, ok := v.(*time.Time)
+	if !ok {
+		return false, errors.New("failed to convert field")
+	}
+	if t == nil {
+		return false, nil
+	}
+	if m.after != nil && t.Before(*m.after) {
+		return false, nil
+	}
+	if m.before != nil && !t.Before(*m.before) {
+		return false, nil
+	}
+	return true, nil
+}
+
+// cursorMatcher matches the photos after a query's cursor, in the query's order. It
+// compares photos the way they're sorted, where storm's q.Gt and q.Lt match every
+// photo without a time.
+type cursorMatcher struct {
+	pq *photoQuery
+}
+
+func (m cursorMatcher) Match(i interface{}) (bool, error) {
+	photo, ok := reflect.Indirect(reflect.ValueOf(i)).Interface().(Photo)
+	if !ok {
+		return false, errors.New("failed to convert photo")
+	}
+	return m.pq.compare(photo, m.pq.after, m.pq.cursor.ID) > 0, nil
+}
+
+// shapeMatcher matches photos by their shape as they're shown.
+type shapeMatcher string
+
+func (m shapeMatcher) Match(i interface{}) (bool, error) {
+	photo, ok := reflect.Indirect(reflect.ValueOf(i)).Interface().(Photo)
+	if !ok {
+		return false, errors.New("failed to convert photo")
+	}
+	switch m {
+	case "landscape":
+		return photo.Width > photo.Height, nil
+	case "portrait":
+		return photo.Height > photo.Width, nil
+	}
+	return photo.Width == photo.Height, nil
+}
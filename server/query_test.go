@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/asdine/storm/q"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPhotoQueryFilters(t *testing.T) {
+	at := func(day int) *time.Time {
+		t := time.Date(2018, 3, day, 12, 0, 0, 0, time.UTC)
+		return &t
+	}
+	photos := []Photo{
+		{ID: "a", CamMake: "Canon", CamModel: "EOS 5D", TakenAt: at(1), UploadedAt: at(2),
+			Megapixels: 12.5, Width: 40, Height: 30, Tags: []string{"Rugby", "outdoor"}, Rating: 4},
+		{ID: "b", CamMake: "Nikon", CamSerial: "123", TakenAt: at(3), UploadedAt: at(3),
+			Megapixels: 24, Width: 30, Height: 40, Orientation: 6, Tags: []string{"rugby"}},
+		{ID: "c", CamMake: "canon", UploadedAt: at(4), Megapixels: 8, Width: 30, Height: 30,
+			Orientation: 1, Tags: []string{"indoor"}, Rating: 2, Albums: []string{"Home Games"}},
+		{ID: "d", UploadedAt: at(5), Width: 30, Height: 20},
+	}
+
+	cases := []struct {
+		query string
+		ids   []string
+	}{
+		{"", []string{"a", "b", "c", "d"}},
+		{"make=CANON", []string{"a", "c"}},
+		{"make=canon&model=eos%205d", []string{"a"}},
+		{"make=can", []string{}},
+		{"serial=123", []string{"b"}},
+		{"taken_after=2018-03-01T12:00:00Z", []string{"a", "b"}},
+		{"taken_before=2018-03-03T12:00:00Z", []string{"a"}},
+		{"uploaded_after=2018-03-03T00:00:00Z&uploaded_before=2018-03-05T00:00:00Z", []string{"b", "c"}},
+		{"min_megapixels=10", []string{"a", "b"}},
+		{"min_megapixels=10&max_megapixels=20", []string{"a"}},
+		{"orientation=landscape", []string{"a", "d"}},
+		{"orientation=portrait", []string{"b"}},
+		{"orientation=square", []string{"c"}},
+		{"orientation=6", []string{"b"}},
+		{"orientation=1", []string{"a", "c", "d"}},
+		{"tags=rugby", []string{"a", "b"}},
+		{"tags=rugby&tags=outdoor", []string{"a"}},
+		{"any_tags=outdoor&any_tags=indoor", []string{"a", "c"}},
+		{"not_tags=rugby", []string{"c", "d"}},
+		{"tags=rugby&not_tags=OUTDOOR", []string{"b"}},
+		{"tag=door", []string{}},
+		{"tag=Outdoor", []string{"a"}},
+		{"tags=rug&tag_match=prefix", []string{"a", "b"}},
+		{"not_tags=in&tag_match=prefix", []string{"a", "b", "d"}},
+		{"min_rating=2", []string{"a", "c"}},
+		{"min_rating=3", []string{"a"}},
+		{"album=home-games", []string{"c"}},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/?"+c.query, nil)
+		pq, err := parsePhotoQuery(r)
+		require.Nil(t, err, c.query)
+
+		matcher := q.And(append(pq.matchers, q.True())...)
+		ids := []string{}
+		for _, photo := range photos {
+			ok, err := matcher.Match(&photo)
+			require.Nil(t, err, c.query)
+			if ok {
+				ids = append(ids, photo.ID)
+			}
+		}
+		assert.EqualValues(t, c.ids, ids, c.query)
+	}
+
+	for _, query := range []string{
+		"limit=0",
+		"start=-1",
+		"sort=tags",
+		"sort=lat",
+		"order=up",
+		"taken_after=yesterday",
+		"min_megapixels=lots",
+		"orientation=9",
+		"orientation=sideways",
+		"cursor=nope",
+		"tag_match=fuzzy",
+		"tags=%21",
+		"min_rating=6",
+	} {
+		r := httptest.NewRequest("GET", "/?"+query, nil)
+		_, err := parsePhotoQuery(r)
+		assert.NotNil(t, err, query)
+	}
+}
+
+func TestPhotoQueryPages(t *testing.T) {
+	s, db, qu := prepareMockServer(t)
+
+	at := func(day int) *time.Time {
+		t := time.Date(2018, 3, day, 12, 0, 0, 0, time.UTC)
+		return &t
+	}
+	photos := []Photo{
+		{ID: "b", TakenAt: at(2), Megapixels: 12},
+		{ID: "d", Megapixels: 8},
+		{ID: "a", TakenAt: at(2), Megapixels: 24},
+		{ID: "c", TakenAt: at(1), Megapixels: 12},
+	}
+	var matchers []q.Matcher
+	db.On("Select", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		matchers = args.Get(0).([]q.Matcher)
+	}).Return(qu)
+	qu.On("Find", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		found := []Photo{}
+		for i := range photos {
+			ok, err := q.And(matchers...).Match(&photos[i])
+			require.Nil(t, err)
+			if ok {
+				found = append(found, photos[i])
+			}
+		}
+		*args.Get(0).(*[]Photo) = found
+	}).Return(nil)
+
+	get := func(query string) GetPhotoIDsResponse {
+		r := httptest.NewRequest("GET", "/?"+query, nil)
+		w := httptest.NewRecorder()
+		s.GetPhotoIDs(w, r)
+		require.EqualValues(t, 200, w.Code, query)
+		var v GetPhotoIDsResponse
+		err := json.Unmarshal(w.Body.Bytes(), &v)
+		require.Nil(t, err)
+		return v
+	}
+
+	// photos without a time taken come first, and ties are broken by ID
+	v := get("limit=10")
+	assert.EqualValues(t, []string{"d", "c", "a", "b"}, v.IDs)
+	assert.Empty(t, v.NextCursor)
+	v = get("sort=megapixels&order=desc&limit=10")
+	assert.EqualValues(t, []string{"a", "c", "b", "d"}, v.IDs)
+
+	v = get("sort=taken_at&order=desc&limit=2")
+	assert.EqualValues(t, []string{"b", "a"}, v.IDs)
+	require.NotEmpty(t, v.NextCursor)
+	cursor := v.NextCursor
+	// one more than the page is asked for, to tell whether there's a page after it
+	qu.AssertCalled(t, "Limit", 3)
+	qu.AssertCalled(t, "Reverse")
+
+	// new photos don't shift the pages after them
+	photos = append(photos, Photo{ID: "e", TakenAt: at(3)}, Photo{ID: "f", TakenAt: at(2)})
+	v = get("sort=taken_at&order=desc&limit=2&cursor=" + cursor)
+	assert.EqualValues(t, []string{"c", "d"}, v.IDs)
+	assert.Empty(t, v.NextCursor)
+
+	// the last photo on a page can be gone by the time the next is asked for
+	photos = photos[:1]
+	v = get("sort=taken_at&order=desc&limit=2&cursor=" + cursor)
+	assert.Empty(t, v.IDs)
+
+	// cursors only work in the order they came from
+	r := httptest.NewRequest("GET", "/?sort=taken_at&limit=2&cursor="+cursor, nil)
+	w := httptest.NewRecorder()
+	s.GetPhotoIDs(w, r)
+	assert.EqualValues(t, 400, w.Code)
+}
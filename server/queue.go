@@ -0,0 +1,414 @@
+package server
+
+import (
+	"context"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/kochman/hotshots/log"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+/*
+ * Processing queue
+ *
+ * Uploaded photos are written to the queue folder and processed by a fixed number
+ * of workers, so that a burst of uploads doesn't hold every photo in memory at once.
+ * Jobs are kept in the database, so photos still queued when the server stops are
+ * processed once it starts again. A job is removed when its photo has been processed.
+ * When processing fails the job is kept along with the error, and so is the upload,
+ * so that the photo can be reprocessed. A photo that fails to be reprocessed is left
+ * as it was, with the error on its job.
+ */
+
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobFailed  = "failed"
+)
+
+type Job struct {
+	PhotoID string `storm:"id" json:"photo_id"`
+	Status  string `storm:"index" json:"status"`
+	Error   string `json:"error,omitempty"`
+	// Whether the photo was processed before, and has its original stored
+	Reprocess  bool       `json:"reprocess"`
+	QueuedAt   *time.Time `storm:"index" json:"queued_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// JobStatus is a job along with how far it is from being processed.
+type JobStatus struct {
+	Job
+	// Queued jobs ahead of this one
+	Position   int `json:"position"`
+	QueueDepth int `json:"queue_depth"`
+}
+
+type QueueResponse struct {
+	Success bool `json:"success"`
+	Workers int  `json:"workers"`
+	Queued  int  `json:"queued"`
+	Running int  `json:"running"`
+	Failed  int  `json:"failed"`
+	// Running jobs, then queued ones in the order they'll be processed
+	Jobs []Job `json:"jobs"`
+}
+
+// processingQueue lets idle workers know about new jobs.
+type processingQueue struct {
+	// held while claiming a job, so that two workers don't get the same one
+	mu   sync.Mutex
+	wake chan struct{}
+}
+
+func newProcessingQueue() *processingQueue {
+	return &processingQueue{wake: make(chan struct{}, 1)}
+}
+
+func (p *processingQueue) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Server) queuePath(id string) string {
+	return path.Join(s.cfg.QueueFolder(), id)
+}
+
+// queuePhoto copies a photo's upload to the queue folder and queues it for processing.
+func (s *Server) queuePhoto(id string, input io.ReadSeeker, reprocess bool) error {
+	if _, err := input.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.queuePath(id), input); err != nil {
+		return err
+	}
+
+	if err := s.queueJob(id, reprocess); err != nil {
+		os.Remove(s.queuePath(id))
+		return err
+	}
+	return nil
+}
+
+// queueFile moves a photo's upload to the queue folder and queues it for processing.
+// The upload is left where it was if it can't be queued.
+func (s *Server) queueFile(id string, file string) error {
+	if err := os.Rename(file, s.queuePath(id)); err != nil {
+		return err
+	}
+	if err := s.queueJob(id, false); err != nil {
+		if err := os.Rename(s.queuePath(id), file); err != nil {
+			log.Error(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// queueJob queues a photo whose upload is in the queue folder for processing.
+func (s *Server) queueJob(id string, reprocess bool) error {
+	now := time.Now()
+	job := Job{
+		PhotoID:   id,
+		Status:    JobQueued,
+		Reprocess: reprocess,
+		QueuedAt:  &now,
+	}
+	if err := s.db.Save(&job); err != nil {
+		return err
+	}
+	s.queue.notify()
+	return nil
+}
+
+// findJobs returns the jobs with a status, oldest first.
+func (s *Server) findJobs(status string) ([]Job, error) {
+	jobs := []Job{}
+	if err := s.db.Find("Status", status, &jobs); err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return jobs[i].QueuedAt.Before(*jobs[j].QueuedAt)
+	})
+	return jobs, nil
+}
+
+// jobStatus returns the job for a photo, if it has one.
+func (s *Server) jobStatus(id string) (*JobStatus, error) {
+	var job Job
+	if err := s.db.One("PhotoID", id, &job); err == storm.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	queued, err := s.findJobs(JobQueued)
+	if err != nil {
+		return nil, err
+	}
+	status := &JobStatus{Job: job, QueueDepth: len(queued)}
+	for i, other := range queued {
+		if other.PhotoID == id {
+			status.Position = i
+		}
+	}
+	return status, nil
+}
+
+// nextJob claims the oldest queued job.
+func (s *Server) nextJob() (Job, bool, error) {
+	s.queue.mu.Lock()
+	defer s.queue.mu.Unlock()
+
+	jobs, err := s.findJobs(JobQueued)
+	if err != nil || len(jobs) == 0 {
+		return Job{}, false, err
+	}
+
+	job := jobs[0]
+	now := time.Now()
+	job.Status = JobRunning
+	job.StartedAt = &now
+	if err := s.db.Save(&job); err != nil {
+		return Job{}, false, err
+	}
+
+	// another worker may be idle
+	if len(jobs) > 1 {
+		s.queue.notify()
+	}
+	return job, true, nil
+}
+
+// processJobs is a worker, which processes queued photos until ctx is done.
+func (s *Server) processJobs(ctx context.Context) {
+	for ctx.Err() == nil {
+		job, ok, err := s.nextJob()
+		if err != nil {
+			log.Error(err)
+		} else if ok {
+			s.processJob(job)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-s.queue.wake:
+		}
+	}
+}
+
+func (s *Server) processJob(job Job) {
+	photo, err := s.GetPhotoFromDatabase(job.PhotoID)
+	if err == storm.ErrNotFound {
+		// replaced or paired since it was queued
+		s.finishJob(job, nil)
+		return
+	} else if err != nil {
+		log.Error(err)
+		s.finishJob(job, err)
+		return
+	}
+	// processed before the server last stopped
+	if photo.Status != Processing && !job.Reprocess {
+		s.finishJob(job, nil)
+		return
+	}
+
+	err = s.processPhoto(photo, job.Reprocess)
+	if err != nil && job.Reprocess {
+		log.WithError(err).Errorf("unable to reprocess %s", photo.ID)
+	} else if err != nil {
+		log.Error(err)
+		photo.UpdateStatus(ProcessingFailed)
+		if err := s.db.Update(&photo); err != nil {
+			log.Error(err)
+		}
+		s.publish(EventPhotoFailed, photo, "")
+	}
+	s.finishJob(job, err)
+}
+
+// processPhoto makes the display image and thumbnail for a queued photo and stores
+// them with its original. Photos that are reprocessed already have their original
+// stored, which is left alone.
+func (s *Server) processPhoto(photo Photo, reprocess bool) error {
+	id := photo.ID
+	input, err := os.Open(s.queuePath(id))
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	// files are processed locally before going to the store
+	work, err := ioutil.TempDir(s.cfg.UploadFolder(), "processing-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(work)
+
+	keys := []string{PhotoKey(id), ThumbKey(id)}
+	photoPath := path.Join(work, PhotoKey(id))
+	thumbPath := path.Join(work, ThumbKey(id))
+
+	var xif *exif.Exif
+	var rect *image.Rectangle
+	if IsRaw(photo.Format) {
+		keys = append(keys, OriginalKey(id, photo.Format))
+		originalPath := path.Join(work, OriginalKey(id, photo.Format))
+		var info os.FileInfo
+		if info, err = input.Stat(); err == nil {
+			xif, rect, err = ProcessRaw(input, info.Size(), photo.Format, id, originalPath, photoPath, thumbPath)
+		}
+	} else if photo.Format == FormatJPEG {
+		xif, rect, err = ProcessPhoto(input, id, photoPath, thumbPath, s.timeout)
+	} else {
+		err = UnsupportedFormat
+	}
+	if err != nil {
+		return err
+	}
+
+	photo.AddMetadata(rect, xif)
+	if photo.Format == FormatJPEG {
+		// the display image of a JPEG is its original
+		if err := addIPTC(&photo, photoPath); err != nil {
+			log.Info("unable to read IPTC for ", id, ": ", err)
+		}
+	}
+	if photo.Rotation != 0 {
+		// the thumbnail is turned the way the photo was rotated by hand
+		display, err := os.Open(photoPath)
+		if err != nil {
+			return err
+		}
+		err = thumbFrom(display, photo.displayOrientation(), thumbPath)
+		display.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if reprocess {
+		original := PhotoKey(id)
+		if IsRaw(photo.Format) {
+			original = OriginalKey(id, photo.Format)
+		}
+		for i, key := range keys {
+			if key == original {
+				keys = append(keys[:i], keys[i+1:]...)
+				break
+			}
+		}
+		// cached renditions are of the previous display image
+		s.deleteFiles(s.renditionKeys(id)...)
+		if err := s.replaceFiles(work, keys...); err != nil {
+			return err
+		}
+	} else if err := s.storeFiles(work, keys...); err != nil {
+		return err
+	}
+
+	photo.UpdateStatus(ProcessingSucceeded)
+
+	if err := s.db.Update(&photo); err != nil {
+		// the files of a reprocessed photo replaced ones it still needs
+		if !reprocess {
+			s.deleteFiles(keys...)
+		}
+		return err
+	}
+	s.publish(EventPhotoProcessed, photo, "")
+
+	s.pairSibling(photo)
+	return nil
+}
+
+// finishJob removes a job and its upload, unless it failed.
+func (s *Server) finishJob(job Job, err error) {
+	if err == nil {
+		if err := os.Remove(s.queuePath(job.PhotoID)); err != nil && !os.IsNotExist(err) {
+			log.Error(err)
+		}
+		if err := s.db.DeleteStruct(&job); err != nil {
+			log.Error(err)
+		}
+		return
+	}
+
+	now := time.Now()
+	job.Status = JobFailed
+	job.Error = err.Error()
+	job.FinishedAt = &now
+	if err := s.db.Save(&job); err != nil {
+		log.Error(err)
+	}
+}
+
+// requeueJobs queues jobs again that were running when the server last stopped, or
+// fails them if their upload is gone.
+func (s *Server) requeueJobs() error {
+	jobs, err := s.findJobs(JobRunning)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		job.StartedAt = nil
+		if _, err := os.Stat(s.queuePath(job.PhotoID)); err == nil {
+			log.Infof("re-queuing %s, which was processing when the server stopped", job.PhotoID)
+			job.Status = JobQueued
+		} else {
+			now := time.Now()
+			job.Status = JobFailed
+			job.Error = "upload missing after the server stopped"
+			job.FinishedAt = &now
+		}
+		if err := s.db.Save(&job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Handlers
+ */
+
+func (s *Server) GetQueue(w http.ResponseWriter, r *http.Request) {
+	v := QueueResponse{
+		Success: true,
+		Workers: s.cfg.ProcessingWorkers,
+		Jobs:    []Job{},
+	}
+	for _, status := range []string{JobRunning, JobQueued, JobFailed} {
+		jobs, err := s.findJobs(status)
+		if err != nil {
+			log.Error(err)
+			WriteError("unable to read from database", 500, w)
+			return
+		}
+		switch status {
+		case JobRunning:
+			v.Running = len(jobs)
+		case JobQueued:
+			v.Queued = len(jobs)
+		case JobFailed:
+			v.Failed = len(jobs)
+			continue
+		}
+		v.Jobs = append(v.Jobs, jobs...)
+	}
+	WriteJsonResponse(&v, 200, w)
+}
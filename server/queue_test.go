@@ -0,0 +1,237 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// mockQueue makes the database return jobs, which are given in no particular order.
+func mockQueue(db *MockDB, running []Job, queued []Job) {
+	for status, jobs := range map[string][]Job{JobRunning: running, JobQueued: queued} {
+		jobs := jobs
+		db.On("Find", "Status", status, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			*args.Get(2).(*[]Job) = append([]Job{}, jobs...)
+		}).Return(nil)
+	}
+	db.On("Find", "Status", JobFailed, mock.Anything, mock.Anything).Return(storm.ErrNotFound)
+}
+
+func queuedAt(minutes int) *time.Time {
+	t := time.Date(2018, 4, 1, 12, minutes, 0, 0, time.UTC)
+	return &t
+}
+
+func TestQueuePhoto(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+	defer os.RemoveAll(s.cfg.PhotosDirectory)
+	db.On("Save", mock.Anything).Return(nil)
+
+	input := bytes.NewReader([]byte("photo"))
+	input.Seek(3, 0)
+	err := s.queuePhoto("1234", input, false)
+	require.Nil(t, err)
+
+	// the whole upload is kept until it's processed
+	data, err := ioutil.ReadFile(s.queuePath("1234"))
+	require.Nil(t, err)
+	assert.EqualValues(t, "photo", data)
+
+	job := db.Calls[0].Arguments.Get(0).(*Job)
+	assert.EqualValues(t, "1234", job.PhotoID)
+	assert.EqualValues(t, JobQueued, job.Status)
+	assert.NotNil(t, job.QueuedAt)
+
+	// and a worker is woken up
+	assert.Len(t, s.queue.wake, 1)
+}
+
+func TestNextJob(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+	defer os.RemoveAll(s.cfg.PhotosDirectory)
+	mockQueue(db, nil, []Job{
+		{PhotoID: "2", Status: JobQueued, QueuedAt: queuedAt(2)},
+		{PhotoID: "1", Status: JobQueued, QueuedAt: queuedAt(1)},
+	})
+	db.On("Save", mock.Anything).Return(nil)
+
+	job, ok, err := s.nextJob()
+	require.Nil(t, err)
+	require.True(t, ok)
+	assert.EqualValues(t, "1", job.PhotoID)
+	assert.EqualValues(t, JobRunning, job.Status)
+	assert.NotNil(t, job.StartedAt)
+	assert.EqualValues(t, &job, db.Calls[1].Arguments.Get(0))
+
+	// another worker is woken up for the rest
+	assert.Len(t, s.queue.wake, 1)
+}
+
+func TestNextJobEmpty(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+	defer os.RemoveAll(s.cfg.PhotosDirectory)
+	db.On("Find", "Status", JobQueued, mock.Anything, mock.Anything).Return(storm.ErrNotFound)
+
+	_, ok, err := s.nextJob()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Len(t, s.queue.wake, 0)
+}
+
+func TestProcessJobFailed(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+	defer os.RemoveAll(s.cfg.PhotosDirectory)
+
+	err := os.Mkdir(s.cfg.UploadFolder(), 0775)
+	require.Nil(t, err)
+	err = ioutil.WriteFile(s.queuePath("1234"), []byte("not a photo"), 0660)
+	require.Nil(t, err)
+
+	db.On("One", "ID", "1234", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*Photo) = Photo{ID: "1234", Status: Processing}
+	}).Return(nil)
+	db.On("Update", mock.Anything).Return(nil)
+	db.On("All", mock.Anything, mock.Anything).Return(nil)
+	db.On("Save", mock.Anything).Return(nil)
+
+	s.processJob(Job{PhotoID: "1234", Status: JobRunning, QueuedAt: queuedAt(1)})
+
+	// the photo fails
+	db.AssertNumberOfCalls(t, "Update", 1)
+	photo := db.Calls[1].Arguments.Get(0).(*Photo)
+	assert.EqualValues(t, ProcessingFailed, photo.Status)
+
+	// and so does the job, which keeps the error
+	job := db.Calls[len(db.Calls)-1].Arguments.Get(0).(*Job)
+	assert.EqualValues(t, JobFailed, job.Status)
+	assert.EqualValues(t, UnsupportedFormat.Error(), job.Error)
+	assert.NotNil(t, job.FinishedAt)
+
+	// the upload is kept to reprocess it from
+	_, err = os.Stat(s.queuePath("1234"))
+	assert.Nil(t, err)
+}
+
+func TestProcessJobReprocessFailed(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+	defer os.RemoveAll(s.cfg.PhotosDirectory)
+
+	err := os.Mkdir(s.cfg.UploadFolder(), 0775)
+	require.Nil(t, err)
+	err = ioutil.WriteFile(s.queuePath("1234"), []byte("not a photo"), 0660)
+	require.Nil(t, err)
+	for _, key := range []string{PhotoKey("1234"), ThumbKey("1234")} {
+		err := ioutil.WriteFile(path.Join(s.cfg.ImgFolder(), key), []byte("processed"), 0660)
+		require.Nil(t, err)
+	}
+
+	db.On("One", "ID", "1234", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*Photo) = Photo{ID: "1234", Format: FormatJPEG, Status: ProcessingSucceeded}
+	}).Return(nil)
+	db.On("Save", mock.Anything).Return(nil)
+
+	s.processJob(Job{PhotoID: "1234", Status: JobRunning, Reprocess: true, QueuedAt: queuedAt(1)})
+
+	// the photo is left as it was, without an event for it
+	db.AssertNotCalled(t, "Update", mock.Anything)
+	db.AssertNotCalled(t, "All", mock.Anything, mock.Anything)
+	for _, key := range []string{PhotoKey("1234"), ThumbKey("1234")} {
+		data, err := ioutil.ReadFile(path.Join(s.cfg.ImgFolder(), key))
+		require.Nil(t, err)
+		assert.EqualValues(t, "processed", data)
+	}
+
+	// and the job fails with the error
+	job := db.Calls[len(db.Calls)-1].Arguments.Get(0).(*Job)
+	assert.EqualValues(t, JobFailed, job.Status)
+	assert.NotEmpty(t, job.Error)
+	assert.True(t, job.Reprocess)
+}
+
+func TestProcessJobAlreadyProcessed(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+	defer os.RemoveAll(s.cfg.PhotosDirectory)
+
+	db.On("One", "ID", "1234", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*Photo) = Photo{ID: "1234", Status: ProcessingSucceeded}
+	}).Return(nil)
+	db.On("DeleteStruct", mock.Anything).Return(nil)
+
+	s.processJob(Job{PhotoID: "1234", Status: JobRunning, QueuedAt: queuedAt(1)})
+	db.AssertNumberOfCalls(t, "DeleteStruct", 1)
+	assert.EqualValues(t, "1234", db.Calls[1].Arguments.Get(0).(*Job).PhotoID)
+}
+
+func TestJobStatus(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+	defer os.RemoveAll(s.cfg.PhotosDirectory)
+
+	queued := []Job{
+		{PhotoID: "3", Status: JobQueued, QueuedAt: queuedAt(3)},
+		{PhotoID: "1", Status: JobQueued, QueuedAt: queuedAt(1)},
+		{PhotoID: "2", Status: JobQueued, QueuedAt: queuedAt(2)},
+	}
+	mockQueue(db, nil, queued)
+	db.On("One", "PhotoID", "3", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*Job) = queued[0]
+	}).Return(nil)
+	db.On("One", "PhotoID", mock.Anything, mock.Anything).Return(storm.ErrNotFound)
+
+	r := MockPhotoCtx(Photo{ID: "3", Status: Processing})
+	w := httptest.NewRecorder()
+	s.GetPhotoMetadata(w, r)
+	require.EqualValues(t, 200, w.Code)
+
+	var v GetPhotoMetadataResponse
+	err := json.Unmarshal(w.Body.Bytes(), &v)
+	require.Nil(t, err)
+	require.NotNil(t, v.Job)
+	assert.EqualValues(t, JobQueued, v.Job.Status)
+	assert.EqualValues(t, 2, v.Job.Position)
+	assert.EqualValues(t, 3, v.Job.QueueDepth)
+
+	status, err := s.jobStatus("4")
+	assert.Nil(t, err)
+	assert.Nil(t, status)
+}
+
+func TestGetQueue(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+	defer os.RemoveAll(s.cfg.PhotosDirectory)
+	s.cfg.ProcessingWorkers = 2
+
+	mockQueue(db, []Job{
+		{PhotoID: "1", Status: JobRunning, QueuedAt: queuedAt(1)},
+	}, []Job{
+		{PhotoID: "3", Status: JobQueued, QueuedAt: queuedAt(3)},
+		{PhotoID: "2", Status: JobQueued, QueuedAt: queuedAt(2)},
+	})
+
+	r := httptest.NewRequest("GET", "/admin/queue", nil)
+	w := httptest.NewRecorder()
+	s.GetQueue(w, r)
+	require.EqualValues(t, 200, w.Code)
+
+	var v QueueResponse
+	err := json.Unmarshal(w.Body.Bytes(), &v)
+	require.Nil(t, err)
+	assert.EqualValues(t, 2, v.Workers)
+	assert.EqualValues(t, 1, v.Running)
+	assert.EqualValues(t, 2, v.Queued)
+	assert.EqualValues(t, 0, v.Failed)
+	ids := []string{}
+	for _, job := range v.Jobs {
+		ids = append(ids, job.PhotoID)
+	}
+	assert.EqualValues(t, []string{"1", "2", "3"}, ids)
+}
@@ -0,0 +1,333 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/kochman/hotshots/log"
+	"github.com/nfnt/resize"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+/*
+ * RAW and HEIF support
+ *
+ * Go can't decode RAW sensor data or HEVC, so the original is stored untouched and
+ * the display image and thumbnail are built from something else: the JPEG preview
+ * that cameras embed in RAW files, and the HEIF image decoded by libheif.
+ */
+
+// Formats of stored originals, named after their usual file extension.
+const (
+	FormatJPEG = "jpg"
+	FormatCR2  = "cr2"
+	FormatCR3  = "cr3"
+	FormatNEF  = "nef"
+	FormatARW  = "arw"
+	FormatDNG  = "dng"
+	FormatHEIC = "heic"
+)
+
+var (
+	UnsupportedFormat = errors.New("unsupported file format")
+	NoPreview         = errors.New("no embedded preview found")
+)
+
+// scanChunkSize is how much of a file is searched for embedded data at a time.
+const scanChunkSize = 1 << 20 // 1M
+
+// maxExifLength is how much of a file is read for its EXIF data, which cameras keep
+// near the start, so that the sensor data isn't read into memory as well.
+const maxExifLength = 1 << 24 // 16M
+
+var contentTypes = map[string]string{
+	FormatJPEG: "image/jpeg",
+	FormatCR2:  "image/x-canon-cr2",
+	FormatCR3:  "image/x-canon-cr3",
+	FormatNEF:  "image/x-nikon-nef",
+	FormatARW:  "image/x-sony-arw",
+	FormatDNG:  "image/x-adobe-dng",
+	FormatHEIC: "image/heic",
+}
+
+// IsRaw returns whether format is stored alongside a preview rather than displayed directly.
+func IsRaw(format string) bool {
+	_, ok := contentTypes[format]
+	return ok && format != FormatJPEG
+}
+
+// ContentType returns the MIME type of an original in the given format.
+func ContentType(format string) string {
+	if t, ok := contentTypes[format]; ok {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// DetectFormat identifies the format of an original from its first bytes. TIFF-based
+// RAW formats all share a signature, so the uploaded filename is used to tell them apart.
+func DetectFormat(input io.ReadSeeker, filename string) (string, error) {
+	header := make([]byte, 12)
+	n, err := io.ReadFull(input, header)
+	if _, err := input.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	header = header[:n]
+
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(filename)), ".")
+	switch {
+	case bytes.HasPrefix(header, []byte{0xFF, 0xD8, 0xFF}):
+		return FormatJPEG, nil
+	case bytes.HasPrefix(header, []byte("II*\x00")) || bytes.HasPrefix(header, []byte("MM\x00*")):
+		if len(header) >= 10 && string(header[8:10]) == "CR" {
+			return FormatCR2, nil
+		}
+		switch ext {
+		case FormatNEF, FormatARW, FormatDNG:
+			return ext, nil
+		}
+	case len(header) == 12 && string(header[4:8]) == "ftyp":
+		switch string(header[8:12]) {
+		case "crx ":
+			return FormatCR3, nil
+		case "heic", "heix", "hevc", "hevx", "mif1", "msf1":
+			return FormatHEIC, nil
+		}
+	}
+	return "", UnsupportedFormat
+}
+
+// Original returns the ID and format of the file a photo was shot as, preferring
+// a paired RAW over the JPEG.
+func (p *Photo) Original() (string, string) {
+	if p.RawID != "" {
+		return p.RawID, p.RawFormat
+	}
+	if p.Format == "" {
+		return p.ID, FormatJPEG
+	}
+	return p.ID, p.Format
+}
+
+// findSignature calls found with the offset of each place signature appears in the
+// first size bytes of input, until found returns false.
+func findSignature(input io.ReaderAt, size int64, signature []byte, found func(offset int64) bool) error {
+	// chunks overlap so that signatures spanning two of them are still found
+	buf := make([]byte, scanChunkSize+len(signature)-1)
+	for start := int64(0); start < size; start += scanChunkSize {
+		chunk := buf
+		if remaining := size - start; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		n, err := input.ReadAt(chunk, start)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		chunk = chunk[:n]
+
+		for i := 0; i < len(chunk) && i < scanChunkSize; {
+			j := bytes.Index(chunk[i:], signature)
+			if j < 0 || i+j >= scanChunkSize {
+				break
+			}
+			if !found(start + int64(i+j)) {
+				return nil
+			}
+			i += j + 1
+		}
+	}
+	return nil
+}
+
+// FindPreview returns the largest JPEG embedded in the first size bytes of input.
+func FindPreview(input io.ReaderAt, size int64) (image.Image, error) {
+	best, bestArea := int64(-1), 0
+	err := findSignature(input, size, []byte{0xFF, 0xD8, 0xFF}, func(offset int64) bool {
+		// lossless JPEG sensor data fails here, as do chance matches in other data
+		if cfg, err := jpeg.DecodeConfig(io.NewSectionReader(input, offset, size-offset)); err == nil {
+			if area := cfg.Width * cfg.Height; area > bestArea {
+				best, bestArea = offset, area
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if best < 0 {
+		return nil, NoPreview
+	}
+	return jpeg.Decode(io.NewSectionReader(input, best, size-best))
+}
+
+// GetRawExif decodes the EXIF data of a RAW or HEIF file of the given size. TIFF-based
+// files can be decoded directly, others keep a TIFF structure inside one of their boxes.
+func GetRawExif(input io.ReaderAt, size int64) (*exif.Exif, error) {
+	decode := func(offset int64) (*exif.Exif, error) {
+		length := size - offset
+		if length > maxExifLength {
+			length = maxExifLength
+		}
+		return exif.Decode(io.NewSectionReader(input, offset, length))
+	}
+
+	x, err := decode(0)
+	if err == nil {
+		return x, nil
+	}
+
+	for _, signature := range [][]byte{[]byte("II*\x00"), []byte("MM\x00*")} {
+		var found *exif.Exif
+		scanErr := findSignature(input, size, signature, func(offset int64) bool {
+			if x, err := decode(offset); err == nil {
+				found = x
+				return false
+			}
+			return true
+		})
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		if found != nil {
+			return found, nil
+		}
+	}
+	return nil, err
+}
+
+// ProcessRaw stores the RAW or HEIF original of the given size at originalPath and
+// saves its preview as the photo and thumbnail.
+func ProcessRaw(input io.ReaderAt, size int64, format string, id string, originalPath string, photoPath string, thumbPath string) (*exif.Exif, *image.Rectangle, error) {
+	log.Infof("saving raw image %s", id)
+
+	if err := writeFileAtomic(originalPath, io.NewSectionReader(input, 0, size)); err != nil {
+		return nil, nil, err
+	}
+
+	x, err := GetRawExif(input, size)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var preview image.Image
+	if format == FormatHEIC {
+		// libheif turns the image the way it's shown, which EXIF only repeats
+		preview, err = DecodeHEIF(input, size)
+	} else if preview, err = FindPreview(input, size); err == nil {
+		// the display image doesn't keep the EXIF orientation, so it's made upright
+		preview = Orient(preview, exifOrientation(x))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	output, err := createAtomic(photoPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer output.Close()
+	if err := jpeg.Encode(output, preview, &jpeg.Options{Quality: 95}); err != nil {
+		return nil, nil, err
+	}
+	if err := output.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	if err := writeThumb(preview, 1, thumbPath); err != nil {
+		return nil, nil, err
+	}
+
+	rect := preview.Bounds()
+	return x, &rect, nil
+}
+
+// writeThumb saves a thumbnail of img, turned by an EXIF orientation.
+func writeThumb(img image.Image, orientation int, path string) error {
+	resizedImg := Orient(resize.Thumbnail(MaxWidth, MaxHeight, img, resize.Bicubic), orientation)
+	output, err := createAtomic(path)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	if err := jpeg.Encode(output, resizedImg, nil); err != nil {
+		return err
+	}
+	return output.Commit()
+}
+
+// filenameStem returns a camera filename without its folder or extension.
+func filenameStem(filename string) string {
+	base := path.Base(filename)
+	return strings.ToLower(strings.TrimSuffix(base, path.Ext(base)))
+}
+
+// IsSibling returns whether a and b are the RAW and JPEG files a camera saved for
+// the same shot, judged by their filename, camera and time taken.
+func IsSibling(a, b Photo) bool {
+	if a.ID == b.ID || a.Filename == "" || a.TakenAt == nil || b.TakenAt == nil {
+		return false
+	}
+	if IsRaw(a.Format) == IsRaw(b.Format) {
+		return false
+	}
+	return filenameStem(a.Filename) == filenameStem(b.Filename) &&
+		a.TakenAt.Equal(*b.TakenAt) &&
+		a.CamSerial == b.CamSerial &&
+		a.CamMake == b.CamMake &&
+		a.CamModel == b.CamModel
+}
+
+// pairSibling merges a freshly processed photo with its RAW or JPEG sibling, so
+// that a shot saved as RAW+JPEG shows up once. The JPEG photo is kept and the RAW
+// photo's original is attached to it.
+func (s *Server) pairSibling(photo Photo) {
+	if photo.TakenAt == nil || photo.RawID != "" {
+		return
+	}
+
+	var candidates []Photo
+	if err := s.db.Find("TakenAt", photo.TakenAt, &candidates); err != nil {
+		return
+	}
+
+	for _, other := range candidates {
+		if other.Status != ProcessingSucceeded || other.RawID != "" || !IsSibling(photo, other) {
+			continue
+		}
+
+		jpg, raw := photo, other
+		if IsRaw(photo.Format) {
+			jpg, raw = other, photo
+		}
+
+		jpg.RawID = raw.ID
+		jpg.RawFormat = raw.Format
+		for _, tag := range raw.Tags {
+			jpg.AddTag(tag)
+		}
+		if err := s.db.Update(&jpg); err != nil {
+			log.Error(err)
+			return
+		}
+		if err := s.db.DeleteStruct(&raw); err != nil {
+			log.Error(err)
+			return
+		}
+
+		// the RAW original stays where it is, only its preview is redundant now
+		s.deleteFiles(append(s.renditionKeys(raw.ID), PhotoKey(raw.ID), ThumbKey(raw.ID))...)
+		s.publish(EventPhotoDeleted, raw, "")
+
+		log.Infof("paired raw %s with %s", raw.ID, jpg.ID)
+		return
+	}
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tiffWithMake builds a minimal little endian TIFF holding only a camera make.
+func tiffWithMake(make string) []byte {
+	value := append([]byte(make), 0)
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("II*\x00")
+	binary.Write(buf, binary.LittleEndian, uint32(8)) // first IFD
+	binary.Write(buf, binary.LittleEndian, uint16(1)) // entries
+	binary.Write(buf, binary.LittleEndian, uint16(0x010F))
+	binary.Write(buf, binary.LittleEndian, uint16(2)) // ASCII
+	binary.Write(buf, binary.LittleEndian, uint32(len(value)))
+	binary.Write(buf, binary.LittleEndian, uint32(26)) // value follows the IFD
+	binary.Write(buf, binary.LittleEndian, uint32(0))  // no next IFD
+	buf.Write(value)
+	return buf.Bytes()
+}
+
+func encodeJPEG(t testing.TB, width, height int) []byte {
+	buf := new(bytes.Buffer)
+	err := jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, width, height)), nil)
+	require.Nil(t, err)
+	return buf.Bytes()
+}
+
+func TestDetectFormat(t *testing.T) {
+	cases := []struct {
+		header   string
+		filename string
+		format   string
+	}{
+		{"\xFF\xD8\xFF\xE1", "IMG_0001.JPG", FormatJPEG},
+		{"\xFF\xD8\xFF\xE1", "", FormatJPEG},
+		{"II*\x00\x10\x00\x00\x00CR\x02\x00", "IMG_0001.CR2", FormatCR2},
+		{"MM\x00*\x00\x00\x00\x08\x00\x00\x00\x00", "DSC_0001.NEF", FormatNEF},
+		{"II*\x00\x08\x00\x00\x00\x00\x00\x00\x00", "DSC00001.ARW", FormatARW},
+		{"II*\x00\x08\x00\x00\x00\x00\x00\x00\x00", "photo.dng", FormatDNG},
+		{"\x00\x00\x00\x18ftypcrx ", "IMG_0001.CR3", FormatCR3},
+		{"\x00\x00\x00\x18ftypheic", "IMG_0001.HEIC", FormatHEIC},
+		{"\x00\x00\x00\x18ftypmif1", "IMG_0001.HEIF", FormatHEIC},
+	}
+	for _, c := range cases {
+		format, err := DetectFormat(bytes.NewReader([]byte(c.header)), c.filename)
+		assert.Nil(t, err, c.filename)
+		assert.EqualValues(t, c.format, format, c.filename)
+	}
+
+	// TIFF-based files need a known extension
+	_, err := DetectFormat(bytes.NewReader([]byte("II*\x00\x08\x00\x00\x00\x00\x00\x00\x00")), "scan.tif")
+	assert.EqualValues(t, UnsupportedFormat, err)
+
+	_, err = DetectFormat(bytes.NewReader([]byte("garbage")), "garbage.jpg")
+	assert.EqualValues(t, UnsupportedFormat, err)
+
+	// the input is rewound for whatever reads it next
+	input := bytes.NewReader([]byte("\xFF\xD8\xFF\xE1 and the rest"))
+	_, err = DetectFormat(input, "")
+	require.Nil(t, err)
+	assert.EqualValues(t, 0, input.Size()-int64(input.Len()))
+}
+
+func TestFindPreview(t *testing.T) {
+	data := tiffWithMake("Canon")
+	data = append(data, []byte("\xFF\xD8\xFF not really a JPEG")...)
+	data = append(data, encodeJPEG(t, 16, 12)...)
+	data = append(data, []byte("sensor data")...)
+	data = append(data, encodeJPEG(t, 64, 48)...)
+	data = append(data, encodeJPEG(t, 32, 24)...)
+
+	preview, err := FindPreview(bytes.NewReader(data), int64(len(data)))
+	require.Nil(t, err)
+	assert.EqualValues(t, image.Rect(0, 0, 64, 48), preview.Bounds())
+
+	_, err = FindPreview(bytes.NewReader(tiffWithMake("Canon")), int64(len(tiffWithMake("Canon"))))
+	assert.EqualValues(t, NoPreview, err)
+
+	// a preview whose signature straddles two chunks of the search is still found
+	data = append(make([]byte, scanChunkSize-1), encodeJPEG(t, 80, 60)...)
+	preview, err = FindPreview(bytes.NewReader(data), int64(len(data)))
+	require.Nil(t, err)
+	assert.EqualValues(t, image.Rect(0, 0, 80, 60), preview.Bounds())
+}
+
+func TestGetRawExif(t *testing.T) {
+	// TIFF-based
+	data := tiffWithMake("Nikon")
+	x, err := GetRawExif(bytes.NewReader(data), int64(len(data)))
+	require.Nil(t, err)
+	tag, err := x.Get(exif.Make)
+	require.Nil(t, err)
+	assert.EqualValues(t, "Nikon\x00", string(tag.Val))
+
+	// TIFF inside a box
+	data = append([]byte("\x00\x00\x00\x18ftypcrx \x00\x00\x00\x00CMT1"), tiffWithMake("Canon")...)
+	x, err = GetRawExif(bytes.NewReader(data), int64(len(data)))
+	require.Nil(t, err)
+	tag, err = x.Get(exif.Make)
+	require.Nil(t, err)
+	assert.EqualValues(t, "Canon\x00", string(tag.Val))
+
+	data = []byte("\x00\x00\x00\x18ftypcrx ")
+	_, err = GetRawExif(bytes.NewReader(data), int64(len(data)))
+	assert.NotNil(t, err)
+}
+
+func TestProcessRaw(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hotshots")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	originalPath := path.Join(dir, "1234.cr2")
+	photoPath := path.Join(dir, "1234.jpg")
+	thumbPath := path.Join(dir, "1234-thumb.jpg")
+
+	data := append(tiffWithMake("Canon"), encodeJPEG(t, 640, 480)...)
+	xif, rect, err := ProcessRaw(bytes.NewReader(data), int64(len(data)), FormatCR2, "1234", originalPath, photoPath, thumbPath)
+	require.Nil(t, err)
+	require.NotNil(t, xif)
+	assert.EqualValues(t, image.Rect(0, 0, 640, 480), *rect)
+
+	original, err := ioutil.ReadFile(originalPath)
+	require.Nil(t, err)
+	assert.EqualValues(t, data, original)
+
+	photo, err := os.Open(photoPath)
+	require.Nil(t, err)
+	defer photo.Close()
+	cfg, err := jpeg.DecodeConfig(photo)
+	require.Nil(t, err)
+	assert.EqualValues(t, 640, cfg.Width)
+
+	thumb, err := os.Open(thumbPath)
+	require.Nil(t, err)
+	defer thumb.Close()
+	cfg, err = jpeg.DecodeConfig(thumb)
+	require.Nil(t, err)
+	assert.EqualValues(t, MaxWidth, cfg.Width)
+
+	// RAW files without a JPEG preview can't be displayed
+	data = tiffWithMake("Canon")
+	_, _, err = ProcessRaw(bytes.NewReader(data), int64(len(data)), FormatCR2, "5678", path.Join(dir, "5678.cr2"), photoPath, thumbPath)
+	assert.EqualValues(t, NoPreview, err)
+
+	// HEIF files are decoded by libheif, which turns away ones that aren't whole
+	data = append([]byte("\x00\x00\x00\x18ftypheic"), tiffWithMake("Apple")...)
+	_, _, err = ProcessRaw(bytes.NewReader(data), int64(len(data)), FormatHEIC, "9abc", path.Join(dir, "9abc.heic"), photoPath, thumbPath)
+	assert.NotNil(t, err)
+}
+
+func TestIsSibling(t *testing.T) {
+	taken := time.Date(2018, 4, 1, 12, 0, 0, 0, time.UTC)
+	later := taken.Add(time.Second)
+
+	jpg := Photo{ID: "1", Format: FormatJPEG, Filename: "IMG_0001.JPG", TakenAt: &taken, CamSerial: "42"}
+	raw := Photo{ID: "2", Format: FormatCR2, Filename: "IMG_0001.CR2", TakenAt: &taken, CamSerial: "42"}
+	assert.True(t, IsSibling(jpg, raw))
+	assert.True(t, IsSibling(raw, jpg))
+
+	// photos from before formats were recorded are JPEGs
+	legacy := jpg
+	legacy.Format = ""
+	assert.True(t, IsSibling(legacy, raw))
+
+	other := raw
+	other.Filename = "IMG_0002.CR2"
+	assert.False(t, IsSibling(jpg, other))
+
+	other = raw
+	other.TakenAt = &later
+	assert.False(t, IsSibling(jpg, other))
+
+	other = raw
+	other.CamSerial = "43"
+	assert.False(t, IsSibling(jpg, other))
+
+	other = jpg
+	other.ID = "3"
+	assert.False(t, IsSibling(jpg, other))
+}
+
+func TestGetOriginal(t *testing.T) {
+	s, _, _ := prepareMockServer(t)
+
+	err := ioutil.WriteFile(path.Join(s.cfg.ImgFolder(), "1234.jpg"), []byte("jpeg"), 0660)
+	require.Nil(t, err)
+	err = ioutil.WriteFile(path.Join(s.cfg.ImgFolder(), "5678.cr2"), []byte("raw"), 0660)
+	require.Nil(t, err)
+
+	// Processing not done
+	r := MockPhotoCtx(Photo{ID: "1234", Status: Processing})
+	w := httptest.NewRecorder()
+
+	s.GetOriginal(w, r)
+	require.EqualValues(t, 400, w.Code)
+
+	// JPEG only
+	r = MockPhotoCtx(Photo{ID: "1234", Status: ProcessingSucceeded, Filename: "IMG_0001.JPG"})
+	w = httptest.NewRecorder()
+
+	s.GetOriginal(w, r)
+	require.EqualValues(t, 200, w.Code)
+	assert.EqualValues(t, "image/jpeg", w.Header().Get("Content-Type"))
+	assert.EqualValues(t, `attachment; filename="IMG_0001.JPG"`, w.Header().Get("Content-Disposition"))
+	assert.EqualValues(t, "jpeg", w.Body.String())
+
+	// RAW paired with the JPEG
+	r = MockPhotoCtx(Photo{
+		ID:        "1234",
+		Status:    ProcessingSucceeded,
+		Format:    FormatJPEG,
+		Filename:  "IMG_0001.JPG",
+		RawID:     "5678",
+		RawFormat: FormatCR2,
+	})
+	w = httptest.NewRecorder()
+
+	s.GetOriginal(w, r)
+	require.EqualValues(t, 200, w.Code)
+	assert.EqualValues(t, "image/x-canon-cr2", w.Header().Get("Content-Type"))
+	assert.EqualValues(t, `attachment; filename="IMG_0001.cr2"`, w.Header().Get("Content-Disposition"))
+	assert.EqualValues(t, "raw", w.Body.String())
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi"
+	"github.com/kochman/hotshots/config"
+	"github.com/kochman/hotshots/log"
+	"github.com/nfnt/resize"
+)
+
+/*
+ * Renditions
+ *
+ * Photos are resized to the configured renditions the first time each one is
+ * requested, and the result is kept in the BlobStore next to the photo.
+ */
+
+const (
+	renditionJPEG = "jpg"
+	renditionWebP = "webp"
+)
+
+func RenditionKey(id string, name string, format string) string {
+	return fmt.Sprintf("%s-%s.%s", id, name, format)
+}
+
+// renditionLock keeps more than one rendition from being generated at a time, since
+// decoding a full size photo takes a lot of memory.
+type renditionLock struct {
+	mu sync.Mutex
+}
+
+func (s *Server) rendition(name string) (config.Rendition, bool) {
+	for _, rendition := range s.cfg.Renditions {
+		if rendition.Name == name {
+			return rendition, true
+		}
+	}
+	return config.Rendition{}, false
+}
+
+// renditionKeys returns the keys of every rendition that may have been cached for a photo.
+func (s *Server) renditionKeys(id string) []string {
+	keys := []string{}
+	for _, rendition := range s.cfg.Renditions {
+		keys = append(keys, RenditionKey(id, rendition.Name, renditionJPEG), RenditionKey(id, rendition.Name, renditionWebP))
+	}
+	return keys
+}
+
+// acceptsWebP returns whether the request's Accept header allows WebP images.
+func acceptsWebP(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil || mediaType != "image/webp" {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+func (s *Server) GetRendition(w http.ResponseWriter, r *http.Request) {
+	photo := r.Context().Value("photo").(Photo)
+	if photo.Status != ProcessingSucceeded {
+		WriteError("photo not processed", 400, w)
+		return
+	}
+	if photo.Deleted {
+		WriteError("photo deleted", 400, w)
+		return
+	}
+
+	rendition, ok := s.rendition(chi.URLParam(r, "name"))
+	if !ok {
+		WriteError("unknown rendition", 404, w)
+		return
+	}
+
+	format, contentType := renditionJPEG, "image/jpeg"
+	if acceptsWebP(r) {
+		format, contentType = renditionWebP, "image/webp"
+	}
+	key := RenditionKey(photo.ID, rendition.Name, format)
+
+	// renditions differ by format, so the key tells them apart
+	w.Header().Set("Vary", "Accept")
+	if setImageCacheHeaders(imageETag(key, photo), photo.UploadedAt, rotatableCacheControl, w, r) {
+		return
+	}
+
+	output, err := s.store.Get(key)
+	if err == BlobNotFound {
+		output, err = s.generateRendition(photo, rendition, format)
+	}
+	if err != nil {
+		log.Error(err)
+		WriteError("unable to access internal storage of rendition", 500, w)
+		return
+	}
+	defer output.Close()
+
+	ServeBlob(output, contentType, photo.UploadedAt, w, r)
+}
+
+// generateRendition resizes a photo to a rendition, turned upright and rotated, and
+// caches the result.
+func (s *Server) generateRendition(photo Photo, rendition config.Rendition, format string) (Blob, error) {
+	id := photo.ID
+	s.renditions.mu.Lock()
+	defer s.renditions.mu.Unlock()
+
+	// another request may have generated it while this one waited
+	key := RenditionKey(id, rendition.Name, format)
+	if output, err := s.store.Get(key); err != BlobNotFound {
+		return output, err
+	}
+
+	input, err := s.store.Get(PhotoKey(id))
+	if err != nil {
+		return nil, err
+	}
+	img, err := jpeg.Decode(input)
+	input.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	// the rendition's dimensions are those of the photo once it's turned
+	orientation := photo.displayOrientation()
+	if swapsAxes(orientation) {
+		rendition.Width, rendition.Height = rendition.Height, rendition.Width
+	}
+	resized := Orient(Resize(img, rendition), orientation)
+	if format == renditionWebP {
+		err = EncodeWebP(buf, resized, 80)
+	} else {
+		err = jpeg.Encode(buf, resized, &jpeg.Options{Quality: 85})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("generated %s rendition of %s", rendition.Name, id)
+	if err := s.store.Put(key, bytes.NewReader(buf.Bytes())); err != nil {
+		return nil, err
+	}
+	return s.store.Get(key)
+}
+
+// Resize scales an image down to fit within a rendition, first cropping it to the
+// rendition's aspect ratio if the rendition is cropped. Images are never scaled up.
+func Resize(img image.Image, rendition config.Rendition) image.Image {
+	if rendition.Crop {
+		img = cropCenter(img, int(rendition.Width), int(rendition.Height))
+	}
+	return resize.Thumbnail(rendition.Width, rendition.Height, img, resize.Bicubic)
+}
+
+// cropCenter cuts the largest area with the aspect ratio width:height out of the middle of img.
+func cropCenter(img image.Image, width, height int) image.Image {
+	b := img.Bounds()
+	crop := b
+	if b.Dx()*height > b.Dy()*width {
+		w := b.Dy() * width / height
+		crop.Min.X = b.Min.X + (b.Dx()-w)/2
+		crop.Max.X = crop.Min.X + w
+	} else {
+		h := b.Dx() * height / width
+		crop.Min.Y = b.Min.Y + (b.Dy()-h)/2
+		crop.Max.Y = crop.Min.Y + h
+	}
+
+	if sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(crop)
+	}
+	cropped := image.NewRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), img, crop.Min, draw.Src)
+	return cropped
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/kochman/hotshots/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func MockRenditionCtx(photo Photo, name string, accept string) *http.Request {
+	r := MockPhotoCtx(photo)
+	r.Header.Set("Accept", accept)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", name)
+	ctx := context.WithValue(r.Context(), chi.RouteCtxKey, rctx)
+	return r.WithContext(ctx)
+}
+
+func TestResize(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 400, 300))
+
+	// fits within the rendition
+	resized := Resize(img, config.Rendition{Width: 200, Height: 200})
+	assert.EqualValues(t, 200, resized.Bounds().Dx())
+	assert.EqualValues(t, 150, resized.Bounds().Dy())
+
+	// fills the rendition
+	resized = Resize(img, config.Rendition{Width: 100, Height: 100, Crop: true})
+	assert.EqualValues(t, 100, resized.Bounds().Dx())
+	assert.EqualValues(t, 100, resized.Bounds().Dy())
+
+	resized = Resize(img, config.Rendition{Width: 100, Height: 200, Crop: true})
+	assert.EqualValues(t, 100, resized.Bounds().Dx())
+	assert.EqualValues(t, 200, resized.Bounds().Dy())
+
+	// never scaled up
+	resized = Resize(img, config.Rendition{Width: 1000, Height: 1000})
+	assert.EqualValues(t, 400, resized.Bounds().Dx())
+	assert.EqualValues(t, 300, resized.Bounds().Dy())
+
+	resized = Resize(img, config.Rendition{Width: 1000, Height: 1000, Crop: true})
+	assert.EqualValues(t, 300, resized.Bounds().Dx())
+	assert.EqualValues(t, 300, resized.Bounds().Dy())
+}
+
+func TestAcceptsWebP(t *testing.T) {
+	cases := map[string]bool{
+		"":                                false,
+		"image/jpeg":                      false,
+		"image/webp":                      true,
+		"image/avif,image/webp,*/*;q=0.8": true,
+		"image/webp;q=0, image/jpeg":      false,
+	}
+	for accept, expected := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept", accept)
+		assert.EqualValues(t, expected, acceptsWebP(r), accept)
+	}
+}
+
+func TestGetRendition(t *testing.T) {
+	s, _, _ := prepareMockServer(t)
+	s.cfg.Renditions = []config.Rendition{{Name: "small", Width: 40, Height: 40}}
+
+	buf := new(bytes.Buffer)
+	err := jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, 400, 300)), nil)
+	require.Nil(t, err)
+	err = s.store.Put(PhotoKey("1234"), bytes.NewReader(buf.Bytes()))
+	require.Nil(t, err)
+
+	photo := Photo{ID: "1234", Status: ProcessingSucceeded}
+
+	// Unknown rendition
+	r := MockRenditionCtx(photo, "huge", "")
+	w := httptest.NewRecorder()
+
+	s.GetRendition(w, r)
+	require.EqualValues(t, 404, w.Code)
+
+	// JPEG is generated and cached
+	r = MockRenditionCtx(photo, "small", "image/jpeg")
+	w = httptest.NewRecorder()
+
+	s.GetRendition(w, r)
+	require.EqualValues(t, 200, w.Code)
+	assert.EqualValues(t, "image/jpeg", w.Header().Get("Content-Type"))
+	assert.EqualValues(t, "Accept", w.Header().Get("Vary"))
+
+	cfg, err := jpeg.DecodeConfig(w.Body)
+	require.Nil(t, err)
+	assert.EqualValues(t, 40, cfg.Width)
+	assert.EqualValues(t, 30, cfg.Height)
+
+	cached, err := s.store.Get(RenditionKey("1234", "small", renditionJPEG))
+	require.Nil(t, err)
+	cached.Close()
+
+	// WebP when the client allows it
+	r = MockRenditionCtx(photo, "small", "image/webp,*/*")
+	w = httptest.NewRecorder()
+
+	s.GetRendition(w, r)
+	require.EqualValues(t, 200, w.Code)
+	assert.EqualValues(t, "image/webp", w.Header().Get("Content-Type"))
+	assert.EqualValues(t, "RIFF", w.Body.String()[:4])
+
+	// served from the cache once the photo itself is gone
+	err = s.store.Delete(PhotoKey("1234"))
+	require.Nil(t, err)
+
+	r = MockRenditionCtx(photo, "small", "image/jpeg")
+	w = httptest.NewRecorder()
+
+	s.GetRendition(w, r)
+	require.EqualValues(t, 200, w.Code)
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/asdine/storm"
+	"github.com/kochman/hotshots/config"
+	"github.com/kochman/hotshots/log"
+)
+
+/*
+ * Reprocessing
+ *
+ * Photos can be processed again from their originals, which brings back photos that
+ * failed and lets processed ones pick up improvements to thumbnails and metadata.
+ * A processed photo's original is copied from the BlobStore to the queue folder, and
+ * the photo stays visible while it's reprocessed. The upload of a photo that failed is
+ * still in the queue folder.
+ */
+
+var (
+	OriginalNotFound = errors.New("original not available")
+	PhotoProcessing  = errors.New("photo is being processed")
+)
+
+// reprocess queues a photo to be processed again from its original.
+func (s *Server) reprocess(photo Photo) error {
+	var job Job
+	err := s.db.One("PhotoID", photo.ID, &job)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	if photo.Status == Processing || (err == nil && job.Status != JobFailed) {
+		return PhotoProcessing
+	}
+
+	switch photo.Status {
+	case ProcessingFailed:
+		if _, err := os.Stat(s.queuePath(photo.ID)); os.IsNotExist(err) {
+			return OriginalNotFound
+		} else if err != nil {
+			return err
+		}
+		photo.UpdateStatus(Processing)
+		if err := s.db.Update(&photo); err != nil {
+			return err
+		}
+		return s.queueJob(photo.ID, false)
+
+	default:
+		// photos from before formats were recorded are all JPEGs
+		if photo.Format == "" {
+			photo.Format = FormatJPEG
+			if err := s.db.Update(&photo); err != nil {
+				return err
+			}
+		}
+		key := PhotoKey(photo.ID)
+		if IsRaw(photo.Format) {
+			key = OriginalKey(photo.ID, photo.Format)
+		}
+		original, err := s.store.Get(key)
+		if err == BlobNotFound {
+			return OriginalNotFound
+		} else if err != nil {
+			return err
+		}
+		defer original.Close()
+		return s.queuePhoto(photo.ID, original, true)
+	}
+}
+
+// Reprocess queues photos in the server's database to be processed again, either all
+// of them or only those that failed, including processed photos that failed to be
+// reprocessed. They're processed once the server starts.
+func Reprocess(cfg *config.Config, db PhotoDB, all bool) (int, error) {
+	s, err := newOfflineServer(cfg, db)
+	if err != nil {
+		return 0, err
+	}
+
+	var photos []Photo
+	if all {
+		err = db.All(&photos)
+	} else {
+		photos, err = s.failedPhotos()
+	}
+	if err != nil && err != storm.ErrNotFound {
+		return 0, err
+	}
+
+	queued := 0
+	for _, photo := range photos {
+		if photo.Deleted {
+			continue
+		}
+		if err := s.reprocess(photo); err == OriginalNotFound || err == PhotoProcessing {
+			log.WithError(err).Warnf("unable to reprocess %s", photo.ID)
+			continue
+		} else if err != nil {
+			return queued, err
+		}
+		queued++
+	}
+	return queued, nil
+}
+
+// failedPhotos returns the photos that failed to be processed, and the processed ones
+// that failed to be reprocessed, which are left as they were.
+func (s *Server) failedPhotos() ([]Photo, error) {
+	var photos []Photo
+	if err := s.db.Find("Status", ProcessingFailed, &photos); err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	jobs, err := s.findJobs(JobFailed)
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		if !job.Reprocess {
+			continue
+		}
+		photo, err := s.GetPhotoFromDatabase(job.PhotoID)
+		if err == storm.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		photos = append(photos, photo)
+	}
+	return photos, nil
+}
+
+/*
+ * Handlers
+ */
+
+func (s *Server) PostReprocess(w http.ResponseWriter, r *http.Request) {
+	photo := r.Context().Value("photo").(Photo)
+	if photo.Deleted {
+		WriteError("photo deleted", 400, w)
+		return
+	}
+
+	switch err := s.reprocess(photo); err {
+	case nil:
+	case OriginalNotFound, PhotoProcessing:
+		WriteError(err.Error(), 409, w)
+		return
+	default:
+		log.Error(err)
+		WriteError("unable to queue photo for processing", 500, w)
+		return
+	}
+
+	// the photo may be processing now
+	photo, err := s.GetPhotoFromDatabase(photo.ID)
+	if err != nil {
+		log.Error(err)
+		WriteError("unable to read from database", 500, w)
+		return
+	}
+	job, err := s.jobStatus(photo.ID)
+	if err != nil {
+		log.Error(err)
+		WriteError("unable to read from database", 500, w)
+		return
+	}
+	WriteJsonResponse(&GetPhotoMetadataResponse{
+		Success: true,
+		Photo:   photo,
+		Job:     job,
+	}, 202, w)
+}
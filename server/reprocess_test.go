@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/asdine/storm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostReprocessFailed(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+	defer os.RemoveAll(s.cfg.PhotosDirectory)
+
+	photo := Photo{ID: "1234", Format: FormatJPEG, Status: ProcessingFailed}
+	db.On("One", "PhotoID", "1234", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*Job) = Job{PhotoID: "1234", Status: JobFailed, QueuedAt: queuedAt(1)}
+	}).Return(nil).Once()
+	db.On("Update", mock.Anything).Return(nil)
+	db.On("Save", mock.Anything).Return(nil)
+
+	// the upload isn't around
+	w := httptest.NewRecorder()
+	s.PostReprocess(w, MockPhotoCtx(photo))
+	assert.EqualValues(t, 409, w.Code)
+
+	// now it is
+	err := ioutil.WriteFile(s.queuePath("1234"), []byte("photo"), 0660)
+	require.Nil(t, err)
+	db.On("One", "PhotoID", "1234", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*Job) = Job{PhotoID: "1234", Status: JobFailed, QueuedAt: queuedAt(1)}
+	}).Return(nil).Once()
+	db.On("One", "ID", "1234", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*Photo) = Photo{ID: "1234", Status: Processing}
+	}).Return(nil)
+	db.On("One", "PhotoID", "1234", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*Job) = Job{PhotoID: "1234", Status: JobQueued, QueuedAt: queuedAt(2)}
+	}).Return(nil)
+	mockQueue(db, nil, []Job{{PhotoID: "1234", Status: JobQueued, QueuedAt: queuedAt(2)}})
+
+	w = httptest.NewRecorder()
+	s.PostReprocess(w, MockPhotoCtx(photo))
+	require.EqualValues(t, 202, w.Code)
+
+	var v GetPhotoMetadataResponse
+	err = json.Unmarshal(w.Body.Bytes(), &v)
+	require.Nil(t, err)
+	assert.EqualValues(t, Processing, v.Photo.Status)
+	require.NotNil(t, v.Job)
+	assert.EqualValues(t, JobQueued, v.Job.Status)
+
+	// the photo is processing again, from the upload that was kept
+	for _, call := range db.Calls {
+		switch data := call.Arguments.Get(0).(type) {
+		case *Photo:
+			assert.EqualValues(t, Processing, data.Status)
+		case *Job:
+			assert.EqualValues(t, JobQueued, data.Status)
+			assert.False(t, data.Reprocess)
+		}
+	}
+
+	// and can't be queued twice
+	w = httptest.NewRecorder()
+	s.PostReprocess(w, MockPhotoCtx(Photo{ID: "1234", Status: Processing}))
+	assert.EqualValues(t, 409, w.Code)
+}
+
+func TestReprocessProcessed(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+	defer os.RemoveAll(s.cfg.PhotosDirectory)
+
+	db.On("One", "PhotoID", mock.Anything, mock.Anything).Return(storm.ErrNotFound)
+	db.On("Update", mock.Anything).Return(nil)
+	db.On("Save", mock.Anything).Return(nil)
+
+	// photos that were never stored can't be reprocessed
+	err := s.reprocess(Photo{ID: "1234", Format: FormatCR2, Status: ProcessingSucceeded})
+	assert.EqualValues(t, OriginalNotFound, err)
+
+	// otherwise the original is copied to the queue
+	err = ioutil.WriteFile(path.Join(s.cfg.ImgFolder(), OriginalKey("1234", FormatCR2)), []byte("raw"), 0660)
+	require.Nil(t, err)
+	err = s.reprocess(Photo{ID: "1234", Format: FormatCR2, Status: ProcessingSucceeded})
+	require.Nil(t, err)
+	data, err := ioutil.ReadFile(s.queuePath("1234"))
+	require.Nil(t, err)
+	assert.EqualValues(t, "raw", data)
+	job := db.Calls[len(db.Calls)-1].Arguments.Get(0).(*Job)
+	assert.EqualValues(t, "1234", job.PhotoID)
+	assert.True(t, job.Reprocess)
+
+	// and photos from before formats were recorded are JPEGs
+	err = ioutil.WriteFile(path.Join(s.cfg.ImgFolder(), PhotoKey("5678")), []byte("jpeg"), 0660)
+	require.Nil(t, err)
+	err = s.reprocess(Photo{ID: "5678", Status: ProcessingSucceeded})
+	require.Nil(t, err)
+	data, err = ioutil.ReadFile(s.queuePath("5678"))
+	require.Nil(t, err)
+	assert.EqualValues(t, "jpeg", data)
+	db.AssertNumberOfCalls(t, "Update", 1)
+}
+
+func TestFailedPhotos(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+
+	db.On("Find", "Status", ProcessingFailed, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*[]Photo) = []Photo{{ID: "1234", Status: ProcessingFailed}}
+	}).Return(nil)
+	db.On("Find", "Status", JobFailed, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*[]Job) = []Job{
+			{PhotoID: "1234", Status: JobFailed, QueuedAt: queuedAt(1)},
+			{PhotoID: "5678", Status: JobFailed, Reprocess: true, QueuedAt: queuedAt(2)},
+			{PhotoID: "9012", Status: JobFailed, Reprocess: true, QueuedAt: queuedAt(3)},
+		}
+	}).Return(nil)
+	db.On("One", "ID", "5678", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*Photo) = Photo{ID: "5678", Status: ProcessingSucceeded}
+	}).Return(nil)
+	db.On("One", "ID", "9012", mock.Anything).Return(storm.ErrNotFound)
+
+	// photos that failed to be reprocessed are included, unless they're gone
+	photos, err := s.failedPhotos()
+	require.Nil(t, err)
+	require.Len(t, photos, 2)
+	assert.EqualValues(t, "1234", photos[0].ID)
+	assert.EqualValues(t, "5678", photos[1].ID)
+}
@@ -2,11 +2,15 @@ package server
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/asdine/storm"
 	"github.com/asdine/storm/q"
@@ -20,13 +24,27 @@ import (
  */
 
 type GetPhotoIDsResponse struct {
+	Success    bool     `json:"success"`
+	IDs        []string `json:"ids"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+type PhotosExistsRequest struct {
+	IDs []string `json:"ids"`
+}
+
+type PhotosExistsResponse struct {
 	Success bool     `json:"success"`
-	IDs     []string `json:"ids"`
+	Unknown []string `json:"unknown"`
+	// Photos the server has but failed to process, which are also unknown, so that
+	// clients send them again even if they were uploaded before
+	Failed []string `json:"failed"`
 }
 
 type GetPhotosResponse struct {
-	Success bool    `json:"success"`
-	Photos  []Photo `json:"photos"`
+	Success    bool    `json:"success"`
+	Photos     []Photo `json:"photos"`
+	NextCursor string  `json:"next_cursor,omitempty"`
 }
 
 type PostPhotoResponse struct {
@@ -36,8 +54,9 @@ type PostPhotoResponse struct {
 }
 
 type GetPhotoMetadataResponse struct {
-	Success bool  `json:"success"`
-	Photo   Photo `json:"photo"`
+	Success bool       `json:"success"`
+	Photo   Photo      `json:"photo"`
+	Job     *JobStatus `json:"job,omitempty"`
 }
 
 type DeletePhotoResponse struct {
@@ -69,6 +88,10 @@ type GetPagesResponse struct {
 	Photos  int  `json:"photos"`
 }
 
+// PhotoExistsError is the error given when a photo is uploaded that the server
+// already has.
+const PhotoExistsError = "photo already exists"
+
 type ErrorResponse struct {
 	Success bool   `json:"success"`
 	Error   string `json:"error"`
@@ -120,10 +143,9 @@ func (s *Server) TagCtx(next http.Handler) http.Handler {
 }
 
 func (s *Server) GetPhotos(w http.ResponseWriter, r *http.Request) {
-	start, limit, err := GetPaginateValues(r)
+	query, err := parsePhotoQuery(r)
 	if err != nil {
-		log.Error(err)
-		WriteError("Unable to parse query string", 400, w)
+		WriteError(err.Error(), 400, w)
 		return
 	}
 
@@ -134,30 +156,25 @@ func (s *Server) GetPhotos(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var photos []Photo
-	query := s.db.Select(q.Eq("Status", ProcessingSucceeded), q.Eq("Deleted", deleted)).Skip(start).Limit(limit).OrderBy("TakenAt")
-
-	if err := query.Find(&photos); err != nil && err != storm.ErrNotFound {
+	photos, next, err := query.find(s.db, q.Eq("Status", ProcessingSucceeded), q.Eq("Deleted", deleted))
+	if err != nil {
 		log.Error(err)
 		WriteError("unable to query photos", 500, w)
 		return
 	}
-	if photos == nil {
-		photos = []Photo{}
-	}
 
 	v := GetPhotosResponse{
-		Success: true,
-		Photos:  photos,
+		Success:    true,
+		Photos:     photos,
+		NextCursor: next,
 	}
 	WriteJsonResponse(v, 200, w)
 }
 
 func (s *Server) GetPhotoIDs(w http.ResponseWriter, r *http.Request) {
-	start, limit, err := GetPaginateValues(r)
+	query, err := parsePhotoQuery(r)
 	if err != nil {
-		log.Error(err)
-		WriteError("Unable to parse query string", 400, w)
+		WriteError(err.Error(), 400, w)
 		return
 	}
 
@@ -168,22 +185,13 @@ func (s *Server) GetPhotoIDs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tag := GetTag(r)
-
-	var photos []Photo
-	dMatcher := q.Eq("Deleted", false)
-	tMatcher := q.NewFieldMatcher("Tags", &TagMatcher{tag})
-	var query storm.Query
-	if deleted {
-		query = s.db.Select(q.Eq("Status", ProcessingSucceeded)).Skip(start).Limit(limit).OrderBy("TakenAt")
-	} else if tag != "" {
-		query = s.db.Select(q.Eq("Status", ProcessingSucceeded), tMatcher, dMatcher).
-			Skip(start).Limit(limit).OrderBy("TakenAt")
-	} else {
-		query = s.db.Select(q.Eq("Status", ProcessingSucceeded), dMatcher).Skip(start).Limit(limit).OrderBy("TakenAt")
+	// deleted photos are included rather than only returned, for the pusher
+	matchers := []q.Matcher{q.Eq("Status", ProcessingSucceeded)}
+	if !deleted {
+		matchers = append(matchers, q.Eq("Deleted", false))
 	}
-
-	if err := query.Find(&photos); err != nil && err != storm.ErrNotFound {
+	photos, next, err := query.find(s.db, matchers...)
+	if err != nil {
 		log.Error(err)
 		WriteError("unable to query photos", 500, w)
 		return
@@ -195,88 +203,197 @@ func (s *Server) GetPhotoIDs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	v := GetPhotoIDsResponse{
+		Success:    true,
+		IDs:        ids,
+		NextCursor: next,
+	}
+	WriteJsonResponse(v, 200, w)
+}
+
+// PostPhotosExists reports which of the given photo IDs the server doesn't have,
+// so that clients don't need to page through every ID to find out.
+func (s *Server) PostPhotosExists(w http.ResponseWriter, r *http.Request) {
+	var req PhotosExistsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Info(err)
+		WriteError("unable to parse request body", 400, w)
+		return
+	}
+	if len(req.IDs) > MaxExistsIDs {
+		WriteError(fmt.Sprintf("at most %d IDs may be checked at once", MaxExistsIDs), 400, w)
+		return
+	}
+
+	unknown := []string{}
+	failed := []string{}
+	for _, id := range req.IDs {
+		photo, err := s.findPhoto(id)
+		if err == nil && photo.Status == ProcessingFailed {
+			unknown = append(unknown, id)
+			failed = append(failed, id)
+		} else if err == storm.ErrNotFound {
+			unknown = append(unknown, id)
+		} else if err != nil {
+			log.Error(err)
+			WriteError("unable to read from database", 500, w)
+			return
+		}
+	}
+
+	v := PhotosExistsResponse{
 		Success: true,
-		IDs:     ids,
+		Unknown: unknown,
+		Failed:  failed,
 	}
 	WriteJsonResponse(v, 200, w)
 }
 
+// PostPhoto streams the photo in a multipart form to disk, rather than holding the
+// form in memory.
 func (s *Server) PostPhoto(w http.ResponseWriter, r *http.Request) {
-	r.ParseMultipartForm(1 << 25) // 32M max memory
-
-	input, _, err := r.FormFile("photo")
+	reader, err := r.MultipartReader()
 	if err != nil {
 		log.Info(err)
 		WriteError("unable to parse form value 'photo'", 400, w)
 		return
 	}
-	defer input.Close()
 
-	id, err := GenPhotoID(input)
+	overwrite := r.URL.Query().Get("overwrite") == "true"
+	var file, id, filename string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Info(err)
+			if file != "" {
+				os.Remove(file)
+			}
+			WriteError("unable to parse form", 400, w)
+			return
+		}
+
+		switch part.FormName() {
+		case "photo":
+			if file != "" {
+				break
+			}
+			filename = part.FileName()
+			file, id, err = s.spoolPhoto(part)
+			if err != nil {
+				log.Info(err)
+				part.Close()
+				WriteError("unable to read form value 'photo'", 400, w)
+				return
+			}
+		case "overwrite":
+			value, err := ioutil.ReadAll(io.LimitReader(part, 16))
+			if err == nil {
+				overwrite = string(value) == "true"
+			}
+		}
+		part.Close()
+	}
+
+	if file == "" {
+		WriteError("unable to parse form value 'photo'", 400, w)
+		return
+	}
+	// a photo sent in one request can't be added later, so it's never kept
+	if !s.AddPhoto(file, id, filename, overwrite, w, r) {
+		os.Remove(file)
+	}
+}
+
+// spoolPhoto streams a photo to a temporary file in the queue folder, hashing it on
+// the way for its ID so that it doesn't need to be read again.
+func (s *Server) spoolPhoto(input io.Reader) (string, string, error) {
+	output, err := ioutil.TempFile(s.cfg.QueueFolder(), "upload-")
+	if err != nil {
+		return "", "", err
+	}
+	digest := sha1.New()
+	if _, err := io.Copy(io.MultiWriter(output, digest), input); err != nil {
+		output.Close()
+		os.Remove(output.Name())
+		return "", "", err
+	}
+	if err := output.Close(); err != nil {
+		os.Remove(output.Name())
+		return "", "", err
+	}
+	return output.Name(), fmt.Sprintf("%x", digest.Sum(nil)), nil
+}
+
+// AddPhoto registers the photo in file and queues it for processing, taking over the
+// file, which must be in the same filesystem as the queue folder. id is the photo's
+// ID, found while the file was written. filename is the name the camera gave the
+// photo, if known. The photo is attributed to whoever made the request r. It returns
+// false if adding the photo failed in a way that trying again may fix, which leaves
+// the file where it is. Otherwise the file is queued, or removed if the photo is
+// turned away.
+func (s *Server) AddPhoto(file string, id string, filename string, overwrite bool, w http.ResponseWriter, r *http.Request) bool {
+	// unrecognized files fail processing like corrupt JPEGs do
+	input, err := os.Open(file)
 	if err != nil {
 		log.Error(err)
-		WriteError("unable to generate photo ID", 500, w)
-		return
+		WriteError("unable to read photo", 500, w)
+		return false
+	}
+	format, err := DetectFormat(input, filename)
+	input.Close()
+	if err != nil && err != UnsupportedFormat {
+		log.Error(err)
+		WriteError("unable to read photo", 500, w)
+		return false
 	}
 
-	overwrite := r.FormValue("overwrite")
-	photo, err := s.GetPhotoFromDatabase(id)
+	photo, err := s.findPhoto(id)
 	if err == nil {
-		if overwrite == "true" {
+		// a RAW paired with another photo can't be overwritten on its own, and
+		// photos that failed processing may be sent again
+		if (overwrite || photo.Status == ProcessingFailed) && photo.ID == id {
 			s.db.DeleteStruct(photo)
 		} else {
-			WriteError("photo already exists", 400, w)
-			return
+			os.Remove(file)
+			WriteError(PhotoExistsError, 400, w)
+			return true
 		}
 	} else if err != storm.ErrNotFound {
 		log.Error(err)
 		WriteError("unable to read from database", 500, w)
-		return
+		return false
 	}
 
-	photo = NewPhoto(id)
+	if filename != "" {
+		filename = path.Base(filename)
+	}
+	photo = NewPhoto(id, format, filename)
+	photo.UploadedBy, photo.Device = uploader(r)
 
 	if err := s.db.Save(&photo); err != nil {
 		log.Error(err)
 		WriteError("unable to write to database", 500, w)
-		return
+		return false
+	}
+
+	if err := s.queueFile(id, file); err != nil {
+		log.Error(err)
+		if err := s.db.DeleteStruct(&photo); err != nil {
+			log.Error(err)
+		}
+		WriteError("unable to queue photo for processing", 500, w)
+		return false
 	}
+	s.publish(EventPhotoCreated, photo, "")
+
 	v := PostPhotoResponse{
 		Success: true,
 		NewID:   id,
 		Status:  Processing,
 	}
 	WriteJsonResponse(v, 200, w)
-
-	go func() {
-		photoPath := path.Join(s.cfg.ImgFolder(), fmt.Sprintf("%s.jpg", id))
-		thumbPath := path.Join(s.cfg.ImgFolder(), fmt.Sprintf("%s-thumb.jpg", id))
-
-		xif, rect, err := ProcessPhoto(input, id, photoPath, thumbPath, s.timeout)
-		if err != nil {
-			log.Error(err)
-			photo.UpdateStatus(ProcessingFailed)
-			if err := s.db.Update(&photo); err != nil {
-				log.Error(err)
-			}
-
-			os.Remove(photoPath)
-			os.Remove(thumbPath)
-			return
-		}
-
-		photo.AddMetadata(rect, xif)
-		photo.UpdateStatus(ProcessingSucceeded)
-
-		if err := s.db.Update(&photo); err != nil {
-			log.Error(err)
-
-			os.Remove(photoPath)
-			os.Remove(thumbPath)
-			return
-		}
-	}()
-
+	return true
 }
 
 func (s *Server) GetPhotoMetadata(w http.ResponseWriter, r *http.Request) {
@@ -284,6 +401,15 @@ func (s *Server) GetPhotoMetadata(w http.ResponseWriter, r *http.Request) {
 		Photo:   r.Context().Value("photo").(Photo),
 		Success: true,
 	}
+	if v.Photo.Status != ProcessingSucceeded {
+		job, err := s.jobStatus(v.Photo.ID)
+		if err != nil {
+			log.Error(err)
+			WriteError("unable to read from database", 500, w)
+			return
+		}
+		v.Job = job
+	}
 	WriteJsonResponse(v, 200, w)
 }
 
@@ -295,7 +421,9 @@ func (s *Server) GetThumbnail(w http.ResponseWriter, r *http.Request) {
 	s.GetImage("%s-thumb.jpg", w, r)
 }
 
-func (s *Server) GetImage(imageFormat string, w http.ResponseWriter, r *http.Request) {
+// GetOriginal downloads the file the photo was shot as, which is the RAW file if
+// one was uploaded.
+func (s *Server) GetOriginal(w http.ResponseWriter, r *http.Request) {
 	photo := r.Context().Value("photo").(Photo)
 	if photo.Status != ProcessingSucceeded {
 		WriteError("photo not processed", 400, w)
@@ -305,8 +433,13 @@ func (s *Server) GetImage(imageFormat string, w http.ResponseWriter, r *http.Req
 		WriteError("photo deleted", 400, w)
 		return
 	}
-	photoPath := path.Join(s.cfg.ImgFolder(), fmt.Sprintf(imageFormat, photo.ID))
-	output, err := os.OpenFile(photoPath, os.O_RDONLY, 0660)
+
+	id, format := photo.Original()
+	if setImageCacheHeaders(id, photo.UploadedAt, immutableCacheControl, w, r) {
+		return
+	}
+
+	output, err := s.store.Get(OriginalKey(id, format))
 	if err != nil {
 		log.Error(err)
 		WriteError("unable to access internal storage of image", 500, w)
@@ -314,19 +447,56 @@ func (s *Server) GetImage(imageFormat string, w http.ResponseWriter, r *http.Req
 	}
 	defer output.Close()
 
-	w.Header().Set("Content-Type", "image/jpeg")
-	w.WriteHeader(200)
-	if _, err := io.Copy(w, output); err != nil {
+	filename := fmt.Sprintf("%s.%s", id, format)
+	if photo.Filename != "" {
+		filename = photo.Filename
+		if photo.RawID != "" {
+			filename = strings.TrimSuffix(filename, path.Ext(filename)) + "." + format
+		}
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	ServeBlob(output, ContentType(format), photo.UploadedAt, w, r)
+}
+
+func (s *Server) GetImage(imageFormat string, w http.ResponseWriter, r *http.Request) {
+	photo := r.Context().Value("photo").(Photo)
+	if photo.Status != ProcessingSucceeded {
+		WriteError("photo not processed", 400, w)
+		return
+	}
+	// thumbnails of deleted photos are shown in the trash
+	if photo.Deleted && fmt.Sprintf(imageFormat, photo.ID) != ThumbKey(photo.ID) {
+		WriteError("photo deleted", 400, w)
+		return
+	}
+	// display images are left as they are when the photo is rotated, thumbnails
+	// are made again
+	etag, cacheControl := photo.ID, immutableCacheControl
+	if fmt.Sprintf(imageFormat, photo.ID) == ThumbKey(photo.ID) {
+		etag, cacheControl = imageETag(photo.ID, photo), rotatableCacheControl
+	}
+	if setImageCacheHeaders(etag, photo.UploadedAt, cacheControl, w, r) {
+		return
+	}
+
+	output, err := s.store.Get(fmt.Sprintf(imageFormat, photo.ID))
+	if err != nil {
 		log.Error(err)
-		WriteError("unable to return image data", 500, w)
+		WriteError("unable to access internal storage of image", 500, w)
 		return
 	}
+	defer output.Close()
+
+	ServeBlob(output, "image/jpeg", photo.UploadedAt, w, r)
 }
 
+// DeletePhoto moves a photo to the trash, keeping its files until it's purged.
 func (s *Server) DeletePhoto(w http.ResponseWriter, r *http.Request) {
 	photo := r.Context().Value("photo").(Photo)
-	if photo.Status != ProcessingSucceeded {
-		WriteError("photo not processed", 400, w)
+	trashed, err := trashPhoto(&photo)
+	if err != nil {
+		WriteError(err.Error(), 400, w)
 		return
 	}
 	log.Info(reflect.TypeOf(photo), photo)
@@ -335,40 +505,52 @@ func (s *Server) DeletePhoto(w http.ResponseWriter, r *http.Request) {
 		Success: true,
 		ID:      photo.ID,
 	}
-	if photo.Deleted {
+	if !trashed {
 		WriteJsonResponse(&v, 200, w)
 		return
 	}
 
-	photo.Deleted = true
-	if err := s.db.UpdateField(&Photo{ID: photo.ID}, "Deleted", true); err != nil {
+	if err := s.db.Update(&Photo{ID: photo.ID, Deleted: true, DeletedAt: photo.DeletedAt}); err != nil {
 		log.Error(err)
 		WriteError("unable to update image database", 500, w)
 		return
 	}
 
-	photoPath := path.Join(s.cfg.ImgFolder(), fmt.Sprintf("%s.jpg", photo.ID))
-	thumbPath := path.Join(s.cfg.ImgFolder(), fmt.Sprintf("%s-thumb.jpg", photo.ID))
+	s.publish(EventPhotoDeleted, photo, "")
+	WriteJsonResponse(&v, 200, w)
+}
 
-	if err := os.Remove(photoPath); err != nil {
-		log.Error(err)
-		WriteError("unable to delete internal storage of image", 500, w)
-		return
+// removePhotoFiles deletes the display image, thumbnail, renditions and original of a
+// photo that's purged from the trash.
+func (s *Server) removePhotoFiles(photo Photo) error {
+	if err := s.store.Delete(PhotoKey(photo.ID)); err != nil {
+		return err
 	}
-	if err := os.Remove(thumbPath); err != nil {
-		log.Error(err)
-		WriteError("unable to delete internal storage of thumbnail", 500, w)
-		return
+	if err := s.store.Delete(ThumbKey(photo.ID)); err != nil {
+		return err
 	}
-
-	WriteJsonResponse(&v, 200, w)
+	s.deleteFiles(s.renditionKeys(photo.ID)...)
+	if id, format := photo.Original(); format != FormatJPEG {
+		if err := s.store.Delete(OriginalKey(id, format)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *Server) PostTag(w http.ResponseWriter, r *http.Request) {
 	photo := r.Context().Value("photo").(Photo)
-	tag := r.Context().Value("tag").(string)
+	tag, err := catalogTag(s.db, r.Context().Value("tag").(string))
+	if err == InvalidTag {
+		WriteError(err.Error(), 400, w)
+		return
+	} else if err != nil {
+		log.Error(err)
+		WriteError("unable to update tag catalog", 500, w)
+		return
+	}
 
-	if err := photo.AddTag(tag); err != nil {
+	if err := photo.AddTag(tag.Name); err != nil {
 		WriteError(err.Error(), 400, w)
 		return
 	}
@@ -379,6 +561,7 @@ func (s *Server) PostTag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.publish(EventTagAdded, photo, tag.Name)
 	WriteJsonResponse(&PostTagResponse{
 		Success: true,
 		ID:      photo.ID,
@@ -411,6 +594,7 @@ func (s *Server) DeleteTag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.publish(EventTagRemoved, photo, tag)
 	WriteJsonResponse(&DeleteTagResponse{
 		Success: true,
 		ID:      photo.ID,
@@ -3,14 +3,18 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/sha1"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path"
+	"sync"
 	"testing"
 	"time"
 
@@ -32,6 +36,16 @@ func (db *MockDB) All(to interface{}, options ...func(*index.Options)) error {
 	args := db.Called(to, options)
 	return args.Error(0)
 }
+
+// Begin starts a MockTx, whose writes go to the MockDB.
+func (db *MockDB) Begin(writable bool) (storm.Node, error) {
+	args := db.Called(writable)
+	if err := args.Error(0); err != nil {
+		return nil, err
+	}
+	return &MockTx{db: db}, nil
+}
+
 func (db *MockDB) Count(data interface{}) (int, error) {
 	args := db.Called(data)
 	return args.Int(0), args.Error(1)
@@ -72,6 +86,11 @@ func (db *MockDB) Update(data interface{}) error {
 	return args.Error(0)
 }
 
+func (db *MockDB) Close() error {
+	args := db.Called()
+	return args.Error(0)
+}
+
 func (db *MockDB) UpdateField(data interface{}, fieldName string, value interface{}) error {
 	args := db.Called(data, fieldName, value)
 	return args.Error(0)
@@ -166,7 +185,7 @@ func TestWriteJsonResponse(t *testing.T) {
 	assert.EqualValues(t, w.Code, 500)
 }
 
-func prepareMockServer(t *testing.T) (Server, *MockDB, *MockQuery) {
+func prepareMockServer(t testing.TB) (Server, *MockDB, *MockQuery) {
 	dir, err := ioutil.TempDir("", "hotshot")
 	require.Nil(t, err)
 
@@ -176,6 +195,9 @@ func prepareMockServer(t *testing.T) (Server, *MockDB, *MockQuery) {
 	err = os.Mkdir(path.Join(dir, "conf.d"), 755)
 	require.Nil(t, err)
 
+	err = os.Mkdir(path.Join(dir, "queue"), 0775)
+	require.Nil(t, err)
+
 	cfg := config.Config{
 		ListenURL:       "localhost:8000",
 		PhotosDirectory: dir,
@@ -186,12 +208,26 @@ func prepareMockServer(t *testing.T) (Server, *MockDB, *MockQuery) {
 	qu.On("Skip", mock.Anything).Return(&qu)
 	qu.On("Limit", mock.Anything).Return(&qu)
 	qu.On("OrderBy", mock.Anything).Return(&qu)
+	qu.On("Reverse").Return(&qu)
 
+	stopping, stop := context.WithCancel(context.Background())
 	return Server{
-		cfg:     cfg,
-		db:      &db,
-		handler: nil,
-		timeout: 2 * time.Minute,
+		cfg:        cfg,
+		db:         &db,
+		store:      NewLocalStore(path.Join(dir, "img")),
+		handler:    nil,
+		timeout:    2 * time.Minute,
+		uploads:    newUploadLocks(),
+		renditions: &renditionLock{},
+		search:     newSearchIndex(),
+		events:     newEventBroker(),
+		webhooks:   newWebhookWorker(),
+		queue:      newProcessingQueue(),
+		logins:     newLoginCache(),
+		sessionKey: []byte("0123456789abcdef0123456789abcdef"),
+		background: &sync.WaitGroup{},
+		stopping:   stopping,
+		stop:       stop,
 	}, &db, &qu
 }
 
@@ -304,8 +340,63 @@ func TestGetPhotoIDs(t *testing.T) {
 	assert.Contains(t, v.IDs, "5678")
 }
 
+func TestPostPhotosExists(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+
+	db.On("One", "ID", "known", mock.Anything).Run(func(args mock.Arguments) {
+		p := args.Get(2).(*Photo)
+		*p = Photo{ID: "known", Status: ProcessingSucceeded}
+	}).Return(nil)
+	db.On("One", "ID", "processing", mock.Anything).Run(func(args mock.Arguments) {
+		p := args.Get(2).(*Photo)
+		*p = Photo{ID: "processing", Status: Processing}
+	}).Return(nil)
+	db.On("One", "ID", "failed", mock.Anything).Run(func(args mock.Arguments) {
+		p := args.Get(2).(*Photo)
+		*p = Photo{ID: "failed", Status: ProcessingFailed}
+	}).Return(nil)
+	db.On("One", "ID", "unknown", mock.Anything).Return(storm.ErrNotFound)
+	db.On("One", "RawID", "unknown", mock.Anything).Return(storm.ErrNotFound)
+	db.On("One", "ID", "raw", mock.Anything).Return(storm.ErrNotFound)
+	db.On("One", "RawID", "raw", mock.Anything).Run(func(args mock.Arguments) {
+		p := args.Get(2).(*Photo)
+		*p = Photo{ID: "known", RawID: "raw", Status: ProcessingSucceeded}
+	}).Return(nil)
+	db.On("One", "ID", "broken", mock.Anything).Return(errors.New(""))
+
+	// Unparseable body
+	r := httptest.NewRequest("POST", "/", bytes.NewBufferString("nope"))
+	w := httptest.NewRecorder()
+
+	s.PostPhotosExists(w, r)
+	require.EqualValues(t, 400, w.Code)
+
+	// Known and unknown photos
+	r = httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"ids": ["known", "unknown", "processing", "failed", "raw"]}`))
+	w = httptest.NewRecorder()
+
+	s.PostPhotosExists(w, r)
+	require.EqualValues(t, 200, w.Code)
+
+	var v PhotosExistsResponse
+	b, _ := ioutil.ReadAll(w.Body)
+	err := json.Unmarshal(b, &v)
+	require.Nil(t, err)
+	assert.True(t, v.Success)
+	assert.EqualValues(t, []string{"unknown", "failed"}, v.Unknown)
+	assert.EqualValues(t, []string{"failed"}, v.Failed)
+
+	// Database failure
+	r = httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"ids": ["broken"]}`))
+	w = httptest.NewRecorder()
+
+	s.PostPhotosExists(w, r)
+	require.EqualValues(t, 500, w.Code)
+}
+
 func TestPostPhoto(t *testing.T) {
-	s, _, _ := prepareMockServer(t)
+	s, db, _ := prepareMockServer(t)
+	defer os.RemoveAll(s.cfg.PhotosDirectory)
 
 	// Photo value not filled
 	r := httptest.NewRequest("", "/", new(bytes.Reader))
@@ -320,16 +411,102 @@ func TestPostPhoto(t *testing.T) {
 	assert.EqualValues(t, w.Code, 400)
 	assert.EqualValues(t, v, ErrorResponse{Success: false, Error: "unable to parse form value 'photo'"})
 
+	// The photo is spooled to the queue, with its ID found on the way
+	data := encodeJPEG(t, 64, 48)
+	db.On("One", mock.Anything, mock.Anything, mock.Anything).Return(storm.ErrNotFound)
+	db.On("Save", mock.Anything).Return(nil)
+	db.On("All", mock.Anything, mock.Anything).Return(nil)
+
+	w = httptest.NewRecorder()
+	s.PostPhoto(w, multipartPhoto(t, data, "IMG_0001.JPG", "true"))
+	require.EqualValues(t, 200, w.Code)
+
+	var resp PostPhotoResponse
+	err = json.Unmarshal(w.Body.Bytes(), &resp)
+	require.Nil(t, err)
+	assert.EqualValues(t, fmt.Sprintf("%x", sha1.Sum(data)), resp.NewID)
+	assert.EqualValues(t, Processing, resp.Status)
+
+	queued, err := ioutil.ReadFile(s.queuePath(resp.NewID))
+	require.Nil(t, err)
+	assert.EqualValues(t, data, queued)
+	photo := db.Calls[len(db.Calls)-3].Arguments.Get(0).(*Photo)
+	assert.EqualValues(t, "IMG_0001.JPG", photo.Filename)
+	assert.EqualValues(t, FormatJPEG, photo.Format)
+	job := db.Calls[len(db.Calls)-2].Arguments.Get(0).(*Job)
+	assert.EqualValues(t, resp.NewID, job.PhotoID)
+
+	// and nothing else is left behind
+	files, err := ioutil.ReadDir(s.cfg.QueueFolder())
+	require.Nil(t, err)
+	assert.Len(t, files, 1)
+
+	// HEIF photos are queued like RAW files, with their format
+	w = httptest.NewRecorder()
+	s.PostPhoto(w, multipartPhoto(t, []byte("\x00\x00\x00\x18ftypheic"), "IMG_0002.HEIC", "false"))
+	require.EqualValues(t, 200, w.Code)
+	photo = db.Calls[len(db.Calls)-3].Arguments.Get(0).(*Photo)
+	assert.EqualValues(t, FormatHEIC, photo.Format)
+
 	// TODO: Photo already in DB + No overwrite Flag
 
 	// TODO: Photo already in DB + Overwrite Flag
+}
+
+// multipartPhoto makes a request uploading data the way the pusher does.
+func multipartPhoto(t testing.TB, data []byte, filename string, overwrite string) *http.Request {
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	part, err := form.CreateFormFile("photo", filename)
+	require.Nil(t, err)
+	_, err = part.Write(data)
+	require.Nil(t, err)
+	err = form.WriteField("overwrite", overwrite)
+	require.Nil(t, err)
+	err = form.Close()
+	require.Nil(t, err)
+
+	r := httptest.NewRequest("POST", "/photos/upload", body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r
+}
 
-	// TODO: Photo Processing Failed
-	// TODO: Photo Processing Success
+// BenchmarkPostPhoto shows the memory used per upload, which doesn't grow with the
+// size of the photo.
+func BenchmarkPostPhoto(b *testing.B) {
+	s, db, _ := prepareMockServer(b)
+	defer os.RemoveAll(s.cfg.PhotosDirectory)
+	db.On("One", mock.Anything, mock.Anything, mock.Anything).Return(storm.ErrNotFound)
+	db.On("Save", mock.Anything).Return(nil)
+	db.On("All", mock.Anything, mock.Anything).Return(nil)
+	db.On("DeleteStruct", mock.Anything).Return(nil)
+
+	data := make([]byte, 16<<20)
+	copy(data, encodeJPEG(b, 64, 48))
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.StopTimer()
+	for i := 0; i < b.N; i++ {
+		// a different photo each time
+		data[len(data)-1] = byte(i)
+		data[len(data)-2] = byte(i >> 8)
+		r := multipartPhoto(b, data, "IMG_0001.JPG", "true")
+		w := httptest.NewRecorder()
+		b.StartTimer()
+		s.PostPhoto(w, r)
+		b.StopTimer()
+		if w.Code != 200 {
+			b.Fatal(w.Body.String())
+		}
+		os.RemoveAll(s.cfg.QueueFolder())
+		os.Mkdir(s.cfg.QueueFolder(), 0775)
+		db.Calls = nil
+	}
 }
 
 func TestGetPhotoMetadata(t *testing.T) {
-	s, _, _ := prepareMockServer(t)
+	s, db, _ := prepareMockServer(t)
+	db.On("One", "PhotoID", "1234", mock.Anything).Return(storm.ErrNotFound)
 
 	r := MockPhotoCtx(Photo{ID: "1234"})
 	w := httptest.NewRecorder()
@@ -343,6 +520,79 @@ func TestGetPhotoMetadata(t *testing.T) {
 	err := json.Unmarshal(b, &v)
 	require.Nil(t, err)
 	assert.EqualValues(t, v.Photo, Photo{ID: "1234"})
+	assert.Nil(t, v.Job)
+}
+
+func TestGetImageCaching(t *testing.T) {
+	s, _, _ := prepareMockServer(t)
+
+	err := ioutil.WriteFile(path.Join(s.cfg.ImgFolder(), "1234.jpg"), []byte("0123456789"), 0660)
+	require.Nil(t, err)
+
+	uploaded := time.Date(2018, 4, 1, 12, 0, 0, 0, time.UTC)
+	photo := Photo{ID: "1234", Status: ProcessingSucceeded, UploadedAt: &uploaded}
+
+	// Full image
+	r := MockPhotoCtx(photo)
+	w := httptest.NewRecorder()
+
+	s.GetImage("%s.jpg", w, r)
+	require.EqualValues(t, 200, w.Code)
+	assert.EqualValues(t, `"1234"`, w.Header().Get("ETag"))
+	assert.EqualValues(t, "public, max-age=31536000, immutable", w.Header().Get("Cache-Control"))
+	assert.EqualValues(t, "Sun, 01 Apr 2018 12:00:00 GMT", w.Header().Get("Last-Modified"))
+	assert.EqualValues(t, "image/jpeg", w.Header().Get("Content-Type"))
+	assert.EqualValues(t, "0123456789", w.Body.String())
+
+	// Client already has it
+	r = MockPhotoCtx(photo)
+	r.Header.Set("If-None-Match", `"5678", "1234"`)
+	w = httptest.NewRecorder()
+
+	s.GetImage("%s.jpg", w, r)
+	require.EqualValues(t, 304, w.Code)
+	assert.EqualValues(t, 0, w.Body.Len())
+
+	// Client has something else
+	r = MockPhotoCtx(photo)
+	r.Header.Set("If-None-Match", `"5678"`)
+	w = httptest.NewRecorder()
+
+	s.GetImage("%s.jpg", w, r)
+	require.EqualValues(t, 200, w.Code)
+
+	// Range
+	r = MockPhotoCtx(photo)
+	r.Header.Set("Range", "bytes=2-5")
+	w = httptest.NewRecorder()
+
+	s.GetImage("%s.jpg", w, r)
+	require.EqualValues(t, 206, w.Code)
+	assert.EqualValues(t, "bytes 2-5/10", w.Header().Get("Content-Range"))
+	assert.EqualValues(t, "2345", w.Body.String())
+
+	// Thumbnails are made again when the photo is rotated, so they're checked first
+	err = ioutil.WriteFile(path.Join(s.cfg.ImgFolder(), ThumbKey("1234")), []byte("01234"), 0660)
+	require.Nil(t, err)
+	photo.Rotation = 90
+	r = MockPhotoCtx(photo)
+	w = httptest.NewRecorder()
+
+	s.GetImage("%s-thumb.jpg", w, r)
+	require.EqualValues(t, 200, w.Code)
+	assert.EqualValues(t, `"1234-r90"`, w.Header().Get("ETag"))
+	assert.EqualValues(t, "public, no-cache", w.Header().Get("Cache-Control"))
+	photo.Rotation = 0
+
+	// Range only if the image is unchanged
+	r = MockPhotoCtx(photo)
+	r.Header.Set("Range", "bytes=2-5")
+	r.Header.Set("If-Range", `"5678"`)
+	w = httptest.NewRecorder()
+
+	s.GetImage("%s.jpg", w, r)
+	require.EqualValues(t, 200, w.Code)
+	assert.EqualValues(t, "0123456789", w.Body.String())
 }
 
 func TestGetImage(t *testing.T) {
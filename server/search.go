@@ -0,0 +1,468 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/kochman/hotshots/log"
+)
+
+/*
+ * Search
+ *
+ * Photos are searched through an inverted index of the words in their tags, captions,
+ * camera, photographer and keywords. The index is kept in memory: it's built from the
+ * database when the server starts, and the database keeps it up to date as photos are
+ * saved and updated. It also counts the tags of processed photos that aren't deleted,
+ * for the tag catalog.
+ *
+ * A search is made of terms, all of which a photo must match:
+ *
+ *  goal                a word in any field
+ *  go*                 a word starting with go
+ *  "penalty kick"      words next to each other, in this order
+ *  camera:canon        a word in a field; the fields are tag, caption, camera,
+ *                      photographer and keyword
+ *  tag:"first half"
+ */
+
+const (
+	SearchTag          = "tag"
+	SearchCaption      = "caption"
+	SearchCamera       = "camera"
+	SearchPhotographer = "photographer"
+	SearchKeyword      = "keyword"
+)
+
+var EmptySearch = errors.New("nothing to search for")
+
+// searchFields are the fields that can be searched, and what's in them.
+var searchFields = map[string]func(p Photo) []string{
+	SearchTag:     func(p Photo) []string { return p.Tags },
+	SearchCaption: func(p Photo) []string { return []string{p.Caption} },
+	SearchCamera: func(p Photo) []string {
+		return []string{p.CamMake, p.CamModel, p.CamSerial}
+	},
+	SearchPhotographer: func(p Photo) []string {
+		return []string{p.Photographer, p.UploadedBy}
+	},
+	SearchKeyword: func(p Photo) []string { return p.Keywords },
+}
+
+// searchIndex maps words to the photos they're in.
+type searchIndex struct {
+	mu    sync.RWMutex
+	words map[string]map[string]bool
+	// the words of each photo's fields, in order, to match phrases
+	photos map[string]map[string][]string
+	// the names of the tags of processed photos that aren't deleted, by slug and
+	// photo, for the tag catalog
+	tags map[string]map[string]string
+	// the slugs in tags of each photo
+	tagged map[string][]string
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		words:  map[string]map[string]bool{},
+		photos: map[string]map[string][]string{},
+		tags:   map[string]map[string]string{},
+		tagged: map[string][]string{},
+	}
+}
+
+// searchWords splits text into lowercase words.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// build indexes all the photos in a database.
+func (i *searchIndex) build(db PhotoDB) error {
+	var photos []Photo
+	if err := db.All(&photos); err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	for _, photo := range photos {
+		i.add(photo)
+	}
+	log.Info(fmt.Sprintf("indexed %d photos for search", len(photos)))
+	return nil
+}
+
+// add indexes a photo, in place of what it was indexed as before.
+func (i *searchIndex) add(photo Photo) {
+	fields := map[string][]string{}
+	for field, values := range searchFields {
+		for _, value := range values(photo) {
+			// values are kept apart so that phrases don't span them
+			if words := searchWords(value); len(words) > 0 {
+				fields[field] = append(append(fields[field], words...), "")
+			}
+		}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.remove(photo.ID)
+	i.photos[photo.ID] = fields
+	for _, words := range fields {
+		for _, word := range words {
+			if word == "" {
+				continue
+			}
+			if i.words[word] == nil {
+				i.words[word] = map[string]bool{}
+			}
+			i.words[word][photo.ID] = true
+		}
+	}
+	if photo.Status != ProcessingSucceeded || photo.Deleted {
+		return
+	}
+	for _, t := range photo.Tags {
+		slug := TagSlug(t)
+		if slug == "" {
+			continue
+		}
+		if i.tags[slug] == nil {
+			i.tags[slug] = map[string]string{}
+		}
+		i.tags[slug][photo.ID] = t
+		i.tagged[photo.ID] = append(i.tagged[photo.ID], slug)
+	}
+}
+
+// delete removes a photo from the index.
+func (i *searchIndex) delete(id string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.remove(id)
+}
+
+func (i *searchIndex) remove(id string) {
+	for _, words := range i.photos[id] {
+		for _, word := range words {
+			delete(i.words[word], id)
+			if len(i.words[word]) == 0 {
+				delete(i.words, word)
+			}
+		}
+	}
+	delete(i.photos, id)
+	for _, slug := range i.tagged[id] {
+		delete(i.tags[slug], id)
+		if len(i.tags[slug]) == 0 {
+			delete(i.tags, slug)
+		}
+	}
+	delete(i.tagged, id)
+}
+
+// tagCounts counts the processed photos that aren't deleted with each tag whose slug
+// match accepts. A tag is named as it is on one of its photos.
+func (i *searchIndex) tagCounts(match func(slug string) bool) map[string]TagCount {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	counts := map[string]TagCount{}
+	for slug, photos := range i.tags {
+		if !match(slug) {
+			continue
+		}
+		count := TagCount{Tag: Tag{Slug: slug}, Count: len(photos)}
+		for _, name := range photos {
+			if count.Name == "" || name < count.Name {
+				count.Name = name
+			}
+		}
+		counts[slug] = count
+	}
+	return counts
+}
+
+// searchTerm is a word or phrase to find, in a field or any of them.
+type searchTerm struct {
+	field string
+	words []string
+	// the last word is a prefix
+	prefix bool
+}
+
+// parseSearch splits a search into its terms.
+func parseSearch(search string) ([]searchTerm, error) {
+	terms := []searchTerm{}
+	rest := strings.TrimSpace(search)
+	for rest != "" {
+		term := searchTerm{}
+		if colon := strings.IndexAny(rest, ": \""); colon > 0 && rest[colon] == ':' {
+			term.field = strings.ToLower(rest[:colon])
+			if _, ok := searchFields[term.field]; !ok {
+				return nil, fmt.Errorf("unable to search by %s", rest[:colon])
+			}
+			rest = rest[colon+1:]
+		}
+
+		var text string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				return nil, errors.New("unterminated phrase")
+			}
+			text, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			end := strings.IndexFunc(rest, unicode.IsSpace)
+			if end < 0 {
+				end = len(rest)
+			}
+			text, rest = rest[:end], rest[end:]
+			term.prefix = strings.HasSuffix(text, "*")
+		}
+		rest = strings.TrimSpace(rest)
+
+		term.words = searchWords(text)
+		if len(term.words) > 0 {
+			terms = append(terms, term)
+		}
+	}
+	if len(terms) == 0 {
+		return nil, EmptySearch
+	}
+	return terms, nil
+}
+
+// search returns the IDs of the photos that match every term of a search.
+func (i *searchIndex) search(search string) ([]string, error) {
+	terms, err := parseSearch(search)
+	if err != nil {
+		return nil, err
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	var matches map[string]bool
+	for _, term := range terms {
+		found := map[string]bool{}
+		for id := range i.candidates(term) {
+			if (matches == nil || matches[id]) && term.matches(i.photos[id]) {
+				found[id] = true
+			}
+		}
+		matches = found
+	}
+
+	ids := make([]string, 0, len(matches))
+	for id := range matches {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// candidates returns the photos with the first word of a term in any field.
+func (i *searchIndex) candidates(term searchTerm) map[string]bool {
+	first := term.words[0]
+	if !term.prefix || len(term.words) > 1 {
+		return i.words[first]
+	}
+	candidates := map[string]bool{}
+	for word, ids := range i.words {
+		if strings.HasPrefix(word, first) {
+			for id := range ids {
+				candidates[id] = true
+			}
+		}
+	}
+	return candidates
+}
+
+// matches returns whether a photo's fields have the words of the term in order.
+func (t searchTerm) matches(fields map[string][]string) bool {
+	for field, words := range fields {
+		if t.field != "" && field != t.field {
+			continue
+		}
+		for start := 0; start+len(t.words) <= len(words); start++ {
+			if t.matchesAt(words[start:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (t searchTerm) matchesAt(words []string) bool {
+	last := len(t.words) - 1
+	for j, word := range t.words {
+		if j == last && t.prefix {
+			return strings.HasPrefix(words[j], word)
+		}
+		if words[j] != word {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Indexing
+ */
+
+// indexedDB keeps a search index up to date as photos are written to a PhotoDB.
+type indexedDB struct {
+	PhotoDB
+	index *searchIndex
+}
+
+func (db *indexedDB) Save(data interface{}) error {
+	if err := db.PhotoDB.Save(data); err != nil {
+		return err
+	}
+	db.reindex(data)
+	return nil
+}
+
+func (db *indexedDB) Update(data interface{}) error {
+	if err := db.PhotoDB.Update(data); err != nil {
+		return err
+	}
+	db.reindex(data)
+	return nil
+}
+
+func (db *indexedDB) UpdateField(data interface{}, fieldName string, value interface{}) error {
+	if err := db.PhotoDB.UpdateField(data, fieldName, value); err != nil {
+		return err
+	}
+	db.reindex(data)
+	return nil
+}
+
+func (db *indexedDB) DeleteStruct(data interface{}) error {
+	if err := db.PhotoDB.DeleteStruct(data); err != nil {
+		return err
+	}
+	if photo, ok := data.(*Photo); ok {
+		db.index.delete(photo.ID)
+	}
+	return nil
+}
+
+// Begin starts a transaction whose photos are indexed once it's committed.
+func (db *indexedDB) Begin(writable bool) (storm.Node, error) {
+	tx, err := db.PhotoDB.Begin(writable)
+	if err != nil {
+		return nil, err
+	}
+	return &indexedTx{Node: tx, db: db}, nil
+}
+
+func (db *indexedDB) reindex(data interface{}) {
+	photo, ok := data.(*Photo)
+	if !ok {
+		return
+	}
+	// updates leave out fields with zero values, so the photo is read back whole
+	var stored Photo
+	if err := db.PhotoDB.One("ID", photo.ID, &stored); err != nil {
+		log.Error(err)
+		return
+	}
+	db.index.add(stored)
+}
+
+type indexedTx struct {
+	storm.Node
+	db      *indexedDB
+	written []interface{}
+	deleted []string
+}
+
+func (tx *indexedTx) Save(data interface{}) error {
+	if err := tx.Node.Save(data); err != nil {
+		return err
+	}
+	tx.written = append(tx.written, data)
+	return nil
+}
+
+func (tx *indexedTx) Update(data interface{}) error {
+	if err := tx.Node.Update(data); err != nil {
+		return err
+	}
+	tx.written = append(tx.written, data)
+	return nil
+}
+
+func (tx *indexedTx) UpdateField(data interface{}, fieldName string, value interface{}) error {
+	if err := tx.Node.UpdateField(data, fieldName, value); err != nil {
+		return err
+	}
+	tx.written = append(tx.written, data)
+	return nil
+}
+
+func (tx *indexedTx) DeleteStruct(data interface{}) error {
+	if err := tx.Node.DeleteStruct(data); err != nil {
+		return err
+	}
+	if photo, ok := data.(*Photo); ok {
+		tx.deleted = append(tx.deleted, photo.ID)
+	}
+	return nil
+}
+
+func (tx *indexedTx) Commit() error {
+	if err := tx.Node.Commit(); err != nil {
+		return err
+	}
+	for _, data := range tx.written {
+		tx.db.reindex(data)
+	}
+	for _, id := range tx.deleted {
+		tx.db.index.delete(id)
+	}
+	return nil
+}
+
+/*
+ * Handlers
+ */
+
+func (s *Server) GetSearch(w http.ResponseWriter, r *http.Request) {
+	query, err := parsePhotoQuery(r)
+	if err != nil {
+		WriteError(err.Error(), 400, w)
+		return
+	}
+	ids, err := s.search.search(r.URL.Query().Get("q"))
+	if err != nil {
+		WriteError(err.Error(), 400, w)
+		return
+	}
+
+	v := GetPhotoIDsResponse{
+		Success: true,
+		IDs:     []string{},
+	}
+	if len(ids) > 0 {
+		photos, next, err := query.find(s.db, q.In("ID", ids), q.Eq("Status", ProcessingSucceeded), q.Eq("Deleted", false))
+		if err != nil {
+			log.Error(err)
+			WriteError("unable to query photos", 500, w)
+			return
+		}
+		for _, photo := range photos {
+			v.IDs = append(v.IDs, photo.ID)
+		}
+		v.NextCursor = next
+	}
+	WriteJsonResponse(v, 200, w)
+}
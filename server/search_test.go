@@ -0,0 +1,169 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func searchPhotos() []Photo {
+	return []Photo{
+		{ID: "a", Tags: []string{"first half", "goal"}, Caption: "Penalty kick by the captain",
+			CamMake: "Canon", CamModel: "EOS 5D Mark III", Photographer: "Jo Smith"},
+		{ID: "b", Tags: []string{"Goalkeeper"}, Caption: "The captain's kick is saved",
+			CamMake: "Nikon", UploadedBy: "sam", Keywords: []string{"rugby", "varsity"}},
+		{ID: "c", Tags: []string{"half time"}, Caption: "First aid", CamMake: "Canon"},
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	index := newSearchIndex()
+	for _, photo := range searchPhotos() {
+		index.add(photo)
+	}
+
+	cases := []struct {
+		search string
+		ids    []string
+	}{
+		{"goal", []string{"a"}},
+		{"GOAL*", []string{"a", "b"}},
+		{"kick", []string{"a", "b"}},
+		{"canon", []string{"a", "c"}},
+		{"camera:canon tag:goal", []string{"a"}},
+		{"caption:canon", []string{}},
+		{`"penalty kick"`, []string{"a"}},
+		{`"kick penalty"`, []string{}},
+		{`caption:"captain s kick"`, []string{"b"}},
+		{`camera:"eos 5d"`, []string{"a"}},
+		{"camera:eos-5*", []string{"a"}},
+		{"first half", []string{"a", "c"}},
+		{`"first half"`, []string{"a"}},
+		// phrases don't span values
+		{`tag:"half goal"`, []string{}},
+		{"photographer:smith", []string{"a"}},
+		{"photographer:sam", []string{"b"}},
+		{"Keyword:rug*", []string{"b"}},
+		{"nothing", []string{}},
+	}
+	for _, c := range cases {
+		ids, err := index.search(c.search)
+		require.Nil(t, err, c.search)
+		sort.Strings(ids)
+		assert.EqualValues(t, c.ids, ids, c.search)
+	}
+
+	for _, search := range []string{"", "  ", "*", "lens:canon", `"goal`} {
+		_, err := index.search(search)
+		assert.NotNil(t, err, search)
+	}
+
+	// photos are indexed again as they change
+	index.add(Photo{ID: "a", Tags: []string{"try"}})
+	ids, err := index.search("goal")
+	require.Nil(t, err)
+	assert.Empty(t, ids)
+	ids, err = index.search("try")
+	require.Nil(t, err)
+	assert.EqualValues(t, []string{"a"}, ids)
+
+	index.delete("a")
+	ids, err = index.search("try")
+	require.Nil(t, err)
+	assert.Empty(t, ids)
+	assert.NotContains(t, index.words, "try")
+}
+
+func TestIndexedDB(t *testing.T) {
+	mockDB := new(MockDB)
+	index := newSearchIndex()
+	db := &indexedDB{PhotoDB: mockDB, index: index}
+
+	stored := Photo{ID: "a", Tags: []string{"goal"}}
+	mockDB.On("Save", mock.Anything).Return(nil)
+	mockDB.On("Update", mock.Anything).Return(nil)
+	mockDB.On("UpdateField", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockDB.On("DeleteStruct", mock.Anything).Return(nil)
+	mockDB.On("One", "ID", "a", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*Photo) = stored
+	}).Return(nil)
+
+	found := func(search string) []string {
+		ids, err := index.search(search)
+		require.Nil(t, err)
+		return ids
+	}
+
+	err := db.Save(&stored)
+	require.Nil(t, err)
+	assert.EqualValues(t, []string{"a"}, found("goal"))
+
+	// the photo as stored is indexed, not what was passed to the update
+	stored.Caption = "A try"
+	err = db.UpdateField(&Photo{ID: "a"}, "Caption", "A try")
+	require.Nil(t, err)
+	assert.EqualValues(t, []string{"a"}, found("goal try"))
+
+	stored.Tags = nil
+	err = db.Update(&stored)
+	require.Nil(t, err)
+	assert.Empty(t, found("goal"))
+
+	// other things are stored as they were
+	err = db.Save(&Job{PhotoID: "a"})
+	require.Nil(t, err)
+	err = db.DeleteStruct(&Job{PhotoID: "a"})
+	require.Nil(t, err)
+	mockDB.AssertNumberOfCalls(t, "One", 3)
+	assert.EqualValues(t, []string{"a"}, found("try"))
+
+	err = db.DeleteStruct(&stored)
+	require.Nil(t, err)
+	assert.Empty(t, found("try"))
+}
+
+func TestGetSearch(t *testing.T) {
+	s, db, qu := prepareMockServer(t)
+	s.search = newSearchIndex()
+	photos := searchPhotos()
+	for _, photo := range photos {
+		s.search.add(photo)
+	}
+
+	db.On("Select", mock.Anything, mock.Anything).Return(qu)
+	qu.On("Find", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		// the photos that were found, which are processed and not deleted
+		*args.Get(0).(*[]Photo) = []Photo{photos[0], photos[2]}
+	}).Return(nil)
+
+	search := func(query string) (int, GetPhotoIDsResponse) {
+		r := httptest.NewRequest("GET", "/search?"+query, nil)
+		w := httptest.NewRecorder()
+		s.GetSearch(w, r)
+		var v GetPhotoIDsResponse
+		err := json.Unmarshal(w.Body.Bytes(), &v)
+		require.Nil(t, err)
+		return w.Code, v
+	}
+
+	code, v := search("q=canon&sort=id&order=desc")
+	require.EqualValues(t, 200, code)
+	assert.EqualValues(t, []string{"c", "a"}, v.IDs)
+	qu.AssertNumberOfCalls(t, "Find", 1)
+
+	// the database isn't asked when nothing matches
+	code, v = search("q=cricket")
+	require.EqualValues(t, 200, code)
+	assert.Empty(t, v.IDs)
+	qu.AssertNumberOfCalls(t, "Find", 1)
+
+	code, _ = search("q=")
+	assert.EqualValues(t, 400, code)
+	code, _ = search("q=lens:canon")
+	assert.EqualValues(t, 400, code)
+}
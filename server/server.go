@@ -1,11 +1,13 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/asdine/storm"
@@ -23,10 +25,27 @@ import (
  * Server struct
  */
 type Server struct {
-	cfg     config.Config
-	db      PhotoDB
-	handler http.Handler
-	timeout time.Duration
+	cfg        config.Config
+	db         PhotoDB
+	search     *searchIndex
+	store      BlobStore
+	handler    http.Handler
+	timeout    time.Duration
+	uploads    *uploadLocks
+	renditions *renditionLock
+	events     *eventBroker
+	webhooks   *webhookWorker
+	queue      *processingQueue
+	logins     *loginCache
+	sessionKey []byte
+
+	httpServer     *http.Server
+	redirectServer *http.Server
+	// Processing workers and webhook deliveries
+	background *sync.WaitGroup
+	// Background work stops when this is done
+	stopping context.Context
+	stop     context.CancelFunc
 }
 
 type PhotoQuery interface {
@@ -37,6 +56,7 @@ type PhotoQuery interface {
 
 type PhotoDB interface {
 	All(to interface{}, options ...func(*index.Options)) error
+	Begin(writable bool) (storm.Node, error)
 	Count(data interface{}) (int, error)
 	DeleteStruct(data interface{}) error
 	Find(fieldName string, value interface{}, to interface{}, options ...func(q *index.Options)) error
@@ -46,39 +66,65 @@ type PhotoDB interface {
 	Select(matchers ...q.Matcher) storm.Query
 	UpdateField(data interface{}, fieldName string, value interface{}) error
 	Update(data interface{}) error
+	Close() error
 }
 
 func New(cfg *config.Config) (*Server, error) {
 	s := &Server{
-		cfg:     *cfg,
-		timeout: 5 * time.Second,
+		cfg:        *cfg,
+		timeout:    5 * time.Second,
+		uploads:    newUploadLocks(),
+		renditions: &renditionLock{},
+		events:     newEventBroker(),
+		webhooks:   newWebhookWorker(),
+		queue:      newProcessingQueue(),
+		search:     newSearchIndex(),
+		logins:     newLoginCache(),
+		background: &sync.WaitGroup{},
 	}
+	s.stopping, s.stop = context.WithCancel(context.Background())
 
 	if err := s.Setup(); err != nil {
 		return nil, err
 	}
 
+	// The login page and the dashboard's assets don't need authentication
+	root := chi.NewRouter()
+	root.Get("/login", s.GetLogin)
+	root.Post("/login", s.PostLogin)
+	FileServer(root, "/web", http.Dir(cfg.WebDirectory))
+
 	router := chi.NewRouter()
+	root.Mount("/", router)
 
-	// HTTP basic auth
+	// HTTP basic auth, API tokens and sessions
 	router.Use(s.auth)
 
 	// Route everything else
 	router.NotFound(NotFound)
 	router.Route("/photos", func(router chi.Router) {
-		router.Get("/", s.GetPhotos)
-		router.Post("/", s.PostPhoto)
-		router.Get("/ids", s.GetPhotoIDs)
-		router.Get("/pages", s.GetPages)
+		router.With(s.allow(readers...)).Get("/", s.GetPhotos)
+		router.With(s.allow(uploaders...)).Post("/", s.PostPhoto)
+		router.With(s.allow(everyone...)).Get("/ids", s.GetPhotoIDs)
+		router.With(s.allow(uploaders...)).Post("/exists", s.PostPhotosExists)
+		router.With(s.allow(readers...)).Get("/pages", s.GetPages)
+		router.With(s.allow(editors...)).Post("/batch", s.PostBatch)
+		router.With(s.allow(editors...)).Get("/trash", s.GetTrash)
 		router.Route("/{pid}", func(router chi.Router) {
 			router.Use(s.PhotoCtx)
-			router.Delete("/", s.DeletePhoto)
-			router.Get("/image.jpg", s.GetPhoto)
-			router.Get("/thumb.jpg", s.GetThumbnail)
-			router.Get("/meta", s.GetPhotoMetadata)
+			router.With(s.allow(editors...)).Delete("/", s.DeletePhoto)
+			router.With(s.allow(editors...)).Post("/restore", s.PostRestorePhoto)
+			router.With(s.allow(readers...)).Get("/image.jpg", s.GetPhoto)
+			router.With(s.allow(readers...)).Get("/thumb.jpg", s.GetThumbnail)
+			router.With(s.allow(readers...)).Get("/original", s.GetOriginal)
+			router.With(s.allow(readers...)).Get("/renditions/{name}.jpg", s.GetRendition)
+			router.With(s.allow(readers...)).Get("/meta", s.GetPhotoMetadata)
+			router.With(s.allow(editors...)).Post("/reprocess", s.PostReprocess)
+			router.With(s.allow(editors...)).Post("/rotate", s.PostRotate)
 			router.Route("/tags", func(router chi.Router) {
-				router.Get("/", s.GetTags)
+				router.With(s.allow(readers...)).Get("/", s.GetTags)
 				router.Route("/{tag}", func(router chi.Router) {
+					router.Use(s.allow(editors...))
 					router.Use(s.TagCtx)
 					router.Post("/", s.PostTag)
 					router.Delete("/", s.DeleteTag)
@@ -87,16 +133,109 @@ func New(cfg *config.Config) (*Server, error) {
 		})
 	})
 
+	router.With(s.allow(readers...)).Get("/search", s.GetSearch)
+
+	router.Route("/tags", func(router chi.Router) {
+		router.With(s.allow(readers...)).Get("/", s.GetTagCatalog)
+		router.Route("/{slug}", func(router chi.Router) {
+			router.Use(s.allow(editors...))
+			router.Post("/rename", s.PostRenameTag)
+			router.Post("/merge", s.PostMergeTag)
+		})
+	})
+	router.With(s.allow(readers...)).Get("/events", s.GetEvents)
+
+	router.Route("/webhooks", func(router chi.Router) {
+		router.Use(s.allow(admins...))
+		router.Get("/", s.GetWebhooks)
+		router.Post("/", s.PostWebhook)
+		router.Route("/{wid}", func(router chi.Router) {
+			router.Use(s.WebhookCtx)
+			router.Get("/", s.GetWebhook)
+			router.Delete("/", s.DeleteWebhook)
+			router.Get("/deliveries", s.GetDeliveries)
+		})
+	})
+
+	router.Route("/tokens", func(router chi.Router) {
+		router.Use(s.allow(admins...))
+		router.Get("/", s.GetTokens)
+		router.Post("/", s.PostToken)
+		router.Route("/{tid}", func(router chi.Router) {
+			router.Use(s.TokenCtx)
+			router.Get("/", s.GetToken)
+			router.Delete("/", s.DeleteToken)
+		})
+	})
+
+	router.Route("/admin", func(router chi.Router) {
+		router.Use(s.allow(admins...))
+		router.Get("/queue", s.GetQueue)
+	})
+
+	router.Route("/uploads", func(router chi.Router) {
+		router.Use(s.allow(uploaders...))
+		router.Post("/", s.PostUpload)
+		router.Route("/{uid}", func(router chi.Router) {
+			router.Use(s.UploadCtx)
+			router.Head("/", s.HeadUpload)
+			router.Patch("/", s.PatchUpload)
+			router.Delete("/", s.DeleteUpload)
+			router.Post("/complete", s.CompleteUpload)
+		})
+	})
+
+	router.Get("/session", s.GetSession)
+	router.Post("/logout", s.PostLogout)
+
 	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, cfg.WebDirectory+"/index.html")
 	})
 
-	FileServer(router, "/web", http.Dir(cfg.WebDirectory))
+	s.handler = root
+
+	s.httpServer = &http.Server{
+		Addr:    cfg.ListenURL,
+		Handler: s.handler,
+	}
+	s.httpServer.RegisterOnShutdown(s.events.close)
+	if cfg.TLS() {
+		tlsConfig, redirect, err := TLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		s.httpServer.TLSConfig = tlsConfig
+		if cfg.TLSRedirectURL != "" {
+			s.redirectServer = &http.Server{
+				Addr:    cfg.TLSRedirectURL,
+				Handler: redirect,
+			}
+		}
+	}
 
-	s.handler = router
 	return s, nil
 }
 
+// newOfflineServer sets up enough of a server to work on its photos from the command
+// line, while the server isn't running.
+func newOfflineServer(cfg *config.Config, db PhotoDB) (*Server, error) {
+	store, err := NewBlobStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{cfg.QueueFolder(), cfg.UploadFolder()} {
+		if err := os.MkdirAll(dir, 0775); err != nil {
+			return nil, err
+		}
+	}
+	return &Server{
+		cfg:   *cfg,
+		db:    db,
+		store: store,
+		queue: newProcessingQueue(),
+	}, nil
+}
+
 // FileServer conveniently sets up a http.FileServer handler to serve
 // static files from a http.FileSystem.
 func FileServer(r chi.Router, path string, root http.FileSystem) {
@@ -126,23 +265,79 @@ func (s *Server) Setup() error {
 		os.Mkdir(s.cfg.ImgFolder(), 0775)
 	}
 
+	if _, err := os.Stat(s.cfg.UploadFolder()); err != nil {
+		os.Mkdir(s.cfg.UploadFolder(), 0775)
+	}
+
+	if _, err := os.Stat(s.cfg.QueueFolder()); err != nil {
+		os.Mkdir(s.cfg.QueueFolder(), 0775)
+	}
+
 	if _, err := os.Stat(s.cfg.ConfFolder()); err != nil {
 		os.Mkdir(s.cfg.ConfFolder(), 0775)
 	}
 
+	sessionKey, err := loadSessionKey(s.cfg.SessionKeyFile())
+	if err != nil {
+		return err
+	}
+	s.sessionKey = sessionKey
+
+	store, err := NewBlobStore(&s.cfg)
+	if err != nil {
+		return err
+	}
+	s.store = store
+
 	db, err := storm.Open(s.cfg.StormFile())
 	if err != nil {
 		return err
 	}
-	s.db = db
+	s.db = &indexedDB{PhotoDB: db, index: s.search}
 
 	if err := s.db.Init(&Photo{}); err != nil {
 		return err
 	}
 
+	if err := s.db.Init(&Upload{}); err != nil {
+		return err
+	}
+
+	if err := s.db.Init(&Job{}); err != nil {
+		return err
+	}
+
+	if err := s.db.Init(&User{}); err != nil {
+		return err
+	}
+
+	if err := s.db.Init(&Session{}); err != nil {
+		return err
+	}
+
+	if err := s.db.Init(&Token{}); err != nil {
+		return err
+	}
+
+	if err := s.db.Init(&Webhook{}); err != nil {
+		return err
+	}
+
+	if err := s.db.Init(&Delivery{}); err != nil {
+		return err
+	}
+
+	if err := s.db.Init(&Tag{}); err != nil {
+		return err
+	}
+
 	exif.RegisterParsers(mknote.All...)
 
-	return nil
+	if err := s.search.build(s.db); err != nil {
+		return err
+	}
+
+	return s.recoverPhotos()
 }
 
 func CanAccessDirectory(serv *Server) bool {
@@ -155,8 +350,53 @@ func CanAccessDirectory(serv *Server) bool {
 	return readErr == nil && writeErr == nil
 }
 
+// Run serves requests until the server is shut down.
 func (s *Server) Run() {
-	if err := http.ListenAndServe(s.cfg.ListenURL, s.handler); err != nil {
+	workers := s.cfg.ProcessingWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			s.processJobs(s.stopping)
+		}()
+	}
+
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		s.deliverWebhooks(s.stopping)
+	}()
+
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		s.emptyTrash(s.stopping)
+	}()
+
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		s.expireUploads(s.stopping)
+	}()
+
+	if s.redirectServer != nil {
+		go func() {
+			if err := s.redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.WithError(err).Error("unable to serve HTTP redirects")
+			}
+		}()
+	}
+
+	var err error
+	if s.httpServer.TLSConfig != nil {
+		err = s.httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = s.httpServer.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		log.WithError(err).Error("unable to serve")
 	}
 }
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/kochman/hotshots/log"
+)
+
+/*
+ * Sessions
+ *
+ * The dashboard logs in through /login, which sets a session cookie signed with a
+ * key kept in the config folder. Sessions are stored so that logging out ends them
+ * for good, and expire after cfg.SessionLifetime.
+ *
+ * Requests authenticated by a session can be forged by other sites, so mutating
+ * ones must carry the session's CSRF token in an X-CSRF-Token header or a
+ * csrf_token form field. The token is also readable by the dashboard's scripts
+ * from the hotshots_csrf cookie. Requests with a bearer token or basic auth are
+ * made by programs like the pusher and don't need one.
+ */
+
+const (
+	sessionCookie = "hotshots_session"
+	csrfCookie    = "hotshots_csrf"
+	csrfHeader    = "X-CSRF-Token"
+	csrfField     = "csrf_token"
+)
+
+type Session struct {
+	ID        string     `storm:"id" json:"id"`
+	Username  string     `storm:"index" json:"username"`
+	CSRFToken string     `json:"csrf_token"`
+	CreatedAt *time.Time `json:"created_at"`
+	ExpiresAt *time.Time `storm:"index" json:"expires_at"`
+}
+
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type SessionResponse struct {
+	Success   bool       `json:"success"`
+	Username  string     `json:"username"`
+	Role      string     `json:"role"`
+	CSRFToken string     `json:"csrf_token,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// loadSessionKey reads the key sessions are signed with, creating it on first start.
+func loadSessionKey(filename string) ([]byte, error) {
+	key, err := ioutil.ReadFile(filename)
+	if err == nil && len(key) >= 32 {
+		return key, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	key = []byte(secret)
+	if err := ioutil.WriteFile(filename, key, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (s *Server) signSession(id string) string {
+	mac := hmac.New(sha256.New, s.sessionKey)
+	mac.Write([]byte(id))
+	return fmt.Sprintf("%s.%x", id, mac.Sum(nil))
+}
+
+// sessionUser returns the user a session belongs to, who may have been removed or
+// had their role changed since logging in.
+func (s *Server) sessionUser(username string) (User, bool) {
+	var user User
+	if err := s.db.One("Username", username, &user); err == nil {
+		return user, true
+	}
+	if len(s.cfg.AuthUsername) != 0 && username == s.cfg.AuthUsername {
+		return User{Username: username, Role: RoleAdmin}, true
+	}
+	return User{}, false
+}
+
+// authenticateSession returns the session and user for a session cookie.
+func (s *Server) authenticateSession(value string) (Session, User, bool) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(s.signSession(parts[0])), []byte(value)) {
+		return Session{}, User{}, false
+	}
+
+	var session Session
+	if err := s.db.One("ID", parts[0], &session); err != nil {
+		return Session{}, User{}, false
+	}
+	if session.ExpiresAt == nil || time.Now().After(*session.ExpiresAt) {
+		if err := s.db.DeleteStruct(&session); err != nil {
+			log.Error(err)
+		}
+		return Session{}, User{}, false
+	}
+
+	user, ok := s.sessionUser(session.Username)
+	if !ok {
+		return Session{}, User{}, false
+	}
+	return session, user, true
+}
+
+// safeMethod returns whether requests with a method don't change anything.
+func safeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// validCSRF returns whether a request carries its session's CSRF token.
+func validCSRF(session Session, r *http.Request) bool {
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		// only read forms that are cheap to parse, not photo uploads
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType == "application/x-www-form-urlencoded" {
+			token = r.PostFormValue(csrfField)
+		}
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRFToken)) == 1
+}
+
+// wantsHTML returns whether a request is a browser loading a page, rather than a script
+// or program calling the API.
+func wantsHTML(r *http.Request) bool {
+	return r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func (s *Server) setSessionCookies(session Session, w http.ResponseWriter, r *http.Request) {
+	secure := r.TLS != nil
+	setCookieSameSite(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    s.signSession(session.ID),
+		Path:     "/",
+		Expires:  *session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   secure,
+	}, "Lax")
+	setCookieSameSite(w, &http.Cookie{
+		Name:    csrfCookie,
+		Value:   session.CSRFToken,
+		Path:    "/",
+		Expires: *session.ExpiresAt,
+		Secure:  secure,
+	}, "Strict")
+}
+
+// setCookieSameSite is http.SetCookie with a SameSite attribute, which http.Cookie
+// only supports from Go 1.11.
+func setCookieSameSite(w http.ResponseWriter, cookie *http.Cookie, sameSite string) {
+	if v := cookie.String(); v != "" {
+		w.Header().Add("Set-Cookie", v+"; SameSite="+sameSite)
+	}
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{sessionCookie, csrfCookie} {
+		http.SetCookie(w, &http.Cookie{
+			Name:    name,
+			Value:   "",
+			Path:    "/",
+			Expires: time.Unix(0, 0),
+			MaxAge:  -1,
+		})
+	}
+}
+
+// pruneSessions deletes sessions that have expired.
+func (s *Server) pruneSessions() {
+	var sessions []Session
+	if err := s.db.All(&sessions); err != nil {
+		if err != storm.ErrNotFound {
+			log.Error(err)
+		}
+		return
+	}
+	now := time.Now()
+	for _, session := range sessions {
+		if session.ExpiresAt == nil || now.After(*session.ExpiresAt) {
+			if err := s.db.DeleteStruct(&session); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+/*
+ * Handlers
+ */
+
+func (s *Server) GetLogin(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, s.cfg.WebDirectory+"/login.html")
+}
+
+// PostLogin starts a session from either the login page's form or a JSON LoginRequest.
+func (s *Server) PostLogin(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	isJSON := mediaType == "application/json"
+
+	var req LoginRequest
+	if isJSON {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			WriteError("unable to parse request body", 400, w)
+			return
+		}
+	} else {
+		req.Username = r.PostFormValue("username")
+		req.Password = r.PostFormValue("password")
+	}
+
+	user, ok := s.authenticate(req.Username, req.Password)
+	if !ok {
+		if isJSON {
+			WriteError("incorrect username or password", 401, w)
+		} else {
+			http.Redirect(w, r, "/login?failed=true", http.StatusSeeOther)
+		}
+		return
+	}
+
+	id, err := randomHex(32)
+	if err != nil {
+		log.Error(err)
+		WriteError("unable to create session", 500, w)
+		return
+	}
+	csrf, err := randomHex(32)
+	if err != nil {
+		log.Error(err)
+		WriteError("unable to create session", 500, w)
+		return
+	}
+	now := time.Now()
+	expires := now.Add(s.cfg.SessionLifetime)
+	session := Session{
+		ID:        id,
+		Username:  user.Username,
+		CSRFToken: csrf,
+		CreatedAt: &now,
+		ExpiresAt: &expires,
+	}
+
+	s.pruneSessions()
+	if err := s.db.Save(&session); err != nil {
+		log.Error(err)
+		WriteError("unable to write to database", 500, w)
+		return
+	}
+
+	s.setSessionCookies(session, w, r)
+	if isJSON {
+		WriteJsonResponse(&SessionResponse{
+			Success:   true,
+			Username:  user.Username,
+			Role:      user.Role,
+			CSRFToken: session.CSRFToken,
+			ExpiresAt: session.ExpiresAt,
+		}, 200, w)
+	} else {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+func (s *Server) GetSession(w http.ResponseWriter, r *http.Request) {
+	v := SessionResponse{Success: true}
+	if user, ok := r.Context().Value("user").(User); ok {
+		v.Username = user.Username
+		v.Role = user.Role
+	}
+	if session, ok := r.Context().Value("session").(Session); ok {
+		v.CSRFToken = session.CSRFToken
+		v.ExpiresAt = session.ExpiresAt
+	}
+	WriteJsonResponse(&v, 200, w)
+}
+
+func (s *Server) PostLogout(w http.ResponseWriter, r *http.Request) {
+	if session, ok := r.Context().Value("session").(Session); ok {
+		if err := s.db.DeleteStruct(&session); err != nil {
+			log.Error(err)
+			WriteError("unable to update session database", 500, w)
+			return
+		}
+	}
+	clearSessionCookies(w)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	WriteJsonResponse(&SessionResponse{Success: true}, 200, w)
+}
+
+// withSession adds a session and its user to a request's context.
+func withSession(r *http.Request, session Session, user User) *http.Request {
+	ctx := context.WithValue(r.Context(), "user", user)
+	ctx = context.WithValue(ctx, "session", session)
+	return r.WithContext(ctx)
+}
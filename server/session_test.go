@@ -0,0 +1,136 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSession(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+	s.cfg.SessionLifetime = time.Hour
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	require.Nil(t, err)
+	db.On("One", "Username", "ana", mock.Anything).Run(func(args mock.Arguments) {
+		user := args.Get(2).(*User)
+		user.Username = "ana"
+		user.PasswordHash = hash
+		user.Role = RoleEditor
+	}).Return(nil)
+	db.On("One", "Username", mock.Anything, mock.Anything).Return(storm.ErrNotFound)
+	db.On("All", mock.Anything, mock.Anything).Return(nil)
+
+	var session Session
+	db.On("Save", mock.Anything).Run(func(args mock.Arguments) {
+		session = *args.Get(0).(*Session)
+	}).Return(nil)
+	db.On("DeleteStruct", mock.Anything).Return(nil)
+	db.On("Count", mock.Anything).Return(1, nil)
+
+	router := chi.NewRouter()
+	router.Post("/login", s.PostLogin)
+	router.Group(func(router chi.Router) {
+		router.Use(s.auth)
+		router.Get("/", func(w http.ResponseWriter, r *http.Request) {})
+		router.Delete("/", func(w http.ResponseWriter, r *http.Request) {})
+		router.Get("/session", s.GetSession)
+		router.Post("/logout", s.PostLogout)
+	})
+
+	login := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {"ana"}, "password": {password}}
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	// a wrong password goes back to the login page
+	w := login("battery staple")
+	assert.EqualValues(t, 303, w.Code)
+	assert.EqualValues(t, "/login?failed=true", w.Header().Get("Location"))
+
+	w = login("correct horse")
+	require.EqualValues(t, 303, w.Code)
+	assert.EqualValues(t, "/", w.Header().Get("Location"))
+	assert.EqualValues(t, "ana", session.Username)
+
+	db.On("One", "ID", session.ID, mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*Session) = session
+	}).Return(nil)
+	db.On("One", "ID", mock.Anything, mock.Anything).Return(storm.ErrNotFound)
+
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 2)
+	setCookies := w.Header()["Set-Cookie"]
+	require.Len(t, setCookies, 2)
+	assert.True(t, strings.HasSuffix(setCookies[0], "; HttpOnly; SameSite=Lax"), setCookies[0])
+	assert.True(t, strings.HasSuffix(setCookies[1], "; SameSite=Strict"), setCookies[1])
+	assert.EqualValues(t, sessionCookie, cookies[0].Name)
+	assert.True(t, cookies[0].HttpOnly)
+	assert.EqualValues(t, csrfCookie, cookies[1].Name)
+	assert.EqualValues(t, session.CSRFToken, cookies[1].Value)
+
+	request := func(method string, target string, cookie *http.Cookie, csrf string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		r.AddCookie(cookie)
+		if csrf != "" {
+			r.Header.Set(csrfHeader, csrf)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.EqualValues(t, 200, request("GET", "/", cookies[0], "").Code)
+	w = request("GET", "/session", cookies[0], "")
+	assert.Contains(t, w.Body.String(), `"role":"editor"`)
+
+	// mutating requests need the CSRF token
+	assert.EqualValues(t, 403, request("DELETE", "/", cookies[0], "").Code)
+	assert.EqualValues(t, 403, request("DELETE", "/", cookies[0], "nope").Code)
+	assert.EqualValues(t, 200, request("DELETE", "/", cookies[0], session.CSRFToken).Code)
+
+	// cookies can't be forged
+	forged := &http.Cookie{Name: sessionCookie, Value: session.ID + ".1234"}
+	w = request("GET", "/", forged, "")
+	assert.EqualValues(t, 401, w.Code)
+	assert.Empty(t, w.Header().Get("WWW-Authenticate"))
+
+	// expired sessions end
+	expired := time.Now().Add(-time.Minute)
+	session.ExpiresAt = &expired
+	assert.EqualValues(t, 401, request("GET", "/", cookies[0], "").Code)
+
+	// and browsers are sent to log in again
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "text/html,application/xhtml+xml")
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.EqualValues(t, 303, w.Code)
+	assert.EqualValues(t, "/login", w.Header().Get("Location"))
+
+	// logging out
+	expires := time.Now().Add(time.Hour)
+	session.ExpiresAt = &expires
+	assert.EqualValues(t, 403, request("POST", "/logout", cookies[0], "").Code)
+	w = request("POST", "/logout", cookies[0], session.CSRFToken)
+	assert.EqualValues(t, 200, w.Code)
+	db.AssertCalled(t, "DeleteStruct", &session)
+	for _, cookie := range w.Result().Cookies() {
+		assert.Empty(t, cookie.Value)
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/asdine/storm"
+	"github.com/kochman/hotshots/log"
+)
+
+/*
+ * Shutdown and recovery
+ *
+ * On shutdown the server stops accepting requests and waits for photos being
+ * processed before closing the database. Photos left processing by a server that
+ * didn't get to finish are queued again on the next start if their upload is still
+ * in the queue folder, and failed otherwise, so that the pusher sends them again.
+ * Files that don't belong to any photo are removed.
+ */
+
+// blobPhotoID matches the photo ID at the start of a key in the BlobStore.
+var blobPhotoID = regexp.MustCompile(`^([0-9a-f]{40})[-.]`)
+
+// Shutdown stops accepting requests and waits until ctx is done for requests,
+// photo processing and webhook deliveries in progress to finish, then closes the
+// database.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stop()
+
+	if s.redirectServer != nil {
+		if err := s.redirectServer.Shutdown(ctx); err != nil {
+			log.WithError(err).Error("unable to shut down HTTP redirects")
+		}
+	}
+	err := s.httpServer.Shutdown(ctx)
+
+	finished := make(chan struct{})
+	go func() {
+		s.background.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		log.Warn("gave up waiting for photos to finish processing")
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+
+	if closeErr := s.db.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// recoverPhotos queues or fails photos that were still processing when the server
+// last stopped, and removes files that don't belong to any photo.
+func (s *Server) recoverPhotos() error {
+	if err := s.requeueJobs(); err != nil {
+		return err
+	}
+
+	var photos []Photo
+	if err := s.db.Find("Status", Processing, &photos); err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	for _, photo := range photos {
+		var job Job
+		err := s.db.One("PhotoID", photo.ID, &job)
+		if err == nil && job.Status == JobQueued {
+			continue
+		} else if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+
+		log.Infof("failing %s, which was processing when the server stopped", photo.ID)
+		if err := s.failPhoto(photo); err != nil {
+			return err
+		}
+	}
+
+	// work directories of photos being processed
+	files, err := ioutil.ReadDir(s.cfg.UploadFolder())
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() && strings.HasPrefix(file.Name(), "processing-") {
+			if err := os.RemoveAll(path.Join(s.cfg.UploadFolder(), file.Name())); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+
+	// uploads without a job
+	files, err = ioutil.ReadDir(s.cfg.QueueFolder())
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		var job Job
+		err := s.db.One("PhotoID", file.Name(), &job)
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+		if err == storm.ErrNotFound {
+			log.Infof("removing orphaned upload %s", file.Name())
+			if err := os.RemoveAll(s.queuePath(file.Name())); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+
+	lister, ok := s.store.(BlobLister)
+	if !ok {
+		return nil
+	}
+	keys, err := lister.Keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		match := blobPhotoID.FindStringSubmatch(key)
+		if match == nil {
+			continue
+		}
+		// a photo that failed may still have its RAW original, or the files from before
+		// it failed to be reprocessed, so files are only orphaned once the photo is gone
+		_, err := s.findPhoto(match[1])
+		if err == storm.ErrNotFound {
+			log.Infof("removing orphaned file %s", key)
+			s.deleteFiles(key)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// failPhoto marks a photo as failed and removes its files, so that the pusher sends
+// it again.
+func (s *Server) failPhoto(photo Photo) error {
+	keys := append(s.renditionKeys(photo.ID), PhotoKey(photo.ID), ThumbKey(photo.ID))
+	if IsRaw(photo.Format) {
+		keys = append(keys, OriginalKey(photo.ID, photo.Format))
+	}
+	s.deleteFiles(keys...)
+
+	photo.UpdateStatus(ProcessingFailed)
+	return s.db.Update(&photo)
+}
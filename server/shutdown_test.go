@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverPhotos(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+	defer os.RemoveAll(s.cfg.PhotosDirectory)
+
+	stuck := "1111111111111111111111111111111111111111"
+	good := "2222222222222222222222222222222222222222"
+	orphan := "3333333333333333333333333333333333333333"
+	requeued := "4444444444444444444444444444444444444444"
+	lost := "5555555555555555555555555555555555555555"
+	failed := "6666666666666666666666666666666666666666"
+
+	err := os.MkdirAll(path.Join(s.cfg.UploadFolder(), "processing-123"), 0775)
+	require.Nil(t, err)
+	for _, key := range []string{
+		PhotoKey(stuck), ThumbKey(stuck), OriginalKey(stuck, FormatCR2),
+		PhotoKey(good), ThumbKey(good), RenditionKey(good, "small", renditionJPEG),
+		PhotoKey(orphan),
+		PhotoKey(failed), ThumbKey(failed), OriginalKey(failed, FormatCR2),
+		"README",
+	} {
+		err := ioutil.WriteFile(path.Join(s.cfg.ImgFolder(), key), []byte("data"), 0660)
+		require.Nil(t, err)
+	}
+	for _, id := range []string{requeued, orphan} {
+		err := ioutil.WriteFile(s.queuePath(id), []byte("data"), 0660)
+		require.Nil(t, err)
+	}
+
+	db.On("Find", "Status", JobRunning, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*[]Job) = []Job{
+			{PhotoID: requeued, Status: JobRunning, QueuedAt: queuedAt(1)},
+			{PhotoID: lost, Status: JobRunning, QueuedAt: queuedAt(2)},
+		}
+	}).Return(nil)
+	db.On("Find", "Status", Processing, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*[]Photo) = []Photo{
+			{ID: stuck, Format: FormatCR2, Status: Processing},
+			{ID: requeued, Status: Processing},
+		}
+	}).Return(nil)
+	saved := map[string]Job{}
+	db.On("Save", mock.Anything).Run(func(args mock.Arguments) {
+		job := *args.Get(0).(*Job)
+		saved[job.PhotoID] = job
+	}).Return(nil)
+	updated := []Photo{}
+	db.On("Update", mock.Anything).Run(func(args mock.Arguments) {
+		updated = append(updated, *args.Get(0).(*Photo))
+	}).Return(nil)
+	db.On("One", "ID", good, mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*Photo) = Photo{ID: good, Status: ProcessingSucceeded}
+	}).Return(nil)
+	db.On("One", "ID", failed, mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*Photo) = Photo{ID: failed, Format: FormatCR2, Status: ProcessingFailed}
+	}).Return(nil)
+	db.On("One", "PhotoID", requeued, mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*Job) = Job{PhotoID: requeued, Status: JobQueued}
+	}).Return(nil)
+	db.On("One", mock.Anything, mock.Anything, mock.Anything).Return(storm.ErrNotFound)
+
+	err = s.recoverPhotos()
+	require.Nil(t, err)
+
+	// the job with its upload still around is queued again, and the other one fails
+	assert.EqualValues(t, JobQueued, saved[requeued].Status)
+	assert.EqualValues(t, JobFailed, saved[lost].Status)
+
+	// the photo without a queued job is failed
+	require.Len(t, updated, 1)
+	assert.EqualValues(t, stuck, updated[0].ID)
+	assert.EqualValues(t, ProcessingFailed, updated[0].Status)
+
+	// and the files of photos that are gone are removed, but not those of failed ones
+	keys, err := s.store.(BlobLister).Keys()
+	require.Nil(t, err)
+	sort.Strings(keys)
+	expected := []string{
+		RenditionKey(good, "small", renditionJPEG), ThumbKey(good), PhotoKey(good),
+		PhotoKey(failed), ThumbKey(failed), OriginalKey(failed, FormatCR2), "README",
+	}
+	sort.Strings(expected)
+	assert.EqualValues(t, expected, keys)
+
+	_, err = os.Stat(s.queuePath(requeued))
+	assert.Nil(t, err)
+	_, err = os.Stat(s.queuePath(orphan))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(s.cfg.UploadFolder(), "processing-123"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestShutdown(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+	defer os.RemoveAll(s.cfg.PhotosDirectory)
+	s.httpServer = &http.Server{}
+	db.On("Close").Return(nil)
+
+	s.background.Add(1)
+
+	// photos still processing are given until the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	assert.EqualValues(t, context.DeadlineExceeded, err)
+	assert.NotNil(t, s.stopping.Err())
+	db.AssertNumberOfCalls(t, "Close", 1)
+
+	// and are waited for if they finish in time
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.background.Done()
+	}()
+	err = s.Shutdown(context.Background())
+	assert.Nil(t, err)
+	db.AssertNumberOfCalls(t, "Close", 2)
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/go-chi/chi"
+	"github.com/kochman/hotshots/log"
+)
+
+/*
+ * Tag catalog
+ *
+ * Tags are told apart by their slug, which is the tag in lowercase with its words
+ * joined by hyphens, so "Red Sox" and "red-sox" are the same tag. Photos keep a tag's
+ * display name, which is the name it was first added with until it's renamed. The
+ * catalog keeps the display name of each tag, and counts come from the search index,
+ * which keeps the tags of processed photos that aren't deleted. Tags added before the
+ * catalog are listed with the name they have on photos.
+ */
+
+var InvalidTag = errors.New("tag must have letters or numbers")
+
+// Tag is a tag in the catalog.
+type Tag struct {
+	Slug string `storm:"id" json:"slug"`
+	Name string `json:"name"`
+}
+
+// TagCount is a tag along with how many photos have it.
+type TagCount struct {
+	Tag
+	Count int `json:"count"`
+}
+
+type GetTagCatalogResponse struct {
+	Success bool       `json:"success"`
+	Tags    []TagCount `json:"tags"`
+}
+
+type RenameTagRequest struct {
+	Name string `json:"name"`
+}
+
+type MergeTagRequest struct {
+	// Slug of the tag to merge into
+	Into string `json:"into"`
+}
+
+type RenameTagResponse struct {
+	Success bool `json:"success"`
+	Tag     Tag  `json:"tag"`
+	// Photos that were changed
+	Photos int `json:"photos"`
+}
+
+// TagSlug returns the slug of a tag, which is empty if it has no letters or numbers.
+func TagSlug(tag string) string {
+	return strings.Join(searchWords(tag), "-")
+}
+
+// newTag returns a tag with a display name, which is the name with its spaces tidied.
+func newTag(name string) (Tag, error) {
+	slug := TagSlug(name)
+	if slug == "" {
+		return Tag{}, InvalidTag
+	}
+	return Tag{Slug: slug, Name: strings.Join(strings.Fields(name), " ")}, nil
+}
+
+// TagMatcher matches photos with any of the tags, or albums, by their slugs. With
+// Prefix, ones starting with any of them match too.
+type TagMatcher struct {
+	Slugs  []string
+	Prefix bool
+}
+
+func (m *TagMatcher) MatchField(v interface{}) (bool, error) {
+	tags, ok := v.([]string)
+	if !ok {
+		return false, errors.New("failed to convert field")
+	}
+	for _, t := range tags {
+		slug := TagSlug(t)
+		for _, want := range m.Slugs {
+			if slug == want || (m.Prefix && strings.HasPrefix(slug, want)) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// tagDB is where the catalog is kept, which is a PhotoDB or a transaction on one.
+type tagDB interface {
+	One(fieldName string, value interface{}, to interface{}) error
+	Save(data interface{}) error
+}
+
+// catalogTag returns the tag in the catalog with the same slug as name, adding it if
+// there isn't one.
+func catalogTag(db tagDB, name string) (Tag, error) {
+	tag, err := newTag(name)
+	if err != nil {
+		return tag, err
+	}
+	var existing Tag
+	if err := db.One("Slug", tag.Slug, &existing); err == nil {
+		return existing, nil
+	} else if err != storm.ErrNotFound {
+		return tag, err
+	}
+	return tag, db.Save(&tag)
+}
+
+// findTag returns the tag with a slug, from the catalog or the photos that have it.
+func (s *Server) findTag(slug string) (Tag, error) {
+	var tag Tag
+	err := s.db.One("Slug", slug, &tag)
+	if err != storm.ErrNotFound {
+		return tag, err
+	}
+
+	var photos []Photo
+	if err := s.db.Select(tagMatcher(slug)).Find(&photos); err != nil && err != storm.ErrNotFound {
+		return tag, err
+	}
+	for _, photo := range photos {
+		for _, t := range photo.Tags {
+			if TagSlug(t) == slug {
+				return Tag{Slug: slug, Name: t}, nil
+			}
+		}
+	}
+	return tag, TagNotExist
+}
+
+// tagMatcher matches the photos with a tag.
+func tagMatcher(slug string) q.Matcher {
+	return q.NewFieldMatcher("Tags", &TagMatcher{Slugs: []string{slug}})
+}
+
+// renameTag gives the photos with a tag the tag to instead, which merges the two if
+// to is another tag, and returns how many photos were changed. The photos are read
+// and written in one transaction with the catalog, so that changes made to them in
+// the meantime aren't lost.
+func (s *Server) renameTag(from Tag, to Tag) (int, error) {
+	tx, err := s.db.Begin(true)
+	if err != nil {
+		return 0, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			if err := tx.Rollback(); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+
+	var photos []Photo
+	if err := tx.Select(tagMatcher(from.Slug)).Find(&photos); err != nil && err != storm.ErrNotFound {
+		return 0, err
+	}
+	if err := tx.Save(&to); err != nil {
+		return 0, err
+	}
+	for i, photo := range photos {
+		tags := []string{}
+		placed := false
+		for _, t := range photo.Tags {
+			slug := TagSlug(t)
+			if slug != from.Slug && slug != to.Slug {
+				tags = append(tags, t)
+			} else if !placed {
+				tags = append(tags, to.Name)
+				placed = true
+			}
+		}
+		photos[i].Tags = tags
+		if err := tx.UpdateField(&photos[i], "Tags", tags); err != nil {
+			return 0, err
+		}
+	}
+	if from.Slug != to.Slug {
+		if err := tx.DeleteStruct(&from); err != nil && err != storm.ErrNotFound {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	committed = true
+
+	for _, photo := range photos {
+		s.publish(EventTagRenamed, photo, to.Name)
+	}
+	return len(photos), nil
+}
+
+/*
+ * Handlers
+ */
+
+// GetTagCatalog lists the tags of processed photos that aren't deleted, the most used
+// first. prefix finds the tags with a word starting with it, for autocompletion.
+func (s *Server) GetTagCatalog(w http.ResponseWriter, r *http.Request) {
+	prefix := TagSlug(r.URL.Query().Get("prefix"))
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			WriteError("invalid limit", 400, w)
+			return
+		}
+	}
+
+	var catalog []Tag
+	if err := s.db.All(&catalog); err != nil && err != storm.ErrNotFound {
+		log.Error(err)
+		WriteError("unable to query tags", 500, w)
+		return
+	}
+
+	counts := s.search.tagCounts(func(slug string) bool {
+		return prefix == "" || strings.HasPrefix(slug, prefix) || strings.Contains(slug, "-"+prefix)
+	})
+	for _, tag := range catalog {
+		if count, ok := counts[tag.Slug]; ok {
+			count.Name = tag.Name
+			counts[tag.Slug] = count
+		}
+	}
+
+	tags := []TagCount{}
+	for _, tag := range counts {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+		return tags[i].Slug < tags[j].Slug
+	})
+	if limit > 0 && len(tags) > limit {
+		tags = tags[:limit]
+	}
+
+	WriteJsonResponse(&GetTagCatalogResponse{
+		Success: true,
+		Tags:    tags,
+	}, 200, w)
+}
+
+func (s *Server) PostRenameTag(w http.ResponseWriter, r *http.Request) {
+	var v RenameTagRequest
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		WriteError("unable to parse tag", 400, w)
+		return
+	}
+	to, err := newTag(v.Name)
+	if err != nil {
+		WriteError(err.Error(), 400, w)
+		return
+	}
+	s.moveTag(TagSlug(chi.URLParam(r, "slug")), to, w)
+}
+
+func (s *Server) PostMergeTag(w http.ResponseWriter, r *http.Request) {
+	var v MergeTagRequest
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		WriteError("unable to parse tag", 400, w)
+		return
+	}
+	to, err := s.findTag(TagSlug(v.Into))
+	if err == TagNotExist {
+		WriteError("tag to merge into does not exist", 400, w)
+		return
+	} else if err != nil {
+		log.Error(err)
+		WriteError("unable to query tags", 500, w)
+		return
+	}
+	s.moveTag(TagSlug(chi.URLParam(r, "slug")), to, w)
+}
+
+// moveTag renames a tag for PostRenameTag and PostMergeTag.
+func (s *Server) moveTag(slug string, to Tag, w http.ResponseWriter) {
+	from, err := s.findTag(slug)
+	if err == TagNotExist {
+		WriteError(err.Error(), 404, w)
+		return
+	} else if err != nil {
+		log.Error(err)
+		WriteError("unable to query tags", 500, w)
+		return
+	}
+
+	changed, err := s.renameTag(from, to)
+	if err != nil {
+		log.Error(err)
+		WriteError("unable to update image database", 500, w)
+		return
+	}
+
+	WriteJsonResponse(&RenameTagResponse{
+		Success: true,
+		Tag:     to,
+		Photos:  changed,
+	}, 200, w)
+}
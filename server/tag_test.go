@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/asdine/storm"
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTagSlug(t *testing.T) {
+	assert.EqualValues(t, "red-sox", TagSlug("Red Sox"))
+	assert.EqualValues(t, "red-sox", TagSlug("  red-sox! "))
+	assert.EqualValues(t, "señor-2018", TagSlug("Señor_2018"))
+	assert.Empty(t, TagSlug("!?"))
+
+	tag, err := newTag("  Red   Sox ")
+	require.Nil(t, err)
+	assert.EqualValues(t, Tag{Slug: "red-sox", Name: "Red Sox"}, tag)
+	_, err = newTag("--")
+	assert.EqualValues(t, InvalidTag, err)
+
+	photo := Photo{Tags: []string{"Red Sox"}}
+	assert.EqualValues(t, TagExists, photo.AddTag("red-sox"))
+	assert.True(t, photo.HasTag("RED SOX"))
+	assert.False(t, photo.HasTag("red"))
+	assert.Nil(t, photo.AddTag("redsox"))
+	assert.Nil(t, photo.DeleteTag("red sox"))
+	assert.EqualValues(t, []string{"redsox"}, photo.Tags)
+
+	exact := TagMatcher{Slugs: []string{"red"}}
+	ok, err := exact.MatchField([]string{"Redsox", "Red Sox"})
+	require.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = exact.MatchField([]string{"RED"})
+	require.Nil(t, err)
+	assert.True(t, ok)
+	prefix := TagMatcher{Slugs: []string{"red"}, Prefix: true}
+	ok, err = prefix.MatchField([]string{"Redsox"})
+	require.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func TestGetTagCatalog(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+
+	for _, photo := range []Photo{
+		{ID: "a", Tags: []string{"red sox", "Goal"}},
+		{ID: "b", Tags: []string{"Red-Sox", "Yankees"}},
+		{ID: "c", Tags: []string{"goal"}},
+		{ID: "d", Tags: []string{"Red Sox", "Redwood"}},
+		{ID: "e", Tags: []string{"red sox", "Cubs"}, Deleted: true},
+	} {
+		photo.Status = ProcessingSucceeded
+		s.search.add(photo)
+	}
+	s.search.add(Photo{ID: "f", Tags: []string{"Red Sox", "Cubs"}, Status: Processing})
+	db.On("All", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(0).(*[]Tag) = []Tag{{Slug: "red-sox", Name: "Red Sox"}}
+	}).Return(nil)
+
+	catalog := func(query string) []TagCount {
+		r := httptest.NewRequest("GET", "/tags?"+query, nil)
+		w := httptest.NewRecorder()
+		s.GetTagCatalog(w, r)
+		require.EqualValues(t, 200, w.Code)
+		var v GetTagCatalogResponse
+		err := json.Unmarshal(w.Body.Bytes(), &v)
+		require.Nil(t, err)
+		return v.Tags
+	}
+
+	assert.EqualValues(t, []TagCount{
+		{Tag{"red-sox", "Red Sox"}, 3},
+		{Tag{"goal", "Goal"}, 2},
+		{Tag{"redwood", "Redwood"}, 1},
+		{Tag{"yankees", "Yankees"}, 1},
+	}, catalog(""))
+	assert.EqualValues(t, []TagCount{{Tag{"red-sox", "Red Sox"}, 3}}, catalog("prefix=red&limit=1"))
+	assert.EqualValues(t, []TagCount{{Tag{"red-sox", "Red Sox"}, 3}}, catalog("prefix=So"))
+	assert.Empty(t, catalog("prefix=sock"))
+
+	// counts follow the photos as they change
+	s.search.add(Photo{ID: "c", Tags: []string{"goal"}, Status: ProcessingSucceeded, Deleted: true})
+	s.search.delete("d")
+	assert.EqualValues(t, []TagCount{
+		{Tag{"red-sox", "Red Sox"}, 2},
+		{Tag{"goal", "Goal"}, 1},
+		{Tag{"yankees", "Yankees"}, 1},
+	}, catalog(""))
+	db.AssertNotCalled(t, "Select", mock.Anything, mock.Anything)
+}
+
+func TestRenameTag(t *testing.T) {
+	s, db, qu := prepareMockServer(t)
+
+	photos := []Photo{
+		{ID: "a", Tags: []string{"red sox", "goal"}},
+		{ID: "b", Tags: []string{"boston", "Red-Sox"}},
+	}
+	inTx, foundInTx := false, 0
+	db.On("Select", mock.Anything, mock.Anything).Return(qu)
+	qu.On("Find", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(0).(*[]Photo) = append([]Photo{}, photos...)
+		if inTx {
+			foundInTx++
+		}
+	}).Return(nil)
+	db.On("One", "Slug", "red-sox", mock.Anything).Return(storm.ErrNotFound)
+	db.On("One", "Slug", "boston", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*Tag) = Tag{Slug: "boston", Name: "Boston"}
+	}).Return(nil)
+	db.On("One", "Slug", mock.Anything, mock.Anything).Return(storm.ErrNotFound)
+	saved := []Tag{}
+	db.On("Save", mock.Anything).Run(func(args mock.Arguments) {
+		saved = append(saved, *args.Get(0).(*Tag))
+	}).Return(nil)
+	updated := []Photo{}
+	db.On("UpdateField", mock.Anything, "Tags", mock.Anything).Run(func(args mock.Arguments) {
+		photo := *args.Get(0).(*Photo)
+		photo.Tags = args.Get(2).([]string)
+		updated = append(updated, photo)
+	}).Return(nil)
+	db.On("DeleteStruct", mock.Anything).Return(storm.ErrNotFound)
+	db.On("All", mock.Anything, mock.Anything).Return(nil)
+	db.On("Begin", true).Run(func(mock.Arguments) { inTx = true }).Return(nil)
+	db.On("Commit").Run(func(mock.Arguments) { inTx = false }).Return(nil)
+	db.On("Rollback").Run(func(mock.Arguments) { inTx = false }).Return(nil)
+
+	post := func(handler http.HandlerFunc, slug string, body string) (int, RenameTagResponse) {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("slug", slug)
+		r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+		w := httptest.NewRecorder()
+		handler(w, r)
+		var v RenameTagResponse
+		json.Unmarshal(w.Body.Bytes(), &v)
+		return w.Code, v
+	}
+	rename, merge := s.PostRenameTag, s.PostMergeTag
+
+	// tags added before the catalog are renamed too
+	code, v := post(rename, "red-sox", `{"name": "Boston  Red Sox"}`)
+	require.EqualValues(t, 200, code)
+	assert.EqualValues(t, Tag{Slug: "boston-red-sox", Name: "Boston Red Sox"}, v.Tag)
+	assert.EqualValues(t, 2, v.Photos)
+	require.Len(t, updated, 2)
+	assert.EqualValues(t, []string{"Boston Red Sox", "goal"}, updated[0].Tags)
+	assert.EqualValues(t, []string{"boston", "Boston Red Sox"}, updated[1].Tags)
+	assert.EqualValues(t, []Tag{v.Tag}, saved)
+	db.AssertNumberOfCalls(t, "Commit", 1)
+	// the photos are read in the transaction, and only their tags are written
+	assert.EqualValues(t, 1, foundInTx)
+	db.AssertNotCalled(t, "Update", mock.Anything)
+
+	// photos that have both tags keep one
+	updated = updated[:0]
+	code, v = post(merge, "red-sox", `{"into": "Boston"}`)
+	require.EqualValues(t, 200, code)
+	assert.EqualValues(t, Tag{Slug: "boston", Name: "Boston"}, v.Tag)
+	require.Len(t, updated, 2)
+	assert.EqualValues(t, []string{"Boston", "goal"}, updated[0].Tags)
+	assert.EqualValues(t, []string{"Boston"}, updated[1].Tags)
+
+	code, _ = post(merge, "red-sox", `{"into": "cubs"}`)
+	assert.EqualValues(t, 400, code)
+	code, _ = post(rename, "red-sox", `{"name": "!"}`)
+	assert.EqualValues(t, 400, code)
+	db.AssertNumberOfCalls(t, "Begin", 2)
+	db.AssertNumberOfCalls(t, "Commit", 2)
+	photos = nil
+	code, _ = post(rename, "red-sox", `{"name": "Sox"}`)
+	assert.EqualValues(t, 404, code)
+}
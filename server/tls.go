@@ -0,0 +1,86 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"github.com/kochman/hotshots/config"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+/*
+ * TLS
+ *
+ * The server serves HTTPS when it has a certificate and key, or domains to get a
+ * certificate for from Let's Encrypt. Certificates from Let's Encrypt are kept in
+ * the config folder and renewed automatically.
+ */
+
+// TLSConfig returns the TLS configuration for the server, along with the handler for
+// plain HTTP requests, which answers ACME challenges when certificates are obtained
+// automatically.
+func TLSConfig(cfg *config.Config) (*tls.Config, http.Handler, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	redirect := RedirectToHTTPS(cfg.ListenURL)
+
+	if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else if len(cfg.TLSAutocertDomains) > 0 {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.TLSAutocertDomains...),
+			Cache:      autocert.DirCache(cfg.AutocertFolder()),
+		}
+		tlsConfig.GetCertificate = manager.GetCertificate
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		redirect = manager.HTTPHandler(redirect)
+	} else {
+		return nil, nil, errors.New("no TLS certificate configured")
+	}
+
+	if cfg.TLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, errors.New("no certificates found in " + cfg.TLSClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.TLSRequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if cfg.TLSRequireClientCert {
+		return nil, nil, errors.New("client certificates can't be required without a client CA")
+	}
+
+	return tlsConfig, redirect, nil
+}
+
+// RedirectToHTTPS redirects requests to the same URL over HTTPS on the port the
+// server listens on.
+func RedirectToHTTPS(listenURL string) http.Handler {
+	_, port, _ := net.SplitHostPort(listenURL)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
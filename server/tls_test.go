@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/kochman/hotshots/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCert writes a self-signed certificate and its key to dir.
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "hotshots.local"},
+		DNSNames:              []string{"hotshots.local"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	certFile := path.Join(dir, "cert.pem")
+	keyFile := path.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	require.Nil(t, err)
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	require.Nil(t, err)
+	return certFile, keyFile
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hotshots")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir)
+
+	_, _, err = TLSConfig(&config.Config{})
+	assert.NotNil(t, err)
+
+	cfg := &config.Config{
+		ListenURL:   ":8443",
+		TLSCertFile: certFile,
+		TLSKeyFile:  keyFile,
+	}
+	tlsConfig, redirect, err := TLSConfig(cfg)
+	require.Nil(t, err)
+	assert.Len(t, tlsConfig.Certificates, 1)
+	assert.EqualValues(t, tls.NoClientCert, tlsConfig.ClientAuth)
+	assert.NotNil(t, redirect)
+
+	// client certificates are verified if given
+	cfg.TLSClientCAFile = certFile
+	tlsConfig, _, err = TLSConfig(cfg)
+	require.Nil(t, err)
+	assert.NotNil(t, tlsConfig.ClientCAs)
+	assert.EqualValues(t, tls.VerifyClientCertIfGiven, tlsConfig.ClientAuth)
+
+	// or required
+	cfg.TLSRequireClientCert = true
+	tlsConfig, _, err = TLSConfig(cfg)
+	require.Nil(t, err)
+	assert.EqualValues(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth)
+
+	// which needs a CA to verify them with
+	cfg.TLSClientCAFile = ""
+	_, _, err = TLSConfig(cfg)
+	assert.NotNil(t, err)
+
+	// the CA file must have certificates in it
+	cfg.TLSClientCAFile = keyFile
+	_, _, err = TLSConfig(cfg)
+	assert.NotNil(t, err)
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	for listenURL, location := range map[string]string{
+		":8443":         "https://hotshots.local:8443/photos?limit=10",
+		":443":          "https://hotshots.local/photos?limit=10",
+		"0.0.0.0:12345": "https://hotshots.local:12345/photos?limit=10",
+	} {
+		r := httptest.NewRequest("GET", "http://hotshots.local:8000/photos?limit=10", nil)
+		w := httptest.NewRecorder()
+		RedirectToHTTPS(listenURL).ServeHTTP(w, r)
+		assert.EqualValues(t, 301, w.Code, listenURL)
+		assert.EqualValues(t, location, w.Header().Get("Location"), listenURL)
+	}
+}
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/go-chi/chi"
+	"github.com/kochman/hotshots/log"
+)
+
+/*
+ * API tokens
+ *
+ * Each device, such as a pusher in a camera kit, gets its own named token so that it
+ * can be revoked on its own. Tokens are sent as "Authorization: Bearer <token>" and
+ * act with the role they were created with. Only a hash of each token is kept.
+ */
+
+// tokenUsedInterval is how often a token's last use is written to the database.
+const tokenUsedInterval = time.Minute
+
+var (
+	TokenExists      = errors.New("token already exists")
+	InvalidTokenName = errors.New("token names may only contain letters, numbers, '.', '_' and '-'")
+)
+
+type Token struct {
+	ID         string     `storm:"id" json:"id"`
+	Name       string     `storm:"unique" json:"name"`
+	Role       string     `json:"role"`
+	Hash       []byte     `json:"hash,omitempty"`
+	CreatedBy  string     `json:"created_by"`
+	CreatedAt  *time.Time `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	LastUsedIP string     `json:"last_used_ip"`
+}
+
+type TokenRequest struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+type TokenResponse struct {
+	Success bool   `json:"success"`
+	Token   Token  `json:"token"`
+	Secret  string `json:"secret,omitempty"`
+}
+
+type GetTokensResponse struct {
+	Success bool    `json:"success"`
+	Tokens  []Token `json:"tokens"`
+}
+
+func hashToken(secret string) []byte {
+	hash := sha256.Sum256([]byte(secret))
+	return hash[:]
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", b), nil
+}
+
+// NewToken creates a token, returning it along with the secret to give to the device.
+func NewToken(name string, role string, createdBy string) (Token, string, error) {
+	if !usernamePattern.MatchString(name) {
+		return Token{}, "", InvalidTokenName
+	}
+	if !ValidRole(role) {
+		return Token{}, "", InvalidRole
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return Token{}, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return Token{}, "", err
+	}
+	secret = id + "." + secret
+
+	now := time.Now()
+	return Token{
+		ID:        id,
+		Name:      name,
+		Role:      role,
+		Hash:      hashToken(secret),
+		CreatedBy: createdBy,
+		CreatedAt: &now,
+	}, secret, nil
+}
+
+// redacted returns the token without its hash, for responses.
+func (t Token) redacted() Token {
+	t.Hash = nil
+	return t
+}
+
+func AddToken(db PhotoDB, name string, role string, createdBy string) (Token, string, error) {
+	token, secret, err := NewToken(name, role, createdBy)
+	if err != nil {
+		return Token{}, "", err
+	}
+
+	var existing Token
+	if err := db.One("Name", name, &existing); err == nil {
+		return Token{}, "", TokenExists
+	} else if err != storm.ErrNotFound {
+		return Token{}, "", err
+	}
+
+	if err := db.Save(&token); err != nil {
+		return Token{}, "", err
+	}
+	return token, secret, nil
+}
+
+func ListTokens(db PhotoDB) ([]Token, error) {
+	var tokens []Token
+	if err := db.All(&tokens); err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// RevokeToken deletes the token with the given name or ID.
+func RevokeToken(db PhotoDB, name string) error {
+	var token Token
+	err := db.One("Name", name, &token)
+	if err == storm.ErrNotFound {
+		err = db.One("ID", name, &token)
+	}
+	if err != nil {
+		return err
+	}
+	return db.DeleteStruct(&token)
+}
+
+// authenticateToken returns the token a bearer token belongs to, noting that it was
+// used by the request.
+func (s *Server) authenticateToken(bearer string, r *http.Request) (Token, bool) {
+	parts := strings.SplitN(bearer, ".", 2)
+	if len(parts) != 2 {
+		return Token{}, false
+	}
+
+	var token Token
+	if err := s.db.One("ID", parts[0], &token); err != nil {
+		return Token{}, false
+	}
+	if subtle.ConstantTimeCompare(token.Hash, hashToken(bearer)) != 1 {
+		return Token{}, false
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	now := time.Now()
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > tokenUsedInterval || token.LastUsedIP != ip {
+		token.LastUsedAt = &now
+		token.LastUsedIP = ip
+		if err := s.db.Update(&Token{ID: token.ID, LastUsedAt: &now, LastUsedIP: ip}); err != nil {
+			log.Error(err)
+		}
+	}
+	return token, true
+}
+
+// bearerToken returns the token from a request's Authorization header, if it has one.
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(auth[7:]), true
+}
+
+// uploader returns who is making a request, and with which device's token if any.
+func uploader(r *http.Request) (string, string) {
+	var username, device string
+	if user, ok := r.Context().Value("user").(User); ok {
+		username = user.Username
+	}
+	if token, ok := r.Context().Value("token").(Token); ok {
+		device = token.Name
+	}
+	return username, device
+}
+
+/*
+ * Handlers
+ */
+
+func (s *Server) TokenCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenID := chi.URLParam(r, "tid")
+		var token Token
+		if err := s.db.One("ID", tokenID, &token); err != nil {
+			log.Info(err)
+			WriteError("unable to find token id", 404, w)
+			return
+		}
+		ctx := context.WithValue(r.Context(), "apitoken", token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (s *Server) GetTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := ListTokens(s.db)
+	if err != nil {
+		log.Error(err)
+		WriteError("unable to query tokens", 500, w)
+		return
+	}
+
+	v := GetTokensResponse{
+		Success: true,
+		Tokens:  []Token{},
+	}
+	for _, token := range tokens {
+		v.Tokens = append(v.Tokens, token.redacted())
+	}
+	WriteJsonResponse(&v, 200, w)
+}
+
+func (s *Server) PostToken(w http.ResponseWriter, r *http.Request) {
+	var req TokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError("unable to parse request body", 400, w)
+		return
+	}
+	if req.Role == "" {
+		req.Role = RolePhotographer
+	}
+
+	username, _ := uploader(r)
+	token, secret, err := AddToken(s.db, req.Name, req.Role, username)
+	if err == InvalidTokenName || err == InvalidRole || err == TokenExists {
+		WriteError(err.Error(), 400, w)
+		return
+	} else if err != nil {
+		log.Error(err)
+		WriteError("unable to write to database", 500, w)
+		return
+	}
+
+	// the secret is only ever shown here
+	WriteJsonResponse(&TokenResponse{
+		Success: true,
+		Token:   token.redacted(),
+		Secret:  secret,
+	}, 201, w)
+}
+
+func (s *Server) GetToken(w http.ResponseWriter, r *http.Request) {
+	token := r.Context().Value("apitoken").(Token)
+	WriteJsonResponse(&TokenResponse{
+		Success: true,
+		Token:   token.redacted(),
+	}, 200, w)
+}
+
+func (s *Server) DeleteToken(w http.ResponseWriter, r *http.Request) {
+	token := r.Context().Value("apitoken").(Token)
+	if err := s.db.DeleteStruct(&token); err != nil {
+		log.Error(err)
+		WriteError("unable to update token database", 500, w)
+		return
+	}
+	WriteJsonResponse(&TokenResponse{
+		Success: true,
+		Token:   token.redacted(),
+	}, 200, w)
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenAuth(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+
+	token, secret, err := NewToken("kit-1", RolePhotographer, "ana")
+	require.Nil(t, err)
+
+	db.On("One", "ID", token.ID, mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*Token) = token
+	}).Return(nil)
+	db.On("One", "ID", mock.Anything, mock.Anything).Return(storm.ErrNotFound)
+	db.On("Update", mock.Anything).Return(nil)
+
+	r := chi.NewRouter()
+	r.Use(s.auth)
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		username, device := uploader(r)
+		w.Write([]byte(username + " " + device))
+	})
+
+	for bearer, statusCode := range map[string]int{
+		secret:                200,
+		secret + "0":          401,
+		"nope":                401,
+		"0000000000000000.00": 401,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.EqualValues(t, statusCode, w.Code, bearer)
+		if statusCode == 200 {
+			assert.EqualValues(t, "ana kit-1", w.Body.String())
+		}
+	}
+
+	// its last use is recorded
+	db.AssertNumberOfCalls(t, "Update", 1)
+	for _, call := range db.Calls {
+		if call.Method == "Update" {
+			update := call.Arguments.Get(0).(*Token)
+			assert.EqualValues(t, token.ID, update.ID)
+			assert.EqualValues(t, "192.0.2.1", update.LastUsedIP)
+			assert.NotNil(t, update.LastUsedAt)
+		}
+	}
+
+	// but not on every request
+	now := time.Now()
+	token.LastUsedAt = &now
+	token.LastUsedIP = "192.0.2.1"
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Authorization", "Bearer "+secret)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.EqualValues(t, 200, w.Code)
+	db.AssertNumberOfCalls(t, "Update", 1)
+}
+
+func TestRevokeToken(t *testing.T) {
+	_, db, _ := prepareMockServer(t)
+
+	db.On("One", "Name", "kit-1", mock.Anything).Run(func(args mock.Arguments) {
+		args.Get(2).(*Token).ID = "1234"
+	}).Return(nil)
+	db.On("One", "Name", mock.Anything, mock.Anything).Return(storm.ErrNotFound)
+	db.On("One", "ID", "5678", mock.Anything).Run(func(args mock.Arguments) {
+		args.Get(2).(*Token).ID = "5678"
+	}).Return(nil)
+	db.On("One", "ID", mock.Anything, mock.Anything).Return(storm.ErrNotFound)
+	db.On("DeleteStruct", mock.Anything).Return(nil)
+
+	err := RevokeToken(db, "kit-1")
+	require.Nil(t, err)
+	assert.EqualValues(t, "1234", db.Calls[len(db.Calls)-1].Arguments.Get(0).(*Token).ID)
+
+	err = RevokeToken(db, "5678")
+	require.Nil(t, err)
+	assert.EqualValues(t, "5678", db.Calls[len(db.Calls)-1].Arguments.Get(0).(*Token).ID)
+
+	err = RevokeToken(db, "kit-2")
+	assert.EqualValues(t, storm.ErrNotFound, err)
+}
+
+func TestPostToken(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+
+	db.On("One", "Name", "kit-1", mock.Anything).Return(nil)
+	db.On("One", "Name", mock.Anything, mock.Anything).Return(storm.ErrNotFound)
+	db.On("Save", mock.Anything).Return(nil)
+
+	for body, statusCode := range map[string]int{
+		`nope`:                               400,
+		`{"name": "kit 2"}`:                  400,
+		`{"name": "kit-2", "role": "owner"}`: 400,
+		`{"name": "kit-1"}`:                  400,
+		`{"name": "kit-2"}`:                  201,
+	} {
+		r := httptest.NewRequest("POST", "/", bytes.NewBufferString(body))
+		r = r.WithContext(context.WithValue(r.Context(), "user", User{Username: "admin", Role: RoleAdmin}))
+		w := httptest.NewRecorder()
+		s.PostToken(w, r)
+		require.EqualValues(t, statusCode, w.Code, body)
+
+		if statusCode == 201 {
+			var v TokenResponse
+			err := json.Unmarshal(w.Body.Bytes(), &v)
+			require.Nil(t, err)
+			assert.EqualValues(t, "kit-2", v.Token.Name)
+			assert.EqualValues(t, RolePhotographer, v.Token.Role)
+			assert.EqualValues(t, "admin", v.Token.CreatedBy)
+			assert.Nil(t, v.Token.Hash)
+			assert.EqualValues(t, hashToken(v.Secret), db.Calls[len(db.Calls)-1].Arguments.Get(0).(*Token).Hash)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/kochman/hotshots/log"
+)
+
+/*
+ * Trash
+ *
+ * Deleting a photo moves it to the trash, where it keeps its files so that it can be
+ * restored. GET /photos/trash lists the photos in the trash, the most recently deleted
+ * first, along with when they'll be purged. A background janitor purges the photos
+ * that have been in the trash for longer than TrashRetention, removing their files and
+ * records. Photos deleted before there was a trash have already lost their files, so
+ * they're purged the first time it runs.
+ */
+
+// trashPollInterval is how often the janitor looks for photos to purge.
+const trashPollInterval = time.Hour
+
+var (
+	PhotoNotProcessed = errors.New("photo not processed")
+	PhotoPurged       = errors.New("photo files were purged")
+)
+
+// TrashedPhoto is a photo in the trash.
+type TrashedPhoto struct {
+	Photo
+	// When the photo will be purged, or null if the trash is kept forever
+	PurgeAt *time.Time `json:"purge_at"`
+}
+
+type GetTrashResponse struct {
+	Success    bool           `json:"success"`
+	Photos     []TrashedPhoto `json:"photos"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+type RestorePhotoResponse struct {
+	Success bool  `json:"success"`
+	Photo   Photo `json:"photo"`
+}
+
+// trashPhoto moves a photo to the trash, and returns false if it was there already.
+func trashPhoto(photo *Photo) (bool, error) {
+	if photo.Status != ProcessingSucceeded {
+		return false, PhotoNotProcessed
+	}
+	if photo.Deleted {
+		return false, nil
+	}
+	now := time.Now()
+	photo.Deleted = true
+	photo.DeletedAt = &now
+	return true, nil
+}
+
+// restorePhoto takes a photo out of the trash, and returns false if it wasn't in it.
+// stored is whether the photo's files are still stored, from photoFilesExist.
+func restorePhoto(photo *Photo, stored bool) (bool, error) {
+	if !photo.Deleted {
+		return false, nil
+	}
+	if !stored {
+		return false, PhotoPurged
+	}
+	photo.Deleted = false
+	photo.DeletedAt = nil
+	return true, nil
+}
+
+// photoFilesExist returns whether a photo's display image and thumbnail are stored.
+func (s *Server) photoFilesExist(photo Photo) (bool, error) {
+	for _, key := range []string{PhotoKey(photo.ID), ThumbKey(photo.ID)} {
+		blob, err := s.store.Get(key)
+		if err == BlobNotFound {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		blob.Close()
+	}
+	return true, nil
+}
+
+// purgeAt returns when a photo in the trash will be purged, or nil if it never will.
+func (s *Server) purgeAt(photo Photo) *time.Time {
+	if s.cfg.TrashRetention <= 0 {
+		return nil
+	}
+	at := time.Now()
+	if photo.DeletedAt != nil {
+		at = photo.DeletedAt.Add(s.cfg.TrashRetention)
+	}
+	return &at
+}
+
+// emptyTrash purges photos as their time in the trash runs out, until ctx is done.
+func (s *Server) emptyTrash(ctx context.Context) {
+	ticker := time.NewTicker(trashPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if purged, err := s.purgeTrash(); err != nil {
+			log.Error(err)
+		} else if purged > 0 {
+			log.Infof("purged %d photos from the trash", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeTrash purges the photos that have been in the trash for longer than
+// TrashRetention, and returns how many it purged.
+func (s *Server) purgeTrash() (int, error) {
+	if s.cfg.TrashRetention <= 0 {
+		return 0, nil
+	}
+
+	var photos []Photo
+	if err := s.db.Find("Deleted", true, &photos); err != nil && err != storm.ErrNotFound {
+		return 0, err
+	}
+
+	purged := 0
+	for _, found := range photos {
+		if !s.purgeDue(found) {
+			continue
+		}
+		photo, ok, err := s.deleteTrashedPhoto(found.ID)
+		if err != nil {
+			return purged, err
+		}
+		if !ok {
+			continue
+		}
+		// files left behind by a failure here have no photo, and fsck removes them
+		if err := s.removePhotoFiles(photo); err != nil {
+			return purged, err
+		}
+		purged++
+		s.publish(EventPhotoPurged, photo, "")
+	}
+	return purged, nil
+}
+
+// purgeDue returns whether a photo is in the trash and its time there has run out.
+func (s *Server) purgeDue(photo Photo) bool {
+	return photo.Deleted && (photo.DeletedAt == nil || time.Since(*photo.DeletedAt) >= s.cfg.TrashRetention)
+}
+
+// deleteTrashedPhoto deletes the record of a photo that's due to be purged. The photo
+// is read again in the same transaction, so that one restored since it was found is
+// left alone, and false is returned.
+func (s *Server) deleteTrashedPhoto(id string) (Photo, bool, error) {
+	tx, err := s.db.Begin(true)
+	if err != nil {
+		return Photo{}, false, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			if err := tx.Rollback(); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+
+	var photo Photo
+	if err := tx.One("ID", id, &photo); err == storm.ErrNotFound {
+		return photo, false, nil
+	} else if err != nil {
+		return photo, false, err
+	}
+	if !s.purgeDue(photo) {
+		return photo, false, nil
+	}
+	if err := tx.DeleteStruct(&photo); err != nil {
+		return photo, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return photo, false, err
+	}
+	committed = true
+	return photo, true, nil
+}
+
+/*
+ * Handlers
+ */
+
+// GetTrash lists the photos in the trash. It takes the filters, order and page of
+// GET /photos, sorting by deleted_at in descending order unless told otherwise.
+func (s *Server) GetTrash(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	if values.Get("sort") == "" {
+		values.Set("sort", "deleted_at")
+		if values.Get("order") == "" {
+			values.Set("order", "desc")
+		}
+		r.URL.RawQuery = values.Encode()
+	}
+	query, err := parsePhotoQuery(r)
+	if err != nil {
+		WriteError(err.Error(), 400, w)
+		return
+	}
+
+	photos, next, err := query.find(s.db, q.Eq("Deleted", true))
+	if err != nil {
+		log.Error(err)
+		WriteError("unable to query photos", 500, w)
+		return
+	}
+
+	trashed := make([]TrashedPhoto, len(photos))
+	for i, photo := range photos {
+		trashed[i] = TrashedPhoto{Photo: photo, PurgeAt: s.purgeAt(photo)}
+	}
+
+	WriteJsonResponse(&GetTrashResponse{
+		Success:    true,
+		Photos:     trashed,
+		NextCursor: next,
+	}, 200, w)
+}
+
+func (s *Server) PostRestorePhoto(w http.ResponseWriter, r *http.Request) {
+	photo := r.Context().Value("photo").(Photo)
+
+	stored := true
+	if photo.Deleted {
+		var err error
+		if stored, err = s.photoFilesExist(photo); err != nil {
+			log.Error(err)
+			WriteError("unable to access internal storage of photo", 500, w)
+			return
+		}
+	}
+
+	restored, err := restorePhoto(&photo, stored)
+	if err == PhotoPurged {
+		WriteError(err.Error(), 410, w)
+		return
+	} else if err != nil {
+		log.Error(err)
+		WriteError("unable to access internal storage of photo", 500, w)
+		return
+	}
+
+	if restored {
+		// Save writes every field, where Update leaves out zero values
+		if err := s.db.Save(&photo); err != nil {
+			log.Error(err)
+			WriteError("unable to update image database", 500, w)
+			return
+		}
+		s.publish(EventPhotoRestored, photo, "")
+	}
+
+	WriteJsonResponse(&RestorePhotoResponse{
+		Success: true,
+		Photo:   photo,
+	}, 200, w)
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// storePhotoFiles stores a display image and thumbnail for a photo.
+func storePhotoFiles(t *testing.T, s Server, id string) {
+	for _, key := range []string{PhotoKey(id), ThumbKey(id)} {
+		err := s.store.Put(key, bytes.NewReader([]byte("jpeg")))
+		require.Nil(t, err)
+	}
+}
+
+func TestDeleteAndRestorePhoto(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+	storePhotoFiles(t, s, "a")
+
+	var updated Photo
+	db.On("Update", mock.Anything).Run(func(args mock.Arguments) {
+		updated = *args.Get(0).(*Photo)
+	}).Return(nil)
+	var saved Photo
+	db.On("Save", mock.Anything).Run(func(args mock.Arguments) {
+		saved = *args.Get(0).(*Photo)
+	}).Return(nil)
+	db.On("All", mock.Anything, mock.Anything).Return(nil)
+
+	// deleting a photo keeps its files
+	photo := Photo{ID: "a", Status: ProcessingSucceeded, Tags: []string{"goal"}}
+	w := httptest.NewRecorder()
+	s.DeletePhoto(w, MockPhotoCtx(photo))
+	require.EqualValues(t, 200, w.Code)
+	assert.True(t, updated.Deleted)
+	require.NotNil(t, updated.DeletedAt)
+	exists, err := s.photoFilesExist(photo)
+	require.Nil(t, err)
+	assert.True(t, exists)
+
+	w = httptest.NewRecorder()
+	s.DeletePhoto(w, MockPhotoCtx(Photo{ID: "b", Status: Processing}))
+	assert.EqualValues(t, 400, w.Code)
+
+	// the thumbnail can still be shown in the trash
+	photo.Deleted = true
+	photo.DeletedAt = updated.DeletedAt
+	w = httptest.NewRecorder()
+	s.GetThumbnail(w, MockPhotoCtx(photo))
+	assert.EqualValues(t, 200, w.Code)
+	w = httptest.NewRecorder()
+	s.GetPhoto(w, MockPhotoCtx(photo))
+	assert.EqualValues(t, 400, w.Code)
+
+	w = httptest.NewRecorder()
+	s.PostRestorePhoto(w, MockPhotoCtx(photo))
+	require.EqualValues(t, 200, w.Code)
+	var v RestorePhotoResponse
+	err = json.Unmarshal(w.Body.Bytes(), &v)
+	require.Nil(t, err)
+	assert.False(t, v.Photo.Deleted)
+	assert.EqualValues(t, Photo{ID: "a", Status: ProcessingSucceeded, Tags: []string{"goal"}}, saved)
+
+	// photos that were purged, or deleted before the trash, can't be restored
+	w = httptest.NewRecorder()
+	s.PostRestorePhoto(w, MockPhotoCtx(Photo{ID: "c", Status: ProcessingSucceeded, Deleted: true}))
+	assert.EqualValues(t, 410, w.Code)
+	db.AssertNumberOfCalls(t, "Save", 1)
+}
+
+func TestPurgeTrash(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+	s.cfg.TrashRetention = 24 * time.Hour
+
+	ago := func(d time.Duration) *time.Time {
+		t := time.Now().Add(-d)
+		return &t
+	}
+	photos := []Photo{
+		{ID: "old", Status: ProcessingSucceeded, Deleted: true, DeletedAt: ago(48 * time.Hour)},
+		{ID: "new", Status: ProcessingSucceeded, Deleted: true, DeletedAt: ago(time.Hour)},
+		{ID: "legacy", Status: ProcessingSucceeded, Deleted: true},
+		{ID: "restored", Status: ProcessingSucceeded, Deleted: true, DeletedAt: ago(48 * time.Hour)},
+	}
+	// restored after the trash was looked through
+	current := map[string]Photo{"restored": {ID: "restored", Status: ProcessingSucceeded}}
+	for _, photo := range photos {
+		storePhotoFiles(t, s, photo.ID)
+		if _, ok := current[photo.ID]; !ok {
+			current[photo.ID] = photo
+		}
+	}
+	db.On("Find", "Deleted", true, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*[]Photo) = photos
+	}).Return(nil)
+	db.On("One", "ID", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*Photo) = current[args.Get(1).(string)]
+	}).Return(nil)
+	db.On("Begin", true).Return(nil)
+	db.On("Commit").Return(nil)
+	db.On("Rollback").Return(nil)
+	deleted := []string{}
+	db.On("DeleteStruct", mock.Anything).Run(func(args mock.Arguments) {
+		deleted = append(deleted, args.Get(0).(*Photo).ID)
+	}).Return(nil)
+	db.On("All", mock.Anything, mock.Anything).Return(nil)
+
+	purged, err := s.purgeTrash()
+	require.Nil(t, err)
+	assert.EqualValues(t, 2, purged)
+	assert.EqualValues(t, []string{"old", "legacy"}, deleted)
+	for _, photo := range photos {
+		exists, err := s.photoFilesExist(photo)
+		require.Nil(t, err)
+		assert.Equal(t, photo.ID == "new" || photo.ID == "restored", exists, photo.ID)
+	}
+	db.AssertNumberOfCalls(t, "Commit", 2)
+
+	// the trash is kept forever without a retention
+	s.cfg.TrashRetention = 0
+	purged, err = s.purgeTrash()
+	require.Nil(t, err)
+	assert.EqualValues(t, 0, purged)
+	db.AssertNumberOfCalls(t, "Find", 1)
+}
+
+func TestGetTrash(t *testing.T) {
+	s, db, qu := prepareMockServer(t)
+	s.cfg.TrashRetention = 24 * time.Hour
+
+	at := func(hour int) *time.Time {
+		t := time.Date(2018, 3, 1, hour, 0, 0, 0, time.UTC)
+		return &t
+	}
+	db.On("Select", mock.Anything, mock.Anything).Return(qu)
+	qu.On("Find", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(0).(*[]Photo) = []Photo{
+			{ID: "a", Deleted: true, DeletedAt: at(9), TakenAt: at(2)},
+			{ID: "b", Deleted: true, DeletedAt: at(12), TakenAt: at(1)},
+		}
+	}).Return(nil)
+
+	get := func(query string) []TrashedPhoto {
+		r := httptest.NewRequest("GET", "/photos/trash?"+query, nil)
+		w := httptest.NewRecorder()
+		s.GetTrash(w, r)
+		require.EqualValues(t, 200, w.Code)
+		var v GetTrashResponse
+		err := json.Unmarshal(w.Body.Bytes(), &v)
+		require.Nil(t, err)
+		return v.Photos
+	}
+
+	// the most recently deleted come first
+	photos := get("")
+	require.Len(t, photos, 2)
+	assert.EqualValues(t, "b", photos[0].ID)
+	assert.EqualValues(t, time.Date(2018, 3, 2, 12, 0, 0, 0, time.UTC), *photos[0].PurgeAt)
+
+	photos = get("sort=taken_at")
+	assert.EqualValues(t, "b", photos[0].ID)
+	photos = get("sort=taken_at&order=desc")
+	assert.EqualValues(t, "a", photos[0].ID)
+}
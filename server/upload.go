@@ -0,0 +1,395 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/go-chi/chi"
+	"github.com/kochman/hotshots/log"
+)
+
+/*
+ * Resumable uploads
+ *
+ * A client creates an upload with POST /uploads and an Upload-Length header,
+ * sends the photo in chunks with PATCH /uploads/{uid} and an Upload-Offset header,
+ * asks HEAD /uploads/{uid} where to resume after a failure, and finally
+ * POST /uploads/{uid}/complete to process the assembled photo. The camera's name
+ * for the photo may be given in an Upload-Filename header when creating the upload.
+ *
+ * Clients that lose track of their uploads can give the photo's ID in an
+ * Upload-Photo-ID header, and creating an upload for a photo that already has one
+ * returns the existing upload instead. Uploads that stop receiving data are thrown
+ * away after UploadExpiry.
+ */
+
+// MaxUploadLength is the largest photo accepted through a resumable upload.
+const MaxUploadLength = 1 << 28 // 256M
+
+// UploadExpiry is how long an upload is kept without receiving any data.
+const UploadExpiry = 24 * time.Hour
+
+// uploadSweepInterval is how often expired uploads are looked for.
+const uploadSweepInterval = time.Hour
+
+type Upload struct {
+	ID        string     `storm:"id" json:"id"`
+	PhotoID   string     `storm:"index" json:"photo_id,omitempty"`
+	Length    int64      `json:"length"`
+	Offset    int64      `json:"offset"`
+	Overwrite bool       `json:"overwrite"`
+	Filename  string     `json:"filename"`
+	CreatedAt *time.Time `storm:"index" json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+type UploadResponse struct {
+	Success bool   `json:"success"`
+	ID      string `json:"id"`
+	Offset  int64  `json:"offset"`
+	Length  int64  `json:"length"`
+}
+
+func NewUpload(id string, length int64, overwrite bool) Upload {
+	now := time.Now()
+	return Upload{
+		ID:        id,
+		Length:    length,
+		Overwrite: overwrite,
+		CreatedAt: &now,
+		UpdatedAt: &now,
+	}
+}
+
+func GenUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", b), nil
+}
+
+func (s *Server) uploadPath(id string) string {
+	return path.Join(s.cfg.UploadFolder(), id)
+}
+
+// uploadLocks tracks which uploads are currently receiving data, so that
+// concurrent requests can't interleave writes to the same file.
+type uploadLocks struct {
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+func newUploadLocks() *uploadLocks {
+	return &uploadLocks{active: map[string]bool{}}
+}
+
+// lock marks an upload as busy, returning false if it already is.
+func (l *uploadLocks) lock(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[id] {
+		return false
+	}
+	l.active[id] = true
+	return true
+}
+
+func (l *uploadLocks) unlock(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.active, id)
+}
+
+func writeUploadResponse(upload Upload, status int, w http.ResponseWriter) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	WriteJsonResponse(&UploadResponse{
+		Success: true,
+		ID:      upload.ID,
+		Offset:  upload.Offset,
+		Length:  upload.Length,
+	}, status, w)
+}
+
+func (s *Server) UploadCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploadID := chi.URLParam(r, "uid")
+		var upload Upload
+		if err := s.db.One("ID", uploadID, &upload); err != nil {
+			log.Info(err)
+			WriteError("unable to find upload id", 404, w)
+			return
+		}
+		ctx := context.WithValue(r.Context(), "upload", upload)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (s *Server) PostUpload(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		WriteError("invalid Upload-Length header", 400, w)
+		return
+	}
+	if length > MaxUploadLength {
+		WriteError("upload too large", 413, w)
+		return
+	}
+
+	// the client may be resuming an upload it has lost track of
+	photoID := r.Header.Get("Upload-Photo-ID")
+	if photoID != "" {
+		var existing Upload
+		err := s.db.One("PhotoID", photoID, &existing)
+		if err == nil && existing.Length == length {
+			w.Header().Set("Location", "/uploads/"+existing.ID)
+			writeUploadResponse(existing, 200, w)
+			return
+		} else if err != nil && err != storm.ErrNotFound {
+			log.Error(err)
+			WriteError("unable to read from database", 500, w)
+			return
+		}
+	}
+
+	id, err := GenUploadID()
+	if err != nil {
+		log.Error(err)
+		WriteError("unable to generate upload ID", 500, w)
+		return
+	}
+
+	f, err := os.OpenFile(s.uploadPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
+	if err != nil {
+		log.Error(err)
+		WriteError("unable to create internal storage of upload", 500, w)
+		return
+	}
+	f.Close()
+
+	upload := NewUpload(id, length, r.URL.Query().Get("overwrite") == "true")
+	upload.Filename = r.Header.Get("Upload-Filename")
+	upload.PhotoID = photoID
+	if err := s.db.Save(&upload); err != nil {
+		log.Error(err)
+		os.Remove(s.uploadPath(id))
+		WriteError("unable to write to database", 500, w)
+		return
+	}
+
+	w.Header().Set("Location", "/uploads/"+id)
+	writeUploadResponse(upload, 201, w)
+}
+
+func (s *Server) HeadUpload(w http.ResponseWriter, r *http.Request) {
+	upload := r.Context().Value("upload").(Upload)
+	writeUploadResponse(upload, 200, w)
+}
+
+func (s *Server) PatchUpload(w http.ResponseWriter, r *http.Request) {
+	upload := r.Context().Value("upload").(Upload)
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		WriteError("invalid Upload-Offset header", 400, w)
+		return
+	}
+
+	if !s.uploads.lock(upload.ID) {
+		WriteError("upload is already receiving data", 409, w)
+		return
+	}
+	defer s.uploads.unlock(upload.ID)
+
+	// Another request may have moved the offset since the context was loaded.
+	if err := s.db.One("ID", upload.ID, &upload); err != nil {
+		log.Error(err)
+		WriteError("unable to read from database", 500, w)
+		return
+	}
+	if offset != upload.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		WriteError("Upload-Offset does not match current offset", 409, w)
+		return
+	}
+
+	f, err := os.OpenFile(s.uploadPath(upload.ID), os.O_WRONLY, 0660)
+	if err != nil {
+		log.Error(err)
+		WriteError("unable to access internal storage of upload", 500, w)
+		return
+	}
+	defer f.Close()
+
+	// Discard anything past the recorded offset left by an interrupted chunk.
+	if err := f.Truncate(upload.Offset); err != nil {
+		log.Error(err)
+		WriteError("unable to access internal storage of upload", 500, w)
+		return
+	}
+	if _, err := f.Seek(upload.Offset, io.SeekStart); err != nil {
+		log.Error(err)
+		WriteError("unable to access internal storage of upload", 500, w)
+		return
+	}
+
+	// Keep whatever arrived even if the connection drops partway through.
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, upload.Length-upload.Offset))
+	if err := f.Sync(); err != nil {
+		log.Error(err)
+		WriteError("unable to write internal storage of upload", 500, w)
+		return
+	}
+
+	upload.Offset += n
+	now := time.Now()
+	upload.UpdatedAt = &now
+	if err := s.db.Update(&upload); err != nil {
+		log.Error(err)
+		WriteError("unable to update upload database", 500, w)
+		return
+	}
+
+	if copyErr != nil {
+		log.Info(copyErr)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		WriteError("unable to read request body", 400, w)
+		return
+	}
+
+	writeUploadResponse(upload, 200, w)
+}
+
+func (s *Server) CompleteUpload(w http.ResponseWriter, r *http.Request) {
+	upload := r.Context().Value("upload").(Upload)
+	if upload.Offset != upload.Length {
+		WriteError("upload is incomplete", 400, w)
+		return
+	}
+
+	if !s.uploads.lock(upload.ID) {
+		WriteError("upload is already receiving data", 409, w)
+		return
+	}
+	defer s.uploads.unlock(upload.ID)
+
+	input, err := os.Open(s.uploadPath(upload.ID))
+	if err != nil {
+		log.Error(err)
+		WriteError("unable to access internal storage of upload", 500, w)
+		return
+	}
+	id, err := GenPhotoID(input)
+	input.Close()
+	if err != nil {
+		log.Error(err)
+		WriteError("unable to generate photo ID", 500, w)
+		return
+	}
+
+	// the upload is kept for the client to complete again if the photo couldn't be
+	// added for now, so that it doesn't have to send the photo again
+	if s.AddPhoto(s.uploadPath(upload.ID), id, upload.Filename, upload.Overwrite, w, r) {
+		// the file is already moved to the queue or removed
+		s.removeUpload(upload)
+	}
+}
+
+func (s *Server) DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	upload := r.Context().Value("upload").(Upload)
+
+	if !s.uploads.lock(upload.ID) {
+		WriteError("upload is already receiving data", 409, w)
+		return
+	}
+	defer s.uploads.unlock(upload.ID)
+
+	s.removeUpload(upload)
+	writeUploadResponse(upload, 200, w)
+}
+
+func (s *Server) removeUpload(upload Upload) {
+	if err := os.Remove(s.uploadPath(upload.ID)); err != nil && !os.IsNotExist(err) {
+		log.Error(err)
+	}
+	if err := s.db.DeleteStruct(&upload); err != nil {
+		log.Error(err)
+	}
+}
+
+// expireUploads throws away uploads that have stopped receiving data, until ctx is done.
+func (s *Server) expireUploads(ctx context.Context) {
+	ticker := time.NewTicker(uploadSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		if expired, err := s.removeExpiredUploads(time.Now()); err != nil {
+			log.Error(err)
+		} else if expired > 0 {
+			log.Infof("removed %d abandoned uploads", expired)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// removeExpiredUploads removes the uploads that haven't received data for longer than
+// UploadExpiry, along with any file in the upload folder that isn't part of an upload,
+// and returns how many uploads it removed.
+func (s *Server) removeExpiredUploads(now time.Time) (int, error) {
+	var uploads []Upload
+	if err := s.db.All(&uploads); err != nil && err != storm.ErrNotFound {
+		return 0, err
+	}
+
+	expired := 0
+	known := map[string]bool{}
+	for _, upload := range uploads {
+		known[upload.ID] = true
+		updated := upload.CreatedAt
+		if upload.UpdatedAt != nil {
+			updated = upload.UpdatedAt
+		}
+		if updated != nil && now.Sub(*updated) < UploadExpiry {
+			continue
+		}
+		if !s.uploads.lock(upload.ID) {
+			// it's receiving data right now
+			continue
+		}
+		s.removeUpload(upload)
+		s.uploads.unlock(upload.ID)
+		expired++
+	}
+
+	files, err := ioutil.ReadDir(s.cfg.UploadFolder())
+	if err != nil {
+		return expired, err
+	}
+	for _, file := range files {
+		if known[file.Name()] || now.Sub(file.ModTime()) < UploadExpiry {
+			continue
+		}
+		if err := os.Remove(path.Join(s.cfg.UploadFolder(), file.Name())); err != nil {
+			log.Error(err)
+		}
+	}
+
+	return expired, nil
+}
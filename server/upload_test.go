@@ -0,0 +1,268 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func MockUploadCtx(upload Upload, body []byte) *http.Request {
+	r := httptest.NewRequest("", "/", bytes.NewReader(body))
+	ctx := context.WithValue(r.Context(), "upload", upload)
+	return r.WithContext(ctx)
+}
+
+func prepareUploadServer(t *testing.T) (Server, *MockDB) {
+	s, db, _ := prepareMockServer(t)
+	err := os.Mkdir(s.cfg.UploadFolder(), 0755)
+	require.Nil(t, err)
+	return s, db
+}
+
+func TestPostUpload(t *testing.T) {
+	s, db := prepareUploadServer(t)
+	db.On("Save", mock.Anything).Return(nil)
+
+	// Missing length
+	r := httptest.NewRequest("POST", "/", nil)
+	w := httptest.NewRecorder()
+
+	s.PostUpload(w, r)
+	require.EqualValues(t, 400, w.Code)
+	db.AssertNumberOfCalls(t, "Save", 0)
+
+	// Too large
+	r = httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("Upload-Length", "999999999999")
+	w = httptest.NewRecorder()
+
+	s.PostUpload(w, r)
+	require.EqualValues(t, 413, w.Code)
+	db.AssertNumberOfCalls(t, "Save", 0)
+
+	// Valid
+	r = httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("Upload-Length", "5")
+	w = httptest.NewRecorder()
+
+	s.PostUpload(w, r)
+	require.EqualValues(t, 201, w.Code)
+	db.AssertNumberOfCalls(t, "Save", 1)
+
+	var v UploadResponse
+	b, _ := ioutil.ReadAll(w.Body)
+	err := json.Unmarshal(b, &v)
+	require.Nil(t, err)
+	assert.True(t, v.Success)
+	assert.EqualValues(t, 0, v.Offset)
+	assert.EqualValues(t, 5, v.Length)
+	assert.EqualValues(t, "/uploads/"+v.ID, w.Header().Get("Location"))
+
+	_, err = os.Stat(s.uploadPath(v.ID))
+	assert.Nil(t, err)
+}
+
+func TestPatchUpload(t *testing.T) {
+	s, db := prepareUploadServer(t)
+
+	upload := NewUpload("1234", 10, false)
+	err := ioutil.WriteFile(s.uploadPath(upload.ID), []byte("leftover"), 0660)
+	require.Nil(t, err)
+
+	stored := upload
+	db.On("One", "ID", "1234", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*Upload) = stored
+	}).Return(nil)
+	db.On("Update", mock.Anything).Run(func(args mock.Arguments) {
+		stored = *args.Get(0).(*Upload)
+	}).Return(nil)
+
+	// Wrong offset
+	r := MockUploadCtx(upload, []byte("hello"))
+	r.Header.Set("Upload-Offset", "3")
+	w := httptest.NewRecorder()
+
+	s.PatchUpload(w, r)
+	require.EqualValues(t, 409, w.Code)
+	assert.EqualValues(t, "0", w.Header().Get("Upload-Offset"))
+	db.AssertNumberOfCalls(t, "Update", 0)
+
+	// First chunk replaces anything past the recorded offset
+	r = MockUploadCtx(upload, []byte("hello"))
+	r.Header.Set("Upload-Offset", "0")
+	w = httptest.NewRecorder()
+
+	s.PatchUpload(w, r)
+	require.EqualValues(t, 200, w.Code)
+	assert.EqualValues(t, "5", w.Header().Get("Upload-Offset"))
+	db.AssertNumberOfCalls(t, "Update", 1)
+
+	// Second chunk is cut off at the upload length, even with a stale context
+	r = MockUploadCtx(upload, []byte(" there!"))
+	r.Header.Set("Upload-Offset", "5")
+	w = httptest.NewRecorder()
+
+	s.PatchUpload(w, r)
+	require.EqualValues(t, 200, w.Code)
+
+	var v UploadResponse
+	b, _ := ioutil.ReadAll(w.Body)
+	err = json.Unmarshal(b, &v)
+	require.Nil(t, err)
+	assert.EqualValues(t, 10, v.Offset)
+
+	contents, err := ioutil.ReadFile(s.uploadPath(upload.ID))
+	require.Nil(t, err)
+	assert.EqualValues(t, "hello ther", string(contents))
+}
+
+func TestHeadUpload(t *testing.T) {
+	s, _ := prepareUploadServer(t)
+
+	upload := NewUpload("1234", 10, false)
+	upload.Offset = 4
+
+	r := MockUploadCtx(upload, nil)
+	w := httptest.NewRecorder()
+
+	s.HeadUpload(w, r)
+	require.EqualValues(t, 200, w.Code)
+	assert.EqualValues(t, "4", w.Header().Get("Upload-Offset"))
+	assert.EqualValues(t, "10", w.Header().Get("Upload-Length"))
+}
+
+func TestCompleteUploadIncomplete(t *testing.T) {
+	s, _ := prepareUploadServer(t)
+
+	upload := NewUpload("1234", 10, false)
+	upload.Offset = 4
+
+	r := MockUploadCtx(upload, nil)
+	w := httptest.NewRecorder()
+
+	s.CompleteUpload(w, r)
+	require.EqualValues(t, 400, w.Code)
+
+	var v ErrorResponse
+	b, _ := ioutil.ReadAll(w.Body)
+	err := json.Unmarshal(b, &v)
+	require.Nil(t, err)
+	assert.EqualValues(t, "upload is incomplete", v.Error)
+}
+
+func TestCompleteUpload(t *testing.T) {
+	s, db := prepareUploadServer(t)
+
+	data := encodeJPEG(t, 64, 48)
+	upload := NewUpload("1234", int64(len(data)), false)
+	upload.Offset = upload.Length
+	err := ioutil.WriteFile(s.uploadPath(upload.ID), data, 0660)
+	require.Nil(t, err)
+
+	db.On("One", mock.Anything, mock.Anything, mock.Anything).Return(storm.ErrNotFound)
+	db.On("Save", mock.Anything).Return(errors.New("database is busy")).Once()
+	db.On("Save", mock.Anything).Return(nil)
+	db.On("DeleteStruct", mock.Anything).Return(nil)
+
+	// the upload is kept when the photo can't be added for now
+	w := httptest.NewRecorder()
+	s.CompleteUpload(w, MockUploadCtx(upload, nil))
+	require.EqualValues(t, 500, w.Code)
+	_, err = os.Stat(s.uploadPath(upload.ID))
+	assert.Nil(t, err)
+	db.AssertNotCalled(t, "DeleteStruct", mock.Anything)
+
+	// so completing it again adds the photo, without sending it again
+	w = httptest.NewRecorder()
+	s.CompleteUpload(w, MockUploadCtx(upload, nil))
+	require.EqualValues(t, 200, w.Code)
+	_, err = os.Stat(s.uploadPath(upload.ID))
+	assert.True(t, os.IsNotExist(err))
+	db.AssertCalled(t, "DeleteStruct", &upload)
+}
+
+func TestPostUploadExisting(t *testing.T) {
+	s, db := prepareUploadServer(t)
+
+	existing := NewUpload("1234", 5, false)
+	existing.PhotoID = "abc"
+	existing.Offset = 3
+	db.On("One", "PhotoID", "abc", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*Upload) = existing
+	}).Return(nil)
+	db.On("One", "PhotoID", "def", mock.Anything).Return(storm.ErrNotFound)
+	db.On("Save", mock.Anything).Return(nil)
+
+	// the client picks up where it left off
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("Upload-Length", "5")
+	r.Header.Set("Upload-Photo-ID", "abc")
+	w := httptest.NewRecorder()
+
+	s.PostUpload(w, r)
+	require.EqualValues(t, 200, w.Code)
+	assert.EqualValues(t, "3", w.Header().Get("Upload-Offset"))
+	assert.EqualValues(t, "/uploads/1234", w.Header().Get("Location"))
+	db.AssertNumberOfCalls(t, "Save", 0)
+
+	// a photo with no upload gets a new one
+	r = httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("Upload-Length", "5")
+	r.Header.Set("Upload-Photo-ID", "def")
+	w = httptest.NewRecorder()
+
+	s.PostUpload(w, r)
+	require.EqualValues(t, 201, w.Code)
+	db.AssertNumberOfCalls(t, "Save", 1)
+	assert.EqualValues(t, "def", db.Calls[len(db.Calls)-1].Arguments.Get(0).(*Upload).PhotoID)
+}
+
+func TestRemoveExpiredUploads(t *testing.T) {
+	s, db := prepareUploadServer(t)
+
+	now := time.Now()
+	recent := NewUpload("recent", 10, false)
+	abandoned := NewUpload("abandoned", 10, false)
+	old := now.Add(-2 * UploadExpiry)
+	abandoned.UpdatedAt = &old
+	busy := NewUpload("busy", 10, false)
+	busy.UpdatedAt = &old
+	for _, id := range []string{"recent", "abandoned", "busy", "stray"} {
+		err := ioutil.WriteFile(s.uploadPath(id), []byte("partial"), 0660)
+		require.Nil(t, err)
+	}
+	err := os.Chtimes(s.uploadPath("stray"), old, old)
+	require.Nil(t, err)
+
+	db.On("All", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(0).(*[]Upload) = []Upload{recent, abandoned, busy}
+	}).Return(nil)
+	db.On("DeleteStruct", mock.Anything).Return(nil)
+
+	// uploads receiving data are left alone
+	s.uploads.lock("busy")
+	defer s.uploads.unlock("busy")
+
+	expired, err := s.removeExpiredUploads(now)
+	require.Nil(t, err)
+	assert.EqualValues(t, 1, expired)
+	db.AssertNumberOfCalls(t, "DeleteStruct", 1)
+	assert.EqualValues(t, "abandoned", db.Calls[len(db.Calls)-1].Arguments.Get(0).(*Upload).ID)
+
+	for id, exists := range map[string]bool{"recent": true, "abandoned": false, "busy": true, "stray": false} {
+		_, err := os.Stat(s.uploadPath(id))
+		assert.EqualValues(t, exists, err == nil, id)
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/asdine/storm"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+ * Users
+ *
+ * Each user has a role, which decides the routes they may use:
+ *   photographer  upload photos, as a pusher does
+ *   viewer        look at photos and their tags
+ *   editor        everything a viewer can do, plus upload, tag and delete photos
+ *   admin         everything, including managing webhooks
+ *
+ * Users are managed with the `hotshots user` commands.
+ */
+
+const (
+	RoleAdmin        = "admin"
+	RoleEditor       = "editor"
+	RolePhotographer = "photographer"
+	RoleViewer       = "viewer"
+)
+
+// Roles allowed on each group of routes. Photo IDs are listed for everyone, for the
+// dashboard and the pusher.
+var (
+	everyone  = []string{RoleViewer, RolePhotographer, RoleEditor, RoleAdmin}
+	readers   = []string{RoleViewer, RoleEditor, RoleAdmin}
+	uploaders = []string{RolePhotographer, RoleEditor, RoleAdmin}
+	editors   = []string{RoleEditor, RoleAdmin}
+	admins    = []string{RoleAdmin}
+)
+
+// MinPasswordLength is the shortest password a user may have.
+const MinPasswordLength = 8
+
+var (
+	UserExists       = errors.New("user already exists")
+	InvalidUsername  = errors.New("usernames may only contain letters, numbers, '.', '_' and '-'")
+	InvalidRole      = errors.New("role must be one of admin, editor, photographer or viewer")
+	PasswordTooShort = errors.New("password must be at least 8 characters")
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+type User struct {
+	Username     string     `storm:"id" json:"username"`
+	PasswordHash []byte     `json:"password_hash,omitempty"`
+	Role         string     `json:"role"`
+	CreatedAt    *time.Time `json:"created_at"`
+}
+
+func ValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleEditor || role == RolePhotographer || role == RoleViewer
+}
+
+// NewUser creates a user with a hashed password.
+func NewUser(username string, password string, role string) (User, error) {
+	if !usernamePattern.MatchString(username) {
+		return User{}, InvalidUsername
+	}
+	if !ValidRole(role) {
+		return User{}, InvalidRole
+	}
+
+	now := time.Now()
+	user := User{
+		Username:  username,
+		Role:      role,
+		CreatedAt: &now,
+	}
+	if err := user.SetPassword(password); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (u *User) SetPassword(password string) error {
+	if len(password) < MinPasswordLength {
+		return PasswordTooShort
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = hash
+	return nil
+}
+
+func (u *User) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password)) == nil
+}
+
+// HasRole returns whether the user has one of the given roles.
+func (u *User) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		if u.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Management, used by the CLI
+ */
+
+func AddUser(db PhotoDB, username string, password string, role string) error {
+	user, err := NewUser(username, password, role)
+	if err != nil {
+		return err
+	}
+
+	var existing User
+	if err := db.One("Username", username, &existing); err == nil {
+		return UserExists
+	} else if err != storm.ErrNotFound {
+		return err
+	}
+
+	return db.Save(&user)
+}
+
+func ListUsers(db PhotoDB) ([]User, error) {
+	var users []User
+	if err := db.All(&users); err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return users, nil
+}
+
+func RemoveUser(db PhotoDB, username string) error {
+	var user User
+	if err := db.One("Username", username, &user); err != nil {
+		return err
+	}
+	return db.DeleteStruct(&user)
+}
+
+func SetUserPassword(db PhotoDB, username string, password string) error {
+	var user User
+	if err := db.One("Username", username, &user); err != nil {
+		return err
+	}
+	if err := user.SetPassword(password); err != nil {
+		return err
+	}
+	return db.Update(&user)
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/asdine/storm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewUser(t *testing.T) {
+	user, err := NewUser("ana", "correct horse", RoleEditor)
+	require.Nil(t, err)
+	assert.EqualValues(t, "ana", user.Username)
+	assert.EqualValues(t, RoleEditor, user.Role)
+	assert.True(t, user.CheckPassword("correct horse"))
+	assert.False(t, user.CheckPassword("battery staple"))
+
+	_, err = NewUser("ana smith", "correct horse", RoleEditor)
+	assert.EqualValues(t, InvalidUsername, err)
+
+	_, err = NewUser("ana", "correct horse", "owner")
+	assert.EqualValues(t, InvalidRole, err)
+
+	_, err = NewUser("ana", "short", RoleEditor)
+	assert.EqualValues(t, PasswordTooShort, err)
+}
+
+func TestAddUser(t *testing.T) {
+	_, db, _ := prepareMockServer(t)
+
+	db.On("One", "Username", "ana", mock.Anything).Return(nil)
+	db.On("One", "Username", "ben", mock.Anything).Return(storm.ErrNotFound)
+	db.On("Save", mock.Anything).Return(nil)
+
+	err := AddUser(db, "ana", "correct horse", RoleViewer)
+	assert.EqualValues(t, UserExists, err)
+	db.AssertNotCalled(t, "Save", mock.Anything)
+
+	err = AddUser(db, "ben", "correct horse", RolePhotographer)
+	require.Nil(t, err)
+	saved := db.Calls[len(db.Calls)-1].Arguments.Get(0).(*User)
+	assert.EqualValues(t, "ben", saved.Username)
+	assert.EqualValues(t, RolePhotographer, saved.Role)
+}
+
+func TestSetUserPassword(t *testing.T) {
+	_, db, _ := prepareMockServer(t)
+
+	db.On("One", "Username", "ana", mock.Anything).Run(func(args mock.Arguments) {
+		user := args.Get(2).(*User)
+		user.Username = "ana"
+		user.Role = RoleEditor
+	}).Return(nil)
+	db.On("One", "Username", "ben", mock.Anything).Return(storm.ErrNotFound)
+	db.On("Update", mock.Anything).Return(nil)
+
+	err := SetUserPassword(db, "ben", "correct horse")
+	assert.EqualValues(t, storm.ErrNotFound, err)
+
+	err = SetUserPassword(db, "ana", "short")
+	assert.EqualValues(t, PasswordTooShort, err)
+
+	err = SetUserPassword(db, "ana", "correct horse")
+	require.Nil(t, err)
+	updated := db.Calls[len(db.Calls)-1].Arguments.Get(0).(*User)
+	assert.EqualValues(t, RoleEditor, updated.Role)
+	assert.True(t, updated.CheckPassword("correct horse"))
+}
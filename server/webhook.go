@@ -0,0 +1,522 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/go-chi/chi"
+	"github.com/kochman/hotshots/log"
+)
+
+/*
+ * Webhooks
+ *
+ * Webhooks are POSTed a JSON Event, the same as the ones on the event stream, for
+ * each event they subscribe to. A webhook with no events gets every event, and one
+ * with a tag only gets events for photos with that tag. Each delivery is signed with
+ * the webhook's secret in an X-Hotshots-Signature header of the form sha256=<hex HMAC>.
+ *
+ * Deliveries are kept in the database and sent by a background worker, which retries
+ * failed ones with exponential backoff until WebhookMaxAttempts is reached. Finished
+ * deliveries are removed once they're older than WebhookDeliveryRetention.
+ */
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookMaxAttempts is how many times a delivery is tried before it's marked failed.
+const WebhookMaxAttempts = 8
+
+// WebhookDeliveryRetention is how long delivered and failed deliveries are kept.
+const WebhookDeliveryRetention = 7 * 24 * time.Hour
+
+const (
+	webhookRetryDelay    = 30 * time.Second
+	webhookPollInterval  = 10 * time.Second
+	webhookPruneInterval = time.Hour
+	webhookTimeout       = 10 * time.Second
+)
+
+var webhookEvents = []string{
+	EventPhotoCreated,
+	EventPhotoProcessed,
+	EventPhotoFailed,
+	EventPhotoDeleted,
+	EventPhotoRotated,
+	EventPhotoRestored,
+	EventPhotoPurged,
+	EventTagAdded,
+	EventTagRemoved,
+	EventTagRenamed,
+}
+
+type Webhook struct {
+	ID        int        `storm:"id,increment" json:"id"`
+	URL       string     `json:"url"`
+	Events    []string   `json:"events"`
+	Tag       string     `json:"tag"`
+	Secret    string     `json:"secret"`
+	CreatedAt *time.Time `json:"created_at"`
+}
+
+type Delivery struct {
+	ID          int             `storm:"id,increment" json:"id"`
+	WebhookID   int             `storm:"index" json:"webhook_id"`
+	EventID     uint64          `json:"event_id"`
+	EventType   string          `json:"event_type"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `storm:"index" json:"status"`
+	Attempts    int             `json:"attempts"`
+	StatusCode  int             `json:"status_code"`
+	Error       string          `json:"error"`
+	CreatedAt   *time.Time      `storm:"index" json:"created_at"`
+	NextAttempt *time.Time      `json:"next_attempt"`
+	DeliveredAt *time.Time      `json:"delivered_at"`
+}
+
+type WebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Tag    string   `json:"tag"`
+	Secret string   `json:"secret"`
+}
+
+type WebhookResponse struct {
+	Success bool    `json:"success"`
+	Webhook Webhook `json:"webhook"`
+}
+
+type GetWebhooksResponse struct {
+	Success  bool      `json:"success"`
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+type GetDeliveriesResponse struct {
+	Success    bool       `json:"success"`
+	Deliveries []Delivery `json:"deliveries"`
+}
+
+// Matches returns whether the webhook subscribes to an event.
+func (h *Webhook) Matches(event Event) bool {
+	if len(h.Events) > 0 && !contains(h.Events, event.Type) {
+		return false
+	}
+	if h.Tag != "" && TagSlug(event.Tag) != TagSlug(h.Tag) && !event.Photo.HasTag(h.Tag) {
+		return false
+	}
+	return true
+}
+
+// redacted returns the webhook without its secret, for responses.
+func (h Webhook) redacted() Webhook {
+	if h.Secret != "" {
+		h.Secret = "redacted"
+	}
+	return h
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SignPayload returns the X-Hotshots-Signature header for a payload.
+func SignPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return fmt.Sprintf("sha256=%x", mac.Sum(nil))
+}
+
+func genWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", b), nil
+}
+
+// retryDelay is how long to wait before the next attempt after a number of failed ones.
+func retryDelay(attempts int) time.Duration {
+	return webhookRetryDelay << uint(attempts-1)
+}
+
+// webhookWorker wakes the delivery worker when there are new deliveries.
+type webhookWorker struct {
+	wake   chan struct{}
+	client *http.Client
+}
+
+func newWebhookWorker() *webhookWorker {
+	return &webhookWorker{
+		wake:   make(chan struct{}, 1),
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// publish sends an event to the event stream and queues it for every webhook that
+// subscribes to it.
+func (s *Server) publish(eventType string, photo Photo, tag string) Event {
+	event := s.events.publish(eventType, photo, tag)
+
+	var hooks []Webhook
+	if err := s.db.All(&hooks); err != nil {
+		log.Error(err)
+		return event
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Error(err)
+		return event
+	}
+
+	queued := false
+	for _, hook := range hooks {
+		if !hook.Matches(event) {
+			continue
+		}
+		now := time.Now()
+		delivery := Delivery{
+			WebhookID:   hook.ID,
+			EventID:     event.ID,
+			EventType:   event.Type,
+			Payload:     payload,
+			Status:      DeliveryPending,
+			CreatedAt:   &now,
+			NextAttempt: &now,
+		}
+		if err := s.db.Save(&delivery); err != nil {
+			log.Error(err)
+			continue
+		}
+		queued = true
+	}
+
+	if queued {
+		select {
+		case s.webhooks.wake <- struct{}{}:
+		default:
+		}
+	}
+	return event
+}
+
+// deliverWebhooks sends pending deliveries and prunes old ones until ctx is done.
+func (s *Server) deliverWebhooks(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	pruneTicker := time.NewTicker(webhookPruneInterval)
+	defer pruneTicker.Stop()
+
+	s.logPrunedDeliveries()
+	for {
+		s.deliverPending(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.webhooks.wake:
+		case <-pruneTicker.C:
+			s.logPrunedDeliveries()
+		}
+	}
+}
+
+func (s *Server) logPrunedDeliveries() {
+	if pruned, err := s.pruneDeliveries(); err != nil {
+		log.Error(err)
+	} else if pruned > 0 {
+		log.Infof("removed %d old webhook deliveries", pruned)
+	}
+}
+
+// pruneDeliveries removes the delivered and failed deliveries that are older than
+// WebhookDeliveryRetention, and returns how many it removed.
+func (s *Server) pruneDeliveries() (int, error) {
+	pruned := 0
+	for _, status := range []string{DeliveryDelivered, DeliveryFailed} {
+		var deliveries []Delivery
+		if err := s.db.Find("Status", status, &deliveries); err != nil {
+			if err == storm.ErrNotFound {
+				continue
+			}
+			return pruned, err
+		}
+		for _, delivery := range deliveries {
+			if delivery.CreatedAt != nil && time.Since(*delivery.CreatedAt) < WebhookDeliveryRetention {
+				continue
+			}
+			if err := s.db.DeleteStruct(&delivery); err != nil && err != storm.ErrNotFound {
+				return pruned, err
+			}
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// deliverPending attempts the deliveries that are due, stopping early if ctx is done.
+func (s *Server) deliverPending(ctx context.Context) {
+	var deliveries []Delivery
+	if err := s.db.Find("Status", DeliveryPending, &deliveries); err != nil {
+		if err != storm.ErrNotFound {
+			log.Error(err)
+		}
+		return
+	}
+
+	now := time.Now()
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil {
+			return
+		}
+		if delivery.NextAttempt != nil && delivery.NextAttempt.After(now) {
+			continue
+		}
+
+		var hook Webhook
+		if err := s.db.One("ID", delivery.WebhookID, &hook); err != nil {
+			log.Error(err)
+			delivery.Status = DeliveryFailed
+			delivery.Error = "webhook not found"
+			delivery.NextAttempt = nil
+			if err := s.db.Save(&delivery); err != nil {
+				log.Error(err)
+			}
+			continue
+		}
+
+		s.attemptDelivery(ctx, hook, &delivery)
+		// Save writes every field, where Update leaves out zero values such as the
+		// error of an earlier attempt that's been cleared
+		if err := s.db.Save(&delivery); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// attemptDelivery sends a delivery to its webhook once, recording the outcome.
+func (s *Server) attemptDelivery(ctx context.Context, hook Webhook, delivery *Delivery) {
+	delivery.Attempts++
+	delivery.StatusCode = 0
+	delivery.Error = ""
+
+	err := s.postWebhook(ctx, hook, delivery)
+	now := time.Now()
+	if err == nil {
+		delivery.Status = DeliveryDelivered
+		delivery.DeliveredAt = &now
+		delivery.NextAttempt = nil
+		return
+	}
+
+	if ctx.Err() != nil {
+		// cut short by shutdown, so it's tried again as if this attempt never happened
+		delivery.Attempts--
+		return
+	}
+
+	log.Infof("delivery %d to webhook %d failed: %s", delivery.ID, hook.ID, err)
+	delivery.Error = err.Error()
+	if delivery.Attempts >= WebhookMaxAttempts {
+		delivery.Status = DeliveryFailed
+		delivery.NextAttempt = nil
+		return
+	}
+	next := now.Add(retryDelay(delivery.Attempts))
+	delivery.NextAttempt = &next
+}
+
+func (s *Server) postWebhook(ctx context.Context, hook Webhook, delivery *Delivery) error {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Hotshots")
+	req.Header.Set("X-Hotshots-Event", delivery.EventType)
+	req.Header.Set("X-Hotshots-Delivery", strconv.Itoa(delivery.ID))
+	if hook.Secret != "" {
+		req.Header.Set("X-Hotshots-Signature", SignPayload(hook.Secret, delivery.Payload))
+	}
+
+	resp, err := s.webhooks.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	delivery.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+/*
+ * Handlers
+ */
+
+func (s *Server) WebhookCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "wid"))
+		if err != nil {
+			WriteError("unable to find webhook id", 404, w)
+			return
+		}
+		var hook Webhook
+		if err := s.db.One("ID", id, &hook); err != nil {
+			log.Info(err)
+			WriteError("unable to find webhook id", 404, w)
+			return
+		}
+		ctx := context.WithValue(r.Context(), "webhook", hook)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (s *Server) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	var hooks []Webhook
+	if err := s.db.All(&hooks); err != nil {
+		log.Error(err)
+		WriteError("unable to query webhooks", 500, w)
+		return
+	}
+
+	v := GetWebhooksResponse{
+		Success:  true,
+		Webhooks: []Webhook{},
+	}
+	for _, hook := range hooks {
+		v.Webhooks = append(v.Webhooks, hook.redacted())
+	}
+	WriteJsonResponse(&v, 200, w)
+}
+
+func (s *Server) PostWebhook(w http.ResponseWriter, r *http.Request) {
+	var req WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError("unable to parse request body", 400, w)
+		return
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		WriteError("invalid webhook url", 400, w)
+		return
+	}
+	for _, event := range req.Events {
+		if !contains(webhookEvents, event) {
+			WriteError("unknown event: "+event, 400, w)
+			return
+		}
+	}
+	if req.Secret == "" {
+		secret, err := genWebhookSecret()
+		if err != nil {
+			log.Error(err)
+			WriteError("unable to generate webhook secret", 500, w)
+			return
+		}
+		req.Secret = secret
+	}
+
+	now := time.Now()
+	hook := Webhook{
+		URL:       req.URL,
+		Events:    req.Events,
+		Tag:       req.Tag,
+		Secret:    req.Secret,
+		CreatedAt: &now,
+	}
+	if hook.Events == nil {
+		hook.Events = []string{}
+	}
+	if err := s.db.Save(&hook); err != nil {
+		log.Error(err)
+		WriteError("unable to write to database", 500, w)
+		return
+	}
+
+	// the secret is only ever shown here
+	WriteJsonResponse(&WebhookResponse{
+		Success: true,
+		Webhook: hook,
+	}, 201, w)
+}
+
+func (s *Server) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	hook := r.Context().Value("webhook").(Webhook)
+	WriteJsonResponse(&WebhookResponse{
+		Success: true,
+		Webhook: hook.redacted(),
+	}, 200, w)
+}
+
+func (s *Server) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	hook := r.Context().Value("webhook").(Webhook)
+
+	if err := s.db.DeleteStruct(&hook); err != nil {
+		log.Error(err)
+		WriteError("unable to update webhook database", 500, w)
+		return
+	}
+	if err := s.db.Select(q.Eq("WebhookID", hook.ID)).Delete(&Delivery{}); err != nil && err != storm.ErrNotFound {
+		log.Error(err)
+	}
+
+	WriteJsonResponse(&WebhookResponse{
+		Success: true,
+		Webhook: hook.redacted(),
+	}, 200, w)
+}
+
+func (s *Server) GetDeliveries(w http.ResponseWriter, r *http.Request) {
+	hook := r.Context().Value("webhook").(Webhook)
+
+	start, limit, err := GetPaginateValues(r)
+	if err != nil {
+		log.Error(err)
+		WriteError("Unable to parse query string", 400, w)
+		return
+	}
+
+	var deliveries []Delivery
+	query := s.db.Select(q.Eq("WebhookID", hook.ID)).OrderBy("CreatedAt").Reverse().Skip(start).Limit(limit)
+	if err := query.Find(&deliveries); err != nil && err != storm.ErrNotFound {
+		log.Error(err)
+		WriteError("unable to query deliveries", 500, w)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []Delivery{}
+	}
+
+	WriteJsonResponse(&GetDeliveriesResponse{
+		Success:    true,
+		Deliveries: deliveries,
+	}, 200, w)
+}
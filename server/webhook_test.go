@@ -0,0 +1,291 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookMatches(t *testing.T) {
+	all := Webhook{}
+	processed := Webhook{Events: []string{EventPhotoProcessed}}
+	goals := Webhook{Events: []string{EventPhotoProcessed, EventTagAdded}, Tag: "goal"}
+
+	event := Event{Type: EventPhotoProcessed, Photo: Photo{ID: "1234"}}
+	assert.True(t, all.Matches(event))
+	assert.True(t, processed.Matches(event))
+	assert.False(t, goals.Matches(event))
+
+	event = Event{Type: EventPhotoProcessed, Photo: Photo{ID: "1234", Tags: []string{"goal"}}}
+	assert.True(t, goals.Matches(event))
+
+	event = Event{Type: EventTagAdded, Photo: Photo{ID: "1234", Tags: []string{"goal"}}, Tag: "goal"}
+	assert.False(t, processed.Matches(event))
+	assert.True(t, goals.Matches(event))
+
+	// the removed tag is no longer on the photo
+	event = Event{Type: EventTagRemoved, Photo: Photo{ID: "1234"}, Tag: "goal"}
+	assert.True(t, all.Matches(event))
+	assert.False(t, goals.Matches(event))
+	assert.True(t, (&Webhook{Tag: "goal"}).Matches(event))
+
+	// tags are compared by their slugs
+	event = Event{Type: EventTagRenamed, Photo: Photo{ID: "1234", Tags: []string{"Red Sox"}}, Tag: "Red Sox"}
+	assert.True(t, (&Webhook{Tag: "red-sox"}).Matches(event))
+	event.Tag = "Boston"
+	assert.True(t, (&Webhook{Tag: "red sox"}).Matches(event))
+	assert.False(t, (&Webhook{Tag: "red"}).Matches(event))
+}
+
+func TestSignPayload(t *testing.T) {
+	assert.EqualValues(t, "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8",
+		SignPayload("key", []byte("The quick brown fox jumps over the lazy dog")))
+}
+
+func TestPublishWebhooks(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+
+	db.On("All", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		hooks := args.Get(0).(*[]Webhook)
+		*hooks = []Webhook{
+			{ID: 1, Events: []string{EventTagAdded}},
+			{ID: 2, Events: []string{EventPhotoDeleted}},
+		}
+	}).Return(nil)
+
+	var saved []Delivery
+	db.On("Save", mock.Anything).Run(func(args mock.Arguments) {
+		saved = append(saved, *args.Get(0).(*Delivery))
+	}).Return(nil)
+
+	event := s.publish(EventTagAdded, Photo{ID: "1234", Tags: []string{"goal"}}, "goal")
+
+	require.Len(t, saved, 1)
+	assert.EqualValues(t, 1, saved[0].WebhookID)
+	assert.EqualValues(t, event.ID, saved[0].EventID)
+	assert.EqualValues(t, DeliveryPending, saved[0].Status)
+
+	var payload Event
+	err := json.Unmarshal(saved[0].Payload, &payload)
+	require.Nil(t, err)
+	assert.EqualValues(t, "goal", payload.Tag)
+	assert.EqualValues(t, "1234", payload.Photo.ID)
+
+	// the worker is woken up
+	select {
+	case <-s.webhooks.wake:
+	default:
+		t.Error("worker not woken")
+	}
+}
+
+func TestAttemptDelivery(t *testing.T) {
+	s, _, _ := prepareMockServer(t)
+
+	status := 200
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.EqualValues(t, SignPayload("secret", body), r.Header.Get("X-Hotshots-Signature"))
+		assert.EqualValues(t, EventPhotoProcessed, r.Header.Get("X-Hotshots-Event"))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	hook := Webhook{ID: 1, URL: server.URL, Secret: "secret"}
+	delivery := Delivery{ID: 1, WebhookID: 1, EventType: EventPhotoProcessed, Payload: []byte(`{"id":1}`), Status: DeliveryPending}
+
+	s.attemptDelivery(context.Background(), hook, &delivery)
+	assert.EqualValues(t, DeliveryDelivered, delivery.Status)
+	assert.EqualValues(t, 1, delivery.Attempts)
+	assert.EqualValues(t, 200, delivery.StatusCode)
+	assert.NotNil(t, delivery.DeliveredAt)
+
+	// failures are retried later
+	status = 500
+	delivery = Delivery{ID: 2, WebhookID: 1, EventType: EventPhotoProcessed, Payload: []byte(`{"id":2}`), Status: DeliveryPending}
+	before := time.Now()
+	s.attemptDelivery(context.Background(), hook, &delivery)
+	assert.EqualValues(t, DeliveryPending, delivery.Status)
+	assert.EqualValues(t, 500, delivery.StatusCode)
+	assert.NotEmpty(t, delivery.Error)
+	require.NotNil(t, delivery.NextAttempt)
+	assert.True(t, delivery.NextAttempt.After(before.Add(webhookRetryDelay-time.Second)))
+
+	s.attemptDelivery(context.Background(), hook, &delivery)
+	assert.True(t, delivery.NextAttempt.After(before.Add(2*webhookRetryDelay)))
+
+	// until there have been too many attempts
+	delivery.Attempts = WebhookMaxAttempts - 1
+	s.attemptDelivery(context.Background(), hook, &delivery)
+	assert.EqualValues(t, DeliveryFailed, delivery.Status)
+	assert.Nil(t, delivery.NextAttempt)
+}
+
+func TestDeliverPendingCanceled(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("delivery sent after shutdown")
+	}))
+	defer server.Close()
+
+	db.On("Find", "Status", DeliveryPending, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*[]Delivery) = []Delivery{{ID: 1, WebhookID: 1, Status: DeliveryPending}}
+	}).Return(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.deliverPending(ctx)
+	db.AssertNotCalled(t, "One", "ID", 1, mock.Anything)
+	db.AssertNotCalled(t, "Save", mock.Anything)
+
+	// a delivery cut short doesn't use up an attempt
+	hook := Webhook{ID: 1, URL: server.URL}
+	delivery := Delivery{ID: 1, WebhookID: 1, Payload: []byte(`{"id":1}`), Status: DeliveryPending, Attempts: 2}
+	s.attemptDelivery(ctx, hook, &delivery)
+	assert.EqualValues(t, DeliveryPending, delivery.Status)
+	assert.EqualValues(t, 2, delivery.Attempts)
+}
+
+func TestDeliverPendingRetried(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	earlier := time.Now().Add(-time.Minute)
+	db.On("Find", "Status", DeliveryPending, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*[]Delivery) = []Delivery{{ID: 1, WebhookID: 1, Payload: []byte(`{"id":1}`),
+			Status: DeliveryPending, Attempts: 1, StatusCode: 500, Error: "500 Internal Server Error", NextAttempt: &earlier}}
+	}).Return(nil)
+	db.On("One", "ID", 1, mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*Webhook) = Webhook{ID: 1, URL: server.URL}
+	}).Return(nil)
+	var saved []Delivery
+	db.On("Save", mock.Anything).Run(func(args mock.Arguments) {
+		saved = append(saved, *args.Get(0).(*Delivery))
+	}).Return(nil)
+
+	// the earlier attempt's error is cleared along with it
+	s.deliverPending(context.Background())
+	require.Len(t, saved, 1)
+	assert.EqualValues(t, DeliveryDelivered, saved[0].Status)
+	assert.EqualValues(t, 200, saved[0].StatusCode)
+	assert.Empty(t, saved[0].Error)
+	assert.Nil(t, saved[0].NextAttempt)
+	db.AssertNotCalled(t, "Update", mock.Anything)
+}
+
+func TestPruneDeliveries(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+
+	recent := time.Now().Add(-time.Hour)
+	old := time.Now().Add(-WebhookDeliveryRetention - time.Hour)
+	db.On("Find", "Status", DeliveryDelivered, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*[]Delivery) = []Delivery{
+			{ID: 1, Status: DeliveryDelivered, CreatedAt: &old},
+			{ID: 2, Status: DeliveryDelivered, CreatedAt: &recent},
+		}
+	}).Return(nil)
+	db.On("Find", "Status", DeliveryFailed, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(2).(*[]Delivery) = []Delivery{{ID: 3, Status: DeliveryFailed, CreatedAt: &old}}
+	}).Return(nil)
+	var deleted []int
+	db.On("DeleteStruct", mock.Anything).Run(func(args mock.Arguments) {
+		deleted = append(deleted, args.Get(0).(*Delivery).ID)
+	}).Return(nil)
+
+	pruned, err := s.pruneDeliveries()
+	require.Nil(t, err)
+	assert.EqualValues(t, 2, pruned)
+	assert.EqualValues(t, []int{1, 3}, deleted)
+
+	// pending deliveries are never pruned, however old
+	db.AssertNotCalled(t, "Find", "Status", DeliveryPending, mock.Anything, mock.Anything)
+}
+
+func TestPostWebhook(t *testing.T) {
+	s, db, _ := prepareMockServer(t)
+	db.On("Save", mock.Anything).Run(func(args mock.Arguments) {
+		args.Get(0).(*Webhook).ID = 1
+	}).Return(nil)
+
+	for _, body := range []string{
+		`nope`,
+		`{"url": "ftp://example.com"}`,
+		`{"url": "https://example.com", "events": ["photo.exploded"]}`,
+	} {
+		w := httptest.NewRecorder()
+		s.PostWebhook(w, httptest.NewRequest("POST", "/", bytes.NewBufferString(body)))
+		assert.EqualValues(t, 400, w.Code, body)
+	}
+	db.AssertNotCalled(t, "Save", mock.Anything)
+
+	w := httptest.NewRecorder()
+	s.PostWebhook(w, httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"url": "https://example.com/hook", "events": ["tag.added"], "tag": "goal"}`)))
+	require.EqualValues(t, 201, w.Code)
+
+	var v WebhookResponse
+	err := json.Unmarshal(w.Body.Bytes(), &v)
+	require.Nil(t, err)
+	assert.EqualValues(t, 1, v.Webhook.ID)
+	assert.EqualValues(t, []string{EventTagAdded}, v.Webhook.Events)
+	assert.EqualValues(t, "goal", v.Webhook.Tag)
+	// a secret is generated when none is given
+	assert.Len(t, v.Webhook.Secret, 64)
+
+	// but not shown again
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), "webhook", v.Webhook))
+	w = httptest.NewRecorder()
+	s.GetWebhook(w, r)
+	require.EqualValues(t, 200, w.Code)
+	err = json.Unmarshal(w.Body.Bytes(), &v)
+	require.Nil(t, err)
+	assert.EqualValues(t, "redacted", v.Webhook.Secret)
+}
+
+func TestGetDeliveries(t *testing.T) {
+	s, db, qu := prepareMockServer(t)
+
+	db.On("One", "ID", 1, mock.Anything).Run(func(args mock.Arguments) {
+		args.Get(2).(*Webhook).ID = 1
+	}).Return(nil)
+	db.On("Select", mock.Anything).Return(qu)
+	qu.On("Reverse").Return(qu)
+	qu.On("Find", mock.Anything).Run(func(args mock.Arguments) {
+		deliveries := args.Get(0).(*[]Delivery)
+		*deliveries = []Delivery{{ID: 2, WebhookID: 1, Status: DeliveryFailed}, {ID: 1, WebhookID: 1, Status: DeliveryDelivered}}
+	}).Return(nil)
+
+	router := chi.NewRouter()
+	router.Route("/webhooks/{wid}", func(router chi.Router) {
+		router.Use(s.WebhookCtx)
+		router.Get("/deliveries", s.GetDeliveries)
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/webhooks/1/deliveries?limit=2", nil))
+	require.EqualValues(t, 200, w.Code)
+
+	var v GetDeliveriesResponse
+	err := json.Unmarshal(w.Body.Bytes(), &v)
+	require.Nil(t, err)
+	require.Len(t, v.Deliveries, 2)
+	assert.EqualValues(t, DeliveryFailed, v.Deliveries[0].Status)
+	qu.AssertCalled(t, "Limit", 2)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/webhooks/nope/deliveries", nil))
+	assert.EqualValues(t, 404, w.Code)
+}
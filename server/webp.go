@@ -0,0 +1,40 @@
+package server
+
+// #cgo pkg-config: libwebp
+// #include <stdlib.h>
+// #include <webp/encode.h>
+import "C"
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"unsafe"
+)
+
+// EncodeWebP writes an image as a lossy WebP with the given quality, from 0 to 100. It
+// uses the system's libwebp, the same way the pusher uses the system's libgphoto2.
+func EncodeWebP(w io.Writer, img image.Image, quality float32) error {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return errors.New("webp: cannot encode an empty image")
+	}
+	// libwebp takes RGBA that isn't premultiplied, which is what NRGBA holds
+	rgba, ok := img.(*image.NRGBA)
+	if !ok || rgba.Rect.Min != (image.Point{}) {
+		rgba = image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Rect, img, bounds.Min, draw.Src)
+	}
+
+	var output *C.uint8_t
+	size := C.WebPEncodeRGBA((*C.uint8_t)(unsafe.Pointer(&rgba.Pix[0])), C.int(bounds.Dx()), C.int(bounds.Dy()),
+		C.int(rgba.Stride), C.float(quality), &output)
+	if size == 0 {
+		return errors.New("webp: libwebp failed to encode the image")
+	}
+	defer C.free(unsafe.Pointer(output))
+
+	_, err := w.Write(C.GoBytes(unsafe.Pointer(output), C.int(size)))
+	return err
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeWebP(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 30; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 6), uint8(y * 8), 128, 255})
+		}
+	}
+
+	// images that don't start at the origin are encoded too
+	buf := new(bytes.Buffer)
+	err := EncodeWebP(buf, img.SubImage(image.Rect(10, 5, 30, 25)), 80)
+	require.Nil(t, err)
+	b := buf.Bytes()
+	require.True(t, len(b) > 30)
+	assert.EqualValues(t, "RIFF", string(b[:4]))
+	assert.EqualValues(t, "WEBPVP8 ", string(b[8:16]))
+	assert.EqualValues(t, 20, binary.LittleEndian.Uint16(b[26:28])&0x3fff)
+	assert.EqualValues(t, 20, binary.LittleEndian.Uint16(b[28:30])&0x3fff)
+
+	err = EncodeWebP(new(bytes.Buffer), image.NewRGBA(image.Rectangle{}), 80)
+	assert.NotNil(t, err)
+}
@@ -11,6 +11,18 @@ window.$ = $;
 window.axios = require('axios');
 Vue.prototype.$http = window.axios;
 
+// Mutating requests carry the session's CSRF token
+window.axios.defaults.xsrfCookieName = 'hotshots_csrf';
+window.axios.defaults.xsrfHeaderName = 'X-CSRF-Token';
+
+// Go back to the login page once the session ends
+window.axios.interceptors.response.use(undefined, function (error) {
+  if (error.response && error.response.status === 401) {
+    window.location = 'login';
+  }
+  return Promise.reject(error);
+});
+
 Vue.use('VueMoment');
 Vue.use(BootstrapVue);
 